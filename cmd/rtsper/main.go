@@ -19,16 +19,34 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"redalf.de/rtsper/pkg/admin"
+	"redalf.de/rtsper/pkg/capture"
 	"redalf.de/rtsper/pkg/cluster"
+	"redalf.de/rtsper/pkg/egress"
 	plog "redalf.de/rtsper/pkg/log"
 	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/relay"
+	"redalf.de/rtsper/pkg/rtmpsrv"
 	"redalf.de/rtsper/pkg/rtspsrv"
 	"redalf.de/rtsper/pkg/topic"
+	"redalf.de/rtsper/pkg/tsingest"
 	"redalf.de/rtsper/pkg/udpalloc"
+	"redalf.de/rtsper/pkg/webrtcsrv"
+	"redalf.de/rtsper/pkg/wsplay"
 )
 
-func loadConfig(path string) (topic.Config, error) {
-	var cfg topic.Config
+// fileConfig is the JSON config file: the topic manager settings plus the
+// ingest inputs, which live outside the topic manager.
+type fileConfig struct {
+	topic.Config
+	TSInputs    []tsingest.Input
+	RTPEgress   []egress.Rule
+	PushTargets []relay.Target
+	// Pins assigns topics to cluster nodes, e.g. {"cam1": "rtsper2"}
+	Pins map[string]string
+}
+
+func loadConfig(path string) (fileConfig, error) {
+	var cfg fileConfig
 	if path == "" {
 		return cfg, nil
 	}
@@ -42,6 +60,30 @@ func loadConfig(path string) (topic.Config, error) {
 	return cfg, nil
 }
 
+// autoCapacity estimates how many publishers this machine can carry from
+// its CPU count and memory (see -auto-max-publishers); it also returns the
+// inputs for logging.
+func autoCapacity(publishersPerCPU, perPublisherMB int) (capacity, numCPU, totalMemMB int) {
+	numCPU = runtime.NumCPU()
+	// Best-effort memory read from /proc/meminfo (Linux). If it fails,
+	// fall back to a large value so memory doesn't become the limiting factor.
+	if v, err := readTotalMemoryMB(); err == nil {
+		totalMemMB = v
+	} else {
+		totalMemMB = 1024 * 16 // assume 16 GB if we cannot read meminfo
+	}
+	cpuLimit := numCPU * publishersPerCPU
+	memLimit := totalMemMB / perPublisherMB
+	capacity = cpuLimit
+	if memLimit < capacity {
+		capacity = memLimit
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	return capacity, numCPU, totalMemMB
+}
+
 // readTotalMemoryMB attempts to read total system memory in MB from /proc/meminfo.
 // Returns an error if the read/parse fails. This is a best-effort helper and
 // only used when auto-sizing is requested.
@@ -69,6 +111,11 @@ func readTotalMemoryMB() (int, error) {
 }
 
 func main() {
+	// subcommands are dispatched before the server flags are parsed
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
 	var (
 		publishPort            = flag.Int("publish-port", 9191, "RTSP publisher port")
 		subscribePort          = flag.Int("subscribe-port", 9192, "RTSP subscriber port")
@@ -78,6 +125,8 @@ func main() {
 		publisherQueueSize     = flag.Int("publisher-queue-size", 1024, "Per-topic inbound queue size")
 		subscriberQueueSize    = flag.Int("subscriber-queue-size", 256, "Per-subscriber queue size")
 		publisherGrace         = flag.Duration("publisher-grace", 5*time.Second, "Publisher grace period for reconnect")
+		// RTSP-over-HTTP tunnels (QuickTime style GET/POST pairs), next to the RTSP ports above
+		rtspHTTPPort = flag.Int("rtsp-http-port", 0, "Port accepting RTSP-over-HTTP tunnels for subscribers (0 = disabled)")
 		// logging options
 		logFile  = flag.String("log-file", "", "Path to log file (optional). If set, log rotation is enabled")
 		logLevel = flag.String("log-level", "info", "Log level: debug,info,warn,error")
@@ -97,12 +146,70 @@ func main() {
 		udpPortStart      = flag.Int("udp-port-start", 0, "Start of UDP port range for allocator (inclusive)")
 		udpPortEnd        = flag.Int("udp-port-end", 0, "End of UDP port range for allocator (inclusive)")
 		configPath        = flag.String("config", "", "Path to JSON config file (optional)")
-		// cluster/static membership for rendezvous hashing (comma-separated node names)
-		clusterNodes = flag.String("cluster-nodes", "", "Comma-separated list of cluster node names (e.g., rtsper1,rtsper2)")
+		// cluster/static membership for rendezvous hashing (comma-separated node entries)
+		clusterNodes = flag.String("cluster-nodes", "", "Comma-separated list of cluster node names, optionally with ;host=,;publish=,;subscribe=,;admin= and ;tags= (e.g., rtsper1,rtsper2;host=10.0.0.12;publish=9291)")
 		nodeName     = flag.String("node-name", "", "Node name for this instance (defaults to hostname)")
-		enableProxy  = flag.Bool("enable-proxy", true, "Enable forwarding RTSP connections to owner nodes")
-		proxyDialTO  = flag.Duration("proxy-dial-timeout", 3*time.Second, "Dial timeout when proxying to owner")
-		proxyIOTo    = flag.Duration("proxy-io-timeout", 30*time.Second, "Idle read/write timeout for proxied connections")
+		// dynamic membership (SWIM-style gossip), alone or on top of -cluster-nodes
+		gossipPort  = flag.Int("gossip-port", 0, "UDP port for gossip cluster membership (0 = disabled, static -cluster-nodes only)")
+		gossipSeeds = flag.String("gossip-seeds", "", "Comma-separated host:port gossip addresses of existing nodes to join")
+		// peer health checks; unhealthy peers are skipped for topic ownership
+		healthCheck     = flag.String("health-check", "", "Cluster peer health check mode: tcp or http (empty = disabled)")
+		healthPort      = flag.Int("health-port", 0, "Port probed on peers (default: publish port for tcp, admin port for http)")
+		healthPath      = flag.String("health-path", "/status", "Path requested by http health checks")
+		healthInterval  = flag.Duration("health-interval", 2*time.Second, "Interval between health checks of a peer")
+		healthTimeout   = flag.Duration("health-timeout", time.Second, "Timeout of a single health check")
+		healthFailAfter = flag.Int("health-fail-threshold", 3, "Consecutive failed checks before a peer is marked unhealthy")
+		healthRiseAfter = flag.Int("health-rise-threshold", 5, "Consecutive passed checks before an unhealthy peer is used again")
+		loadPlacement   = flag.Bool("load-placement", false, "Place new topics on the least-loaded cluster node instead of their rendezvous owner")
+		loadInterval    = flag.Duration("load-interval", 2*time.Second, "Interval between load reports exchanged with cluster peers")
+		maxLoadPubs     = flag.Int("max-load-publishers", 0, "Refuse new sessions while this node has this many publishers (0 = no limit)")
+		maxLoadSubs     = flag.Int("max-load-subscribers", 0, "Refuse new sessions while this node has this many subscribers (0 = no limit)")
+		maxIngressMbps  = flag.Float64("max-ingress-mbps", 0, "Refuse new sessions while ingress exceeds this bitrate (0 = no limit)")
+		maxEgressMbps   = flag.Float64("max-egress-mbps", 0, "Refuse new sessions while estimated egress exceeds this bitrate (0 = no limit)")
+		maxCPUPercent   = flag.Float64("max-cpu-percent", 0, "Refuse new sessions while process CPU usage exceeds this percentage of all cores (0 = no limit)")
+		drainKickDelay  = flag.Duration("drain-kick-delay", 2*time.Second, "How long a draining node waits before asking its publishers to reconnect to the new owner")
+		leaseTTL        = flag.Duration("lease-ttl", 10*time.Second, "How long a task lease granted to a node lasts without renewal; a failed node's tasks move to another node after about this long")
+		leaseVoters     = flag.String("lease-voters", "", "Comma-separated nodes whose majority grants task leases (default: the current members; set it with gossip so that partitioned nodes cannot both hold a lease)")
+		enableProxy     = flag.Bool("enable-proxy", true, "Enable forwarding RTSP connections to owner nodes")
+		proxyDialTO     = flag.Duration("proxy-dial-timeout", 3*time.Second, "Dial timeout when proxying to owner")
+		proxyIOTo       = flag.Duration("proxy-io-timeout", 30*time.Second, "Idle read/write timeout for proxied connections")
+		clusterTLSCert  = flag.String("cluster-tls-cert", "", "PEM certificate of this node for mutual TLS between nodes; must name the node (empty = plain TCP)")
+		clusterTLSKey   = flag.String("cluster-tls-key", "", "PEM private key of -cluster-tls-cert")
+		clusterTLSCA    = flag.String("cluster-tls-ca", "", "PEM cluster CA that signs the node certificates")
+		proxyProtoFrom  = flag.String("proxy-protocol-trusted", "", "Comma-separated CIDRs/IPs (load balancers, other nodes) whose connections may start with a PROXY protocol v1/v2 header")
+		proxyProtoSend  = flag.Bool("proxy-protocol-send", false, "Send a PROXY protocol v2 header with the client address on connections proxied to the owner")
+		redirectPub     = flag.Bool("redirect-publish", false, "Redirect publishers of topics owned by other nodes with RTSP 302 instead of proxying")
+		redirectSub     = flag.Bool("redirect-subscribe", false, "Redirect subscribers of topics owned by other nodes with RTSP 302 instead of proxying")
+		redirectAgents  = flag.String("redirect-proxy-agents", "", "Comma-separated User-Agent substrings of clients that do not follow redirects and are proxied instead")
+		nodeWeight      = flag.String("node-weight", "", "Weight of this node for topic ownership: a number, or auto to derive it from CPU/memory like -auto-max-publishers (default 1)")
+		nodeWeights     = flag.String("node-weights", "", "Comma-separated node=weight pairs for the other nodes (gossip announces each node's own weight)")
+		advertiseHosts  = flag.String("advertise-hosts", "", "Comma-separated node=host pairs used in redirects (default: node names)")
+		edgeRelay       = flag.Bool("edge-relay", false, "Serve subscribers of topics owned by other nodes from one local pull per topic instead of proxying each connection")
+		replicate       = flag.String("replicate-topics", "", "Comma-separated topics kept as a hot replica on the next node in rendezvous order, which takes them over when the owner fails")
+		replicaHold     = flag.Duration("replica-hold", 30*time.Second, "How long a promoted replica, or one whose owner is unreachable, waits for the stream to return")
+		mcastRange      = flag.String("multicast-ip-range", "", "CIDR from which multicast groups are allocated for subscribers (empty = multicast disabled)")
+		mcastRTPPort    = flag.Int("multicast-rtp-port", 8002, "Even UDP port for multicast RTP (RTCP uses the next port)")
+		// packet capture (admin API)
+		captureDir         = flag.String("capture-dir", "captures", "Directory for RTP captures started via the admin API")
+		captureMaxDuration = flag.Duration("capture-max-duration", 10*time.Minute, "Upper bound for a single capture's duration")
+		captureMaxBytes    = flag.Int64("capture-max-bytes", 512<<20, "Upper bound for a single capture's file size in bytes")
+		// WebRTC (WHEP/WHIP) endpoints on the admin HTTP server
+		enableWebRTC    = flag.Bool("enable-webrtc", false, "Enable WebRTC playback (WHEP) and ingest (WHIP) on the admin HTTP server")
+		webrtcUDPPort   = flag.Int("webrtc-udp-port", 0, "Single UDP port for all WebRTC ICE traffic (0 = ephemeral port per session)")
+		webrtcPublicIPs = flag.String("webrtc-public-ips", "", "Comma-separated IPs advertised as WebRTC host candidates (NAT 1:1)")
+		whipToken       = flag.String("whip-token", "", "Bearer token required for WHIP publishing (empty = no authentication)")
+		// WebSocket fMP4 playback for MSE players on the admin HTTP server
+		enableWS = flag.Bool("enable-ws", false, "Enable WebSocket fMP4 playback (/ws/{topic}) on the admin HTTP server")
+		// RTMP ingest (rtmp://host/live/{topic})
+		enableRTMP = flag.Bool("enable-rtmp", false, "Enable RTMP ingest listener for encoders such as OBS and FFmpeg")
+		rtmpPort   = flag.Int("rtmp-port", 1935, "RTMP ingest port")
+		rtmpKeys   = flag.String("rtmp-keys", "", "Comma-separated topic:key stream keys for RTMP publishing; '*' matches any topic (empty = no keys)")
+		// MPEG-TS inputs, in addition to TSInputs from the config file
+		tsInputs = flag.String("ts-inputs", "", "Comma-separated topic=url MPEG-TS inputs, e.g. cam1=udp://239.1.1.1:5000?iface=eth0,cam2=srt://:9000")
+		// static RTP push egress, in addition to RTPEgress from the config file
+		rtpEgress = flag.String("rtp-egress", "", "Comma-separated topic/name=host:port RTP push destinations, e.g. cam1/wall=239.0.0.1:5004 (ts://host:port for MPEG-TS)")
+		// push relay targets, in addition to PushTargets from the config file
+		pushTargets = flag.String("push-targets", "", "Comma-separated topic/name=rtsp://[user:pass@]host/path targets to republish topics to (TCP)")
 	)
 	flag.Parse()
 
@@ -119,6 +226,38 @@ func main() {
 			*nodeName = v
 		}
 	}
+	if *gossipPort == 0 {
+		if v, err := strconv.Atoi(os.Getenv("GOSSIP_PORT")); err == nil {
+			*gossipPort = v
+		}
+	}
+	if *advertiseHosts == "" {
+		*advertiseHosts = os.Getenv("ADVERTISE_HOSTS")
+	}
+	if !*edgeRelay {
+		*edgeRelay = os.Getenv("EDGE_RELAY") == "true"
+	}
+	if *gossipSeeds == "" {
+		*gossipSeeds = os.Getenv("GOSSIP_SEEDS")
+	}
+	if *replicate == "" {
+		*replicate = os.Getenv("REPLICATE_TOPICS")
+	}
+	if *leaseVoters == "" {
+		*leaseVoters = os.Getenv("LEASE_VOTERS")
+	}
+	if *proxyProtoFrom == "" {
+		*proxyProtoFrom = os.Getenv("PROXY_PROTOCOL_TRUSTED")
+	}
+	if *clusterTLSCert == "" {
+		*clusterTLSCert = os.Getenv("CLUSTER_TLS_CERT")
+	}
+	if *clusterTLSKey == "" {
+		*clusterTLSKey = os.Getenv("CLUSTER_TLS_KEY")
+	}
+	if *clusterTLSCA == "" {
+		*clusterTLSCA = os.Getenv("CLUSTER_TLS_CA")
+	}
 	if *otelEndpoint == "" {
 		if v := os.Getenv("OTEL_ENDPOINT"); v != "" {
 			*otelEndpoint = v
@@ -127,19 +266,70 @@ func main() {
 
 	// init cluster if provided
 	var cl *cluster.Cluster
-	if *clusterNodes != "" {
+	var gossip *cluster.Gossip
+	if *clusterNodes != "" || *gossipPort > 0 {
 		if *nodeName == "" {
 			hn, err := os.Hostname()
 			if err == nil {
 				*nodeName = hn
 			}
 		}
-		c, err := cluster.NewFromCSV(*clusterNodes, *nodeName)
+		nodes := *clusterNodes
+		if nodes == "" {
+			// gossip only: start alone and learn the others from the seeds
+			nodes = *nodeName
+		}
+		c, err := cluster.NewFromCSV(nodes, *nodeName)
 		if err != nil {
 			plog.Error("failed to initialize cluster: %v", err)
 			os.Exit(1)
 		}
 		cl = c
+		if *advertiseHosts != "" {
+			hosts, err := cluster.ParseAdvertised(*advertiseHosts)
+			if err != nil {
+				plog.Error("invalid -advertise-hosts: %v", err)
+				os.Exit(1)
+			}
+			cl.SetAdvertised(hosts)
+		}
+		if *nodeWeights != "" {
+			weights, err := cluster.ParseWeights(*nodeWeights)
+			if err != nil {
+				plog.Error("invalid -node-weights: %v", err)
+				os.Exit(1)
+			}
+			for n, w := range weights {
+				cl.SetWeight(n, w)
+			}
+		}
+		switch *nodeWeight {
+		case "":
+		case "auto":
+			capacity, numCPU, totalMemMB := autoCapacity(*publishersPerCPU, *perPublisherMB)
+			cl.SetWeight(cl.Self(), float64(capacity))
+			plog.Info("cluster: node weight auto: cpu=%d cores mem=%dMB -> weight=%d", numCPU, totalMemMB, capacity)
+		default:
+			w, err := strconv.ParseFloat(*nodeWeight, 64)
+			if err != nil || w <= 0 {
+				plog.Error("invalid -node-weight %q (want a positive number or auto)", *nodeWeight)
+				os.Exit(1)
+			}
+			cl.SetWeight(cl.Self(), w)
+		}
+		if *gossipPort > 0 {
+			gcfg := cluster.GossipConfig{Bind: fmt.Sprintf(":%d", *gossipPort)}
+			for _, s := range strings.Split(*gossipSeeds, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					gcfg.Seeds = append(gcfg.Seeds, s)
+				}
+			}
+			gossip, err = cluster.NewGossip(cl, gcfg)
+			if err != nil {
+				plog.Error("failed to start gossip: %v", err)
+				os.Exit(1)
+			}
+		}
 		plog.Info("cluster: members=%v self=%s", cl.Members(), cl.Self())
 	}
 
@@ -169,7 +359,7 @@ func main() {
 	}
 
 	// Merge flags over file config. Flags that are non-default override file.
-	cfg := fileCfg
+	cfg := fileCfg.Config
 	// basic defaults if file empty
 	if cfg.PublisherQueueSize == 0 {
 		cfg.PublisherQueueSize = *publisherQueueSize
@@ -280,37 +470,179 @@ func main() {
 	// and picks the minimum of the two. If the result is < 1, fall back
 	// to 1 to avoid a 0-sized limit.
 	if *autoMaxPublishers {
-		numCPU := runtime.NumCPU()
-		// Best-effort memory read from /proc/meminfo (Linux). If it fails,
-		// fall back to a large value so memory doesn't become the limiting factor.
-		totalMemMB := 0
-		if v, err := readTotalMemoryMB(); err == nil {
-			totalMemMB = v
-		} else {
-			totalMemMB = 1024 * 16 // assume 16 GB if we cannot read meminfo
-		}
-		cpuLimit := numCPU * (*publishersPerCPU)
-		memLimit := totalMemMB / (*perPublisherMB)
-		computed := cpuLimit
-		if memLimit < computed {
-			computed = memLimit
-		}
-		if computed < 1 {
-			computed = 1
-		}
+		computed, numCPU, totalMemMB := autoCapacity(*publishersPerCPU, *perPublisherMB)
 		cfg.MaxPublishers = computed
 		plog.Info("auto-max-publishers enabled: cpu=%d cores mem=%dMB -> max_publishers=%d", numCPU, totalMemMB, cfg.MaxPublishers)
 	}
 
+	if cl != nil {
+		// announced to gossip peers and used where our entry has no ports
+		cl.SetLocalPorts(cfg.PublishPort, cfg.SubscribePort, *adminPort)
+		for t, node := range fileCfg.Pins {
+			if err := cl.SetPin(t, node); err != nil {
+				plog.Error("invalid config pin: %v", err)
+				os.Exit(1)
+			}
+		}
+	} else if len(fileCfg.Pins) > 0 {
+		plog.Warn("config Pins have no effect without a cluster")
+	}
+
 	m := topic.NewManager(cfg)
+	captures := capture.NewManager(m, *captureDir, *captureMaxDuration, *captureMaxBytes)
+	egressRules := fileCfg.RTPEgress
+	if *rtpEgress != "" {
+		parsed, err := egress.ParseRules(*rtpEgress)
+		if err != nil {
+			plog.Error("invalid -rtp-egress: %v", err)
+			os.Exit(1)
+		}
+		egressRules = append(egressRules, parsed...)
+	}
+	egresses := egress.NewManager(m)
+	for _, r := range egressRules {
+		if err := egresses.Add(r); err != nil {
+			plog.Error("failed to start egress: %v", err)
+			os.Exit(1)
+		}
+	}
+	relayTargets := fileCfg.PushTargets
+	if *pushTargets != "" {
+		parsed, err := relay.ParseTargets(*pushTargets)
+		if err != nil {
+			plog.Error("invalid -push-targets: %v", err)
+			os.Exit(1)
+		}
+		relayTargets = append(relayTargets, parsed...)
+	}
+	relays := relay.NewManager(m)
+	for _, t := range relayTargets {
+		if err := relays.Add(t); err != nil {
+			plog.Error("failed to add push target: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	var health *cluster.HealthChecker
+	if cl != nil && *healthCheck != "" {
+		hcfg := cluster.HealthConfig{
+			Mode:          *healthCheck,
+			Port:          *healthPort,
+			Path:          *healthPath,
+			Interval:      *healthInterval,
+			Timeout:       *healthTimeout,
+			FailThreshold: *healthFailAfter,
+			RiseThreshold: *healthRiseAfter,
+		}
+		if hcfg.Port == 0 {
+			// the peers' ports from their membership entries, else this
+			// node's ones
+			hcfg.EntryPorts = true
+			hcfg.Port = cfg.PublishPort
+			if hcfg.Mode == cluster.HealthHTTP {
+				hcfg.Port = *adminPort
+			}
+		}
+		h, err := cluster.NewHealthChecker(cl, hcfg)
+		if err != nil {
+			plog.Error("invalid health check configuration: %v", err)
+			os.Exit(1)
+		}
+		health = h
+	}
+
+	var drainer *cluster.Drainer
+	if cl != nil {
+		drainer = cluster.NewDrainer(cl, m, cluster.DrainConfig{AdminPort: *adminPort, KickDelay: *drainKickDelay})
+	}
+
+	var load *cluster.LoadMonitor
+	thresholds := cluster.LoadThresholds{
+		Publishers:  *maxLoadPubs,
+		Subscribers: *maxLoadSubs,
+		IngressMbps: *maxIngressMbps,
+		EgressMbps:  *maxEgressMbps,
+		CPU:         *maxCPUPercent,
+	}
+	if cl != nil && (*loadPlacement || thresholds != (cluster.LoadThresholds{})) {
+		load = cluster.NewLoadMonitor(cl, m, cluster.LoadConfig{
+			AdminPort:  *adminPort,
+			Interval:   *loadInterval,
+			Thresholds: thresholds,
+			Placement:  *loadPlacement,
+		})
+	}
 
 	// start admin server
 	mux := http.NewServeMux()
 	mux.HandleFunc("/status", admin.StatusHandler(m))
+	mux.HandleFunc("/capture", admin.CaptureListHandler(captures))
+	mux.HandleFunc("/capture/start", admin.CaptureStartHandler(captures))
+	mux.HandleFunc("/capture/stop", admin.CaptureStopHandler(captures))
+	mux.HandleFunc("GET /egress", admin.EgressListHandler(egresses))
+	mux.HandleFunc("GET /sdp/{topic}/{egress}", admin.EgressSDPHandler(egresses))
+	mux.HandleFunc("GET /relay", admin.RelayListHandler(relays))
 	// cluster admin (optional)
+	var leases *cluster.LeaseManager
 	if cl != nil {
 		mux.HandleFunc("/cluster", admin.ClusterHandler(cl))
-		mux.HandleFunc("/cluster/drain", admin.DrainHandler(cl))
+		mux.HandleFunc("/cluster/drain", admin.DrainHandler(drainer))
+		mux.HandleFunc("GET /cluster/drain/status", admin.DrainStatusHandler(drainer))
+		mux.HandleFunc("GET /cluster/events", admin.ClusterEventsHandler(cl))
+		mux.HandleFunc("/cluster/simulate", admin.ClusterSimulateHandler(cl))
+		mux.HandleFunc("/cluster/placements", admin.PlacementHandler(cl))
+		mux.HandleFunc("/cluster/pins", admin.PinHandler(cl, cluster.NewPinSync(cl, *adminPort)))
+		var voters []string
+		for _, v := range strings.Split(*leaseVoters, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				voters = append(voters, v)
+			}
+		}
+		if len(voters) == 0 && gossip != nil {
+			plog.Warn("task leases count a majority of the members seen through gossip; set -lease-voters so that partitioned nodes cannot both hold a lease")
+		}
+		leases = cluster.NewLeaseManager(cl, cluster.LeaseConfig{AdminPort: *adminPort, TTL: *leaseTTL, Voters: voters})
+		mux.HandleFunc("/cluster/leases", admin.LeaseHandler(leases))
+		rtmpLocatePort := 0
+		if *enableRTMP {
+			rtmpLocatePort = *rtmpPort
+		}
+		mux.HandleFunc("GET /cluster/status", admin.ClusterStatusHandler(cluster.NewStatusCollector(cl, m, *adminPort, 0)))
+		mux.HandleFunc("GET /cluster/locate", admin.LocateHandler(cl, cluster.Endpoints{
+			PublishPort:   cfg.PublishPort,
+			SubscribePort: cfg.SubscribePort,
+			RTSPHTTPPort:  *rtspHTTPPort,
+			RTMPPort:      rtmpLocatePort,
+			AdminPort:     *adminPort,
+			WebRTC:        *enableWebRTC,
+			WebSocket:     *enableWS,
+		}))
+		if load != nil {
+			mux.HandleFunc("GET /cluster/load", admin.LoadHandler(load))
+		}
+	}
+	var webrtcSrv *webrtcsrv.Server
+	if *enableWebRTC {
+		wcfg := webrtcsrv.Config{UDPPort: *webrtcUDPPort, SubscriberQueueSize: cfg.SubscriberQueueSize, BearerToken: *whipToken}
+		for _, ip := range strings.Split(*webrtcPublicIPs, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				wcfg.PublicIPs = append(wcfg.PublicIPs, ip)
+			}
+		}
+		ws, err := webrtcsrv.NewServer(m, cl, wcfg)
+		if err != nil {
+			plog.Error("failed to initialize WebRTC: %v", err)
+			os.Exit(1)
+		}
+		ws.Register(mux)
+		webrtcSrv = ws
+		plog.Info("webrtc: WHEP/WHIP enabled on admin port (udp port %d)", *webrtcUDPPort)
+	}
+	var wsSrv *wsplay.Server
+	if *enableWS {
+		wsSrv = wsplay.NewServer(m, cl, wsplay.Config{SubscriberQueueSize: cfg.SubscriberQueueSize})
+		wsSrv.Register(mux)
+		plog.Info("ws: fMP4 WebSocket playback enabled on admin port")
 	}
 	mux.Handle("/metrics", promhttp.Handler())
 	adminSrv := &http.Server{Addr: fmt.Sprintf(":%d", *adminPort), Handler: mux}
@@ -327,6 +659,76 @@ func main() {
 
 	// start RTSP servers
 	rtspSrv := rtspsrv.NewServer(m, cfg.PublishPort, cfg.SubscribePort, alloc, cl, *enableProxy, *proxyDialTO, *proxyIOTo)
+	if *rtspHTTPPort > 0 {
+		rtspSrv.SetHTTPTunnelPort(*rtspHTTPPort)
+	}
+	if *redirectPub || *redirectSub {
+		var agents []string
+		for _, a := range strings.Split(*redirectAgents, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				agents = append(agents, a)
+			}
+		}
+		rtspSrv.SetRedirect(*redirectPub, *redirectSub, agents)
+	}
+	if load != nil {
+		rtspSrv.SetLoadBalancer(load)
+	}
+	if *clusterTLSCert != "" {
+		if cl == nil {
+			plog.Error("-cluster-tls-cert requires a cluster")
+			os.Exit(1)
+		}
+		pt, err := cluster.LoadPeerTLS(cl, *clusterTLSCert, *clusterTLSKey, *clusterTLSCA)
+		if err != nil {
+			plog.Error("invalid cluster TLS configuration: %v", err)
+			os.Exit(1)
+		}
+		rtspSrv.SetPeerTLS(pt)
+		plog.Info("cluster: mutual TLS between nodes enabled")
+	}
+	if *proxyProtoFrom != "" || *proxyProtoSend {
+		trusted, err := rtspsrv.ParseTrustedNets(*proxyProtoFrom)
+		if err != nil {
+			plog.Error("invalid -proxy-protocol-trusted: %v", err)
+			os.Exit(1)
+		}
+		rtspSrv.SetProxyProtocol(trusted, *proxyProtoSend)
+	}
+	mux.HandleFunc("GET /sessions", admin.SessionListHandler(rtspSrv))
+	if *mcastRange != "" {
+		rtspSrv.SetMulticast(*mcastRange, *mcastRTPPort)
+	}
+	if *edgeRelay {
+		if cl == nil {
+			plog.Warn("-edge-relay has no effect without a cluster")
+		}
+		rtspSrv.SetEdgeRelay(true)
+		mux.HandleFunc("GET /edge", admin.EdgeListHandler(rtspSrv))
+	}
+	if *replicate != "" {
+		if cl == nil {
+			plog.Warn("-replicate-topics has no effect without a cluster")
+		}
+		var topics []string
+		for _, t := range strings.Split(*replicate, ",") {
+			if t = strings.TrimSpace(t); t == "" {
+				continue
+			}
+			if !topic.ValidName(t) {
+				plog.Error("invalid topic %q in -replicate-topics", t)
+				os.Exit(1)
+			}
+			topics = append(topics, t)
+		}
+		rtspSrv.SetReplication(topics, *replicaHold)
+		mux.HandleFunc("GET /replicas", admin.ReplicaListHandler(rtspSrv))
+	}
+	var migrator *cluster.Migrator
+	if cl != nil {
+		migrator = cluster.NewMigrator(cl, m, rtspSrv, cluster.MigrateConfig{AdminPort: *adminPort})
+		mux.HandleFunc("/cluster/migrate", admin.MigrateHandler(migrator))
+	}
 	if err := rtspSrv.Start(ctx); err != nil {
 		plog.Error("failed to start rtsp servers: %v", err)
 		if allocatorRelease != nil {
@@ -335,16 +737,84 @@ func main() {
 		os.Exit(1)
 	}
 
+	var rtmpSrv *rtmpsrv.Server
+	if *enableRTMP {
+		keys, err := rtmpsrv.ParseStreamKeys(*rtmpKeys)
+		if err != nil {
+			plog.Error("invalid -rtmp-keys: %v", err)
+			os.Exit(1)
+		}
+		rtmpSrv = rtmpsrv.NewServer(m, cl, rtmpsrv.Config{Port: *rtmpPort, StreamKeys: keys})
+		if err := rtmpSrv.Start(ctx); err != nil {
+			plog.Error("failed to start rtmp server: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	inputs := fileCfg.TSInputs
+	if *tsInputs != "" {
+		parsed, err := tsingest.ParseInputs(*tsInputs)
+		if err != nil {
+			plog.Error("invalid -ts-inputs: %v", err)
+			os.Exit(1)
+		}
+		inputs = append(inputs, parsed...)
+	}
+	var tsIngest *tsingest.Manager
+	if len(inputs) > 0 {
+		tsIngest = tsingest.NewManager(m, cl)
+		for _, in := range inputs {
+			if err := tsIngest.Add(in); err != nil {
+				plog.Error("failed to start ts input for topic %s: %v", in.Topic, err)
+				os.Exit(1)
+			}
+		}
+	}
+
 	// Wait for signal
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
 
 	plog.Info("shutdown requested")
+	if gossip != nil {
+		// tell the other nodes first so they take over our topics
+		gossip.Close()
+	}
+	if health != nil {
+		health.Close()
+	}
+	if drainer != nil {
+		drainer.Close()
+	}
+	if load != nil {
+		load.Close()
+	}
+	if migrator != nil {
+		migrator.Close()
+	}
+	if leases != nil {
+		leases.Close()
+	}
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 5*time.Second)
 	defer shutdownCancel()
 	adminSrv.Shutdown(shutdownCtx)
+	captures.Close()
+	egresses.Close()
+	relays.Close()
+	if wsSrv != nil {
+		wsSrv.Close()
+	}
+	if webrtcSrv != nil {
+		webrtcSrv.Close()
+	}
+	if rtmpSrv != nil {
+		rtmpSrv.Close()
+	}
+	if tsIngest != nil {
+		tsIngest.Close()
+	}
 	rtspSrv.Close()
 	m.Shutdown()
 	if allocatorRelease != nil {
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/aler9/gortsplib"
+
+	"redalf.de/rtsper/pkg/capture"
+	plog "redalf.de/rtsper/pkg/log"
+)
+
+// runReplay implements `rtsper replay`: it re-publishes a pcap or rtpdump
+// capture taken via the admin capture API to an RTSP server, preserving the
+// original packet timing.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var (
+		in        = fs.String("in", "", "Capture file (.pcap or .rtpdump) to replay")
+		sdpPath   = fs.String("sdp", "", "SDP file describing the tracks (defaults to <in>.sdp)")
+		target    = fs.String("url", "", "RTSP URL to publish to (e.g. rtsp://localhost:9191/topic1)")
+		transport = fs.String("transport", "tcp", "RTSP transport: tcp or udp")
+		loop      = fs.Bool("loop", false, "Replay the capture in a loop until interrupted")
+	)
+	fs.Parse(args)
+	if *in == "" || *target == "" {
+		fmt.Fprintln(os.Stderr, "usage: rtsper replay -in <capture> -url rtsp://host:port/topic [-sdp file] [-transport tcp|udp] [-loop]")
+		return 2
+	}
+	if *sdpPath == "" {
+		*sdpPath = *in + ".sdp"
+	}
+
+	pkts, err := readCapture(*in)
+	if err != nil {
+		plog.Error("replay: %v", err)
+		return 1
+	}
+	sdpBytes, err := os.ReadFile(*sdpPath)
+	if err != nil {
+		plog.Error("replay: read SDP: %v", err)
+		return 1
+	}
+	var tracks gortsplib.Tracks
+	if _, err := tracks.Unmarshal(sdpBytes); err != nil {
+		plog.Error("replay: parse SDP: %v", err)
+		return 1
+	}
+
+	var tr gortsplib.Transport
+	switch *transport {
+	case "tcp":
+		tr = gortsplib.TransportTCP
+	case "udp":
+		tr = gortsplib.TransportUDP
+	default:
+		plog.Error("replay: unknown transport %q", *transport)
+		return 2
+	}
+	c := gortsplib.Client{Transport: &tr}
+	if err := c.StartPublishing(*target, tracks); err != nil {
+		plog.Error("replay: start publishing to %s: %v", *target, err)
+		return 1
+	}
+	defer c.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	plog.Info("replay: publishing %d packets from %s to %s (loop=%v)", len(pkts), *in, *target, *loop)
+	if err := capture.Replay(ctx, pkts, tracks, *loop, c.WritePacketRTP); err != nil && err != context.Canceled {
+		plog.Error("replay: %v", err)
+		return 1
+	}
+	plog.Info("replay: done")
+	return 0
+}
+
+// readCapture loads a capture file, detecting the format from its header.
+func readCapture(path string) ([]capture.Packet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(b, []byte("#!rtpplay")) {
+		return capture.ReadRtpdump(bytes.NewReader(b))
+	}
+	return capture.ReadPcap(bytes.NewReader(b))
+}
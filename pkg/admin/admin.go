@@ -2,8 +2,12 @@ package admin
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"redalf.de/rtsper/pkg/cluster"
 	"redalf.de/rtsper/pkg/topic"
 )
 
@@ -47,14 +51,88 @@ func ClusterHandler(cl interface{}) http.HandlerFunc {
 			}
 			resp["draining"] = drains
 		}
+		// include the membership entries with hosts, ports and tags
+		type caddrs interface {
+			Addrs() []cluster.NodeAddr
+		}
+		if ca, ok := cl.(caddrs); ok {
+			resp["nodes"] = ca.Addrs()
+		}
+		// include owner selection weights if available
+		type cweights interface {
+			Weights() map[string]float64
+		}
+		if cw, ok := cl.(cweights); ok {
+			resp["weights"] = cw.Weights()
+		}
+		// with load sharing, include every node's load and the placements
+		type cload interface {
+			Loads() []cluster.Load
+			Placements() []cluster.Placement
+		}
+		if cl, ok := cl.(cload); ok {
+			if loads := cl.Loads(); loads != nil {
+				resp["load"] = loads
+			}
+			if placements := cl.Placements(); placements != nil {
+				resp["placements"] = placements
+			}
+		}
+		// include the pins with the effective owner of each pinned topic
+		type cpins interface {
+			Pins() []cluster.Pin
+		}
+		if cp, ok := cl.(cpins); ok {
+			if pins := cp.Pins(); pins != nil {
+				resp["pins"] = pins
+			}
+		}
+		// include the topic migrations started by this node
+		type cmigrate interface {
+			Migrations() []cluster.Migration
+		}
+		if cm, ok := cl.(cmigrate); ok {
+			if migrations := cm.Migrations(); migrations != nil {
+				resp["migrations"] = migrations
+			}
+		}
+		// include the task leases granted and held by this node
+		type cleases interface {
+			Leases() []cluster.Lease
+		}
+		if cl, ok := cl.(cleases); ok {
+			if leases := cl.Leases(); leases != nil {
+				resp["leases"] = leases
+			}
+		}
+		// with gossip membership, include each member's protocol state
+		type cgossip interface {
+			MemberStates() []cluster.MemberStatus
+		}
+		if cg, ok := cl.(cgossip); ok {
+			if states := cg.MemberStates(); states != nil {
+				resp["gossip"] = states
+			}
+		}
+		// with health checks, include each peer's health
+		type chealth interface {
+			PeerHealth() []cluster.PeerHealth
+		}
+		if ch, ok := cl.(chealth); ok {
+			if peers := ch.PeerHealth(); peers != nil {
+				resp["health"] = peers
+			}
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	}
 }
 
-// DrainHandler toggles draining state for a cluster node.
-// Usage: POST /cluster/drain?node=<name>&drain=true|false
+// DrainHandler toggles draining state for a cluster node. If the cluster
+// can propagate drain state, the change is forwarded to the other members
+// unless local=true is given (which is how peers forward it).
+// Usage: POST /cluster/drain?node=<name>&drain=true|false[&local=true]
 func DrainHandler(cl interface{}) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if cl == nil {
@@ -102,7 +180,127 @@ func DrainHandler(cl interface{}) http.HandlerFunc {
 			return
 		}
 		cc.SetDraining(node, drain)
+		resp := map[string]interface{}{"node": node, "draining": drain}
+		type cprop interface {
+			PropagateDrain(string, bool) map[string]string
+		}
+		if cp, ok := cl.(cprop); ok && r.URL.Query().Get("local") != "true" {
+			resp["peers"] = cp.PropagateDrain(node, drain)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// DrainStatusHandler reports this node's drain progress, including whether
+// it has no sessions left and can be stopped.
+// Usage: GET /cluster/drain/status
+func DrainStatusHandler(cl interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type cstatus interface {
+			Status() cluster.DrainStatus
+		}
+		cs, ok := cl.(cstatus)
+		if cl == nil || !ok {
+			http.Error(w, "no cluster configured", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cs.Status())
+	}
+}
+
+// maxSimulatedTopics bounds the topics of one simulation.
+const maxSimulatedTopics = 100000
+
+// ClusterSimulateHandler shows how a list of topics would be distributed
+// over the members with their current weights. Topics are given as a
+// comma-separated topics parameter, one per line in a POST body, or as
+// count=N to simulate the synthetic names topic-0 … topic-(N-1).
+// Usage: GET /cluster/simulate?topics=a,b,c | ?count=N
+func ClusterSimulateHandler(cl interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type csim interface {
+			Simulate([]string) cluster.Simulation
+		}
+		cs, ok := cl.(csim)
+		if cl == nil || !ok {
+			http.Error(w, "no cluster configured", http.StatusNotFound)
+			return
+		}
+		var topics []string
+		add := func(list string) {
+			for _, t := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+				if t = strings.TrimSpace(t); t != "" {
+					topics = append(topics, t)
+				}
+			}
+		}
+		add(r.URL.Query().Get("topics"))
+		if r.Method == http.MethodPost {
+			body, err := io.ReadAll(io.LimitReader(r.Body, 8<<20))
+			if err != nil {
+				http.Error(w, "failed to read body", http.StatusBadRequest)
+				return
+			}
+			add(string(body))
+		}
+		if v := r.URL.Query().Get("count"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > maxSimulatedTopics {
+				http.Error(w, "invalid count parameter", http.StatusBadRequest)
+				return
+			}
+			for i := 0; i < n; i++ {
+				topics = append(topics, "topic-"+strconv.Itoa(i))
+			}
+		}
+		if len(topics) == 0 {
+			http.Error(w, "missing topics or count parameter", http.StatusBadRequest)
+			return
+		}
+		if len(topics) > maxSimulatedTopics {
+			http.Error(w, "too many topics", http.StatusBadRequest)
+			return
+		}
+		sim := cs.Simulate(topics)
+		if r.URL.Query().Get("count") != "" || len(topics) > 1000 {
+			// the per-topic owners are not useful for large lists
+			sim.Owners = nil
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sim)
+	}
+}
+
+// ClusterEventsHandler lists membership events (joins, suspicions,
+// failures, leaves) seen by gossip.
+// Usage: GET /cluster/events?since=<seq>
+func ClusterEventsHandler(cl interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type cevents interface {
+			Events(since uint64) []cluster.Event
+		}
+		ce, ok := cl.(cevents)
+		if cl == nil || !ok {
+			http.Error(w, "no cluster configured", http.StatusNotFound)
+			return
+		}
+		var since uint64
+		if v := r.URL.Query().Get("since"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid since parameter", http.StatusBadRequest)
+				return
+			}
+			since = n
+		}
+		events := ce.Events(since)
+		if events == nil {
+			http.Error(w, "cluster membership is static (gossip disabled)", http.StatusNotFound)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"node": node, "draining": drain})
+		json.NewEncoder(w).Encode(map[string]interface{}{"events": events})
 	}
 }
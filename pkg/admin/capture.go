@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"redalf.de/rtsper/pkg/capture"
+)
+
+// CaptureListHandler lists running and recently finished captures.
+// Usage: GET /capture
+func CaptureListHandler(cm *capture.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"captures": cm.List()})
+	}
+}
+
+// CaptureStartHandler starts capturing a topic's inbound RTP/RTCP.
+// Usage: POST /capture/start?topic=<name>&format=pcap|rtpdump&duration=30s&max_bytes=<n>
+func CaptureStartHandler(cm *capture.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		topicName := q.Get("topic")
+		if topicName == "" {
+			http.Error(w, "missing topic parameter", http.StatusBadRequest)
+			return
+		}
+		opts := capture.Options{Format: capture.Format(q.Get("format"))}
+		if v := q.Get("duration"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, "invalid duration parameter", http.StatusBadRequest)
+				return
+			}
+			opts.MaxDuration = d
+		}
+		if v := q.Get("max_bytes"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid max_bytes parameter", http.StatusBadRequest)
+				return
+			}
+			opts.MaxBytes = n
+		}
+		st, err := cm.Start(topicName, opts)
+		if err != nil {
+			code := http.StatusBadRequest
+			switch {
+			case errors.Is(err, capture.ErrNoTopic):
+				code = http.StatusNotFound
+			case errors.Is(err, capture.ErrCaptureRunning):
+				code = http.StatusConflict
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	}
+}
+
+// CaptureStopHandler stops a running capture.
+// Usage: POST /capture/stop?topic=<name>
+func CaptureStopHandler(cm *capture.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		topicName := r.URL.Query().Get("topic")
+		if topicName == "" {
+			http.Error(w, "missing topic parameter", http.StatusBadRequest)
+			return
+		}
+		st, err := cm.Stop(topicName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	}
+}
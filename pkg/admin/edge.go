@@ -0,0 +1,18 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"redalf.de/rtsper/pkg/rtspsrv"
+)
+
+// EdgeListHandler lists the topics this node pulls from their owners to
+// serve local subscribers.
+// Usage: GET /edge
+func EdgeListHandler(s *rtspsrv.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"pulls": s.EdgePulls()})
+	}
+}
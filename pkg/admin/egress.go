@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"redalf.de/rtsper/pkg/egress"
+)
+
+// EgressListHandler lists egress rules with their counters.
+// Usage: GET /egress
+func EgressListHandler(em *egress.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"egress": em.List()})
+	}
+}
+
+// EgressSDPHandler serves the SDP file of an egress rule.
+// Usage: GET /sdp/{topic}/{egress}
+func EgressSDPHandler(em *egress.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := em.SDP(r.PathValue("topic"), r.PathValue("egress"))
+		if err != nil {
+			code := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, egress.ErrNotFound), errors.Is(err, egress.ErrNoSDP):
+				code = http.StatusNotFound
+			case errors.Is(err, egress.ErrNoStream):
+				code = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Write(b)
+	}
+}
@@ -0,0 +1,53 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"redalf.de/rtsper/pkg/cluster"
+)
+
+// LeaseHandler lists the leases known to this node, and grants and
+// releases leases for the other members, which call it while acquiring,
+// renewing and giving up their leases. Refused grants answer 409 with the
+// lease as granted by this node.
+// Usage: GET /cluster/leases,
+// POST /cluster/leases?name=<task>&holder=<node>&token=<n>&ttl=<duration>,
+// DELETE /cluster/leases?name=<task>&holder=<node>&token=<n>
+func LeaseHandler(lm *cluster.LeaseManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"leases": lm.Leases()})
+			return
+		}
+		q := r.URL.Query()
+		name, holder := q.Get("name"), q.Get("holder")
+		token, err := strconv.ParseUint(q.Get("token"), 10, 64)
+		if name == "" || holder == "" || err != nil || token == 0 {
+			http.Error(w, "name, holder and a positive token are required", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			ttl, err := time.ParseDuration(q.Get("ttl"))
+			if err != nil || ttl <= 0 {
+				http.Error(w, "invalid ttl", http.StatusBadRequest)
+				return
+			}
+			l, ok := lm.Grant(name, holder, token, ttl)
+			w.Header().Set("Content-Type", "application/json")
+			if !ok {
+				w.WriteHeader(http.StatusConflict)
+			}
+			json.NewEncoder(w).Encode(l)
+		case http.MethodDelete:
+			lm.Release(name, holder, token)
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
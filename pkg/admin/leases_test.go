@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"redalf.de/rtsper/pkg/cluster"
+)
+
+func leaseRequest(t *testing.T, h http.Handler, method, query string) (*httptest.ResponseRecorder, cluster.Lease) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, "/cluster/leases?"+query, nil))
+	var l cluster.Lease
+	if w.Code == http.StatusOK || w.Code == http.StatusConflict {
+		json.Unmarshal(w.Body.Bytes(), &l)
+	}
+	return w, l
+}
+
+func TestLeaseHandler(t *testing.T) {
+	cl, err := cluster.NewFromCSV("a,b,c", "a")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	lm := cluster.NewLeaseManager(cl, cluster.LeaseConfig{})
+	defer lm.Close()
+	h := LeaseHandler(lm)
+
+	for _, q := range []string{
+		"holder=b&token=1&ttl=1m",
+		"name=job&token=1&ttl=1m",
+		"name=job&holder=b&token=0&ttl=1m",
+		"name=job&holder=b&token=x&ttl=1m",
+		"name=job&holder=b&token=1",
+		"name=job&holder=b&token=1&ttl=-1s",
+	} {
+		if w, _ := leaseRequest(t, h, http.MethodPost, q); w.Code != http.StatusBadRequest {
+			t.Fatalf("POST %s: expected 400, got %d", q, w.Code)
+		}
+	}
+	if w, _ := leaseRequest(t, h, http.MethodPut, "name=job&holder=b&token=1"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", w.Code)
+	}
+
+	if w, l := leaseRequest(t, h, http.MethodPost, "name=job&holder=b&token=1&ttl=1m"); w.Code != http.StatusOK || l.Holder != "b" || l.Token != 1 {
+		t.Fatalf("grant: %d %+v", w.Code, l)
+	}
+	// a live lease is refused to another node, with the lease it holds
+	if w, l := leaseRequest(t, h, http.MethodPost, "name=job&holder=c&token=2&ttl=1m"); w.Code != http.StatusConflict || l.Holder != "b" || l.Token != 1 {
+		t.Fatalf("expected 409 with b's lease, got %d %+v", w.Code, l)
+	}
+	if w, _ := leaseRequest(t, h, http.MethodDelete, "name=job&holder=b&token=1"); w.Code != http.StatusOK {
+		t.Fatalf("release: %d", w.Code)
+	}
+	if w, l := leaseRequest(t, h, http.MethodPost, "name=job&holder=c&token=2&ttl=1m"); w.Code != http.StatusOK || l.Holder != "c" {
+		t.Fatalf("grant after release: %d %+v", w.Code, l)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cluster/leases", nil))
+	var list struct{ Leases []cluster.Lease }
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Leases) != 1 || list.Leases[0].Holder != "c" || list.Leases[0].Token != 2 {
+		t.Fatalf("unexpected list %s: %v", w.Body, err)
+	}
+}
+
+func TestLeaseHandlerBetweenNodes(t *testing.T) {
+	names := []string{"a", "b", "c"}
+	handlers := make(map[string]*http.ServeMux)
+	var entries []string
+	for _, name := range names {
+		mux := http.NewServeMux()
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+		_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		entries = append(entries, fmt.Sprintf("%s;host=127.0.0.1;admin=%s", name, port))
+		handlers[name] = mux
+	}
+
+	var mu sync.Mutex
+	running := make(map[string]uint64)
+	for _, name := range names {
+		cl, err := cluster.NewFromCSV(strings.Join(entries, ","), name)
+		if err != nil {
+			t.Fatalf("cluster %s: %v", name, err)
+		}
+		lm := cluster.NewLeaseManager(cl, cluster.LeaseConfig{TTL: 300 * time.Millisecond})
+		defer lm.Close()
+		handlers[name].HandleFunc("/cluster/leases", LeaseHandler(lm))
+		if err := lm.Run("relay/cam1", func(ctx context.Context, token uint64) {
+			mu.Lock()
+			running[name] = token
+			mu.Unlock()
+			<-ctx.Done()
+		}); err != nil {
+			t.Fatalf("run on %s: %v", name, err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(running)
+		var token uint64
+		for _, tok := range running {
+			token = tok
+		}
+		mu.Unlock()
+		if n == 1 && token == 1 {
+			break
+		}
+		if n > 1 || time.Now().After(deadline) {
+			t.Fatalf("expected the task on one node with token 1, got %d nodes, token %d", n, token)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,53 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"redalf.de/rtsper/pkg/cluster"
+)
+
+// LoadHandler serves this node's load to its peers.
+// Usage: GET /cluster/load
+func LoadHandler(lm *cluster.LoadMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lm.Local())
+	}
+}
+
+// PlacementHandler records a placement decided by a topic's home node
+// (GET lists the known placements).
+// Usage: POST /cluster/placements?topic=<name>&node=<node>&home=<node>[&created=<unix ns>]
+func PlacementHandler(cl *cluster.Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"placements": cl.Placements()})
+			return
+		case http.MethodPost:
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		p := cluster.Placement{Topic: q.Get("topic"), Node: q.Get("node"), Home: q.Get("home")}
+		if v := q.Get("created"); v != "" {
+			ns, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid created parameter", http.StatusBadRequest)
+				return
+			}
+			p.Created = time.Unix(0, ns)
+		}
+		if err := cl.AddPlacement(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"topic": p.Topic, "node": p.Node})
+	}
+}
@@ -0,0 +1,34 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"redalf.de/rtsper/pkg/cluster"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// ClusterStatusHandler merges the /status of all members; unreachable
+// members are listed with their error and the result is marked partial.
+// Usage: GET /cluster/status
+func ClusterStatusHandler(sc *cluster.StatusCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sc.Collect(r.Context()))
+	}
+}
+
+// LocateHandler returns the owner of a topic and the URLs to publish and
+// play it with every enabled protocol.
+// Usage: GET /cluster/locate?topic=<name>
+func LocateHandler(cl *cluster.Cluster, ep cluster.Endpoints) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("topic")
+		if !topic.ValidName(name) {
+			http.Error(w, "missing or invalid topic parameter", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cl.Locate(name, ep))
+	}
+}
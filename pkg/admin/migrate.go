@@ -0,0 +1,60 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"redalf.de/rtsper/pkg/cluster"
+)
+
+// MigrateHandler moves a topic to another node without dropping its
+// subscribers; the request may be sent to any node and is forwarded to the
+// topic's owner. GET lists the migrations started by this node. Peers use
+// local=true to run the steps on the target.
+// Usage: POST /cluster/migrate?topic=<name>&to=<node>
+func MigrateHandler(m *cluster.Migrator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		local := q.Get("local") == "true"
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && local:
+			json.NewEncoder(w).Encode(map[string]interface{}{"topic": q.Get("topic"), "publisher": m.LocalPublisher(q.Get("topic"))})
+			return
+		case r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]interface{}{"migrations": m.Migrations()})
+			return
+		case r.Method != http.MethodPost:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if q.Get("topic") == "" {
+			http.Error(w, "missing topic parameter", http.StatusBadRequest)
+			return
+		}
+		if local {
+			if err := m.Step(q.Get("step"), q.Get("topic"), q.Get("from")); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"topic": q.Get("topic"), "step": q.Get("step")})
+			return
+		}
+		if q.Get("to") == "" {
+			http.Error(w, "missing to parameter", http.StatusBadRequest)
+			return
+		}
+		mg, err := m.Migrate(q.Get("topic"), q.Get("to"))
+		if err != nil {
+			code := http.StatusBadGateway
+			if errors.Is(err, cluster.ErrInvalidMigration) {
+				code = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(mg)
+	}
+}
@@ -0,0 +1,47 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"redalf.de/rtsper/pkg/cluster"
+)
+
+// PinHandler lists, sets and removes topic pins. Changes are forwarded to
+// the other members unless local=true is given (which is how peers forward
+// them).
+// Usage: GET /cluster/pins, POST /cluster/pins?topic=<name>&node=<node>,
+// DELETE /cluster/pins?topic=<name>
+func PinHandler(cl *cluster.Cluster, ps *cluster.PinSync) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		topicName := q.Get("topic")
+		var node string
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"pins": cl.Pins()})
+			return
+		case http.MethodPost:
+			node = q.Get("node")
+			if err := cl.SetPin(topicName, node); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			if !cl.RemovePin(topicName) && q.Get("local") != "true" {
+				http.Error(w, "topic is not pinned", http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		resp := map[string]interface{}{"topic": topicName, "node": node, "owner": cl.Owner(topicName)}
+		if ps != nil && q.Get("local") != "true" {
+			resp["peers"] = ps.Propagate(topicName, node)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
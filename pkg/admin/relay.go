@@ -0,0 +1,17 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"redalf.de/rtsper/pkg/relay"
+)
+
+// RelayListHandler lists push relay targets with their health.
+// Usage: GET /relay
+func RelayListHandler(rm *relay.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"targets": rm.List()})
+	}
+}
@@ -0,0 +1,18 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"redalf.de/rtsper/pkg/rtspsrv"
+)
+
+// ReplicaListHandler lists the replicated topics this node holds as their
+// standby.
+// Usage: GET /replicas
+func ReplicaListHandler(s *rtspsrv.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"replicas": s.Replicas()})
+	}
+}
@@ -0,0 +1,18 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"redalf.de/rtsper/pkg/rtspsrv"
+)
+
+// SessionListHandler lists the RTSP sessions of this node with their client
+// addresses.
+// Usage: GET /sessions
+func SessionListHandler(s *rtspsrv.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"sessions": s.Sessions()})
+	}
+}
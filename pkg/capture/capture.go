@@ -0,0 +1,298 @@
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// Format selects the on-disk capture format.
+type Format string
+
+const (
+	FormatPcap    Format = "pcap"
+	FormatRtpdump Format = "rtpdump"
+)
+
+// Packet is a single captured RTP or RTCP packet.
+type Packet struct {
+	Time  time.Time
+	Track int
+	RTCP  bool
+	Data  []byte
+}
+
+// Options bound a single capture. Zero values fall back to the manager limits.
+type Options struct {
+	Format      Format
+	MaxDuration time.Duration
+	MaxBytes    int64
+}
+
+var (
+	ErrCaptureRunning = errors.New("capture already running for topic")
+	ErrNoCapture      = errors.New("no capture running for topic")
+	ErrNoTopic        = errors.New("topic has no active stream")
+)
+
+// tapID identifies the capture tap on a topic; one capture per topic is allowed.
+const tapID = "capture"
+
+type packetWriter interface {
+	WritePacket(Packet) (int, error)
+	Flush() error
+}
+
+// Manager runs at most one capture per topic and writes files into dir.
+type Manager struct {
+	mgr         *topic.Manager
+	dir         string
+	maxDuration time.Duration
+	maxBytes    int64
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	done     []Status
+}
+
+// NewManager creates a capture manager. maxDuration and maxBytes are hard
+// upper bounds applied to every capture.
+func NewManager(mgr *topic.Manager, dir string, maxDuration time.Duration, maxBytes int64) *Manager {
+	return &Manager{mgr: mgr, dir: dir, maxDuration: maxDuration, maxBytes: maxBytes, sessions: make(map[string]*session)}
+}
+
+// Status describes a running or finished capture.
+type Status struct {
+	Topic    string    `json:"topic"`
+	Format   Format    `json:"format"`
+	Path     string    `json:"path"`
+	SDPPath  string    `json:"sdp_path"`
+	Started  time.Time `json:"started"`
+	Deadline time.Time `json:"deadline"`
+	MaxBytes int64     `json:"max_bytes"`
+	Bytes    int64     `json:"bytes"`
+	Packets  int64     `json:"packets"`
+	Dropped  int64     `json:"dropped"`
+	Running  bool      `json:"running"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// session is a running capture of a single topic.
+type session struct {
+	m        *Manager
+	topic    string
+	format   Format
+	path     string
+	sdpPath  string
+	started  time.Time
+	deadline time.Time
+	maxBytes int64
+
+	f      *os.File
+	w      packetWriter
+	ch     chan Packet
+	stop   chan string
+	done   chan struct{}
+	reason string
+
+	bytes   atomic.Int64
+	packets atomic.Int64
+	dropped atomic.Int64
+}
+
+// Start begins capturing inbound packets of the topic. The topic must have an
+// active stream so its tracks can be recorded into the sidecar SDP file.
+func (m *Manager) Start(topicName string, opts Options) (Status, error) {
+	st := m.mgr.GetTopicStream(topicName)
+	if st == nil {
+		return Status{}, ErrNoTopic
+	}
+	if opts.Format == "" {
+		opts.Format = FormatPcap
+	}
+	if opts.Format != FormatPcap && opts.Format != FormatRtpdump {
+		return Status{}, fmt.Errorf("unknown capture format %q", opts.Format)
+	}
+	if opts.MaxDuration <= 0 || opts.MaxDuration > m.maxDuration {
+		opts.MaxDuration = m.maxDuration
+	}
+	if opts.MaxBytes <= 0 || opts.MaxBytes > m.maxBytes {
+		opts.MaxBytes = m.maxBytes
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[topicName]; ok {
+		return Status{}, ErrCaptureRunning
+	}
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return Status{}, err
+	}
+	now := time.Now()
+	base := fmt.Sprintf("%s-%s", topicName, now.UTC().Format("20060102T150405Z"))
+	path := filepath.Join(m.dir, base+"."+string(opts.Format))
+	sdpPath := path + ".sdp"
+	if err := os.WriteFile(sdpPath, st.Tracks().Marshal(false), 0o644); err != nil {
+		return Status{}, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return Status{}, err
+	}
+	var w packetWriter
+	if opts.Format == FormatRtpdump {
+		w, err = newRtpdumpWriter(f, now)
+	} else {
+		w, err = newPcapWriter(f)
+	}
+	if err != nil {
+		f.Close()
+		return Status{}, err
+	}
+
+	s := &session{
+		m:        m,
+		topic:    topicName,
+		format:   opts.Format,
+		path:     path,
+		sdpPath:  sdpPath,
+		started:  now,
+		deadline: now.Add(opts.MaxDuration),
+		maxBytes: opts.MaxBytes,
+		f:        f,
+		w:        w,
+		ch:       make(chan Packet, 1024),
+		stop:     make(chan string, 1),
+		done:     make(chan struct{}),
+	}
+	m.sessions[topicName] = s
+	m.mgr.AddTap(topicName, tapID, s.tap)
+	go s.run()
+	plog.Info("capture: started %s capture of topic %s -> %s", s.format, topicName, path)
+	return s.status(), nil
+}
+
+// Stop ends the capture for the topic and returns its final status.
+func (m *Manager) Stop(topicName string) (Status, error) {
+	m.mu.Lock()
+	s, ok := m.sessions[topicName]
+	m.mu.Unlock()
+	if !ok {
+		return Status{}, ErrNoCapture
+	}
+	s.requestStop("stopped")
+	<-s.done
+	return s.status(), nil
+}
+
+// List returns running captures followed by recently finished ones.
+func (m *Manager) List() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Status, 0, len(m.sessions)+len(m.done))
+	for _, s := range m.sessions {
+		out = append(out, s.status())
+	}
+	out = append(out, m.done...)
+	return out
+}
+
+// Close stops all running captures.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	sessions := make([]*session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mu.Unlock()
+	for _, s := range sessions {
+		s.requestStop("shutdown")
+		<-s.done
+	}
+}
+
+// tap is called on the ingest path; it never blocks and counts drops instead.
+func (s *session) tap(pkt *topic.InboundPacket) {
+	data := make([]byte, len(pkt.Raw))
+	copy(data, pkt.Raw)
+	select {
+	case s.ch <- Packet{Time: time.Now(), Track: pkt.Track, RTCP: pkt.RTCP, Data: data}:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *session) requestStop(reason string) {
+	select {
+	case s.stop <- reason:
+	default:
+	}
+}
+
+func (s *session) run() {
+	timer := time.NewTimer(time.Until(s.deadline))
+	defer timer.Stop()
+	reason := ""
+	for reason == "" {
+		select {
+		case pkt := <-s.ch:
+			n, err := s.w.WritePacket(pkt)
+			if err != nil {
+				reason = "write error: " + err.Error()
+				continue
+			}
+			s.packets.Add(1)
+			if s.bytes.Add(int64(n)) >= s.maxBytes {
+				reason = "max bytes reached"
+			}
+		case <-timer.C:
+			reason = "max duration reached"
+		case r := <-s.stop:
+			reason = r
+		}
+	}
+	s.m.mgr.RemoveTap(s.topic, tapID)
+	if err := s.w.Flush(); err != nil {
+		plog.Warn("capture: flush %s: %v", s.path, err)
+	}
+	s.f.Close()
+
+	s.m.mu.Lock()
+	s.reason = reason
+	delete(s.m.sessions, s.topic)
+	st := s.status()
+	s.m.done = append(s.m.done, st)
+	// keep a short history of finished captures
+	if len(s.m.done) > 32 {
+		s.m.done = s.m.done[len(s.m.done)-32:]
+	}
+	s.m.mu.Unlock()
+	close(s.done)
+	plog.Info("capture: topic %s finished (%s): %d packets, %d bytes", s.topic, reason, st.Packets, st.Bytes)
+}
+
+// status snapshots the session. Caller must hold m.mu or have observed done.
+func (s *session) status() Status {
+	running := s.reason == ""
+	return Status{
+		Topic:    s.topic,
+		Format:   s.format,
+		Path:     s.path,
+		SDPPath:  s.sdpPath,
+		Started:  s.started,
+		Deadline: s.deadline,
+		MaxBytes: s.maxBytes,
+		Bytes:    s.bytes.Load(),
+		Packets:  s.packets.Load(),
+		Dropped:  s.dropped.Load(),
+		Running:  running,
+		Reason:   s.reason,
+	}
+}
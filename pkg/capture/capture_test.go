@@ -0,0 +1,177 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtp"
+
+	"redalf.de/rtsper/pkg/topic"
+)
+
+func rtpBytes(t *testing.T, pt uint8, seq uint16, ts uint32) []byte {
+	t.Helper()
+	p := rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: pt, SequenceNumber: seq, Timestamp: ts, SSRC: 1}, Payload: []byte{1, 2, 3}}
+	b, err := p.Marshal()
+	if err != nil {
+		t.Fatalf("marshal rtp: %v", err)
+	}
+	return b
+}
+
+func TestPcapRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newPcapWriter(&buf)
+	if err != nil {
+		t.Fatalf("newPcapWriter: %v", err)
+	}
+	now := time.Unix(1700000000, 123456000)
+	in := []Packet{
+		{Time: now, Track: 0, Data: rtpBytes(t, 96, 1, 0)},
+		{Time: now.Add(40 * time.Millisecond), Track: 1, Data: rtpBytes(t, 97, 7, 100)},
+		{Time: now.Add(50 * time.Millisecond), Track: 1, RTCP: true, Data: []byte{0x80, 200, 0, 1, 0, 0, 0, 1}},
+	}
+	for _, p := range in {
+		if _, err := w.WritePacket(p); err != nil {
+			t.Fatalf("WritePacket: %v", err)
+		}
+	}
+	w.Flush()
+
+	out, err := ReadPcap(&buf)
+	if err != nil {
+		t.Fatalf("ReadPcap: %v", err)
+	}
+	if len(out) != len(in) {
+		t.Fatalf("expected %d packets, got %d", len(in), len(out))
+	}
+	for i := range in {
+		if out[i].Track != in[i].Track || out[i].RTCP != in[i].RTCP || !bytes.Equal(out[i].Data, in[i].Data) {
+			t.Fatalf("packet %d mismatch: got %+v want %+v", i, out[i], in[i])
+		}
+		if !out[i].Time.Equal(in[i].Time) {
+			t.Fatalf("packet %d time mismatch: got %v want %v", i, out[i].Time, in[i].Time)
+		}
+	}
+}
+
+func TestRtpdumpRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	start := time.Unix(1700000000, 0)
+	w, err := newRtpdumpWriter(&buf, start)
+	if err != nil {
+		t.Fatalf("newRtpdumpWriter: %v", err)
+	}
+	w.WritePacket(Packet{Time: start.Add(10 * time.Millisecond), Data: rtpBytes(t, 96, 1, 0)})
+	w.WritePacket(Packet{Time: start.Add(30 * time.Millisecond), RTCP: true, Data: []byte{0x80, 200, 0, 1, 0, 0, 0, 1}})
+	w.Flush()
+
+	out, err := ReadRtpdump(&buf)
+	if err != nil {
+		t.Fatalf("ReadRtpdump: %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 packets, got %d", len(out))
+	}
+	if out[0].RTCP || !out[1].RTCP {
+		t.Fatalf("unexpected RTCP flags: %v %v", out[0].RTCP, out[1].RTCP)
+	}
+	if d := out[1].Time.Sub(out[0].Time); d != 20*time.Millisecond {
+		t.Fatalf("expected 20ms between packets, got %v", d)
+	}
+}
+
+func TestReplayMapsPayloadTypesAndLoops(t *testing.T) {
+	tracks := gortsplib.Tracks{
+		&gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1},
+		&gortsplib.TrackOpus{PayloadType: 111, SampleRate: 48000, ChannelCount: 2},
+	}
+	now := time.Now()
+	pkts := []Packet{
+		{Time: now, Track: -1, Data: rtpBytes(t, 96, 10, 1000)},
+		{Time: now.Add(5 * time.Millisecond), Track: -1, Data: rtpBytes(t, 111, 20, 2000)},
+		{Time: now.Add(6 * time.Millisecond), Track: -1, RTCP: true, Data: []byte{0x80, 200, 0, 1, 0, 0, 0, 1}},
+	}
+	type sent struct {
+		track int
+		seq   uint16
+		ts    uint32
+	}
+	var got []sent
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := Replay(ctx, pkts, tracks, true, func(track int, p *rtp.Packet) error {
+		got = append(got, sent{track, p.SequenceNumber, p.Timestamp})
+		if len(got) == 4 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("expected 4 packets, got %d", len(got))
+	}
+	if got[0].track != 0 || got[1].track != 1 {
+		t.Fatalf("unexpected track mapping: %+v", got)
+	}
+	if got[2].seq != 11 || got[2].ts <= 1000 {
+		t.Fatalf("expected shifted seq/timestamp on second loop, got %+v", got[2])
+	}
+}
+
+func TestClockTicksAfterLongLoops(t *testing.T) {
+	// nanoseconds times 90 kHz overflow 64 bits after about 57h
+	d := 100*time.Hour + 500*time.Millisecond
+	if got := clockTicks(d, 90000); got != 100*3600*90000+45000 {
+		t.Fatalf("unexpected ticks %d", got)
+	}
+}
+
+func TestManagerCapturesTapPackets(t *testing.T) {
+	m := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 1, PublisherQueueSize: 16, PublisherGracePeriod: topic.Duration{Duration: time.Second}})
+	if err := m.RegisterPublisher(context.Background(), "cam1", topic.NewPublisherSession("p1")); err != nil {
+		t.Fatalf("register publisher: %v", err)
+	}
+	m.SetTopicStream("cam1", gortsplib.NewServerStream(gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1}}))
+
+	cm := NewManager(m, t.TempDir(), time.Minute, 1<<20)
+	st, err := cm.Start("cam1", Options{Format: FormatPcap})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if _, err := cm.Start("cam1", Options{}); err != ErrCaptureRunning {
+		t.Fatalf("expected ErrCaptureRunning, got %v", err)
+	}
+	m.PublishPacket("cam1", &topic.InboundPacket{Track: 0, Raw: rtpBytes(t, 96, 1, 0)})
+	m.PublishRTCP("cam1", &topic.InboundPacket{Track: 0, Raw: []byte{0x80, 200, 0, 1, 0, 0, 0, 1}})
+	time.Sleep(20 * time.Millisecond)
+
+	final, err := cm.Stop("cam1")
+	if err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if final.Running || final.Packets != 2 {
+		t.Fatalf("unexpected final status: %+v", final)
+	}
+	f, err := os.Open(st.Path)
+	if err != nil {
+		t.Fatalf("open capture: %v", err)
+	}
+	defer f.Close()
+	pkts, err := ReadPcap(f)
+	if err != nil {
+		t.Fatalf("ReadPcap: %v", err)
+	}
+	if len(pkts) != 2 || !pkts[1].RTCP {
+		t.Fatalf("unexpected captured packets: %+v", pkts)
+	}
+	if _, err := os.Stat(st.SDPPath); err != nil {
+		t.Fatalf("expected sidecar SDP: %v", err)
+	}
+}
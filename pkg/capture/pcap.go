@@ -0,0 +1,160 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// pcap files carry raw IPv4 datagrams (LINKTYPE_RAW). RTP/RTCP packets are
+// wrapped into synthetic IPv4/UDP headers; the UDP destination port encodes
+// the track (BasePort + 2*track for RTP, +1 for RTCP) so Wireshark's
+// "Decode As RTP" and our own reader can tell tracks apart.
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapLinkRaw    = 101
+	pcapSnapLen    = 65535
+	ipv4HeaderLen  = 20
+	udpHeaderLen   = 8
+	pcapRecordHdr  = 16
+	pcapGlobalHdr  = 24
+	BasePort       = 5000
+	srcPort        = 4000
+	maxPcapPayload = pcapSnapLen - ipv4HeaderLen - udpHeaderLen
+)
+
+var (
+	srcIP = [4]byte{10, 0, 0, 1}
+	dstIP = [4]byte{10, 0, 0, 2}
+)
+
+type pcapWriter struct {
+	w *bufio.Writer
+}
+
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	bw := bufio.NewWriter(w)
+	hdr := make([]byte, pcapGlobalHdr)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	// thiszone and sigfigs stay zero
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkRaw)
+	if _, err := bw.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &pcapWriter{w: bw}, nil
+}
+
+func (p *pcapWriter) WritePacket(pkt Packet) (int, error) {
+	if len(pkt.Data) > maxPcapPayload {
+		return 0, fmt.Errorf("packet too large for pcap: %d bytes", len(pkt.Data))
+	}
+	port := BasePort + 2*pkt.Track
+	if pkt.RTCP {
+		port++
+	}
+	total := ipv4HeaderLen + udpHeaderLen + len(pkt.Data)
+	buf := make([]byte, pcapRecordHdr+ipv4HeaderLen+udpHeaderLen)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(pkt.Time.Unix()))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(pkt.Time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(total))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(total))
+
+	ip := buf[pcapRecordHdr:]
+	ip[0] = 0x45 // version 4, IHL 5
+	binary.BigEndian.PutUint16(ip[2:], uint16(total))
+	ip[8] = 64 // TTL
+	ip[9] = 17 // UDP
+	copy(ip[12:16], srcIP[:])
+	copy(ip[16:20], dstIP[:])
+	binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip[:ipv4HeaderLen]))
+
+	udp := ip[ipv4HeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(srcPort+2*pkt.Track))
+	binary.BigEndian.PutUint16(udp[2:], uint16(port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderLen+len(pkt.Data)))
+	// UDP checksum 0 means "not computed" for IPv4
+
+	if _, err := p.w.Write(buf); err != nil {
+		return 0, err
+	}
+	if _, err := p.w.Write(pkt.Data); err != nil {
+		return 0, err
+	}
+	return len(buf) + len(pkt.Data), nil
+}
+
+func (p *pcapWriter) Flush() error { return p.w.Flush() }
+
+func ipChecksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// ReadPcap reads a capture written by this package. Only LINKTYPE_RAW IPv4/UDP
+// records are understood; other records are skipped.
+func ReadPcap(r io.Reader) ([]Packet, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, pcapGlobalHdr)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("read pcap header: %w", err)
+	}
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(hdr) == pcapMagic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr) == pcapMagic:
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("not a pcap file (bad magic)")
+	}
+	if lt := order.Uint32(hdr[20:]); lt != pcapLinkRaw {
+		return nil, fmt.Errorf("unsupported pcap link type %d (expected raw IP)", lt)
+	}
+
+	var out []Packet
+	rec := make([]byte, pcapRecordHdr)
+	for {
+		if _, err := io.ReadFull(br, rec); err != nil {
+			if err == io.EOF {
+				return out, nil
+			}
+			return out, fmt.Errorf("read pcap record: %w", err)
+		}
+		sec := order.Uint32(rec[0:])
+		usec := order.Uint32(rec[4:])
+		incl := order.Uint32(rec[8:])
+		data := make([]byte, incl)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return out, fmt.Errorf("read pcap record data: %w", err)
+		}
+		if len(data) < ipv4HeaderLen+udpHeaderLen || data[0]>>4 != 4 || data[9] != 17 {
+			continue
+		}
+		ihl := int(data[0]&0x0f) * 4
+		if len(data) < ihl+udpHeaderLen {
+			continue
+		}
+		port := int(binary.BigEndian.Uint16(data[ihl+2:]))
+		if port < BasePort {
+			continue
+		}
+		out = append(out, Packet{
+			Time:  time.Unix(int64(sec), int64(usec)*1000),
+			Track: (port - BasePort) / 2,
+			RTCP:  (port-BasePort)%2 == 1,
+			Data:  data[ihl+udpHeaderLen:],
+		})
+	}
+}
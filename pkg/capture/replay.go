@@ -0,0 +1,108 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtp"
+)
+
+// loopGap separates the end of one replay iteration from the start of the next.
+const loopGap = 20 * time.Millisecond
+
+// Replay re-sends the captured RTP packets through write with their original
+// relative timing. Packets with Track -1 (rtpdump) are mapped to tracks by RTP
+// payload type. RTCP packets are skipped since the publishing client produces
+// its own sender reports. When loop is true the capture is repeated with RTP
+// timestamps and sequence numbers shifted so players see a continuous stream.
+func Replay(ctx context.Context, pkts []Packet, tracks gortsplib.Tracks, loop bool, write func(track int, pkt *rtp.Packet) error) error {
+	ptToTrack := make(map[uint8]int)
+	for i, t := range tracks {
+		md := t.MediaDescription()
+		if len(md.MediaName.Formats) == 0 {
+			continue
+		}
+		if pt, err := strconv.Atoi(md.MediaName.Formats[0]); err == nil {
+			ptToTrack[uint8(pt)] = i
+		}
+	}
+
+	type entry struct {
+		offset time.Duration
+		track  int
+		pkt    rtp.Packet
+	}
+	var entries []entry
+	var first time.Time
+	for _, p := range pkts {
+		if p.RTCP {
+			continue
+		}
+		var rp rtp.Packet
+		if err := rp.Unmarshal(p.Data); err != nil {
+			continue
+		}
+		track := p.Track
+		if track < 0 {
+			var ok bool
+			if track, ok = ptToTrack[rp.PayloadType]; !ok {
+				continue
+			}
+		}
+		if track >= len(tracks) {
+			continue
+		}
+		if first.IsZero() {
+			first = p.Time
+		}
+		entries = append(entries, entry{offset: p.Time.Sub(first), track: track, pkt: rp})
+	}
+	if len(entries) == 0 {
+		return errors.New("capture contains no replayable RTP packets")
+	}
+	span := entries[len(entries)-1].offset + loopGap
+
+	// per-track packet counts drive sequence number shifts between loops
+	counts := make([]uint16, len(tracks))
+	for _, e := range entries {
+		counts[e.track]++
+	}
+
+	start := time.Now()
+	for iter := 0; ; iter++ {
+		iterStart := start.Add(time.Duration(iter) * span)
+		for _, e := range entries {
+			if d := time.Until(iterStart.Add(e.offset)); d > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(d):
+				}
+			} else if err := ctx.Err(); err != nil {
+				return err
+			}
+			pkt := e.pkt
+			if iter > 0 {
+				pkt.Timestamp += uint32(clockTicks(time.Duration(iter)*span, tracks[e.track].ClockRate()))
+				pkt.SequenceNumber += uint16(iter) * counts[e.track]
+			}
+			if err := write(e.track, &pkt); err != nil {
+				return fmt.Errorf("write packet: %w", err)
+			}
+		}
+		if !loop {
+			return nil
+		}
+	}
+}
+
+// clockTicks converts d to units of a clock rate. Whole seconds and the
+// rest are scaled separately, so that long replays do not overflow.
+func clockTicks(d time.Duration, rate int) int64 {
+	sec, rem := int64(d/time.Second), int64(d%time.Second)
+	return sec*int64(rate) + rem*int64(rate)/int64(time.Second)
+}
@@ -0,0 +1,104 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// rtpdump is the rtptools format: a text preamble followed by a binary file
+// header and length-prefixed packets with millisecond offsets. The format has
+// no notion of tracks, so the reader reports Track -1 and callers map packets
+// to tracks by RTP payload type.
+
+const rtpdumpPreamble = "#!rtpplay1.0 "
+
+type rtpdumpWriter struct {
+	w     *bufio.Writer
+	start time.Time
+}
+
+func newRtpdumpWriter(w io.Writer, start time.Time) (*rtpdumpWriter, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(bw, "%s%d.%d.%d.%d/%d\n", rtpdumpPreamble, dstIP[0], dstIP[1], dstIP[2], dstIP[3], BasePort); err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 16)
+	binary.BigEndian.PutUint32(hdr[0:], uint32(start.Unix()))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(start.Nanosecond()/1000))
+	copy(hdr[8:12], srcIP[:])
+	binary.BigEndian.PutUint16(hdr[12:], srcPort)
+	if _, err := bw.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &rtpdumpWriter{w: bw, start: start}, nil
+}
+
+func (r *rtpdumpWriter) WritePacket(pkt Packet) (int, error) {
+	if len(pkt.Data)+8 > 0xffff {
+		return 0, fmt.Errorf("packet too large for rtpdump: %d bytes", len(pkt.Data))
+	}
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint16(hdr[0:], uint16(len(pkt.Data)+8))
+	if !pkt.RTCP {
+		// plen is the RTP length; zero marks RTCP
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(pkt.Data)))
+	}
+	off := pkt.Time.Sub(r.start)
+	if off < 0 {
+		off = 0
+	}
+	binary.BigEndian.PutUint32(hdr[4:], uint32(off.Milliseconds()))
+	if _, err := r.w.Write(hdr); err != nil {
+		return 0, err
+	}
+	if _, err := r.w.Write(pkt.Data); err != nil {
+		return 0, err
+	}
+	return len(hdr) + len(pkt.Data), nil
+}
+
+func (r *rtpdumpWriter) Flush() error { return r.w.Flush() }
+
+// ReadRtpdump reads an rtpdump file. Returned packets carry Track -1.
+func ReadRtpdump(rd io.Reader) ([]Packet, error) {
+	br := bufio.NewReader(rd)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("read rtpdump preamble: %w", err)
+	}
+	if !strings.HasPrefix(line, rtpdumpPreamble) {
+		return nil, errors.New("not an rtpdump file (bad preamble)")
+	}
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("read rtpdump header: %w", err)
+	}
+	start := time.Unix(int64(binary.BigEndian.Uint32(hdr[0:])), int64(binary.BigEndian.Uint32(hdr[4:]))*1000)
+
+	var out []Packet
+	ph := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, ph); err != nil {
+			if err == io.EOF {
+				return out, nil
+			}
+			return out, fmt.Errorf("read rtpdump packet header: %w", err)
+		}
+		length := int(binary.BigEndian.Uint16(ph[0:]))
+		plen := binary.BigEndian.Uint16(ph[2:])
+		off := time.Duration(binary.BigEndian.Uint32(ph[4:])) * time.Millisecond
+		if length < 8 {
+			return out, fmt.Errorf("invalid rtpdump packet length %d", length)
+		}
+		data := make([]byte, length-8)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return out, fmt.Errorf("read rtpdump packet: %w", err)
+		}
+		out = append(out, Packet{Time: start.Add(off), Track: -1, RTCP: plen == 0, Data: data})
+	}
+}
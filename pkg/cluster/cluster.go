@@ -2,24 +2,56 @@ package cluster
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/cespare/xxhash/v2"
 )
 
-// Cluster is a simple static cluster using rendezvous hashing for owner selection.
+// Cluster is a simple cluster using rendezvous hashing for owner selection.
+// Membership starts from a static list and may be changed at runtime (see
+// Gossip), so all methods are safe for concurrent use.
 type Cluster struct {
+	mu       sync.RWMutex
 	nodes    []string
 	nodeSet  map[string]struct{}
 	self     string
 	draining map[string]bool
+	// unhealthy nodes failed their health checks (see HealthChecker)
+	unhealthy map[string]bool
+	// advertised maps node names to the host clients should use to reach
+	// them (see SetAdvertised)
+	advertised map[string]string
+	// addrs are the membership entries with hosts and ports of the nodes
+	// (see NodeAddr)
+	addrs map[string]NodeAddr
+	// weights of the nodes for owner selection; missing nodes weigh 1
+	weights map[string]float64
+	// placements pin topics to the node chosen by load-aware placement
+	// (see LoadMonitor)
+	placements map[string]*Placement
+	// pins assign topics to nodes by hand; they take precedence over
+	// placements (see SetPin)
+	pins map[string]string
+
+	gossip   *Gossip
+	health   *HealthChecker
+	load     *LoadMonitor
+	migrator *Migrator
+	// leases grants and holds task leases (nil = disabled)
+	leases *LeaseManager
 }
 
-// NewFromCSV creates a Cluster from a comma-separated list of node names.
-// nodeList entries should be simple hostnames that resolve to the rtsper instances
-// on the Docker network (e.g., "rtsper1,rtsper2").
+// NewFromCSV creates a Cluster from a comma-separated list of node entries.
+// Entries are simple hostnames that resolve to the rtsper instances on the
+// Docker network (e.g., "rtsper1,rtsper2"), optionally with the host and
+// ports to reach them (see ParseNodeAddr).
 func NewFromCSV(nodeList string, self string) (*Cluster, error) {
-	c := &Cluster{nodeSet: make(map[string]struct{}), draining: make(map[string]bool)}
+	c := &Cluster{nodeSet: make(map[string]struct{}), draining: make(map[string]bool), unhealthy: make(map[string]bool)}
 	if nodeList == "" {
 		return nil, errors.New("empty cluster nodes")
 	}
@@ -29,8 +61,18 @@ func NewFromCSV(nodeList string, self string) (*Cluster, error) {
 		if p == "" {
 			continue
 		}
-		c.nodes = append(c.nodes, p)
-		c.nodeSet[p] = struct{}{}
+		a, err := ParseNodeAddr(p)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := c.nodeSet[a.ID]; ok {
+			continue
+		}
+		c.nodes = append(c.nodes, a.ID)
+		c.nodeSet[a.ID] = struct{}{}
+		if a.String() != a.ID {
+			c.setAddrLocked(a)
+		}
 	}
 	if len(c.nodes) == 0 {
 		return nil, errors.New("no valid cluster nodes")
@@ -47,20 +89,102 @@ func NewFromCSV(nodeList string, self string) (*Cluster, error) {
 	return c, nil
 }
 
-// Members returns the configured nodes in iteration order.
-func (c *Cluster) Members() []string { return c.nodes }
+// Members returns the current nodes in the order they joined.
+func (c *Cluster) Members() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.nodes...)
+}
 
-// Owner returns the node name that should own the topic using rendezvous hashing.
-// Draining nodes are skipped.
+// AddNode adds a node to the membership; it reports whether it was new.
+func (c *Cluster) AddNode(node string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.nodeSet[node]; ok || node == "" {
+		return false
+	}
+	c.nodes = append(c.nodes, node)
+	c.nodeSet[node] = struct{}{}
+	return true
+}
+
+// RemoveNode removes a node from the membership; it reports whether the
+// node was a member. This node itself is never removed.
+func (c *Cluster) RemoveNode(node string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.nodeSet[node]; !ok || node == c.self {
+		return false
+	}
+	delete(c.nodeSet, node)
+	delete(c.draining, node)
+	delete(c.unhealthy, node)
+	delete(c.weights, node)
+	for i, n := range c.nodes {
+		if n == node {
+			c.nodes = append(c.nodes[:i:i], c.nodes[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Owner returns the node name that should own the topic: the node it is
+// pinned to, else the node it was placed on, else the result of weighted
+// rendezvous hashing, so a node owns a share of the topics proportional to
+// its weight. Draining and unhealthy nodes are skipped.
 func (c *Cluster) Owner(topic string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ownerLocked(topic)
+}
+
+func (c *Cluster) ownerLocked(topic string) string {
+	if n, ok := c.pinnedLocked(topic); ok {
+		return n
+	}
+	if p, ok := c.placements[topic]; ok && c.eligibleLocked(p.Node) {
+		return p.Node
+	}
+	return c.homeLocked(topic)
+}
+
+// eligibleLocked reports whether node is a member that may own topics.
+func (c *Cluster) eligibleLocked(node string) bool {
+	_, ok := c.nodeSet[node]
+	return ok && !c.draining[node] && !c.unhealthy[node]
+}
+
+// Home returns the rendezvous owner of topic, ignoring placements. The home
+// node decides where new topics are placed.
+func (c *Cluster) Home(topic string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.homeLocked(topic)
+}
+
+func (c *Cluster) homeLocked(topic string) string {
+	return c.rankLocked(topic, "")
+}
+
+// Standby returns the node next in rendezvous order after the owner of
+// topic: the one that owns it when the owner fails, or "" if there is none.
+func (c *Cluster) Standby(topic string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rankLocked(topic, c.ownerLocked(topic))
+}
+
+// rankLocked returns the eligible node with the highest rendezvous score
+// for topic other than except.
+func (c *Cluster) rankLocked(topic, except string) string {
 	var best string
-	var bestScore uint64
+	var bestScore float64
 	for _, n := range c.nodes {
-		if c.draining[n] {
+		if n == except || c.draining[n] || c.unhealthy[n] {
 			continue
 		}
-		key := n + "|" + topic
-		score := xxhash.Sum64String(key)
+		score := rendezvousScore(n, topic, c.weightLocked(n))
 		if best == "" || score > bestScore {
 			best = n
 			bestScore = score
@@ -69,16 +193,143 @@ func (c *Cluster) Owner(topic string) string {
 	return best
 }
 
+// rendezvousScore is -weight/ln(u) for the node/topic hash mapped to u in
+// (0,1). With equal weights it orders nodes like the plain hash.
+func rendezvousScore(node, topic string, weight float64) float64 {
+	h := xxhash.Sum64String(node + "|" + topic)
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+// SetWeight sets the weight of node for owner selection; non-positive
+// weights reset it to 1.
+func (c *Cluster) SetWeight(node string, w float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.weights == nil {
+		c.weights = make(map[string]float64)
+	}
+	if w <= 0 || w == 1 {
+		delete(c.weights, node)
+		return
+	}
+	c.weights[node] = w
+}
+
+// Weight returns the weight of node (1 unless set).
+func (c *Cluster) Weight(node string) float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.weightLocked(node)
+}
+
+func (c *Cluster) weightLocked(node string) float64 {
+	if w, ok := c.weights[node]; ok {
+		return w
+	}
+	return 1
+}
+
+// Weights returns the weight of every member.
+func (c *Cluster) Weights() map[string]float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make(map[string]float64, len(c.nodes))
+	for _, n := range c.nodes {
+		out[n] = c.weightLocked(n)
+	}
+	return out
+}
+
+// ParseWeights parses "node=weight" pairs separated by commas, e.g.
+// "rtsper1=4,rtsper2=32".
+func ParseWeights(s string) (map[string]float64, error) {
+	out := make(map[string]float64)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		node, v, ok := strings.Cut(part, "=")
+		w, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if !ok || strings.TrimSpace(node) == "" || err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid node weight %q (want node=weight, weight > 0)", part)
+		}
+		out[strings.TrimSpace(node)] = w
+	}
+	return out, nil
+}
+
+// SimulatedNode is one node's result of Simulate.
+type SimulatedNode struct {
+	Node          string  `json:"node"`
+	Weight        float64 `json:"weight"`
+	Eligible      bool    `json:"eligible"`
+	Topics        int     `json:"topics"`
+	Share         float64 `json:"share"`
+	ExpectedShare float64 `json:"expected_share"`
+}
+
+// Simulation is the distribution of a set of topics over the members.
+type Simulation struct {
+	Topics int               `json:"topics"`
+	Nodes  []SimulatedNode   `json:"nodes"`
+	Owners map[string]string `json:"owners,omitempty"`
+}
+
+// Simulate computes the owner of each topic with the current membership and
+// weights, and compares each node's share with its expected (weighted)
+// share. Draining and unhealthy nodes are not eligible.
+func (c *Cluster) Simulate(topics []string) Simulation {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	sim := Simulation{Topics: len(topics), Owners: make(map[string]string, len(topics))}
+	counts := make(map[string]int)
+	for _, t := range topics {
+		o := c.ownerLocked(t)
+		sim.Owners[t] = o
+		counts[o]++
+	}
+	total := 0.0
+	for _, n := range c.nodes {
+		if !c.draining[n] && !c.unhealthy[n] {
+			total += c.weightLocked(n)
+		}
+	}
+	for _, n := range c.nodes {
+		sn := SimulatedNode{Node: n, Weight: c.weightLocked(n), Eligible: !c.draining[n] && !c.unhealthy[n], Topics: counts[n]}
+		if len(topics) > 0 {
+			sn.Share = float64(sn.Topics) / float64(len(topics))
+		}
+		if sn.Eligible && total > 0 {
+			sn.ExpectedShare = sn.Weight / total
+		}
+		sim.Nodes = append(sim.Nodes, sn)
+	}
+	sort.Slice(sim.Nodes, func(i, j int) bool { return sim.Nodes[i].Node < sim.Nodes[j].Node })
+	return sim
+}
+
 // IsSelf returns true if the provided node matches this node's identity.
 func (c *Cluster) IsSelf(node string) bool {
 	return node == c.self
 }
 
+// IsMember reports whether node is currently a member.
+func (c *Cluster) IsMember(node string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.nodeSet[node]
+	return ok
+}
+
 // Self returns this node's configured name.
 func (c *Cluster) Self() string { return c.self }
 
 // SetDraining marks a node as draining (ignored for new owner selection when true).
 func (c *Cluster) SetDraining(node string, d bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if _, ok := c.nodeSet[node]; ok {
 		c.draining[node] = d
 	}
@@ -86,8 +337,75 @@ func (c *Cluster) SetDraining(node string, d bool) {
 
 // IsDraining reports whether the named node is marked draining.
 func (c *Cluster) IsDraining(node string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	if d, ok := c.draining[node]; ok {
 		return d
 	}
 	return false
 }
+
+// SetHealthy marks a node as passing (true) or failing (false) health
+// checks; unhealthy nodes are ignored for owner selection.
+func (c *Cluster) SetHealthy(node string, healthy bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.nodeSet[node]; !ok {
+		return
+	}
+	if healthy {
+		delete(c.unhealthy, node)
+	} else {
+		c.unhealthy[node] = true
+	}
+}
+
+// ParseAdvertised parses "node=host" pairs separated by commas, e.g.
+// "rtsper1=cam1.example.com,rtsper2=203.0.113.7".
+func ParseAdvertised(s string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		node, host, ok := strings.Cut(part, "=")
+		node, host = strings.TrimSpace(node), strings.TrimSpace(host)
+		if !ok || node == "" || host == "" {
+			return nil, fmt.Errorf("invalid advertised address %q (want node=host)", part)
+		}
+		out[node] = host
+	}
+	return out, nil
+}
+
+// SetAdvertised sets the hosts under which clients reach the nodes, e.g.
+// public names when node names only resolve inside the cluster network.
+func (c *Cluster) SetAdvertised(hosts map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advertised = hosts
+}
+
+// Advertised returns the host clients should use to reach node: the
+// advertised host if one was set, else the host of its membership entry,
+// else the node name.
+func (c *Cluster) Advertised(node string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if h, ok := c.advertised[node]; ok {
+		return h
+	}
+	if h := c.addrs[node].Host; h != "" {
+		return h
+	}
+	return node
+}
+
+// IsHealthy reports whether the named node passes its health checks. Nodes
+// are healthy unless a health checker marked them otherwise.
+func (c *Cluster) IsHealthy(node string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.unhealthy[node]
+}
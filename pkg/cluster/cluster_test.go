@@ -1,6 +1,10 @@
 package cluster
 
-import "testing"
+import (
+	"math"
+	"strconv"
+	"testing"
+)
 
 func TestOwnerDeterminism(t *testing.T) {
 	c, err := NewFromCSV("a,b,c", "a")
@@ -29,3 +33,154 @@ func TestOwnerSkipsDraining(t *testing.T) {
 		t.Fatalf("expected owner to change after draining; still %s", orig)
 	}
 }
+
+func TestAddRemoveNode(t *testing.T) {
+	c, err := NewFromCSV("n1", "n1")
+	if err != nil {
+		t.Fatalf("failed to create cluster: %v", err)
+	}
+	if !c.AddNode("n2") || c.AddNode("n2") {
+		t.Fatalf("expected n2 to be added exactly once")
+	}
+	if c.RemoveNode("n1") {
+		t.Fatalf("self must not be removed")
+	}
+	if !c.RemoveNode("n2") || len(c.Members()) != 1 || c.Owner("t") != "n1" {
+		t.Fatalf("unexpected members after removal: %v", c.Members())
+	}
+}
+
+func TestAdvertised(t *testing.T) {
+	hosts, err := ParseAdvertised("n1=cam1.example.com, n2=203.0.113.7")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	c, _ := NewFromCSV("n1,n2,n3", "n1")
+	c.SetAdvertised(hosts)
+	if c.Advertised("n1") != "cam1.example.com" || c.Advertised("n2") != "203.0.113.7" || c.Advertised("n3") != "n3" {
+		t.Fatalf("unexpected advertised hosts %v", hosts)
+	}
+	if _, err := ParseAdvertised("n1"); err == nil {
+		t.Fatalf("expected error for missing host")
+	}
+}
+
+func TestWeightedOwner(t *testing.T) {
+	c, _ := NewFromCSV("small,big", "small")
+	plain := make(map[string]string)
+	topics := make([]string, 10000)
+	for i := range topics {
+		topics[i] = "topic-" + strconv.Itoa(i)
+		plain[topics[i]] = c.Owner(topics[i])
+	}
+
+	// equal weights keep the unweighted assignment
+	c.SetWeight("small", 2)
+	c.SetWeight("big", 2)
+	for _, tp := range topics {
+		if c.Owner(tp) != plain[tp] {
+			t.Fatalf("equal weights moved %s", tp)
+		}
+	}
+
+	// a node with 4x the weight owns about 80% of the topics, and topics
+	// only move towards it
+	c.SetWeight("small", 1)
+	c.SetWeight("big", 4)
+	sim := c.Simulate(topics)
+	for _, n := range sim.Nodes {
+		if math.Abs(n.Share-n.ExpectedShare) > 0.02 {
+			t.Fatalf("node %s owns %.3f of the topics, expected %.3f", n.Node, n.Share, n.ExpectedShare)
+		}
+	}
+	for tp, o := range sim.Owners {
+		if o == "small" && plain[tp] != "small" {
+			t.Fatalf("topic %s moved to the lighter node", tp)
+		}
+	}
+
+	c.SetDraining("big", true)
+	if sim := c.Simulate(topics[:10]); sim.Nodes[0].Node != "big" || sim.Nodes[0].Eligible || sim.Nodes[1].ExpectedShare != 1 {
+		t.Fatalf("unexpected simulation while draining: %+v", sim.Nodes)
+	}
+}
+
+func TestPinnedOwner(t *testing.T) {
+	c, _ := NewFromCSV("n1,n2,n3", "n1")
+	home := c.Owner("cam1")
+	pinned := "n1"
+	if home == pinned {
+		pinned = "n2"
+	}
+	if err := c.SetPin("cam1", pinned); err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+	if err := c.SetPin("../x", "n1"); err == nil {
+		t.Fatalf("expected error for invalid topic")
+	}
+	if c.Owner("cam1") != pinned {
+		t.Fatalf("pin ignored: owner %s, pinned to %s", c.Owner("cam1"), pinned)
+	}
+	// pins win over placements
+	c.AddPlacement(Placement{Topic: "cam1", Node: home, Home: home})
+	if c.Owner("cam1") != pinned {
+		t.Fatalf("placement overrode pin: owner %s", c.Owner("cam1"))
+	}
+
+	// draining, unhealthy and unknown nodes fall back to the usual owner
+	for _, fallback := range []string{"draining", "unhealthy", "not a member"} {
+		switch fallback {
+		case "draining":
+			c.SetDraining(pinned, true)
+		case "unhealthy":
+			c.SetDraining(pinned, false)
+			c.SetHealthy(pinned, false)
+		case "not a member":
+			c.SetHealthy(pinned, true)
+			c.RemoveNode(pinned)
+		}
+		pins := c.Pins()
+		if len(pins) != 1 || pins[0].Owner == pinned || pins[0].Owner != c.Owner("cam1") || pins[0].Fallback != fallback {
+			t.Fatalf("unexpected pins while %s: %+v", fallback, pins)
+		}
+	}
+	c.AddNode(pinned)
+	if c.Owner("cam1") != pinned || c.Pins()[0].Fallback != "" {
+		t.Fatalf("pin not restored on rejoin: %+v", c.Pins())
+	}
+	if !c.RemovePin("cam1") || c.Pins() != nil || c.Owner("cam1") != home {
+		t.Fatalf("pin not removed: owner %s", c.Owner("cam1"))
+	}
+}
+
+func TestStandbyTakesOverOnFailure(t *testing.T) {
+	c, _ := NewFromCSV("n1,n2,n3,n4", "n1")
+	for i := 0; i < 20; i++ {
+		name := "cam" + strconv.Itoa(i)
+		owner, standby := c.Owner(name), c.Standby(name)
+		if standby == "" || standby == owner {
+			t.Fatalf("%s: standby %q for owner %s", name, standby, owner)
+		}
+		c.SetHealthy(owner, false)
+		if got := c.Owner(name); got != standby {
+			t.Fatalf("%s: owner %s after %s failed, standby was %s", name, got, owner, standby)
+		}
+		c.SetHealthy(owner, true)
+	}
+
+	// the standby of a pinned topic is its rendezvous owner
+	home := c.Owner("cam1")
+	pinned := "n1"
+	if home == pinned {
+		pinned = "n2"
+	}
+	c.SetPin("cam1", pinned)
+	if c.Standby("cam1") != home {
+		t.Fatalf("standby %s of pinned topic, want %s", c.Standby("cam1"), home)
+	}
+
+	single, _ := NewFromCSV("n1", "n1")
+	if s := single.Standby("cam1"); s != "" {
+		t.Fatalf("standby %q in a single-node cluster", s)
+	}
+}
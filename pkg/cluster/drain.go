@@ -0,0 +1,200 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// drainTick is how often the drain workflow checks progress.
+const drainTick = 500 * time.Millisecond
+
+// DrainConfig configures drain propagation and handoff.
+type DrainConfig struct {
+	// AdminPort is the admin HTTP port of the peers, which are addressed by
+	// node name.
+	AdminPort int
+	// KickDelay is how long a draining node waits before asking its
+	// publishers to reconnect elsewhere; default 2s.
+	KickDelay time.Duration
+	// Timeout bounds each peer admin call; default 3s.
+	Timeout time.Duration
+}
+
+// DrainStatus reports the handoff progress of this node.
+type DrainStatus struct {
+	Node        string     `json:"node"`
+	Draining    bool       `json:"draining"`
+	Since       *time.Time `json:"since,omitempty"`
+	Topics      int        `json:"topics"`
+	Publishers  int        `json:"publishers"`
+	Subscribers int        `json:"subscribers"`
+	Kicked      int        `json:"publishers_kicked"`
+	SafeToStop  bool       `json:"safe_to_stop"`
+}
+
+// Drainer shares drain state across the cluster and hands off this node's
+// sessions while it is draining: new sessions are refused (ownership moves
+// to other nodes), publishers are asked to reconnect elsewhere, and the
+// node reports when it is empty and safe to stop.
+type Drainer struct {
+	cl     *Cluster
+	mgr    *topic.Manager
+	cfg    DrainConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	draining bool
+	since    time.Time
+	kicked   int
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDrainer starts the drain workflow for cl.
+func NewDrainer(cl *Cluster, mgr *topic.Manager, cfg DrainConfig) *Drainer {
+	if cfg.KickDelay <= 0 {
+		cfg.KickDelay = 2 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 3 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Drainer{
+		cl:     cl,
+		mgr:    mgr,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		cancel: cancel,
+	}
+	d.wg.Add(1)
+	go d.run(ctx)
+	return d
+}
+
+// Close stops the workflow.
+func (d *Drainer) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// Members returns the cluster members.
+func (d *Drainer) Members() []string { return d.cl.Members() }
+
+// IsDraining reports whether node is draining.
+func (d *Drainer) IsDraining(node string) bool { return d.cl.IsDraining(node) }
+
+// SetDraining sets the drain state of node on this node only.
+func (d *Drainer) SetDraining(node string, drain bool) {
+	d.cl.SetDraining(node, drain)
+	d.check()
+}
+
+// PropagateDrain sets the drain state of node on all other members through
+// their admin API and returns the result per peer ("ok" or the error).
+func (d *Drainer) PropagateDrain(node string, drain bool) map[string]string {
+	out := make(map[string]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range d.cl.Members() {
+		if d.cl.IsSelf(peer) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := "ok"
+			if err := d.callPeer(peer, node, drain); err != nil {
+				res = err.Error()
+				plog.Warn("cluster: propagating drain of %s to %s failed: %v", node, peer, err)
+			}
+			mu.Lock()
+			out[peer] = res
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+func (d *Drainer) callPeer(peer, node string, drain bool) error {
+	q := url.Values{"node": {node}, "drain": {strconv.FormatBool(drain)}, "local": {"true"}}
+	u := "http://" + d.cl.AdminAddr(peer, d.cfg.AdminPort) + "/cluster/drain?" + q.Encode()
+	res, err := d.client.Post(u, "", nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// Status reports this node's drain progress.
+func (d *Drainer) Status() DrainStatus {
+	st := DrainStatus{Node: d.cl.Self()}
+	for _, t := range d.mgr.Status().Topics {
+		if t.HasPublisher {
+			st.Topics++
+			st.Publishers++
+		}
+		st.Subscribers += t.SubscriberCount
+	}
+	d.mu.Lock()
+	st.Draining = d.draining
+	if d.draining {
+		since := d.since
+		st.Since = &since
+	}
+	st.Kicked = d.kicked
+	d.mu.Unlock()
+	st.SafeToStop = st.Draining && st.Publishers == 0 && st.Subscribers == 0
+	return st
+}
+
+func (d *Drainer) run(ctx context.Context) {
+	defer d.wg.Done()
+	ticker := time.NewTicker(drainTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.check()
+		}
+	}
+}
+
+// check follows this node's drain flag and kicks publishers once the
+// other nodes had time to learn that it is draining.
+func (d *Drainer) check() {
+	draining := d.cl.IsDraining(d.cl.Self())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case draining && !d.draining:
+		d.draining = true
+		d.since = time.Now()
+		d.kicked = 0
+		plog.Info("cluster: node %s draining: refusing new sessions, publishers are moved in %s", d.cl.Self(), d.cfg.KickDelay)
+	case !draining && d.draining:
+		d.draining = false
+		plog.Info("cluster: node %s no longer draining", d.cl.Self())
+	}
+	if d.draining && time.Since(d.since) >= d.cfg.KickDelay {
+		if n := d.mgr.KickPublishers(); n > 0 {
+			d.kicked += n
+			plog.Info("cluster: asked %d publishers to reconnect to their new owner", n)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package cluster
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"redalf.de/rtsper/pkg/topic"
+)
+
+func TestDrainPropagatesToPeers(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/cluster/drain" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		got = append(got, r.URL.RawQuery)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	c, err := NewFromCSV("self,127.0.0.1", "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	d := NewDrainer(c, topic.NewManager(topic.Config{MaxPublishers: 5}), DrainConfig{AdminPort: peerPort(t, srv.Listener.Addr().String())})
+	defer d.Close()
+
+	d.SetDraining("self", true)
+	res := d.PropagateDrain("self", true)
+	if len(res) != 1 || res["127.0.0.1"] != "ok" {
+		t.Fatalf("unexpected propagation result %v", res)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 || got[0] != "drain=true&local=true&node=self" {
+		t.Fatalf("peer saw %v", got)
+	}
+	if !c.IsDraining("self") {
+		t.Fatalf("self should be draining locally")
+	}
+}
+
+func TestDrainKicksPublishersUntilSafeToStop(t *testing.T) {
+	c, err := NewFromCSV("self,other", "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	m := topic.NewManager(topic.Config{MaxPublishers: 5, MaxSubscribersPerTopic: 5})
+	pub := topic.NewPublisherSession("p1")
+	if err := m.RegisterPublisher(context.Background(), "t1", pub); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	// stands in for the protocol server closing the kicked connection
+	go func() {
+		<-pub.Done()
+		m.UnregisterPublisher("t1")
+	}()
+
+	d := NewDrainer(c, m, DrainConfig{KickDelay: 100 * time.Millisecond})
+	defer d.Close()
+	if st := d.Status(); st.Draining || st.SafeToStop || st.Publishers != 1 {
+		t.Fatalf("unexpected status before drain: %+v", st)
+	}
+
+	d.SetDraining("self", true)
+	if owner := c.Owner("t1"); owner != "other" {
+		t.Fatalf("draining node still owns the topic (owner %q)", owner)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		st := d.Status()
+		if st.SafeToStop {
+			if st.Kicked != 1 || st.Since == nil {
+				t.Fatalf("unexpected status after drain: %+v", st)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node never became safe to stop: %+v", st)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	d.SetDraining("self", false)
+	if st := d.Status(); st.Draining || st.SafeToStop {
+		t.Fatalf("drain not cancelled: %+v", st)
+	}
+}
@@ -0,0 +1,685 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	plog "redalf.de/rtsper/pkg/log"
+)
+
+// Member states of the gossip protocol.
+const (
+	StateAlive   = "alive"
+	StateSuspect = "suspect"
+	StateDead    = "dead"
+	StateLeft    = "left"
+)
+
+// Membership event types.
+const (
+	EventJoin    = "join"
+	EventSuspect = "suspect"
+	EventAlive   = "alive"
+	EventDead    = "dead"
+	EventLeave   = "leave"
+)
+
+const (
+	// maxEvents bounds the event history kept for /cluster/events.
+	maxEvents = 256
+	// indirectProbes is how many members are asked to probe an unresponsive
+	// member before it is suspected.
+	indirectProbes = 3
+	// maxDatagram bounds gossip messages; full membership is piggybacked on
+	// every message, which is fine for clusters of a few dozen nodes.
+	maxDatagram = 64 << 10
+)
+
+// GossipConfig configures SWIM-style membership.
+type GossipConfig struct {
+	// Bind is the UDP address to listen on, e.g. ":7946".
+	Bind string
+	// Seeds are gossip addresses (host:port) contacted to join the cluster.
+	Seeds []string
+	// ProbeInterval is the protocol period; one member is probed per period.
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long to wait for a direct ack before asking other
+	// members to probe.
+	ProbeTimeout time.Duration
+	// SuspectTimeout is how long a member stays suspect before it is
+	// declared dead and removed from owner selection.
+	SuspectTimeout time.Duration
+	// DeadRetention is how long dead members stay listed.
+	DeadRetention time.Duration
+}
+
+// MemberStatus is a member as seen by the gossip protocol.
+type MemberStatus struct {
+	Name        string    `json:"name"`
+	Addr        string    `json:"addr,omitempty"`
+	State       string    `json:"state"`
+	Incarnation uint64    `json:"incarnation"`
+	Weight      float64   `json:"weight,omitempty"`
+	Since       time.Time `json:"since"`
+}
+
+// Event is a membership change.
+type Event struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Node string    `json:"node"`
+	Type string    `json:"type"`
+}
+
+// member is the wire and table representation of a node.
+type member struct {
+	Name        string `json:"name"`
+	Addr        string `json:"addr,omitempty"`
+	State       string `json:"state"`
+	Incarnation uint64 `json:"inc"`
+	// Weight is announced by the node itself for owner selection
+	Weight float64 `json:"weight,omitempty"`
+	// Node is the membership entry announced by the node itself
+	Node *NodeAddr `json:"node,omitempty"`
+
+	since time.Time
+}
+
+// message is a gossip datagram. Every message carries the sender's view of
+// the membership.
+type message struct {
+	Type    string   `json:"type"` // ping, ack, ping-req, leave
+	From    string   `json:"from"`
+	Seq     uint64   `json:"seq"`
+	Target  string   `json:"target,omitempty"` // ping-req: address to probe
+	Members []member `json:"members,omitempty"`
+}
+
+// relay is a ping sent on behalf of another member.
+type relay struct {
+	to  *net.UDPAddr
+	seq uint64
+}
+
+// Gossip maintains cluster membership with a SWIM-style failure detector:
+// members are probed in turn, unresponsive ones are probed indirectly
+// through other members, then suspected and finally declared dead. Joins
+// and failures update the Cluster's rendezvous membership.
+type Gossip struct {
+	cl   *Cluster
+	cfg  GossipConfig
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	members map[string]*member
+	seq     uint64
+	acks    map[uint64]chan struct{}
+	relays  map[uint64]relay
+	events  []Event
+	evSeq   uint64
+	order   []string // probe order, reshuffled every round
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewGossip starts gossip membership for cl on cfg.Bind and contacts the
+// seeds. The cluster keeps its static members until gossip learns about
+// their state.
+func NewGossip(cl *Cluster, cfg GossipConfig) (*Gossip, error) {
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = time.Second
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = cfg.ProbeInterval / 3
+	}
+	if cfg.SuspectTimeout <= 0 {
+		cfg.SuspectTimeout = 5 * cfg.ProbeInterval
+	}
+	if cfg.DeadRetention <= 0 {
+		cfg.DeadRetention = 30 * cfg.ProbeInterval
+	}
+	addr, err := net.ResolveUDPAddr("udp", cfg.Bind)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	g := &Gossip{
+		cl:      cl,
+		cfg:     cfg,
+		conn:    conn,
+		members: make(map[string]*member),
+		acks:    make(map[uint64]chan struct{}),
+		relays:  make(map[uint64]relay),
+		done:    make(chan struct{}),
+	}
+	// a restarted node must outrank what others remember about it
+	g.members[cl.Self()] = &member{Name: cl.Self(), State: StateAlive, Incarnation: uint64(time.Now().UnixMilli()), Weight: cl.Weight(cl.Self()), since: time.Now()}
+	cl.AddNode(cl.Self())
+	cl.mu.Lock()
+	cl.gossip = g
+	cl.mu.Unlock()
+
+	g.wg.Add(2)
+	go g.readLoop()
+	go g.probeLoop()
+	plog.Info("cluster: gossip listening on %s, seeds %v", conn.LocalAddr(), cfg.Seeds)
+	return g, nil
+}
+
+// Addr returns the gossip listen address.
+func (g *Gossip) Addr() net.Addr { return g.conn.LocalAddr() }
+
+// Close announces that this node leaves and stops the protocol.
+func (g *Gossip) Close() {
+	g.closeOnce.Do(func() {
+		g.mu.Lock()
+		self := g.members[g.cl.Self()]
+		self.State = StateLeft
+		self.Incarnation++
+		targets := g.peerAddrs(StateAlive, StateSuspect)
+		g.mu.Unlock()
+		for _, a := range targets {
+			g.send(a, &message{Type: "leave"})
+		}
+		g.stop()
+	})
+}
+
+// stop ends the protocol without telling anyone, as a crash would.
+func (g *Gossip) stop() {
+	close(g.done)
+	g.conn.Close()
+	g.wg.Wait()
+}
+
+// Members returns the gossip view of the membership ordered by name.
+func (g *Gossip) Members() []MemberStatus {
+	g.mu.Lock()
+	out := make([]MemberStatus, 0, len(g.members))
+	for _, m := range g.members {
+		out = append(out, MemberStatus{Name: m.Name, Addr: m.Addr, State: m.State, Incarnation: m.Incarnation, Weight: m.Weight, Since: m.since})
+	}
+	g.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Events returns the membership events after seq (0 for all retained).
+func (g *Gossip) Events(since uint64) []Event {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := []Event{}
+	for _, e := range g.events {
+		if e.Seq > since {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func (g *Gossip) readLoop() {
+	defer g.wg.Done()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-g.done:
+				return
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		var msg message
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			plog.Debug("cluster: gossip: bad message from %s: %v", from, err)
+			continue
+		}
+		if msg.From == "" || msg.From == g.cl.Self() {
+			continue
+		}
+		g.handle(&msg, from)
+	}
+}
+
+func (g *Gossip) handle(msg *message, from *net.UDPAddr) {
+	g.mu.Lock()
+	g.merge(msg.Members, msg.From, from.String())
+	var ack chan struct{}
+	var rl relay
+	var relayed bool
+	switch msg.Type {
+	case "ack":
+		ack = g.acks[msg.Seq]
+		delete(g.acks, msg.Seq)
+		rl, relayed = g.relays[msg.Seq]
+		delete(g.relays, msg.Seq)
+	case "ping-req":
+		// probe the target on the requester's behalf
+		g.seq++
+		g.relays[g.seq] = relay{to: from, seq: msg.Seq}
+	}
+	seq := g.seq
+	g.mu.Unlock()
+
+	switch msg.Type {
+	case "ping":
+		g.send(from, &message{Type: "ack", Seq: msg.Seq})
+	case "ping-req":
+		if target, err := net.ResolveUDPAddr("udp", msg.Target); err == nil {
+			g.send(target, &message{Type: "ping", Seq: seq})
+		}
+	case "ack":
+		if ack != nil {
+			close(ack)
+		}
+		if relayed {
+			g.send(rl.to, &message{Type: "ack", Seq: rl.seq})
+		}
+	}
+}
+
+// merge applies a member list received from sender (reachable at addr).
+// Caller must hold g.mu.
+func (g *Gossip) merge(members []member, sender, addr string) {
+	for _, m := range members {
+		if m.Name == sender {
+			// the sender's own address is best taken from the packet
+			m.Addr = addr
+		}
+		g.apply(m)
+	}
+}
+
+// apply merges one member update using SWIM precedence: a higher
+// incarnation wins; at equal incarnation suspect overrides alive, and dead
+// or left override both. Caller must hold g.mu.
+func (g *Gossip) apply(m member) {
+	self := g.cl.Self()
+	cur, ok := g.members[m.Name]
+	if m.Name == self {
+		if (m.State == StateSuspect || m.State == StateDead) && m.Incarnation >= cur.Incarnation && cur.State == StateAlive {
+			// refute: outrank the rumour, the next messages spread it
+			cur.Incarnation = m.Incarnation + 1
+			plog.Info("cluster: gossip: refuting %s rumour about self", m.State)
+		}
+		return
+	}
+	if m.Addr == "" && ok {
+		m.Addr = cur.Addr
+	}
+	if !ok {
+		if m.State == StateDead || m.State == StateLeft {
+			// nothing to forget
+			return
+		}
+		m.since = time.Now()
+		g.members[m.Name] = &m
+		g.cl.AddNode(m.Name)
+		if m.Weight > 0 {
+			g.cl.SetWeight(m.Name, m.Weight)
+		}
+		g.setAddr(&m)
+		g.event(m.Name, EventJoin)
+		if m.State == StateSuspect {
+			g.event(m.Name, EventSuspect)
+		}
+		return
+	}
+	if m.Weight > 0 && m.Weight != cur.Weight {
+		// a node's weight only changes with a restart, so any report is
+		// as good as the current one
+		cur.Weight = m.Weight
+		g.cl.SetWeight(m.Name, m.Weight)
+	}
+	if m.Node != nil {
+		cur.Node = m.Node
+		g.setAddr(cur)
+	}
+	if !supersedes(m, *cur) {
+		if cur.Addr == "" && m.Addr != "" {
+			cur.Addr = m.Addr
+		}
+		return
+	}
+	prev := cur.State
+	cur.Incarnation = m.Incarnation
+	if m.Addr != "" {
+		cur.Addr = m.Addr
+	}
+	if prev == m.State {
+		return
+	}
+	cur.State = m.State
+	cur.since = time.Now()
+	g.transition(cur.Name, prev, m.State)
+}
+
+// rejoin adds a member that was dead or left back to the cluster. Caller
+// must hold g.mu.
+func (g *Gossip) rejoin(name string) {
+	g.cl.AddNode(name)
+	if m := g.members[name]; m != nil && m.Weight > 0 {
+		g.cl.SetWeight(name, m.Weight)
+	}
+	g.event(name, EventJoin)
+}
+
+// setAddr records the membership entry m announced, if any.
+func (g *Gossip) setAddr(m *member) {
+	if m.Node == nil {
+		return
+	}
+	a := *m.Node
+	a.ID = m.Name
+	g.cl.SetAddr(a)
+}
+
+func supersedes(n, cur member) bool {
+	rank := func(s string) int {
+		switch s {
+		case StateSuspect:
+			return 1
+		case StateDead, StateLeft:
+			return 2
+		}
+		return 0
+	}
+	if n.Incarnation != cur.Incarnation {
+		return n.Incarnation > cur.Incarnation
+	}
+	return rank(n.State) > rank(cur.State)
+}
+
+// transition updates the cluster and records the event for a state change.
+// Caller must hold g.mu.
+func (g *Gossip) transition(name, from, to string) {
+	gone := from == StateDead || from == StateLeft
+	switch to {
+	case StateAlive:
+		if gone {
+			g.rejoin(name)
+		} else {
+			g.event(name, EventAlive)
+		}
+	case StateSuspect:
+		if gone {
+			g.rejoin(name)
+		}
+		g.event(name, EventSuspect)
+	case StateDead:
+		if !gone {
+			g.cl.RemoveNode(name)
+			g.event(name, EventDead)
+		}
+	case StateLeft:
+		if !gone {
+			g.cl.RemoveNode(name)
+			g.event(name, EventLeave)
+		}
+	}
+}
+
+// event records a membership event. Caller must hold g.mu.
+func (g *Gossip) event(node, typ string) {
+	g.evSeq++
+	g.events = append(g.events, Event{Seq: g.evSeq, Time: time.Now(), Node: node, Type: typ})
+	if len(g.events) > maxEvents {
+		g.events = g.events[len(g.events)-maxEvents:]
+	}
+	plog.Info("cluster: member %s: %s", node, typ)
+}
+
+func (g *Gossip) probeLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		g.joinSeeds()
+		g.probe()
+		g.expire()
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// joinSeeds pings the seeds that are not known members yet.
+func (g *Gossip) joinSeeds() {
+	g.mu.Lock()
+	known := make(map[string]bool)
+	for _, m := range g.members {
+		if m.Addr != "" && m.State != StateDead && m.State != StateLeft {
+			known[m.Addr] = true
+		}
+	}
+	g.mu.Unlock()
+	local := g.conn.LocalAddr().(*net.UDPAddr)
+	for _, s := range g.cfg.Seeds {
+		a, err := net.ResolveUDPAddr("udp", s)
+		if err != nil {
+			plog.Debug("cluster: gossip: seed %s: %v", s, err)
+			continue
+		}
+		if known[a.String()] || (a.Port == local.Port && (a.IP.IsLoopback() || isLocalIP(a.IP))) {
+			continue
+		}
+		g.send(a, &message{Type: "ping", Seq: g.nextSeq()})
+	}
+}
+
+// probe runs one SWIM round against the next member.
+func (g *Gossip) probe() {
+	g.mu.Lock()
+	var target *member
+	for range 2 {
+		if len(g.order) == 0 {
+			for name, m := range g.members {
+				if name != g.cl.Self() && (m.State == StateAlive || m.State == StateSuspect) && m.Addr != "" {
+					g.order = append(g.order, name)
+				}
+			}
+			rand.Shuffle(len(g.order), func(i, j int) { g.order[i], g.order[j] = g.order[j], g.order[i] })
+		}
+		for len(g.order) > 0 && target == nil {
+			m := g.members[g.order[0]]
+			g.order = g.order[1:]
+			if m != nil && (m.State == StateAlive || m.State == StateSuspect) && m.Addr != "" {
+				target = m
+			}
+		}
+		if target != nil {
+			break
+		}
+	}
+	if target == nil {
+		g.mu.Unlock()
+		return
+	}
+	g.seq++
+	seq := g.seq
+	ack := make(chan struct{})
+	g.acks[seq] = ack
+	name, addr, inc := target.Name, target.Addr, target.Incarnation
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.acks, seq)
+		g.mu.Unlock()
+	}()
+
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+	g.send(to, &message{Type: "ping", Seq: seq})
+	if g.wait(ack, g.cfg.ProbeTimeout) {
+		return
+	}
+
+	// ask others to probe it
+	g.mu.Lock()
+	var helpers []string
+	for _, m := range g.members {
+		if m.Name != g.cl.Self() && m.Name != name && m.State == StateAlive && m.Addr != "" {
+			helpers = append(helpers, m.Addr)
+		}
+	}
+	g.mu.Unlock()
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	for _, h := range helpers[:min(len(helpers), indirectProbes)] {
+		if ha, err := net.ResolveUDPAddr("udp", h); err == nil {
+			g.send(ha, &message{Type: "ping-req", Seq: seq, Target: addr})
+		}
+	}
+	if g.wait(ack, g.cfg.ProbeInterval-g.cfg.ProbeTimeout) {
+		return
+	}
+
+	g.mu.Lock()
+	if m := g.members[name]; m != nil && m.State == StateAlive && m.Incarnation == inc {
+		m.State = StateSuspect
+		m.since = time.Now()
+		g.transition(name, StateAlive, StateSuspect)
+	}
+	g.mu.Unlock()
+}
+
+func (g *Gossip) wait(ack chan struct{}, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ack:
+		return true
+	case <-t.C:
+	case <-g.done:
+	}
+	return false
+}
+
+// expire declares long-suspected members dead and forgets old dead ones.
+func (g *Gossip) expire() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for name, m := range g.members {
+		switch m.State {
+		case StateSuspect:
+			if now.Sub(m.since) >= g.cfg.SuspectTimeout {
+				m.State = StateDead
+				m.since = now
+				g.transition(name, StateSuspect, StateDead)
+			}
+		case StateDead, StateLeft:
+			if now.Sub(m.since) >= g.cfg.DeadRetention {
+				delete(g.members, name)
+			}
+		}
+	}
+}
+
+// send writes msg to addr with this node's view of the membership.
+func (g *Gossip) send(addr *net.UDPAddr, msg *message) {
+	g.mu.Lock()
+	msg.From = g.cl.Self()
+	msg.Members = make([]member, 0, len(g.members))
+	for _, m := range g.members {
+		mm := *m
+		if mm.Name == msg.From {
+			// ports may be recorded after gossip started
+			mm.Node = g.cl.announced()
+		}
+		msg.Members = append(msg.Members, mm)
+	}
+	g.mu.Unlock()
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if _, err := g.conn.WriteToUDP(b, addr); err != nil {
+		plog.Debug("cluster: gossip: send to %s: %v", addr, err)
+	}
+}
+
+func (g *Gossip) nextSeq() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.seq++
+	return g.seq
+}
+
+// peerAddrs returns the addresses of members in the given states. Caller
+// must hold g.mu.
+func (g *Gossip) peerAddrs(states ...string) []*net.UDPAddr {
+	var out []*net.UDPAddr
+	for _, m := range g.members {
+		if m.Name == g.cl.Self() || m.Addr == "" {
+			continue
+		}
+		for _, s := range states {
+			if m.State == s {
+				if a, err := net.ResolveUDPAddr("udp", m.Addr); err == nil {
+					out = append(out, a)
+				}
+				break
+			}
+		}
+	}
+	return out
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MemberStates returns the gossip view of the membership, or nil when the
+// membership is static.
+func (c *Cluster) MemberStates() []MemberStatus {
+	c.mu.RLock()
+	g := c.gossip
+	c.mu.RUnlock()
+	if g == nil {
+		return nil
+	}
+	return g.Members()
+}
+
+// Events returns membership events after seq, or nil when the membership
+// is static.
+func (c *Cluster) Events(since uint64) []Event {
+	c.mu.RLock()
+	g := c.gossip
+	c.mu.RUnlock()
+	if g == nil {
+		return nil
+	}
+	return g.Events(since)
+}
@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+func startNode(t *testing.T, name string, seeds ...string) (*Cluster, *Gossip) {
+	t.Helper()
+	c, err := NewFromCSV(name, name)
+	if err != nil {
+		t.Fatalf("cluster %s: %v", name, err)
+	}
+	g, err := NewGossip(c, GossipConfig{
+		Bind:           "127.0.0.1:0",
+		Seeds:          seeds,
+		ProbeInterval:  50 * time.Millisecond,
+		SuspectTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("gossip %s: %v", name, err)
+	}
+	return c, g
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasMembers(c *Cluster, want ...string) bool {
+	got := c.Members()
+	if len(got) != len(want) {
+		return false
+	}
+	set := make(map[string]bool)
+	for _, m := range got {
+		set[m] = true
+	}
+	for _, w := range want {
+		if !set[w] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestGossipJoinFailLeave(t *testing.T) {
+	ca, ga := startNode(t, "a")
+	defer ga.Close()
+	cb, gb := startNode(t, "b", ga.Addr().String())
+	defer gb.Close()
+	cc, gc := startNode(t, "c", ga.Addr().String())
+
+	// b and c only know a, but learn about each other through it
+	for _, c := range []*Cluster{ca, cb, cc} {
+		waitFor(t, c.Self()+" to see all nodes", func() bool { return hasMembers(c, "a", "b", "c") })
+	}
+
+	// c crashes: it is suspected, then declared dead and no longer owns topics
+	gc.stop()
+	waitFor(t, "c to be removed", func() bool { return hasMembers(ca, "a", "b") && hasMembers(cb, "a", "b") })
+	for i := 0; i < 50; i++ {
+		if o := ca.Owner(string(rune('a' + i))); o == "c" {
+			t.Fatalf("dead node still owns topics")
+		}
+	}
+	var types []string
+	for _, e := range ca.Events(0) {
+		if e.Node == "c" {
+			types = append(types, e.Type)
+		}
+	}
+	if len(types) < 3 || types[0] != EventJoin || types[len(types)-2] != EventSuspect || types[len(types)-1] != EventDead {
+		t.Fatalf("unexpected events for c: %v", types)
+	}
+
+	// b leaves gracefully
+	last := ca.Events(0)
+	gb.Close()
+	waitFor(t, "b to leave", func() bool { return hasMembers(ca, "a") })
+	ev := ca.Events(last[len(last)-1].Seq)
+	if len(ev) != 1 || ev[0].Node != "b" || ev[0].Type != EventLeave {
+		t.Fatalf("expected a single leave event, got %+v", ev)
+	}
+	for _, m := range ca.MemberStates() {
+		if m.Name == "b" && m.State != StateLeft {
+			t.Fatalf("expected b to be listed as left, got %s", m.State)
+		}
+	}
+}
+
+func TestGossipAnnouncesWeight(t *testing.T) {
+	_, ga := startNode(t, "a")
+	defer ga.Close()
+	cb, err := NewFromCSV("b", "b")
+	if err != nil {
+		t.Fatalf("cluster b: %v", err)
+	}
+	cb.SetWeight("b", 8)
+	gb, err := NewGossip(cb, GossipConfig{Bind: "127.0.0.1:0", Seeds: []string{ga.Addr().String()}, ProbeInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("gossip b: %v", err)
+	}
+	defer gb.Close()
+	waitFor(t, "a to learn b's weight", func() bool { return ga.cl.Weight("b") == 8 })
+}
+
+func TestGossipAnnouncesAddr(t *testing.T) {
+	ca, ga := startNode(t, "a")
+	defer ga.Close()
+	cb, gb := startNode(t, "b", ga.Addr().String())
+	defer gb.Close()
+	// recorded after gossip started, like the ports in main
+	cb.SetLocalPorts(9291, 9292, 8081)
+	waitFor(t, "a to learn b's ports", func() bool {
+		n := ca.Addr("b")
+		return n.PublishPort == 9291 && n.SubscribePort == 9292 && n.AdminPort == 8081
+	})
+	if a := ca.AdminAddr("b", 8080); a != "b:8081" {
+		t.Fatalf("unexpected admin address of b: %s", a)
+	}
+}
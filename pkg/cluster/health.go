@@ -0,0 +1,286 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+)
+
+// Health check modes.
+const (
+	HealthTCP  = "tcp"
+	HealthHTTP = "http"
+)
+
+// HealthConfig configures peer health checks.
+type HealthConfig struct {
+	// Mode is HealthTCP (connect to Port) or HealthHTTP (GET Path on Port,
+	// expecting a 2xx answer).
+	Mode string
+	// Port is probed on every peer, addressed by its node name.
+	Port int
+	// EntryPorts probes the publish port (tcp) or admin port (http) of the
+	// peer's membership entry instead, falling back to Port.
+	EntryPorts bool
+	// Path is requested in HTTP mode; default "/status".
+	Path string
+	// Interval between checks of a peer; default 2s.
+	Interval time.Duration
+	// Timeout of a single check; default 1s.
+	Timeout time.Duration
+	// FailThreshold consecutive failures mark a peer unhealthy; default 3.
+	FailThreshold int
+	// RiseThreshold consecutive successes mark an unhealthy peer healthy
+	// again; default 5. Keeping it above FailThreshold avoids flapping
+	// ownership when a peer is intermittently reachable.
+	RiseThreshold int
+}
+
+// PeerHealth is the health of one peer for the admin API.
+type PeerHealth struct {
+	Node       string     `json:"node"`
+	Healthy    bool       `json:"healthy"`
+	Successes  int        `json:"consecutive_successes"`
+	Failures   int        `json:"consecutive_failures"`
+	LastCheck  *time.Time `json:"last_check,omitempty"`
+	LastChange *time.Time `json:"last_change,omitempty"`
+	Latency    string     `json:"latency,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+type peerState struct {
+	healthy    bool
+	successes  int
+	failures   int
+	lastCheck  time.Time
+	lastChange time.Time
+	latency    time.Duration
+	lastErr    string
+}
+
+// HealthChecker probes the cluster's peers and marks those failing
+// FailThreshold checks in a row unhealthy, which excludes them from owner
+// selection like draining nodes, until RiseThreshold checks in a row pass.
+type HealthChecker struct {
+	cl     *Cluster
+	cfg    HealthConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	peers map[string]*peerState
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewHealthChecker validates cfg and starts checking the peers of cl.
+func NewHealthChecker(cl *Cluster, cfg HealthConfig) (*HealthChecker, error) {
+	switch cfg.Mode {
+	case HealthTCP, HealthHTTP:
+	default:
+		return nil, fmt.Errorf("unknown health check mode %q (want tcp or http)", cfg.Mode)
+	}
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("invalid health check port %d", cfg.Port)
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/status"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 2 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.FailThreshold <= 0 {
+		cfg.FailThreshold = 3
+	}
+	if cfg.RiseThreshold <= 0 {
+		cfg.RiseThreshold = 5
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &HealthChecker{
+		cl:     cl,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		peers:  make(map[string]*peerState),
+		cancel: cancel,
+	}
+	cl.mu.Lock()
+	cl.health = h
+	cl.mu.Unlock()
+	h.wg.Add(1)
+	go h.run(ctx)
+	plog.Info("cluster: %s health checks on port %d every %s (fail %d, rise %d)", cfg.Mode, cfg.Port, cfg.Interval, cfg.FailThreshold, cfg.RiseThreshold)
+	return h, nil
+}
+
+// Close stops the checks.
+func (h *HealthChecker) Close() {
+	h.cancel()
+	h.wg.Wait()
+}
+
+func (h *HealthChecker) run(ctx context.Context) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(h.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		h.round(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// round checks all current peers in parallel and forgets departed ones.
+func (h *HealthChecker) round(ctx context.Context) {
+	members := h.cl.Members()
+	current := make(map[string]bool, len(members))
+	var wg sync.WaitGroup
+	for _, node := range members {
+		if h.cl.IsSelf(node) {
+			continue
+		}
+		current[node] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := h.check(ctx, node)
+			if ctx.Err() != nil {
+				return
+			}
+			h.record(node, err, time.Since(start))
+		}()
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	for node := range h.peers {
+		if !current[node] {
+			delete(h.peers, node)
+			metrics.DeletePeerHealth(node)
+		}
+	}
+	h.mu.Unlock()
+}
+
+func (h *HealthChecker) check(ctx context.Context, node string) error {
+	addr := net.JoinHostPort(h.cl.Addr(node).Host, strconv.Itoa(h.cfg.Port))
+	if h.cfg.EntryPorts {
+		if h.cfg.Mode == HealthTCP {
+			addr = h.cl.PublishAddr(node, h.cfg.Port)
+		} else {
+			addr = h.cl.AdminAddr(node, h.cfg.Port)
+		}
+	}
+	if h.cfg.Mode == HealthTCP {
+		d := net.Dialer{Timeout: h.cfg.Timeout}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+h.cfg.Path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// record applies one check result with hysteresis.
+func (h *HealthChecker) record(node string, err error, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ps, ok := h.peers[node]
+	if !ok {
+		// peers start healthy so a restart does not move every topic
+		ps = &peerState{healthy: true}
+		h.peers[node] = ps
+	}
+	ps.lastCheck = time.Now()
+	ps.latency = latency
+	metrics.IncPeerHealthCheck(node, err == nil)
+	if err == nil {
+		ps.successes++
+		ps.failures = 0
+		ps.lastErr = ""
+		if !ps.healthy && ps.successes >= h.cfg.RiseThreshold {
+			ps.healthy = true
+			ps.lastChange = ps.lastCheck
+			h.cl.SetHealthy(node, true)
+			plog.Info("cluster: peer %s healthy again after %d checks", node, ps.successes)
+		}
+	} else {
+		ps.failures++
+		ps.successes = 0
+		ps.lastErr = err.Error()
+		if ps.healthy && ps.failures >= h.cfg.FailThreshold {
+			ps.healthy = false
+			ps.lastChange = ps.lastCheck
+			h.cl.SetHealthy(node, false)
+			plog.Warn("cluster: peer %s unhealthy after %d failed checks: %v", node, ps.failures, err)
+		}
+	}
+	metrics.SetPeerHealthy(node, ps.healthy)
+}
+
+// Peers returns the health of all checked peers ordered by name.
+func (h *HealthChecker) Peers() []PeerHealth {
+	h.mu.Lock()
+	out := make([]PeerHealth, 0, len(h.peers))
+	for node, ps := range h.peers {
+		p := PeerHealth{
+			Node:      node,
+			Healthy:   ps.healthy,
+			Successes: ps.successes,
+			Failures:  ps.failures,
+			LastError: ps.lastErr,
+		}
+		if !ps.lastCheck.IsZero() {
+			t := ps.lastCheck
+			p.LastCheck = &t
+			p.Latency = ps.latency.Round(time.Microsecond).String()
+		}
+		if !ps.lastChange.IsZero() {
+			t := ps.lastChange
+			p.LastChange = &t
+		}
+		out = append(out, p)
+	}
+	h.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Node < out[j].Node })
+	return out
+}
+
+// PeerHealth returns the health of the peers, or nil when health checks
+// are disabled.
+func (c *Cluster) PeerHealth() []PeerHealth {
+	c.mu.RLock()
+	h := c.health
+	c.mu.RUnlock()
+	if h == nil {
+		return nil
+	}
+	return h.Peers()
+}
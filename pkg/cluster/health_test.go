@@ -0,0 +1,91 @@
+package cluster
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func peerPort(t *testing.T, addr string) int {
+	t.Helper()
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("split %s: %v", addr, err)
+	}
+	port, _ := strconv.Atoi(p)
+	return port
+}
+
+func TestHealthCheckHysteresis(t *testing.T) {
+	var up atomic.Bool
+	up.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" || !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	// the peer is addressed by its node name
+	c, err := NewFromCSV("self,127.0.0.1", "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	h, err := NewHealthChecker(c, HealthConfig{
+		Mode:          HealthHTTP,
+		Port:          peerPort(t, srv.Listener.Addr().String()),
+		Interval:      20 * time.Millisecond,
+		FailThreshold: 2,
+		RiseThreshold: 4,
+	})
+	if err != nil {
+		t.Fatalf("health: %v", err)
+	}
+	defer h.Close()
+
+	waitFor(t, "first check", func() bool { p := c.PeerHealth(); return len(p) == 1 && p[0].LastCheck != nil })
+	if !c.IsHealthy("127.0.0.1") {
+		t.Fatalf("expected peer to be healthy")
+	}
+
+	up.Store(false)
+	waitFor(t, "peer to become unhealthy", func() bool { return !c.IsHealthy("127.0.0.1") })
+	for i := 0; i < 50; i++ {
+		if o := c.Owner("topic" + strconv.Itoa(i)); o != "self" {
+			t.Fatalf("unhealthy peer still owns topic%d", i)
+		}
+	}
+
+	// recovery needs RiseThreshold passing checks in a row
+	up.Store(true)
+	waitFor(t, "peer to recover", func() bool { return c.IsHealthy("127.0.0.1") })
+	p := c.PeerHealth()[0]
+	if p.Successes < 4 || p.LastChange == nil || p.LastError != "" {
+		t.Fatalf("unexpected peer health %+v", p)
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := peerPort(t, ln.Addr().String())
+	c, _ := NewFromCSV("self,127.0.0.1", "self")
+	h, err := NewHealthChecker(c, HealthConfig{Mode: HealthTCP, Port: port, Interval: 20 * time.Millisecond, FailThreshold: 1})
+	if err != nil {
+		t.Fatalf("health: %v", err)
+	}
+	defer h.Close()
+	waitFor(t, "first check", func() bool { p := c.PeerHealth(); return len(p) == 1 && p[0].Successes > 0 })
+	ln.Close()
+	waitFor(t, "peer to become unhealthy", func() bool { return !c.IsHealthy("127.0.0.1") })
+
+	if _, err := NewHealthChecker(c, HealthConfig{Mode: "icmp", Port: 1}); err == nil {
+		t.Fatalf("expected unknown mode to fail")
+	}
+}
@@ -0,0 +1,460 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+)
+
+// Lease is a node's right to run a named task, as granted by the node
+// reporting it.
+type Lease struct {
+	Name   string `json:"name"`
+	Holder string `json:"holder"`
+	// Token increases with every new holder of the lease; tasks hand it to
+	// the systems they write to so that writes of a previous holder can be
+	// refused (fencing)
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+	// Held is set on the holder while its task runs
+	Held bool `json:"held,omitempty"`
+}
+
+// LeaseConfig configures a LeaseManager.
+type LeaseConfig struct {
+	// AdminPort is the peers' admin port (see AdminAddr)
+	AdminPort int
+	// TTL is how long a grant lasts without renewal (default 10s). Holders
+	// renew every TTL/3, and a task is moved TTL after its holder failed.
+	// A holder that cannot renew stops its task TTL/3 (the request
+	// timeout) before its lease ends, however long its requests take.
+	TTL time.Duration
+	// Voters are the nodes whose grants count towards a lease. With a
+	// fixed set, nodes that see different members (e.g. gossip during a
+	// partition) still need a majority of the same nodes; when empty, the
+	// current members vote.
+	Voters []string
+}
+
+// LeaseManager assigns tasks to exactly one node: the owner of a task's
+// name acquires a lease on it from a majority of the voters, runs the task
+// while it holds the lease and renews it. Every member also grants leases
+// to the others through the admin API (POST /cluster/leases). A grant is
+// only given to a token higher than any the member granted before, unless
+// the holder renews its own, so two nodes never hold a majority at once and
+// tokens grow with every new holder.
+type LeaseManager struct {
+	cl     *Cluster
+	cfg    LeaseConfig
+	client *http.Client
+
+	mu sync.Mutex
+	// grants are the leases granted by this node, kept after they expire
+	// to remember their tokens
+	grants map[string]*Lease
+	tasks  map[string]*leaseTask
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// leaseTask is a task run by Run while this node holds its lease.
+type leaseTask struct {
+	name string
+	run  func(ctx context.Context, token uint64)
+
+	// guarded by LeaseManager.mu
+	token uint64
+	valid time.Time
+
+	// next is the token of the next attempt to acquire the lease
+	next   uint64
+	cancel context.CancelFunc
+	done   chan struct{}
+	// expiry cancels the task when the lease is not renewed in time, and
+	// sets expired
+	expiry  *time.Timer
+	expired bool
+}
+
+// NewLeaseManager enables leases for cl.
+func NewLeaseManager(cl *Cluster, cfg LeaseConfig) *LeaseManager {
+	if cfg.TTL <= 0 {
+		cfg.TTL = 10 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	lm := &LeaseManager{
+		cl:     cl,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.TTL / 3},
+		grants: make(map[string]*Lease),
+		tasks:  make(map[string]*leaseTask),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	cl.mu.Lock()
+	cl.leases = lm
+	cl.mu.Unlock()
+	return lm
+}
+
+// Close stops the tasks running here and releases their leases.
+func (lm *LeaseManager) Close() {
+	lm.cancel()
+	lm.wg.Wait()
+}
+
+// Run runs task on the node that holds the lease on name, which every
+// member should register alike. The owner of name acquires the lease; the
+// context passed to task is cancelled when the lease is lost or moves to a
+// new owner, and task must return then. It runs again wherever the lease
+// is acquired next, with a higher token.
+func (lm *LeaseManager) Run(name string, task func(ctx context.Context, token uint64)) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if _, ok := lm.tasks[name]; ok {
+		return fmt.Errorf("lease task %s already exists", name)
+	}
+	t := &leaseTask{name: name, run: task}
+	lm.tasks[name] = t
+	lm.wg.Add(1)
+	go lm.runTask(t)
+	return nil
+}
+
+// Holding returns the token of the lease on name while this node holds it.
+func (lm *LeaseManager) Holding(name string) (uint64, bool) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	t, ok := lm.tasks[name]
+	if !ok || t.token == 0 {
+		return 0, false
+	}
+	return t.token, true
+}
+
+// Grant grants the lease on name to holder with token for ttl if no other
+// node holds it and token is higher than any granted before, or renews it
+// for its holder. It returns the lease as granted by this node afterwards.
+func (lm *LeaseManager) Grant(name, holder string, token uint64, ttl time.Duration) (Lease, bool) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	now := time.Now()
+	g, ok := lm.grants[name]
+	if !ok {
+		g = &Lease{Name: name}
+		lm.grants[name] = g
+	}
+	live := now.Before(g.Expires)
+	granted := token > 0 && ((token > g.Token && (!live || g.Holder == holder)) ||
+		(token == g.Token && g.Holder == holder))
+	if granted {
+		g.Holder = holder
+		g.Token = token
+		g.Expires = now.Add(ttl)
+	}
+	return *g, granted
+}
+
+// Release ends the grant of holder's lease on name with token early. The
+// token is remembered.
+func (lm *LeaseManager) Release(name, holder string, token uint64) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if g, ok := lm.grants[name]; ok && g.Holder == holder && g.Token == token {
+		g.Expires = time.Time{}
+	}
+}
+
+// Leases returns the unexpired leases granted by this node and the ones it
+// holds, ordered by name.
+func (lm *LeaseManager) Leases() []Lease {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	now := time.Now()
+	var out []Lease
+	seen := make(map[string]bool)
+	for _, g := range lm.grants {
+		if !now.Before(g.Expires) {
+			continue
+		}
+		l := *g
+		if t, ok := lm.tasks[g.Name]; ok && t.token != 0 && t.token == g.Token && lm.cl.IsSelf(g.Holder) {
+			l.Held = true
+		}
+		seen[g.Name] = true
+		out = append(out, l)
+	}
+	for _, t := range lm.tasks {
+		if t.token != 0 && !seen[t.name] {
+			out = append(out, Lease{Name: t.name, Holder: lm.cl.Self(), Token: t.token, Expires: t.valid, Held: true})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Leases returns the leases known to this node, or nil when leases are
+// disabled.
+func (c *Cluster) Leases() []Lease {
+	c.mu.RLock()
+	lm := c.leases
+	c.mu.RUnlock()
+	if lm == nil {
+		return nil
+	}
+	return lm.Leases()
+}
+
+// runTask acquires, renews and releases the lease of t as its owner
+// changes, and starts and stops the task with it.
+func (lm *LeaseManager) runTask(t *leaseTask) {
+	defer lm.wg.Done()
+	interval := lm.cfg.TTL / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		owner := lm.cl.Owner(t.name)
+		lm.mu.Lock()
+		held, expired := t.token != 0, t.expired
+		lm.mu.Unlock()
+		switch {
+		case held && !lm.cl.IsSelf(owner):
+			plog.Info("cluster: lease %s: owner is now %s, handing it over", t.name, owner)
+			lm.release(t.name, lm.stop(t))
+			metrics.IncLeaseEvents("released")
+		case expired:
+			// the expiry timer stopped the task before any other node
+			// could acquire the lease
+			plog.Warn("cluster: lease %s: not renewed in time, stopped the task", t.name)
+			lm.stop(t)
+			metrics.IncLeaseEvents("lost")
+		case held:
+			start := time.Now()
+			if lm.request(t.name, t.token, true) {
+				lm.extend(t, start.Add(lm.cfg.TTL))
+			}
+		case lm.cl.IsSelf(owner):
+			lm.acquire(t)
+		}
+		select {
+		case <-ticker.C:
+		case <-lm.ctx.Done():
+			lm.mu.Lock()
+			held = t.token != 0
+			lm.mu.Unlock()
+			if held {
+				lm.release(t.name, lm.stop(t))
+			}
+			return
+		}
+	}
+}
+
+// acquire tries to obtain the lease of t from a majority and starts the
+// task with it.
+func (lm *LeaseManager) acquire(t *leaseTask) {
+	lm.mu.Lock()
+	if g, ok := lm.grants[t.name]; ok && !lm.cl.IsSelf(g.Holder) && g.Token >= t.next {
+		t.next = g.Token + 1
+	}
+	if t.next == 0 {
+		t.next = 1
+	}
+	token := t.next
+	lm.mu.Unlock()
+
+	start := time.Now()
+	if !lm.request(t.name, token, false) {
+		return
+	}
+	ctx, cancel := context.WithCancel(lm.ctx)
+	lm.mu.Lock()
+	t.token = token
+	t.valid = start.Add(lm.cfg.TTL)
+	t.cancel = cancel
+	t.done = make(chan struct{})
+	t.expiry = time.AfterFunc(time.Until(lm.stopAt(t.valid)), func() {
+		lm.mu.Lock()
+		if t.token == token {
+			t.expired = true
+		}
+		lm.mu.Unlock()
+		cancel()
+	})
+	lm.mu.Unlock()
+	plog.Info("cluster: lease %s acquired with token %d", t.name, token)
+	metrics.IncLeaseEvents("acquired")
+	go func() {
+		defer close(t.done)
+		t.run(ctx, token)
+	}()
+}
+
+// stopAt returns when the task of a lease valid until valid must stop. A
+// renewal that is still in flight then can no longer make a difference,
+// and the task has returned before any voter's grant runs out.
+func (lm *LeaseManager) stopAt(valid time.Time) time.Time {
+	return valid.Add(-lm.client.Timeout)
+}
+
+// extend moves the expiry of the task of t after a renewal, unless it has
+// passed already.
+func (lm *LeaseManager) extend(t *leaseTask, valid time.Time) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if t.expiry == nil || !t.expiry.Stop() {
+		return
+	}
+	t.valid = valid
+	t.expiry.Reset(time.Until(lm.stopAt(valid)))
+}
+
+// stop cancels the task of t, waits for it to return and returns the
+// token of the lease it held.
+func (lm *LeaseManager) stop(t *leaseTask) uint64 {
+	lm.mu.Lock()
+	token, cancel, done := t.token, t.cancel, t.done
+	t.token = 0
+	t.next = token + 1
+	t.cancel, t.done = nil, nil
+	if t.expiry != nil {
+		t.expiry.Stop()
+		t.expiry = nil
+	}
+	t.expired = false
+	lm.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	return token
+}
+
+// voters returns the nodes asked for grants.
+func (lm *LeaseManager) voters() []string {
+	if len(lm.cfg.Voters) > 0 {
+		return lm.cfg.Voters
+	}
+	return lm.cl.Members()
+}
+
+// release gives up this node's lease on name with token on all voters.
+func (lm *LeaseManager) release(name string, token uint64) {
+	for _, m := range lm.voters() {
+		if lm.cl.IsSelf(m) {
+			lm.Release(name, m, token)
+			continue
+		}
+		if err := lm.callPeer(http.MethodDelete, m, name, token, nil); err != nil {
+			plog.Debug("cluster: releasing lease %s on %s: %v", name, m, err)
+		}
+	}
+}
+
+// request asks all voters to grant or renew the lease on name with token
+// and reports whether a majority did. Partial grants of a failed attempt to
+// acquire it are released, and the next attempt uses a token above those
+// granted to other nodes; partial grants of a failed renewal stay until they
+// expire, like the lease. No member grants a token to two nodes, so a
+// token can be tried again.
+func (lm *LeaseManager) request(name string, token uint64, renew bool) bool {
+	members := lm.voters()
+	self := lm.cl.Self()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var granted []string
+	// the highest token granted to another node
+	var highest uint64
+	for _, m := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var l Lease
+			ok := false
+			if lm.cl.IsSelf(m) {
+				l, ok = lm.Grant(name, self, token, lm.cfg.TTL)
+			} else if err := lm.callPeer(http.MethodPost, m, name, token, &l); err == nil {
+				ok = true
+			} else if !errors.Is(err, errLeaseDenied) {
+				plog.Debug("cluster: lease %s on %s: %v", name, m, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				granted = append(granted, m)
+			}
+			if l.Holder != self && l.Token > highest {
+				highest = l.Token
+			}
+		}()
+	}
+	wg.Wait()
+	if len(granted) > len(members)/2 {
+		return true
+	}
+	if renew {
+		return false
+	}
+	lm.mu.Lock()
+	if t, ok := lm.tasks[name]; ok && t.token == 0 && highest >= t.next {
+		t.next = highest + 1
+	}
+	lm.mu.Unlock()
+	for _, m := range granted {
+		if m == self {
+			lm.Release(name, m, token)
+		} else {
+			lm.callPeer(http.MethodDelete, m, name, token, nil)
+		}
+	}
+	return false
+}
+
+// errLeaseDenied is returned by callPeer when a peer refuses a grant.
+var errLeaseDenied = errors.New("lease denied")
+
+// callPeer asks peer to grant (POST) or release (DELETE) this node's lease
+// on name with token. Granted and refused leases are decoded into l.
+func (lm *LeaseManager) callPeer(method, peer, name string, token uint64, l *Lease) error {
+	q := url.Values{
+		"name":   {name},
+		"holder": {lm.cl.Self()},
+		"token":  {strconv.FormatUint(token, 10)},
+	}
+	if method == http.MethodPost {
+		q.Set("ttl", lm.cfg.TTL.String())
+	}
+	req, err := http.NewRequest(method, "http://"+lm.cl.AdminAddr(peer, lm.cfg.AdminPort)+"/cluster/leases?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := lm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusConflict && l != nil:
+		if err := json.NewDecoder(res.Body).Decode(l); err != nil {
+			return err
+		}
+		return errLeaseDenied
+	case res.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected status %s", res.Status)
+	case l != nil:
+		return json.NewDecoder(res.Body).Decode(l)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeaseGrantFencing(t *testing.T) {
+	cl, _ := NewFromCSV("a,b,c", "a")
+	lm := NewLeaseManager(cl, LeaseConfig{})
+	defer lm.Close()
+
+	if _, ok := lm.Grant("job", "b", 0, time.Minute); ok {
+		t.Fatal("granted token 0")
+	}
+	if _, ok := lm.Grant("job", "b", 3, time.Minute); !ok {
+		t.Fatal("first grant refused")
+	}
+	if _, ok := lm.Grant("job", "b", 3, time.Minute); !ok {
+		t.Fatal("renewal refused")
+	}
+	if l, ok := lm.Grant("job", "c", 4, time.Minute); ok || l.Holder != "b" || l.Token != 3 {
+		t.Fatalf("granted a live lease to another node: %+v", l)
+	}
+	// released leases go to higher tokens only
+	lm.Release("job", "b", 3)
+	if _, ok := lm.Grant("job", "c", 3, time.Minute); ok {
+		t.Fatal("granted a used token to a new holder")
+	}
+	if _, ok := lm.Grant("job", "c", 4, time.Minute); !ok {
+		t.Fatal("grant after release refused")
+	}
+	if _, ok := lm.Grant("job", "b", 3, time.Minute); ok {
+		t.Fatal("previous holder renewed with its old token")
+	}
+	// expired leases too
+	if _, ok := lm.Grant("other", "b", 1, time.Millisecond); !ok {
+		t.Fatal("grant refused")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := lm.Grant("other", "c", 2, time.Minute); !ok {
+		t.Fatal("expired lease not granted to another node")
+	}
+	if ls := cl.Leases(); len(ls) != 2 || ls[0].Name != "job" || ls[0].Holder != "c" || ls[0].Token != 4 || ls[0].Held {
+		t.Fatalf("unexpected leases %+v", ls)
+	}
+}
+
+// leaseNode is an in-process member that grants leases over HTTP like
+// admin.LeaseHandler, which pkg/cluster cannot import; the handler itself
+// is tested in pkg/admin.
+type leaseNode struct {
+	cl  *Cluster
+	lm  *LeaseManager
+	srv *httptest.Server
+	// down makes the node unreachable and its requests fail
+	down atomic.Bool
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func (n *leaseNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	token, _ := strconv.ParseUint(q.Get("token"), 10, 64)
+	switch r.Method {
+	case http.MethodPost:
+		ttl, _ := time.ParseDuration(q.Get("ttl"))
+		l, ok := n.lm.Grant(q.Get("name"), q.Get("holder"), token, ttl)
+		if !ok {
+			w.WriteHeader(http.StatusConflict)
+		}
+		json.NewEncoder(w).Encode(l)
+	case http.MethodDelete:
+		n.lm.Release(q.Get("name"), q.Get("holder"), token)
+	}
+}
+
+func startLeaseNodes(t *testing.T, cfg LeaseConfig, names ...string) map[string]*leaseNode {
+	t.Helper()
+	nodes := make(map[string]*leaseNode)
+	var entries []string
+	for _, name := range names {
+		n := &leaseNode{}
+		n.srv = httptest.NewServer(n)
+		entries = append(entries, fmt.Sprintf("%s;host=127.0.0.1;admin=%d", name, peerPort(t, n.srv.Listener.Addr().String())))
+		nodes[name] = n
+	}
+	for _, name := range names {
+		n := nodes[name]
+		cl, err := NewFromCSV(strings.Join(entries, ","), name)
+		if err != nil {
+			t.Fatalf("cluster %s: %v", name, err)
+		}
+		n.cl = cl
+		n.lm = NewLeaseManager(cl, cfg)
+		tr := http.DefaultTransport
+		n.lm.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			if n.down.Load() {
+				return nil, errors.New("node is down")
+			}
+			return tr.RoundTrip(r)
+		})
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.lm.Close()
+			n.srv.Close()
+		}
+	})
+	return nodes
+}
+
+// taskRecorder tracks where a leased task runs.
+type taskRecorder struct {
+	mu      sync.Mutex
+	running map[string]uint64
+	max     int
+	starts  int
+}
+
+func (tr *taskRecorder) task(node string) func(context.Context, uint64) {
+	return func(ctx context.Context, token uint64) {
+		tr.mu.Lock()
+		tr.running[node] = token
+		tr.starts++
+		tr.max = max(tr.max, len(tr.running))
+		tr.mu.Unlock()
+		<-ctx.Done()
+		tr.mu.Lock()
+		delete(tr.running, node)
+		tr.mu.Unlock()
+	}
+}
+
+// only reports whether the task runs on node alone, with token.
+func (tr *taskRecorder) only(node string, token uint64) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tok, ok := tr.running[node]
+	return ok && len(tr.running) == 1 && tok == token
+}
+
+func TestLeaseRunsTaskOnceAndMovesOnFailure(t *testing.T) {
+	const ttl = 300 * time.Millisecond
+	nodes := startLeaseNodes(t, LeaseConfig{TTL: ttl}, "a", "b", "c")
+	rec := &taskRecorder{running: make(map[string]uint64)}
+	for name, n := range nodes {
+		if err := n.lm.Run("relay/cam1", rec.task(name)); err != nil {
+			t.Fatalf("run on %s: %v", name, err)
+		}
+	}
+	if err := nodes["a"].lm.Run("relay/cam1", rec.task("a")); err == nil {
+		t.Fatal("expected an error registering a task twice")
+	}
+
+	// the owner of the task runs it, and keeps it while renewing
+	first := nodes["a"].cl.Owner("relay/cam1")
+	waitFor(t, "the task on its owner", func() bool { return rec.only(first, 1) })
+	time.Sleep(3 * ttl)
+	if !rec.only(first, 1) || rec.starts != 1 {
+		t.Fatalf("task not kept on %s: %+v", first, rec.running)
+	}
+	if tok, ok := nodes[first].lm.Holding("relay/cam1"); !ok || tok != 1 {
+		t.Fatalf("holder reports token %d %v", tok, ok)
+	}
+	for name, n := range nodes {
+		ls := n.cl.Leases()
+		if len(ls) != 1 || ls[0].Holder != first || ls[0].Token != 1 || ls[0].Held != (name == first) {
+			t.Fatalf("leases on %s: %+v", name, ls)
+		}
+	}
+
+	// the holder crashes; the others notice and the standby takes over
+	// once the lease has expired, with a higher token
+	nodes[first].down.Store(true)
+	nodes[first].srv.Close()
+	var second string
+	for name, n := range nodes {
+		if name != first {
+			n.cl.SetHealthy(first, false)
+			second = n.cl.Owner("relay/cam1")
+		}
+	}
+	waitFor(t, "the task on "+second, func() bool { return rec.only(second, 2) })
+	if _, ok := nodes[first].lm.Holding("relay/cam1"); ok {
+		t.Fatal("the failed node still holds the lease")
+	}
+
+	// ownership moves on: the lease is handed over without waiting for it
+	// to expire
+	var third string
+	for name, n := range nodes {
+		if name != first {
+			n.cl.SetDraining(second, true)
+			third = n.cl.Owner("relay/cam1")
+		}
+	}
+	waitFor(t, "the task on "+third, func() bool { return rec.only(third, 3) })
+	if rec.max != 1 {
+		t.Fatalf("the task ran on %d nodes at once", rec.max)
+	}
+}
+
+func TestLeaseVotersKeepPartitionsFromBothHoldingALease(t *testing.T) {
+	const ttl = 300 * time.Millisecond
+	names := []string{"a", "b", "c", "d"}
+	nodes := startLeaseNodes(t, LeaseConfig{TTL: ttl, Voters: names}, names...)
+
+	// a partition into halves, where each side only sees its own members
+	// like gossip would
+	side := map[string]int{"a": 0, "b": 0, "c": 1, "d": 1}
+	for name, n := range nodes {
+		reachable := make(map[string]bool)
+		for other, o := range nodes {
+			if side[other] == side[name] {
+				reachable[o.srv.Listener.Addr().String()] = true
+			} else {
+				n.cl.RemoveNode(other)
+			}
+		}
+		tr := n.lm.client.Transport
+		n.lm.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			if !reachable[r.URL.Host] {
+				return nil, errors.New("partitioned")
+			}
+			return tr.RoundTrip(r)
+		})
+	}
+	rec := &taskRecorder{running: make(map[string]uint64)}
+	for name, n := range nodes {
+		if err := n.lm.Run("relay/cam1", rec.task(name)); err != nil {
+			t.Fatalf("run on %s: %v", name, err)
+		}
+	}
+	// both sides have an owner of the task, but neither a majority of the
+	// voters
+	time.Sleep(3 * ttl)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.starts != 0 {
+		t.Fatalf("the task ran %d times without a majority of the voters: %+v", rec.starts, rec.running)
+	}
+}
+
+func TestLeaseTaskStopsInTimeWhenRenewalStalls(t *testing.T) {
+	const ttl = 300 * time.Millisecond
+	nodes := startLeaseNodes(t, LeaseConfig{TTL: ttl}, "a", "b", "c")
+	holder := nodes["a"].cl.Owner("relay/cam1")
+
+	// once failing, one renewal fails at once and the next ones hang until
+	// the request timeout: the task must not wait for them
+	var failing atomic.Bool
+	var calls atomic.Int32
+	n := nodes[holder]
+	tr := n.lm.client.Transport
+	n.lm.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if !failing.Load() || r.Method != http.MethodPost {
+			return tr.RoundTrip(r)
+		}
+		if calls.Add(1) > 2 {
+			<-r.Context().Done()
+		}
+		return nil, errors.New("voter unavailable")
+	})
+
+	type stop struct {
+		at, valid time.Time
+	}
+	stops := make(chan stop, len(nodes))
+	for name, n := range nodes {
+		lm := n.lm
+		if err := lm.Run("relay/cam1", func(ctx context.Context, token uint64) {
+			<-ctx.Done()
+			lm.mu.Lock()
+			valid := lm.tasks["relay/cam1"].valid
+			lm.mu.Unlock()
+			stops <- stop{at: time.Now(), valid: valid}
+		}); err != nil {
+			t.Fatalf("run on %s: %v", name, err)
+		}
+	}
+	waitFor(t, "the lease on "+holder, func() bool {
+		_, ok := n.lm.Holding("relay/cam1")
+		return ok
+	})
+	failing.Store(true)
+
+	select {
+	case s := <-stops:
+		if late := s.at.Sub(s.valid.Add(-ttl / 3)); late > 30*time.Millisecond {
+			t.Fatalf("task stopped %s after the renewal deadline, %s before its lease ends", late, s.valid.Sub(s.at))
+		}
+	case <-time.After(5 * ttl):
+		t.Fatal("task not stopped after failed renewals")
+	}
+}
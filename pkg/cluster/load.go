@@ -0,0 +1,562 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// LoadThresholds bound the load a node accepts new sessions at; zero
+// values are not checked.
+type LoadThresholds struct {
+	Publishers  int
+	Subscribers int
+	IngressMbps float64
+	EgressMbps  float64
+	// CPU is the process CPU usage in percent of all cores.
+	CPU float64
+}
+
+// exceeded returns which threshold l is over, or "".
+func (t LoadThresholds) exceeded(l Load) string {
+	switch {
+	case t.Publishers > 0 && l.Publishers >= t.Publishers:
+		return "publishers"
+	case t.Subscribers > 0 && l.Subscribers >= t.Subscribers:
+		return "subscribers"
+	case t.IngressMbps > 0 && l.IngressMbps >= t.IngressMbps:
+		return "ingress"
+	case t.EgressMbps > 0 && l.EgressMbps >= t.EgressMbps:
+		return "egress"
+	case t.CPU > 0 && l.CPU >= t.CPU:
+		return "cpu"
+	}
+	return ""
+}
+
+// Load is the load a node reports to its peers.
+type Load struct {
+	Node        string    `json:"node"`
+	Time        time.Time `json:"time"`
+	Publishers  int       `json:"publishers"`
+	Subscribers int       `json:"subscribers"`
+	IngressMbps float64   `json:"ingress_mbps"`
+	// EgressMbps is estimated from each topic's ingress rate and its
+	// subscriber count.
+	EgressMbps float64 `json:"egress_mbps"`
+	CPU        float64 `json:"cpu_percent"`
+	// Overloaded names the exceeded threshold; the node refuses new
+	// sessions and is skipped for new placements.
+	Overloaded string `json:"overloaded,omitempty"`
+	// Topics are the topics with a publisher on the node; they keep
+	// placements on it alive.
+	Topics []string `json:"topics,omitempty"`
+	// Placements are the placements decided by the node as home of the
+	// topics.
+	Placements []Placement `json:"placements,omitempty"`
+	// Error is set in /cluster when the node's load could not be fetched.
+	Error string `json:"error,omitempty"`
+}
+
+// Placement assigns a topic to a node other than its rendezvous owner.
+type Placement struct {
+	Topic   string    `json:"topic"`
+	Node    string    `json:"node"`
+	Home    string    `json:"home"`
+	Created time.Time `json:"created"`
+
+	lastSeen time.Time
+}
+
+// LoadConfig configures load sharing, placement and admission control.
+type LoadConfig struct {
+	// AdminPort is the admin HTTP port of the peers, which are addressed by
+	// node name.
+	AdminPort int
+	// Interval between load reports; default 2s.
+	Interval time.Duration
+	// Timeout bounds each peer request; default 1s.
+	Timeout time.Duration
+	// Thresholds above which this node refuses new sessions.
+	Thresholds LoadThresholds
+	// Placement places new topics on the least-loaded eligible node
+	// instead of their rendezvous owner.
+	Placement bool
+	// PlacementTTL is how long a placement is kept once its node no longer
+	// has the topic; default 60s.
+	PlacementTTL time.Duration
+}
+
+// LoadMonitor measures this node's load, fetches the load of its peers
+// and, with Placement, places new topics on the least-loaded node. The
+// placements are sticky: a topic stays on its node while it is published
+// there, even if the load changes.
+type LoadMonitor struct {
+	cl     *Cluster
+	mgr    *topic.Manager
+	cfg    LoadConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	local     Load
+	peers     map[string]Load
+	prevBytes map[string]int64
+	prevTime  time.Time
+	prevCPU   time.Duration
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewLoadMonitor starts measuring and sharing load for cl.
+func NewLoadMonitor(cl *Cluster, mgr *topic.Manager, cfg LoadConfig) *LoadMonitor {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 2 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.PlacementTTL <= 0 {
+		cfg.PlacementTTL = time.Minute
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	lm := &LoadMonitor{
+		cl:        cl,
+		mgr:       mgr,
+		cfg:       cfg,
+		client:    &http.Client{Timeout: cfg.Timeout},
+		peers:     make(map[string]Load),
+		prevBytes: make(map[string]int64),
+		prevTime:  time.Now(),
+		prevCPU:   processCPU(),
+		cancel:    cancel,
+	}
+	lm.local = lm.measure()
+	cl.mu.Lock()
+	cl.load = lm
+	if cl.placements == nil {
+		cl.placements = make(map[string]*Placement)
+	}
+	cl.mu.Unlock()
+	lm.wg.Add(1)
+	go lm.run(ctx)
+	return lm
+}
+
+// Close stops load sharing.
+func (lm *LoadMonitor) Close() {
+	lm.cancel()
+	lm.wg.Wait()
+}
+
+func (lm *LoadMonitor) run(ctx context.Context) {
+	defer lm.wg.Done()
+	ticker := time.NewTicker(lm.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		local := lm.measure()
+		lm.mu.Lock()
+		prev := lm.local.Overloaded
+		lm.local = local
+		lm.mu.Unlock()
+		if local.Overloaded != prev {
+			if local.Overloaded != "" {
+				plog.Warn("cluster: node overloaded (%s), refusing new sessions", local.Overloaded)
+			} else {
+				plog.Info("cluster: node no longer overloaded")
+			}
+		}
+		metrics.SetOverloaded(local.Overloaded != "")
+		lm.poll(ctx)
+		lm.expire()
+	}
+}
+
+// measure computes this node's load since the previous measurement.
+func (lm *LoadMonitor) measure() Load {
+	now := time.Now()
+	cpu := processCPU()
+	l := Load{Node: lm.cl.Self(), Time: now}
+	elapsed := now.Sub(lm.prevTime).Seconds()
+	bytes := make(map[string]int64)
+	for _, t := range lm.mgr.Status().Topics {
+		bytes[t.Name] = t.BytesIn
+		l.Subscribers += t.SubscriberCount
+		if !t.HasPublisher {
+			continue
+		}
+		l.Publishers++
+		l.Topics = append(l.Topics, t.Name)
+		if prev, ok := lm.prevBytes[t.Name]; ok && elapsed > 0 && t.BytesIn >= prev {
+			mbps := float64(t.BytesIn-prev) * 8 / elapsed / 1e6
+			l.IngressMbps += mbps
+			l.EgressMbps += mbps * float64(t.SubscriberCount)
+		}
+	}
+	if elapsed > 0 {
+		l.CPU = (cpu - lm.prevCPU).Seconds() / elapsed / float64(runtime.NumCPU()) * 100
+	}
+	lm.prevBytes, lm.prevTime, lm.prevCPU = bytes, now, cpu
+	sort.Strings(l.Topics)
+	l.Overloaded = lm.cfg.Thresholds.exceeded(l)
+	return l
+}
+
+// processCPU returns the CPU time used by this process.
+func processCPU() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// poll fetches the load of all peers and applies their placements.
+func (lm *LoadMonitor) poll(ctx context.Context) {
+	var mu sync.Mutex
+	reports := make(map[string]Load)
+	var wg sync.WaitGroup
+	for _, peer := range lm.cl.Members() {
+		if lm.cl.IsSelf(peer) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := lm.fetch(ctx, peer)
+			if err != nil {
+				l = Load{Node: peer, Time: time.Now(), Error: err.Error()}
+			}
+			mu.Lock()
+			reports[peer] = l
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+	lm.mu.Lock()
+	lm.peers = reports
+	lm.mu.Unlock()
+
+	now := time.Now()
+	lm.cl.mu.Lock()
+	for _, l := range reports {
+		for _, p := range l.Placements {
+			// the home keeps reporting a placement until it expires there
+			if cur, ok := lm.cl.placements[p.Topic]; !ok || cur.Created.Before(p.Created) {
+				p.lastSeen = now
+				lm.cl.placements[p.Topic] = &p
+			} else if cur.Created.Equal(p.Created) {
+				cur.lastSeen = now
+			}
+		}
+		for _, t := range l.Topics {
+			if p, ok := lm.cl.placements[t]; ok && p.Node == l.Node {
+				p.lastSeen = now
+			}
+		}
+	}
+	lm.cl.mu.Unlock()
+}
+
+func (lm *LoadMonitor) fetch(ctx context.Context, peer string) (Load, error) {
+	var l Load
+	u := "http://" + lm.cl.AdminAddr(peer, lm.cfg.AdminPort) + "/cluster/load"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return l, err
+	}
+	res, err := lm.client.Do(req)
+	if err != nil {
+		return l, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return l, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&l); err != nil {
+		return l, err
+	}
+	l.Node = peer
+	return l, nil
+}
+
+// expire drops placements whose node has not had the topic for
+// PlacementTTL; a new publisher of the topic is placed again.
+func (lm *LoadMonitor) expire() {
+	active := make(map[string]bool)
+	for _, t := range lm.Local().Topics {
+		active[t] = true
+	}
+	now := time.Now()
+	lm.cl.mu.Lock()
+	defer lm.cl.mu.Unlock()
+	for name, p := range lm.cl.placements {
+		if p.Node == lm.cl.self && active[name] {
+			p.lastSeen = now
+		}
+		if now.Sub(p.lastSeen) > lm.cfg.PlacementTTL {
+			delete(lm.cl.placements, name)
+			plog.Debug("cluster: placement of %s on %s expired", name, p.Node)
+		}
+	}
+}
+
+// Local returns this node's load, including the placements it decided.
+func (lm *LoadMonitor) Local() Load {
+	lm.mu.Lock()
+	l := lm.local
+	lm.mu.Unlock()
+	l.Topics = append([]string(nil), l.Topics...)
+	l.Placements = nil
+	lm.cl.mu.RLock()
+	for _, p := range lm.cl.placements {
+		if p.Home == lm.cl.self {
+			l.Placements = append(l.Placements, *p)
+		}
+	}
+	lm.cl.mu.RUnlock()
+	sort.Slice(l.Placements, func(i, j int) bool { return l.Placements[i].Topic < l.Placements[j].Topic })
+	return l
+}
+
+// Loads returns the load of all members, this node first.
+func (lm *LoadMonitor) Loads() []Load {
+	out := []Load{lm.Local()}
+	lm.mu.Lock()
+	for _, l := range lm.peers {
+		out = append(out, l)
+	}
+	lm.mu.Unlock()
+	sort.Slice(out[1:], func(i, j int) bool { return out[1+i].Node < out[1+j].Node })
+	return out
+}
+
+// Overloaded returns the threshold this node is over, or "" when it
+// accepts new sessions.
+func (lm *LoadMonitor) Overloaded() string {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	return lm.local.Overloaded
+}
+
+// Place returns the node that should own topic. Topics that are already
+// placed keep their node, and only the home (rendezvous owner) of a topic
+// places it: on the eligible node with the lowest weighted load, which is
+// told before anyone is sent there. Without Placement, and for pinned
+// topics, this is Owner.
+func (lm *LoadMonitor) Place(topicName string) string {
+	owner := lm.cl.Owner(topicName)
+	if !lm.cfg.Placement || !topic.ValidName(topicName) || !lm.cl.IsSelf(lm.cl.Home(topicName)) {
+		return owner
+	}
+	if _, pinned := lm.cl.Pinned(topicName); pinned {
+		return owner
+	}
+	lm.cl.mu.RLock()
+	_, placed := lm.cl.placements[topicName]
+	lm.cl.mu.RUnlock()
+	if placed || lm.mgr.GetTopicStream(topicName) != nil {
+		return owner
+	}
+
+	node := lm.leastLoaded(owner)
+	if node == owner {
+		return owner
+	}
+	p := Placement{Topic: topicName, Node: node, Home: lm.cl.Self(), Created: time.Now()}
+	if err := lm.push(node, p); err != nil {
+		plog.Warn("cluster: placing %s on %s failed, keeping it on %s: %v", topicName, node, owner, err)
+		return owner
+	}
+	p.lastSeen = p.Created
+	lm.cl.mu.Lock()
+	lm.cl.placements[topicName] = &p
+	lm.cl.mu.Unlock()
+	plog.Info("cluster: placed new topic %s on %s", topicName, node)
+	// the other peers learn it from our next load report; tell them now
+	// so that subscribers find the topic right away
+	for _, peer := range lm.cl.Members() {
+		if peer != node && !lm.cl.IsSelf(peer) {
+			go lm.push(peer, p)
+		}
+	}
+	return node
+}
+
+// Admission is where a new session for a topic belongs and whether this
+// node may take it.
+type Admission struct {
+	// Owner is the node that serves the topic; publishers place new topics.
+	Owner string
+	// Overloaded is the load threshold this node is over, or "" when it
+	// accepts new sessions.
+	Overloaded string
+}
+
+// Admit returns the admission of a new publisher (publish) or subscriber
+// of topicName.
+func (lm *LoadMonitor) Admit(topicName string, publish bool) Admission {
+	a := Admission{Overloaded: lm.Overloaded()}
+	if publish {
+		a.Owner = lm.Place(topicName)
+	} else {
+		a.Owner = lm.cl.Owner(topicName)
+	}
+	return a
+}
+
+// Admit is the placement and admission check of every ingest and playback
+// entry point: the rendezvous owner of topicName, or with load sharing the
+// LoadMonitor's placement and overload state. Sessions for other owners go
+// there; overloaded nodes refuse (503) or redirect new sessions.
+func (c *Cluster) Admit(topicName string, publish bool) Admission {
+	c.mu.RLock()
+	lm := c.load
+	c.mu.RUnlock()
+	if lm == nil {
+		return Admission{Owner: c.Owner(topicName)}
+	}
+	return lm.Admit(topicName, publish)
+}
+
+// leastLoaded returns the eligible, not overloaded node with the lowest
+// weighted load; ties and missing reports keep fallback.
+func (lm *LoadMonitor) leastLoaded(fallback string) string {
+	loads := make(map[string]Load)
+	for _, l := range lm.Loads() {
+		if l.Error == "" {
+			loads[l.Node] = l
+		}
+	}
+	score := func(l Load, w float64) float64 {
+		// bitrate dominates; publishers break ties on idle nodes
+		return (l.IngressMbps + l.EgressMbps + float64(l.Publishers)*0.001) / w
+	}
+	best := fallback
+	fl, ok := loads[fallback]
+	if !ok || fl.Overloaded != "" {
+		best = ""
+	}
+	bestScore := 0.0
+	if best != "" {
+		bestScore = score(fl, lm.cl.Weight(fallback))
+	}
+	lm.cl.mu.RLock()
+	nodes := append([]string(nil), lm.cl.nodes...)
+	lm.cl.mu.RUnlock()
+	for _, n := range nodes {
+		l, ok := loads[n]
+		if !ok || l.Overloaded != "" || n == fallback {
+			continue
+		}
+		lm.cl.mu.RLock()
+		eligible := lm.cl.eligibleLocked(n)
+		lm.cl.mu.RUnlock()
+		if !eligible {
+			continue
+		}
+		if s := score(l, lm.cl.Weight(n)); best == "" || s < bestScore {
+			best, bestScore = n, s
+		}
+	}
+	if best == "" {
+		return fallback
+	}
+	return best
+}
+
+// push tells node about a placement.
+func (lm *LoadMonitor) push(node string, p Placement) error {
+	return pushPlacement(lm.client, lm.cl.AdminAddr(node, lm.cfg.AdminPort), p)
+}
+
+// pushPlacement tells the node with the admin API on addr about a placement.
+func pushPlacement(client *http.Client, addr string, p Placement) error {
+	q := url.Values{"topic": {p.Topic}, "node": {p.Node}, "home": {p.Home}, "created": {strconv.FormatInt(p.Created.UnixNano(), 10)}}
+	u := "http://" + addr + "/cluster/placements?" + q.Encode()
+	res, err := client.Post(u, "", nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// AddPlacement records a placement decided by the topic's home node.
+func (lm *LoadMonitor) AddPlacement(p Placement) error {
+	return lm.cl.AddPlacement(p)
+}
+
+// AddPlacement records a placement decided by the topic's home node or by
+// a migration; the newest placement of a topic wins.
+func (c *Cluster) AddPlacement(p Placement) error {
+	if !topic.ValidName(p.Topic) || strings.TrimSpace(p.Node) == "" {
+		return fmt.Errorf("invalid placement of %q on %q", p.Topic, p.Node)
+	}
+	if p.Created.IsZero() {
+		p.Created = time.Now()
+	}
+	p.lastSeen = time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.placements == nil {
+		c.placements = make(map[string]*Placement)
+	}
+	if cur, ok := c.placements[p.Topic]; ok && cur.Created.After(p.Created) {
+		return nil
+	}
+	c.placements[p.Topic] = &p
+	return nil
+}
+
+// Placements returns the placements known to this node ordered by topic,
+// or nil when there are none.
+func (c *Cluster) Placements() []Placement {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.placements) == 0 {
+		return nil
+	}
+	out := make([]Placement, 0, len(c.placements))
+	for _, p := range c.placements {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Topic < out[j].Topic })
+	return out
+}
+
+// Loads returns the load of all members, or nil when load sharing is
+// disabled.
+func (c *Cluster) Loads() []Load {
+	c.mu.RLock()
+	lm := c.load
+	c.mu.RUnlock()
+	if lm == nil {
+		return nil
+	}
+	return lm.Loads()
+}
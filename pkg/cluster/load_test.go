@@ -0,0 +1,121 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// homeTopic returns a topic name whose rendezvous owner is c itself.
+func homeTopic(t *testing.T, c *Cluster) string {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		name := "cam" + strconv.Itoa(i)
+		if c.IsSelf(c.Home(name)) {
+			return name
+		}
+	}
+	t.Fatalf("no topic homed on self")
+	return ""
+}
+
+func TestLoadPlacement(t *testing.T) {
+	// the peer reports an idle node, or an overloaded one
+	var peerOverloaded atomic.Bool
+	var mu sync.Mutex
+	var pushed []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cluster/load":
+			l := Load{Node: "127.0.0.1", Time: time.Now()}
+			if peerOverloaded.Load() {
+				l.Overloaded = "cpu"
+			}
+			json.NewEncoder(w).Encode(l)
+		case "/cluster/placements":
+			mu.Lock()
+			pushed = append(pushed, r.URL.Query().Get("topic")+"@"+r.URL.Query().Get("node"))
+			mu.Unlock()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewFromCSV("self,127.0.0.1", "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	m := topic.NewManager(topic.Config{MaxPublishers: 10})
+	for i := 0; i < 3; i++ {
+		if err := m.RegisterPublisher(context.Background(), "busy"+strconv.Itoa(i), topic.NewPublisherSession("p")); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+	}
+	lm := NewLoadMonitor(c, m, LoadConfig{
+		AdminPort:    peerPort(t, srv.Listener.Addr().String()),
+		Interval:     50 * time.Millisecond,
+		Thresholds:   LoadThresholds{Publishers: 3},
+		Placement:    true,
+		PlacementTTL: 300 * time.Millisecond,
+	})
+	defer lm.Close()
+	waitFor(t, "peer load", func() bool { return len(c.Loads()) == 2 && c.Loads()[1].Error == "" })
+	if lm.Overloaded() != "publishers" {
+		t.Fatalf("expected overload by publishers, got %q", lm.Overloaded())
+	}
+	// subscribers are admitted by owner, and told about the overload
+	if a := c.Admit("busy0", false); a.Owner != "self" || a.Overloaded != "publishers" {
+		t.Fatalf("unexpected subscriber admission %+v", a)
+	}
+
+	// a new topic homed here goes to the idle peer, which is told first
+	name := homeTopic(t, c)
+	if a := c.Admit(name, true); a.Owner != "127.0.0.1" || a.Overloaded != "publishers" {
+		t.Fatalf("placed as %+v, want the idle peer", a)
+	}
+	mu.Lock()
+	if len(pushed) != 1 || pushed[0] != name+"@127.0.0.1" {
+		t.Fatalf("peer was told %v", pushed)
+	}
+	mu.Unlock()
+	if c.Owner(name) != "127.0.0.1" || len(c.Placements()) != 1 {
+		t.Fatalf("placement not applied: owner %s, placements %v", c.Owner(name), c.Placements())
+	}
+	// sticky while it lives, and the peer's load no longer matters
+	peerOverloaded.Store(true)
+	if node := lm.Place(name); node != "127.0.0.1" {
+		t.Fatalf("placement moved to %q", node)
+	}
+
+	// the peer never reports the topic, so the placement expires
+	waitFor(t, "placement to expire", func() bool { return len(c.Placements()) == 0 })
+	if c.Owner(name) != "self" {
+		t.Fatalf("owner after expiry %s", c.Owner(name))
+	}
+	// an overloaded peer is not chosen
+	waitFor(t, "peer overload", func() bool { return c.Loads()[1].Overloaded != "" })
+	if node := lm.Place(name); node != "self" {
+		t.Fatalf("placed on overloaded peer %q", node)
+	}
+}
+
+func TestAdmitWithoutLoadSharing(t *testing.T) {
+	c, err := NewFromCSV("self,other", "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	for _, publish := range []bool{true, false} {
+		if a := c.Admit("cam1", publish); a.Owner != c.Owner("cam1") || a.Overloaded != "" {
+			t.Fatalf("unexpected admission %+v", a)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// Migration phases, in order; a migration ends in MigrationDone or
+// MigrationFailed.
+const (
+	// MigrationPulling: the target pulls the topic from its owner
+	MigrationPulling = "pulling"
+	// MigrationSwitching: ownership moves to the target
+	MigrationSwitching = "switching"
+	// MigrationHandingOver: the previous owner serves its subscribers from
+	// the target and asks the publisher to reconnect
+	MigrationHandingOver = "handing-over"
+	// MigrationAwaitingPublisher: waiting for the publisher on the target
+	MigrationAwaitingPublisher = "awaiting-publisher"
+	MigrationDone              = "done"
+	MigrationFailed            = "failed"
+)
+
+const (
+	// migrationPoll is how often a migration checks for the publisher on
+	// the target.
+	migrationPoll = 500 * time.Millisecond
+	// migrationRetention is how long finished migrations are listed.
+	migrationRetention = time.Hour
+)
+
+// ErrInvalidMigration is returned for migrations that cannot be started.
+var ErrInvalidMigration = errors.New("invalid migration")
+
+// MigrationRelay moves the media of a topic between nodes; it is
+// implemented by the RTSP server.
+type MigrationRelay interface {
+	// PullTopic feeds the local topic from its owner, holding it for the
+	// publisher, which replaces the pull without disconnecting readers.
+	PullTopic(topic, from string) error
+	// StopPull stops the pull; with keep, the topic stays held for its
+	// publisher for a while.
+	StopPull(topic string, keep bool) error
+	// HandOver feeds the local topic from its new owner to, keeping local
+	// subscribers, and asks the publisher to reconnect.
+	HandOver(topic, to string) error
+}
+
+// MigrateConfig configures topic migrations.
+type MigrateConfig struct {
+	// AdminPort is the admin HTTP port of the peers, which are addressed by
+	// node name.
+	AdminPort int
+	// Timeout bounds each peer admin call; default 5s.
+	Timeout time.Duration
+	// PublisherTimeout is how long a migration waits for the publisher to
+	// reconnect to the target; default 30s.
+	PublisherTimeout time.Duration
+}
+
+// Migration is the state of a topic migration.
+type Migration struct {
+	Topic   string    `json:"topic"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Phase   string    `json:"phase"`
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (mg *Migration) finished() bool {
+	return mg.Phase == MigrationDone || mg.Phase == MigrationFailed
+}
+
+// Migrator moves topics between nodes without dropping subscribers: the
+// target pulls the topic from its owner, a placement moves ownership to the
+// target, the previous owner serves its subscribers from the target like an
+// edge, and only the publisher reconnects. Edge relays of other nodes
+// follow the new owner.
+type Migrator struct {
+	cl     *Cluster
+	mgr    *topic.Manager
+	relay  MigrationRelay
+	cfg    MigrateConfig
+	client *http.Client
+
+	mu         sync.Mutex
+	migrations map[string]*Migration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewMigrator enables topic migrations for cl.
+func NewMigrator(cl *Cluster, mgr *topic.Manager, relay MigrationRelay, cfg MigrateConfig) *Migrator {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.PublisherTimeout <= 0 {
+		cfg.PublisherTimeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Migrator{
+		cl:         cl,
+		mgr:        mgr,
+		relay:      relay,
+		cfg:        cfg,
+		client:     &http.Client{Timeout: cfg.Timeout},
+		migrations: make(map[string]*Migration),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	cl.mu.Lock()
+	cl.migrator = m
+	cl.mu.Unlock()
+	return m
+}
+
+// Close stops running migrations.
+func (m *Migrator) Close() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// Migrate starts moving topicName to node to. Requests for topics owned by
+// another node are forwarded to it.
+func (m *Migrator) Migrate(topicName, to string) (Migration, error) {
+	// pins take precedence over the placement a migration creates
+	if n, pinned := m.cl.Pinned(topicName); pinned {
+		return Migration{}, fmt.Errorf("%w: topic %s is pinned to %s", ErrInvalidMigration, topicName, n)
+	}
+	owner := m.cl.Owner(topicName)
+	if owner != "" && !m.cl.IsSelf(owner) {
+		return m.forward(owner, topicName, to)
+	}
+	return m.start(topicName, to)
+}
+
+func (m *Migrator) start(topicName, to string) (Migration, error) {
+	self := m.cl.Self()
+	m.cl.mu.RLock()
+	_, member := m.cl.nodeSet[to]
+	eligible := m.cl.eligibleLocked(to)
+	m.cl.mu.RUnlock()
+	switch {
+	case !topic.ValidName(topicName):
+		return Migration{}, fmt.Errorf("%w: invalid topic name %q", ErrInvalidMigration, topicName)
+	case !member:
+		return Migration{}, fmt.Errorf("%w: unknown node %q", ErrInvalidMigration, to)
+	case to == self:
+		return Migration{}, fmt.Errorf("%w: topic %s is already owned by %s", ErrInvalidMigration, topicName, to)
+	case !eligible:
+		return Migration{}, fmt.Errorf("%w: node %s is draining or unhealthy", ErrInvalidMigration, to)
+	case !m.LocalPublisher(topicName):
+		return Migration{}, fmt.Errorf("%w: topic %s has no publisher on %s", ErrInvalidMigration, topicName, self)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, ok := m.migrations[topicName]; ok && !cur.finished() {
+		return Migration{}, fmt.Errorf("%w: topic %s is already being migrated to %s", ErrInvalidMigration, topicName, cur.To)
+	}
+	for name, mg := range m.migrations {
+		if mg.finished() && time.Since(mg.Updated) > migrationRetention {
+			delete(m.migrations, name)
+		}
+	}
+	now := time.Now()
+	mg := &Migration{Topic: topicName, From: self, To: to, Phase: MigrationPulling, Started: now, Updated: now}
+	m.migrations[topicName] = mg
+	plog.Info("cluster: migrating topic %s from %s to %s", topicName, self, to)
+	m.wg.Add(1)
+	go m.run(mg)
+	return *mg, nil
+}
+
+func (m *Migrator) run(mg *Migration) {
+	defer m.wg.Done()
+	fail := func(err error) {
+		m.mu.Lock()
+		mg.Phase = MigrationFailed
+		mg.Error = err.Error()
+		mg.Updated = time.Now()
+		m.mu.Unlock()
+		metrics.IncMigrations(MigrationFailed)
+		plog.Warn("cluster: migration of %s to %s failed: %v", mg.Topic, mg.To, err)
+	}
+
+	if err := m.step(mg.To, "pull", mg.Topic); err != nil {
+		fail(fmt.Errorf("target cannot pull the topic: %w", err))
+		return
+	}
+
+	m.setPhase(mg, MigrationSwitching)
+	p := Placement{Topic: mg.Topic, Node: mg.To, Home: m.cl.Self(), Created: time.Now()}
+	// the target must own the topic before anyone is sent there
+	if err := pushPlacement(m.client, m.cl.AdminAddr(mg.To, m.cfg.AdminPort), p); err != nil {
+		m.step(mg.To, "abort", mg.Topic)
+		fail(fmt.Errorf("moving ownership: %w", err))
+		return
+	}
+	m.cl.AddPlacement(p)
+	for _, peer := range m.cl.Members() {
+		if peer != mg.To && !m.cl.IsSelf(peer) {
+			go func() {
+				if err := pushPlacement(m.client, m.cl.AdminAddr(peer, m.cfg.AdminPort), p); err != nil {
+					plog.Warn("cluster: telling %s about the migration of %s failed: %v", peer, mg.Topic, err)
+				}
+			}()
+		}
+	}
+	// the target stops reading from us before we read from it
+	if err := m.step(mg.To, "cutover", mg.Topic); err != nil {
+		fail(fmt.Errorf("stopping the pull on the target: %w", err))
+		return
+	}
+
+	m.setPhase(mg, MigrationHandingOver)
+	if err := m.relay.HandOver(mg.Topic, mg.To); err != nil {
+		fail(fmt.Errorf("handing over local subscribers: %w", err))
+		return
+	}
+
+	m.setPhase(mg, MigrationAwaitingPublisher)
+	deadline := time.Now().Add(m.cfg.PublisherTimeout)
+	ticker := time.NewTicker(migrationPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if ok, err := m.published(mg.To, mg.Topic); err == nil && ok {
+			m.setPhase(mg, MigrationDone)
+			metrics.IncMigrations(MigrationDone)
+			plog.Info("cluster: topic %s migrated to %s", mg.Topic, mg.To)
+			return
+		}
+		if time.Now().After(deadline) {
+			fail(fmt.Errorf("publisher did not reconnect to %s within %s", mg.To, m.cfg.PublisherTimeout))
+			return
+		}
+	}
+}
+
+func (m *Migrator) setPhase(mg *Migration, phase string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mg.Phase = phase
+	mg.Updated = time.Now()
+}
+
+// Step runs one step of a migration started by from on this node, the
+// target: "pull", "cutover" or "abort".
+func (m *Migrator) Step(step, topicName, from string) error {
+	switch step {
+	case "pull":
+		return m.relay.PullTopic(topicName, from)
+	case "cutover":
+		return m.relay.StopPull(topicName, true)
+	case "abort":
+		return m.relay.StopPull(topicName, false)
+	}
+	return fmt.Errorf("%w: unknown step %q", ErrInvalidMigration, step)
+}
+
+// LocalPublisher reports whether topicName has a publisher on this node,
+// not counting one that only holds it during a migration.
+func (m *Migrator) LocalPublisher(topicName string) bool {
+	for _, t := range m.mgr.Status().Topics {
+		if t.Name == topicName {
+			return t.HasPublisher && !t.Standby
+		}
+	}
+	return false
+}
+
+// Migrations returns the migrations started by this node, oldest first.
+func (m *Migrator) Migrations() []Migration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Migration, 0, len(m.migrations))
+	for _, mg := range m.migrations {
+		out = append(out, *mg)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// Migrations returns the migrations started by this node, or nil when
+// migrations are disabled.
+func (c *Cluster) Migrations() []Migration {
+	c.mu.RLock()
+	m := c.migrator
+	c.mu.RUnlock()
+	if m == nil {
+		return nil
+	}
+	return m.Migrations()
+}
+
+func (m *Migrator) peerURL(node string, q url.Values) string {
+	return "http://" + m.cl.AdminAddr(node, m.cfg.AdminPort) + "/cluster/migrate?" + q.Encode()
+}
+
+// step asks the target to run a migration step.
+func (m *Migrator) step(node, step, topicName string) error {
+	q := url.Values{"topic": {topicName}, "from": {m.cl.Self()}, "step": {step}, "local": {"true"}}
+	res, err := m.client.Post(m.peerURL(node, q), "", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return peerError(res)
+	}
+	return nil
+}
+
+// published asks node whether the topic has its publisher there.
+func (m *Migrator) published(node, topicName string) (bool, error) {
+	res, err := m.client.Get(m.peerURL(node, url.Values{"topic": {topicName}, "local": {"true"}}))
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, peerError(res)
+	}
+	var st struct {
+		Publisher bool `json:"publisher"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&st); err != nil {
+		return false, err
+	}
+	return st.Publisher, nil
+}
+
+// forward starts the migration on the owner of the topic.
+func (m *Migrator) forward(owner, topicName, to string) (Migration, error) {
+	res, err := m.client.Post(m.peerURL(owner, url.Values{"topic": {topicName}, "to": {to}}), "", nil)
+	if err != nil {
+		return Migration{}, fmt.Errorf("forwarding to owner %s: %w", owner, err)
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+	case http.StatusBadRequest:
+		return Migration{}, fmt.Errorf("%w: %s: %v", ErrInvalidMigration, owner, peerError(res))
+	default:
+		return Migration{}, fmt.Errorf("forwarding to owner %s: %w", owner, peerError(res))
+	}
+	var mg Migration
+	if err := json.NewDecoder(res.Body).Decode(&mg); err != nil {
+		return Migration{}, fmt.Errorf("forwarding to owner %s: %w", owner, err)
+	}
+	return mg, nil
+}
+
+// peerError describes an unsuccessful admin response.
+func peerError(res *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	if msg := strings.TrimSpace(string(b)); msg != "" {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("unexpected status %s", res.Status)
+}
@@ -0,0 +1,111 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// fakeRelay records the hand-over on the previous owner.
+type fakeRelay struct {
+	mu       sync.Mutex
+	handover []string
+}
+
+func (r *fakeRelay) PullTopic(string, string) error { return errors.New("not the target") }
+func (r *fakeRelay) StopPull(string, bool) error    { return errors.New("not the target") }
+func (r *fakeRelay) HandOver(topic, to string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handover = append(r.handover, topic+"@"+to)
+	return nil
+}
+
+func TestMigrateTopic(t *testing.T) {
+	// the target records the steps and has the publisher after cutover
+	var mu sync.Mutex
+	var steps []string
+	var published bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		q := r.URL.Query()
+		switch {
+		case r.URL.Path == "/cluster/placements":
+			steps = append(steps, "placement:"+q.Get("node"))
+		case r.URL.Path == "/cluster/migrate" && r.Method == http.MethodPost:
+			steps = append(steps, q.Get("step")+":"+q.Get("from"))
+			published = q.Get("step") == "cutover"
+		case r.URL.Path == "/cluster/migrate":
+			json.NewEncoder(w).Encode(map[string]interface{}{"publisher": published})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewFromCSV("self,127.0.0.1", "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	if c.Migrations() != nil {
+		t.Fatalf("expected no migrations before NewMigrator")
+	}
+	name := homeTopic(t, c)
+	m := topic.NewManager(topic.Config{MaxPublishers: 10})
+	relay := &fakeRelay{}
+	mig := NewMigrator(c, m, relay, MigrateConfig{AdminPort: peerPort(t, srv.Listener.Addr().String()), PublisherTimeout: 5 * time.Second})
+	defer mig.Close()
+
+	if _, err := mig.Migrate(name, "127.0.0.1"); !errors.Is(err, ErrInvalidMigration) {
+		t.Fatalf("expected an error without a local publisher, got %v", err)
+	}
+	if err := m.RegisterPublisher(context.Background(), name, topic.NewPublisherSession("p")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	for _, to := range []string{"nope", "self"} {
+		if _, err := mig.Migrate(name, to); !errors.Is(err, ErrInvalidMigration) {
+			t.Fatalf("expected an error migrating to %s, got %v", to, err)
+		}
+	}
+
+	mg, err := mig.Migrate(name, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if mg.From != "self" || mg.To != "127.0.0.1" || mg.Phase != MigrationPulling {
+		t.Fatalf("unexpected migration %+v", mg)
+	}
+	waitFor(t, "migration to finish", func() bool {
+		ms := c.Migrations()
+		return len(ms) == 1 && ms[0].Phase == MigrationDone
+	})
+
+	if owner := c.Owner(name); owner != "127.0.0.1" {
+		t.Fatalf("ownership not moved: owner %s", owner)
+	}
+	mu.Lock()
+	got := append([]string(nil), steps...)
+	mu.Unlock()
+	want := []string{"pull:self", "placement:127.0.0.1", "cutover:self"}
+	if len(got) != len(want) {
+		t.Fatalf("target saw %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("target saw %v, want %v", got, want)
+		}
+	}
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	if len(relay.handover) != 1 || relay.handover[0] != name+"@127.0.0.1" {
+		t.Fatalf("unexpected hand-over %v", relay.handover)
+	}
+}
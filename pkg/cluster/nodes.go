@@ -0,0 +1,218 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// NodeAddr is a membership entry: how peers and clients reach a node. Empty
+// fields fall back to the defaults, i.e. the node ID as host and this node's
+// own ports, so plain node names keep working when all nodes share their
+// ports.
+type NodeAddr struct {
+	ID string `json:"id"`
+	// Host is the address peers and clients use for the node
+	Host          string   `json:"host,omitempty"`
+	PublishPort   int      `json:"publish_port,omitempty"`
+	SubscribePort int      `json:"subscribe_port,omitempty"`
+	AdminPort     int      `json:"admin_port,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+// ParseNodeAddr parses a membership entry: a node ID, optionally followed
+// by ";key=value" attributes host, publish, subscribe, admin and tags
+// (separated by "|"), e.g.
+// "rtsper2;host=10.0.0.12;publish=9291;subscribe=9292;admin=8081;tags=ssd|eu".
+func ParseNodeAddr(s string) (NodeAddr, error) {
+	fields := strings.Split(s, ";")
+	a := NodeAddr{ID: strings.TrimSpace(fields[0])}
+	if a.ID == "" || strings.Contains(a.ID, "=") {
+		return NodeAddr{}, fmt.Errorf("invalid node entry %q (want id;key=value...)", s)
+	}
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(f, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || v == "" {
+			return NodeAddr{}, fmt.Errorf("invalid attribute %q of node %s", f, a.ID)
+		}
+		var port *int
+		switch k {
+		case "host":
+			a.Host = v
+		case "publish":
+			port = &a.PublishPort
+		case "subscribe":
+			port = &a.SubscribePort
+		case "admin":
+			port = &a.AdminPort
+		case "tags":
+			for _, t := range strings.Split(v, "|") {
+				if t = strings.TrimSpace(t); t != "" {
+					a.Tags = append(a.Tags, t)
+				}
+			}
+		default:
+			return NodeAddr{}, fmt.Errorf("unknown attribute %q of node %s", k, a.ID)
+		}
+		if port != nil {
+			p, err := strconv.Atoi(v)
+			if err != nil || p <= 0 || p > 65535 {
+				return NodeAddr{}, fmt.Errorf("invalid %s port %q of node %s", k, v, a.ID)
+			}
+			*port = p
+		}
+	}
+	return a, nil
+}
+
+// String formats a in the syntax of ParseNodeAddr.
+func (a NodeAddr) String() string {
+	var b strings.Builder
+	b.WriteString(a.ID)
+	if a.Host != "" {
+		b.WriteString(";host=" + a.Host)
+	}
+	for _, p := range []struct {
+		k string
+		v int
+	}{{"publish", a.PublishPort}, {"subscribe", a.SubscribePort}, {"admin", a.AdminPort}} {
+		if p.v > 0 {
+			b.WriteString(";" + p.k + "=" + strconv.Itoa(p.v))
+		}
+	}
+	if len(a.Tags) > 0 {
+		b.WriteString(";tags=" + strings.Join(a.Tags, "|"))
+	}
+	return b.String()
+}
+
+// HasTag reports whether a carries tag.
+func (a NodeAddr) HasTag(tag string) bool {
+	for _, t := range a.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAddr sets the membership entry of a.ID. Empty fields of a keep what
+// is known about the node, so partial announcements do not erase
+// configuration.
+func (c *Cluster) SetAddr(a NodeAddr) {
+	if a.ID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setAddrLocked(a)
+}
+
+func (c *Cluster) setAddrLocked(a NodeAddr) {
+	if c.addrs == nil {
+		c.addrs = make(map[string]NodeAddr)
+	}
+	cur := c.addrs[a.ID]
+	cur.ID = a.ID
+	if a.Host != "" {
+		cur.Host = a.Host
+	}
+	if a.PublishPort > 0 {
+		cur.PublishPort = a.PublishPort
+	}
+	if a.SubscribePort > 0 {
+		cur.SubscribePort = a.SubscribePort
+	}
+	if a.AdminPort > 0 {
+		cur.AdminPort = a.AdminPort
+	}
+	if a.Tags != nil {
+		cur.Tags = append([]string(nil), a.Tags...)
+	}
+	c.addrs[a.ID] = cur
+}
+
+// SetLocalPorts records the ports this node serves on in its own entry
+// where none were configured, so that gossip announces them.
+func (c *Cluster) SetLocalPorts(publish, subscribe, admin int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a := c.addrs[c.self]
+	if a.PublishPort == 0 {
+		a.PublishPort = publish
+	}
+	if a.SubscribePort == 0 {
+		a.SubscribePort = subscribe
+	}
+	if a.AdminPort == 0 {
+		a.AdminPort = admin
+	}
+	a.ID = c.self
+	c.setAddrLocked(a)
+}
+
+// Addr returns the membership entry of node with its host filled in; ports
+// that were not configured are zero.
+func (c *Cluster) Addr(node string) NodeAddr {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	a := c.addrs[node]
+	a.ID = node
+	a.Tags = append([]string(nil), a.Tags...)
+	if a.Host == "" {
+		a.Host = node
+	}
+	return a
+}
+
+// Addrs returns the entries of all members in membership order.
+func (c *Cluster) Addrs() []NodeAddr {
+	out := make([]NodeAddr, 0)
+	for _, n := range c.Members() {
+		out = append(out, c.Addr(n))
+	}
+	return out
+}
+
+// announced returns the entry this node gossips about itself, or nil when
+// it has none.
+func (c *Cluster) announced() *NodeAddr {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	a, ok := c.addrs[c.self]
+	if !ok {
+		return nil
+	}
+	a.Tags = append([]string(nil), a.Tags...)
+	return &a
+}
+
+// PublishAddr returns host:port of node's RTSP publish listener; port is
+// used when the node's entry has none.
+func (c *Cluster) PublishAddr(node string, port int) string {
+	a := c.Addr(node)
+	return joinPort(a.Host, a.PublishPort, port)
+}
+
+// SubscribeAddr returns host:port of node's RTSP subscribe listener; port
+// is used when the node's entry has none.
+func (c *Cluster) SubscribeAddr(node string, port int) string {
+	a := c.Addr(node)
+	return joinPort(a.Host, a.SubscribePort, port)
+}
+
+// AdminAddr returns host:port of node's admin API; port is used when the
+// node's entry has none.
+func (c *Cluster) AdminAddr(node string, port int) string {
+	a := c.Addr(node)
+	return joinPort(a.Host, a.AdminPort, port)
+}
+
+func joinPort(host string, port, fallback int) string {
+	if port <= 0 {
+		port = fallback
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
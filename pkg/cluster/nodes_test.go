@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNodeAddr(t *testing.T) {
+	a, err := ParseNodeAddr("rtsper2;host=10.0.0.12;publish=9291;subscribe=9292;admin=8081;tags=ssd|eu")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := NodeAddr{ID: "rtsper2", Host: "10.0.0.12", PublishPort: 9291, SubscribePort: 9292, AdminPort: 8081, Tags: []string{"ssd", "eu"}}
+	if !reflect.DeepEqual(a, want) {
+		t.Fatalf("got %+v, want %+v", a, want)
+	}
+	if s := a.String(); s != "rtsper2;host=10.0.0.12;publish=9291;subscribe=9292;admin=8081;tags=ssd|eu" {
+		t.Fatalf("unexpected String %q", s)
+	}
+	for _, bad := range []string{"", ";host=x", "n;host", "n;publish=0", "n;admin=x", "n;color=red", "a=b"} {
+		if _, err := ParseNodeAddr(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestNodeEntries(t *testing.T) {
+	c, err := NewFromCSV("n1, n2;host=10.0.0.2;subscribe=9292;tags=ssd, n3", "n1")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	if m := c.Members(); !reflect.DeepEqual(m, []string{"n1", "n2", "n3"}) {
+		t.Fatalf("unexpected members %v", m)
+	}
+	// plain names keep using their name and this node's ports
+	if a := c.PublishAddr("n3", 9191); a != "n3:9191" {
+		t.Fatalf("unexpected publish address of n3: %s", a)
+	}
+	if a := c.PublishAddr("n2", 9191); a != "10.0.0.2:9191" {
+		t.Fatalf("unexpected publish address of n2: %s", a)
+	}
+	if a := c.SubscribeAddr("n2", 9192); a != "10.0.0.2:9292" {
+		t.Fatalf("unexpected subscribe address of n2: %s", a)
+	}
+	if h := c.Advertised("n2"); h != "10.0.0.2" {
+		t.Fatalf("unexpected advertised host of n2: %s", h)
+	}
+	c.SetAdvertised(map[string]string{"n2": "cam.example.com"})
+	if h := c.Advertised("n2"); h != "cam.example.com" {
+		t.Fatalf("advertised host does not override the entry: %s", h)
+	}
+	if !c.Addr("n2").HasTag("ssd") {
+		t.Fatal("n2 lost its tag")
+	}
+
+	// announcements fill in what is unknown without erasing configuration
+	c.SetAddr(NodeAddr{ID: "n2", AdminPort: 8081})
+	if a := c.Addr("n2"); a.Host != "10.0.0.2" || a.SubscribePort != 9292 || a.AdminPort != 8081 {
+		t.Fatalf("unexpected merged entry %+v", a)
+	}
+	c.SetLocalPorts(9191, 9192, 8080)
+	if a := c.announced(); a == nil || a.PublishPort != 9191 || a.AdminPort != 8080 {
+		t.Fatalf("unexpected own entry %+v", a)
+	}
+}
+
+func TestLocateUsesOwnerPorts(t *testing.T) {
+	c, err := NewFromCSV("n1;host=10.0.0.1;subscribe=9292;admin=8081", "n1")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	loc := c.Locate("cam1", Endpoints{PublishPort: 9191, SubscribePort: 9192, AdminPort: 8080, WebRTC: true})
+	if loc.Publish["rtsp"] != "rtsp://10.0.0.1:9191/cam1" || loc.Play["rtsp"] != "rtsp://10.0.0.1:9292/cam1" || loc.Play["whep"] != "http://10.0.0.1:8081/whep/cam1" {
+		t.Fatalf("unexpected location %+v", loc)
+	}
+}
@@ -0,0 +1,163 @@
+package cluster
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// Pin assigns a topic to a node by hand, e.g. the node with the recording
+// disk. It overrides placements and rendezvous hashing while the node is
+// eligible; otherwise the topic falls back to its usual owner.
+type Pin struct {
+	Topic string `json:"topic"`
+	Node  string `json:"node"`
+	// Owner is the effective owner of the topic
+	Owner string `json:"owner"`
+	// Fallback explains why Owner is not Node: "not a member", "draining"
+	// or "unhealthy"
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// SetPin pins topicName to node. The node need not be a member yet; the pin
+// takes effect once it joins.
+func (c *Cluster) SetPin(topicName, node string) error {
+	node = strings.TrimSpace(node)
+	if !topic.ValidName(topicName) || node == "" {
+		return fmt.Errorf("invalid pin of %q on %q", topicName, node)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pins == nil {
+		c.pins = make(map[string]string)
+	}
+	c.pins[topicName] = node
+	return nil
+}
+
+// RemovePin removes the pin of topicName; it reports whether there was one.
+func (c *Cluster) RemovePin(topicName string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.pins[topicName]
+	delete(c.pins, topicName)
+	return ok
+}
+
+// Pins returns the pins ordered by topic with their effective owners, or
+// nil when there are none.
+func (c *Cluster) Pins() []Pin {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.pins) == 0 {
+		return nil
+	}
+	out := make([]Pin, 0, len(c.pins))
+	for t, n := range c.pins {
+		p := Pin{Topic: t, Node: n, Owner: c.ownerLocked(t)}
+		if p.Owner != n {
+			p.Fallback = c.ineligibleLocked(n)
+		}
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Topic < out[j].Topic })
+	return out
+}
+
+// Pinned returns the node topicName is pinned to if the pin is in effect.
+func (c *Cluster) Pinned(topicName string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pinnedLocked(topicName)
+}
+
+func (c *Cluster) pinnedLocked(topicName string) (string, bool) {
+	n, ok := c.pins[topicName]
+	if !ok || !c.eligibleLocked(n) {
+		return "", false
+	}
+	return n, true
+}
+
+// ineligibleLocked explains why node may not own topics.
+func (c *Cluster) ineligibleLocked(node string) string {
+	_, ok := c.nodeSet[node]
+	switch {
+	case !ok:
+		return "not a member"
+	case c.draining[node]:
+		return "draining"
+	case c.unhealthy[node]:
+		return "unhealthy"
+	}
+	return ""
+}
+
+// PinSync shares pin changes with the other members through their admin
+// API, like drain state.
+type PinSync struct {
+	cl        *Cluster
+	adminPort int
+	client    *http.Client
+}
+
+// NewPinSync shares the pins of cl with the peers' admin API on adminPort.
+func NewPinSync(cl *Cluster, adminPort int) *PinSync {
+	return &PinSync{cl: cl, adminPort: adminPort, client: &http.Client{Timeout: 3 * time.Second}}
+}
+
+// Propagate sets (node != "") or removes the pin of topicName on all other
+// members and returns the result per peer ("ok" or the error).
+func (ps *PinSync) Propagate(topicName, node string) map[string]string {
+	out := make(map[string]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range ps.cl.Members() {
+		if ps.cl.IsSelf(peer) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := "ok"
+			if err := ps.callPeer(peer, topicName, node); err != nil {
+				res = err.Error()
+				plog.Warn("cluster: propagating pin of %s to %s failed: %v", topicName, peer, err)
+			}
+			mu.Lock()
+			out[peer] = res
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+func (ps *PinSync) callPeer(peer, topicName, node string) error {
+	q := url.Values{"topic": {topicName}, "local": {"true"}}
+	method := http.MethodDelete
+	if node != "" {
+		q.Set("node", node)
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, "http://"+ps.cl.AdminAddr(peer, ps.adminPort)+"/cluster/pins?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := ps.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// NodeStatus summarizes one member in a ClusterStatus.
+type NodeStatus struct {
+	Node string `json:"node"`
+	// Host and Tags come from the node's membership entry
+	Host            string   `json:"host"`
+	Tags            []string `json:"tags,omitempty"`
+	PublisherCount  int      `json:"publisher_count"`
+	Topics          int      `json:"topics"`
+	SubscriberCount int      `json:"subscriber_count"`
+	// Error is set when the node's status could not be fetched
+	Error string `json:"error,omitempty"`
+}
+
+// ClusterTopic is a topic of one member in a ClusterStatus.
+type ClusterTopic struct {
+	topic.TopicStatus
+	Node string `json:"node"`
+	// Owner is the node that should own the topic
+	Owner string `json:"owner"`
+}
+
+// ClusterStatus merges the topic status of all members.
+type ClusterStatus struct {
+	Nodes           []NodeStatus   `json:"nodes"`
+	Topics          []ClusterTopic `json:"topics"`
+	PublisherCount  int            `json:"publisher_count"`
+	SubscriberCount int            `json:"subscriber_count"`
+	// Partial is set when some nodes could not be reached
+	Partial bool `json:"partial"`
+}
+
+// StatusCollector fetches the status of all members from their admin API.
+type StatusCollector struct {
+	cl        *Cluster
+	mgr       *topic.Manager
+	adminPort int
+	client    *http.Client
+}
+
+// NewStatusCollector collects the status of the members of cl from the
+// admin API on adminPort, each request bounded by timeout (default 2s).
+func NewStatusCollector(cl *Cluster, mgr *topic.Manager, adminPort int, timeout time.Duration) *StatusCollector {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	return &StatusCollector{cl: cl, mgr: mgr, adminPort: adminPort, client: &http.Client{Timeout: timeout}}
+}
+
+// Collect fetches and merges the status of all members. Unreachable members
+// are reported with their error and leave the result partial.
+func (sc *StatusCollector) Collect(ctx context.Context) ClusterStatus {
+	members := sc.cl.Members()
+	results := make([]topic.StatusJSON, len(members))
+	errs := make([]error, len(members))
+	var wg sync.WaitGroup
+	for i, node := range members {
+		if sc.cl.IsSelf(node) {
+			results[i] = sc.mgr.Status()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = sc.fetch(ctx, node)
+		}()
+	}
+	wg.Wait()
+
+	var cs ClusterStatus
+	for i, node := range members {
+		a := sc.cl.Addr(node)
+		ns := NodeStatus{Node: node, Host: a.Host, Tags: a.Tags}
+		if errs[i] != nil {
+			ns.Error = errs[i].Error()
+			cs.Partial = true
+			cs.Nodes = append(cs.Nodes, ns)
+			continue
+		}
+		st := results[i]
+		ns.PublisherCount = st.PublisherCount
+		ns.Topics = len(st.Topics)
+		for _, t := range st.Topics {
+			ns.SubscriberCount += t.SubscriberCount
+			cs.Topics = append(cs.Topics, ClusterTopic{TopicStatus: t, Node: node, Owner: sc.cl.Owner(t.Name)})
+		}
+		cs.PublisherCount += ns.PublisherCount
+		cs.SubscriberCount += ns.SubscriberCount
+		cs.Nodes = append(cs.Nodes, ns)
+	}
+	sort.Slice(cs.Nodes, func(i, j int) bool { return cs.Nodes[i].Node < cs.Nodes[j].Node })
+	sort.Slice(cs.Topics, func(i, j int) bool {
+		if cs.Topics[i].Name != cs.Topics[j].Name {
+			return cs.Topics[i].Name < cs.Topics[j].Name
+		}
+		return cs.Topics[i].Node < cs.Topics[j].Node
+	})
+	return cs
+}
+
+func (sc *StatusCollector) fetch(ctx context.Context, node string) (topic.StatusJSON, error) {
+	var st topic.StatusJSON
+	u := "http://" + sc.cl.AdminAddr(node, sc.adminPort) + "/status"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return st, err
+	}
+	res, err := sc.client.Do(req)
+	if err != nil {
+		return st, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&st); err != nil {
+		return st, err
+	}
+	return st, nil
+}
+
+// Endpoints are the ports this node serves its protocols on. Members are
+// assumed to use the same ones unless their membership entry has others
+// (publish, subscribe and admin ports only). Zero ports are disabled.
+type Endpoints struct {
+	PublishPort   int
+	SubscribePort int
+	// RTSPHTTPPort accepts RTSP-over-HTTP tunnels for players
+	RTSPHTTPPort int
+	RTMPPort     int
+	// AdminPort serves WHIP/WHEP and WebSocket playback when enabled
+	AdminPort int
+	WebRTC    bool
+	WebSocket bool
+}
+
+// Location tells clients where a topic lives.
+type Location struct {
+	Topic string `json:"topic"`
+	Owner string `json:"owner"`
+	// Home is the rendezvous owner, which differs from Owner for pinned and
+	// placed topics
+	Home   string `json:"home"`
+	Pinned bool   `json:"pinned,omitempty"`
+	// Publish and Play map protocols to URLs on the owner's advertised host
+	Publish map[string]string `json:"publish"`
+	Play    map[string]string `json:"play"`
+}
+
+// Locate returns the owner of topicName and the URLs to publish and play it
+// there with every enabled protocol.
+func (c *Cluster) Locate(topicName string, ep Endpoints) Location {
+	owner := c.Owner(topicName)
+	_, pinned := c.Pinned(topicName)
+	loc := Location{
+		Topic:   topicName,
+		Owner:   owner,
+		Home:    c.Home(topicName),
+		Pinned:  pinned,
+		Publish: make(map[string]string),
+		Play:    make(map[string]string),
+	}
+	host := c.Advertised(owner)
+	addr := func(port int) string { return net.JoinHostPort(host, strconv.Itoa(port)) }
+	na := c.Addr(owner)
+	if ep.PublishPort > 0 {
+		loc.Publish["rtsp"] = "rtsp://" + joinPort(host, na.PublishPort, ep.PublishPort) + "/" + topicName
+	}
+	if ep.SubscribePort > 0 {
+		loc.Play["rtsp"] = "rtsp://" + joinPort(host, na.SubscribePort, ep.SubscribePort) + "/" + topicName
+	}
+	if ep.RTSPHTTPPort > 0 {
+		loc.Play["rtsp_http"] = "rtsp://" + addr(ep.RTSPHTTPPort) + "/" + topicName
+	}
+	if ep.RTMPPort > 0 {
+		loc.Publish["rtmp"] = "rtmp://" + addr(ep.RTMPPort) + "/live/" + topicName
+	}
+	admin := joinPort(host, na.AdminPort, ep.AdminPort)
+	if ep.AdminPort > 0 && ep.WebRTC {
+		loc.Publish["whip"] = "http://" + admin + "/whip/" + topicName
+		loc.Play["whep"] = "http://" + admin + "/whep/" + topicName
+	}
+	if ep.AdminPort > 0 && ep.WebSocket {
+		loc.Play["ws"] = "ws://" + admin + "/ws/" + topicName
+	}
+	return loc
+}
@@ -0,0 +1,74 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"redalf.de/rtsper/pkg/topic"
+)
+
+func TestCollectStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(topic.StatusJSON{PublisherCount: 1, Topics: []topic.TopicStatus{
+			{Name: "cam2", HasPublisher: true, SubscriberCount: 3},
+		}})
+	}))
+	defer srv.Close()
+
+	// 127.0.0.2 does not listen on the peer's port
+	c, err := NewFromCSV("self,127.0.0.1,127.0.0.2", "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	m := topic.NewManager(topic.Config{MaxPublishers: 5})
+	if err := m.RegisterPublisher(context.Background(), "cam1", topic.NewPublisherSession("p")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	sc := NewStatusCollector(c, m, peerPort(t, srv.Listener.Addr().String()), 0)
+	cs := sc.Collect(context.Background())
+
+	if !cs.Partial || cs.PublisherCount != 2 || cs.SubscriberCount != 3 {
+		t.Fatalf("unexpected totals %+v", cs)
+	}
+	if len(cs.Nodes) != 3 || cs.Nodes[1].Node != "127.0.0.2" || cs.Nodes[1].Error == "" || cs.Nodes[0].Error != "" || cs.Nodes[2].Topics != 1 {
+		t.Fatalf("unexpected nodes %+v", cs.Nodes)
+	}
+	if len(cs.Topics) != 2 || cs.Topics[0].Name != "cam1" || cs.Topics[0].Node != "self" || cs.Topics[1].Node != "127.0.0.1" || cs.Topics[1].Owner != c.Owner("cam2") {
+		t.Fatalf("unexpected topics %+v", cs.Topics)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	c, _ := NewFromCSV("n1,n2", "n1")
+	c.SetAdvertised(map[string]string{"n2": "cams.example.com"})
+	if err := c.SetPin("cam1", "n2"); err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+	loc := c.Locate("cam1", Endpoints{PublishPort: 9191, SubscribePort: 9192, RTMPPort: 1935, AdminPort: 8080, WebRTC: true})
+	if loc.Owner != "n2" || !loc.Pinned {
+		t.Fatalf("unexpected owner %+v", loc)
+	}
+	want := map[string]string{
+		"rtsp": "rtsp://cams.example.com:9191/cam1",
+		"rtmp": "rtmp://cams.example.com:1935/live/cam1",
+		"whip": "http://cams.example.com:8080/whip/cam1",
+	}
+	if len(loc.Publish) != len(want) {
+		t.Fatalf("unexpected publish URLs %v", loc.Publish)
+	}
+	for k, v := range want {
+		if loc.Publish[k] != v {
+			t.Fatalf("publish %s: got %q, want %q", k, loc.Publish[k], v)
+		}
+	}
+	if len(loc.Play) != 2 || loc.Play["rtsp"] != "rtsp://cams.example.com:9192/cam1" || loc.Play["whep"] != "http://cams.example.com:8080/whep/cam1" {
+		t.Fatalf("unexpected play URLs %v", loc.Play)
+	}
+}
@@ -0,0 +1,135 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// PeerTLS secures connections between the nodes with mutual TLS: both ends
+// present a certificate signed by the cluster CA whose identity, a DNS or
+// IP subject alternative name or the common name, is a node ID. Peers must
+// be members; a dialled peer must be the node that was meant.
+type PeerTLS struct {
+	cl    *Cluster
+	cert  tls.Certificate
+	roots *x509.CertPool
+}
+
+// LoadPeerTLS reads this node's certificate and key and the cluster CA
+// from PEM files.
+func LoadPeerTLS(cl *Cluster, certFile, keyFile, caFile string) (*PeerTLS, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cluster tls certificate: %w", err)
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("cluster tls ca: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("cluster tls ca: no certificates in %s", caFile)
+	}
+	return NewPeerTLS(cl, cert, roots)
+}
+
+// NewPeerTLS secures the connections of cl with cert, which must identify
+// this node, and the cluster CA roots.
+func NewPeerTLS(cl *Cluster, cert tls.Certificate, roots *x509.CertPool) (*PeerTLS, error) {
+	leaf := cert.Leaf
+	if leaf == nil && len(cert.Certificate) > 0 {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("cluster tls certificate: %w", err)
+		}
+	}
+	if leaf == nil {
+		return nil, errors.New("cluster tls certificate: empty")
+	}
+	if !slices.Contains(Identities(leaf), cl.Self()) {
+		return nil, fmt.Errorf("cluster tls certificate does not identify node %s (has %v)", cl.Self(), Identities(leaf))
+	}
+	return &PeerTLS{cl: cl, cert: cert, roots: roots}, nil
+}
+
+// Identities returns the node IDs a certificate may stand for.
+func Identities(cert *x509.Certificate) []string {
+	ids := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		ids = append(ids, ip.String())
+	}
+	if cert.Subject.CommonName != "" && !slices.Contains(ids, cert.Subject.CommonName) {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return ids
+}
+
+// ServerConfig accepts connections from members only.
+func (pt *PeerTLS) ServerConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{pt.cert},
+		// verified against the CA and membership in VerifyConnection
+		ClientAuth: tls.RequireAnyClientCert,
+		MinVersion: tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, err := pt.verify(cs, "")
+			return err
+		},
+	}
+}
+
+// ClientConfig connects to node, whichever address it is dialled on.
+func (pt *PeerTLS) ClientConfig(node string) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{pt.cert},
+		// the node ID is checked instead of the dialled host
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, err := pt.verify(cs, node)
+			return err
+		},
+	}
+}
+
+// Peer returns the member a verified connection comes from.
+func (pt *PeerTLS) Peer(cs tls.ConnectionState) (string, error) {
+	return pt.verify(cs, "")
+}
+
+// verify checks the peer certificate of cs against the CA and returns the
+// member it identifies: want, or any member when want is empty.
+func (pt *PeerTLS) verify(cs tls.ConnectionState, want string) (string, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return "", errors.New("no peer certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	inter := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		inter.AddCert(c)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         pt.roots,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return "", err
+	}
+	ids := Identities(leaf)
+	if want != "" {
+		if !slices.Contains(ids, want) {
+			return "", fmt.Errorf("peer certificate %v is not node %s", ids, want)
+		}
+		return want, nil
+	}
+	for _, id := range ids {
+		if pt.cl.IsMember(id) {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("peer certificate %v is not a member", ids)
+}
@@ -0,0 +1,239 @@
+// Package egress pushes topics to fixed network destinations for receivers
+// that cannot pull over RTSP.
+package egress
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// queueSize is the per-rule packet queue; packets are dropped when a
+// destination cannot keep up rather than stalling ingest.
+const queueSize = 1024
+
+// activeWindow is how recently a rule must have sent to be reported active.
+const activeWindow = 2 * time.Second
+
+// Output formats.
+const (
+	FormatRTP = "rtp"
+	FormatTS  = "ts"
+)
+
+var (
+	ErrExists   = errors.New("egress rule already exists")
+	ErrNotFound = errors.New("egress rule not found")
+	// ErrNoSDP is returned for SDP requests on MPEG-TS rules.
+	ErrNoSDP = errors.New("MPEG-TS egress has no SDP")
+)
+
+// Rule pushes a topic to a UDP destination. With the RTP format track i is
+// sent to Destination's port + 2*i (RTP) and the port above it (RTCP); with
+// the TS format all tracks are remuxed into one MPEG transport stream sent
+// to Destination.
+type Rule struct {
+	Name        string
+	Topic       string
+	Destination string
+	// Format is FormatRTP (default) or FormatTS.
+	Format string
+	// TTL and Interface apply to multicast destinations.
+	TTL       int
+	Interface string
+}
+
+// ParseRules parses comma-separated "topic/name=host:port" entries, e.g.
+// "cam1/decoder1=239.0.0.1:5004,cam2/wall=10.0.0.5:6000". A "ts://" prefix
+// on the destination selects MPEG-TS output, e.g. "cam1/stb=ts://239.1.1.1:1234".
+func ParseRules(s string) ([]Rule, error) {
+	var out []Rule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, dest, ok := strings.Cut(item, "=")
+		topicName, name, ok2 := strings.Cut(key, "/")
+		if !ok || !ok2 || dest == "" {
+			return nil, fmt.Errorf("invalid egress rule %q (want topic/name=host:port)", item)
+		}
+		format := FormatRTP
+		if d, ok := strings.CutPrefix(dest, "ts://"); ok {
+			format, dest = FormatTS, d
+		}
+		out = append(out, Rule{Name: name, Topic: topicName, Destination: dest, Format: format})
+	}
+	return out, nil
+}
+
+// Status describes an egress rule for the admin API.
+type Status struct {
+	Name        string     `json:"name"`
+	Topic       string     `json:"topic"`
+	Destination string     `json:"destination"`
+	Format      string     `json:"format"`
+	State       string     `json:"state"`
+	PacketsSent int64      `json:"packets_sent"`
+	BytesSent   int64      `json:"bytes_sent"`
+	Dropped     int64      `json:"dropped"`
+	LastSent    *time.Time `json:"last_sent,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// egressor is one running rule.
+type egressor interface {
+	tap(pkt *topic.InboundPacket)
+	status() Status
+	sdp() ([]byte, error)
+	close()
+}
+
+// Manager owns the egress rules. Rules attach to topics through packet taps,
+// so they keep running across publisher reconnects.
+type Manager struct {
+	mgr *topic.Manager
+
+	mu    sync.Mutex
+	rules map[string]*entry
+}
+
+type entry struct {
+	rule Rule
+	e    egressor
+}
+
+// NewManager creates an empty egress manager.
+func NewManager(mgr *topic.Manager) *Manager {
+	return &Manager{mgr: mgr, rules: make(map[string]*entry)}
+}
+
+func ruleKey(topicName, name string) string { return topicName + "/" + name }
+
+func tapID(name string) string { return "egress-" + name }
+
+// Add validates a rule and starts pushing.
+func (m *Manager) Add(r Rule) error {
+	if !topic.ValidName(r.Topic) || !topic.ValidName(r.Name) {
+		return fmt.Errorf("invalid egress rule %s/%s: names must match topic naming rules", r.Topic, r.Name)
+	}
+	switch r.Format {
+	case "":
+		r.Format = FormatRTP
+	case FormatRTP, FormatTS:
+	default:
+		return fmt.Errorf("egress %s/%s: unknown format %q (want rtp or ts)", r.Topic, r.Name, r.Format)
+	}
+	dest, err := net.ResolveUDPAddr("udp4", r.Destination)
+	if err != nil {
+		return fmt.Errorf("egress %s/%s: %w", r.Topic, r.Name, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := ruleKey(r.Topic, r.Name)
+	if _, ok := m.rules[key]; ok {
+		return ErrExists
+	}
+	var e egressor
+	if r.Format == FormatTS {
+		e, err = newTSEgress(m.mgr, r, dest)
+	} else {
+		e, err = newRTPEgress(m.mgr, r, dest)
+	}
+	if err != nil {
+		return fmt.Errorf("egress %s/%s: %w", r.Topic, r.Name, err)
+	}
+	m.rules[key] = &entry{rule: r, e: e}
+	m.mgr.AddTap(r.Topic, tapID(r.Name), e.tap)
+	return nil
+}
+
+// Remove stops a rule.
+func (m *Manager) Remove(topicName, name string) error {
+	m.mu.Lock()
+	ent, ok := m.rules[ruleKey(topicName, name)]
+	delete(m.rules, ruleKey(topicName, name))
+	m.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	m.mgr.RemoveTap(topicName, tapID(name))
+	ent.e.close()
+	metrics.DeleteEgress(topicName, name)
+	return nil
+}
+
+// List returns the status of all rules ordered by topic and name.
+func (m *Manager) List() []Status {
+	m.mu.Lock()
+	out := make([]Status, 0, len(m.rules))
+	for _, ent := range m.rules {
+		out = append(out, ent.e.status())
+	}
+	m.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		return ruleKey(out[i].Topic, out[i].Name) < ruleKey(out[j].Topic, out[j].Name)
+	})
+	return out
+}
+
+// SDP returns the session description receivers of a rule should use.
+func (m *Manager) SDP(topicName, name string) ([]byte, error) {
+	m.mu.Lock()
+	ent, ok := m.rules[ruleKey(topicName, name)]
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return ent.e.sdp()
+}
+
+// Close stops all rules.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	rules := m.rules
+	m.rules = make(map[string]*entry)
+	m.mu.Unlock()
+	for _, ent := range rules {
+		m.mgr.RemoveTap(ent.rule.Topic, tapID(ent.rule.Name))
+		ent.e.close()
+	}
+}
+
+// listenUDP opens the sending socket of a rule, applying the multicast TTL
+// and interface.
+func listenUDP(r Rule, dest *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	if dest.IP.IsMulticast() {
+		pc := ipv4.NewPacketConn(conn)
+		if r.TTL > 0 {
+			if err := pc.SetMulticastTTL(r.TTL); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		if r.Interface != "" {
+			ifi, err := net.InterfaceByName(r.Interface)
+			if err == nil {
+				err = pc.SetMulticastInterface(ifi)
+			}
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	}
+	return conn, nil
+}
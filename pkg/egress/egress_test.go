@@ -0,0 +1,233 @@
+package egress
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtp"
+
+	"redalf.de/rtsper/pkg/mpegts"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+func readRTP(t *testing.T, conn *net.UDPConn) *rtp.Packet {
+	t.Helper()
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var p rtp.Packet
+	if err := p.Unmarshal(buf[:n]); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	return &p
+}
+
+func publish(t *testing.T, m *topic.Manager, ssrc uint32, seq uint16, ts uint32) {
+	t.Helper()
+	raw, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: ts, SSRC: ssrc}, Payload: []byte{1, 2, 3}}).Marshal()
+	if !m.PublishPacket("cam1", &topic.InboundPacket{Track: 0, Raw: raw}) {
+		t.Fatalf("publish packet failed")
+	}
+}
+
+func TestRTPEgressSurvivesReconnect(t *testing.T) {
+	recv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer recv.Close()
+
+	m := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	em := NewManager(m)
+	defer em.Close()
+	if err := em.Add(Rule{Name: "wall", Topic: "cam1", Destination: recv.LocalAddr().String()}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := em.Add(Rule{Name: "wall", Topic: "cam1", Destination: recv.LocalAddr().String()}); err != ErrExists {
+		t.Fatalf("expected duplicate rule to fail, got %v", err)
+	}
+	if _, err := em.SDP("cam1", "wall"); err != ErrNoStream {
+		t.Fatalf("expected ErrNoStream before publishing, got %v", err)
+	}
+
+	if err := m.RegisterPublisher(context.Background(), "cam1", topic.NewPublisherSession("p1")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	m.SetTopicStream("cam1", gortsplib.NewServerStream(gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1}}))
+	publish(t, m, 1111, 100, 90000)
+	first := readRTP(t, recv)
+	publish(t, m, 1111, 101, 93000)
+	sentSecond := time.Now()
+	second := readRTP(t, recv)
+	if first.SSRC == 1111 || second.SSRC != first.SSRC || second.SequenceNumber != first.SequenceNumber+1 || second.Timestamp-first.Timestamp != 3000 {
+		t.Fatalf("unexpected rewrite: first=%d/%d second=%d/%d", first.SSRC, first.SequenceNumber, second.SSRC, second.SequenceNumber)
+	}
+
+	// a reconnecting publisher with a new SSRC and sequence continues the stream
+	m.UnregisterPublisher("cam1")
+	if err := m.RegisterPublisher(context.Background(), "cam1", topic.NewPublisherSession("p2")); err != nil {
+		t.Fatalf("re-register: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	publish(t, m, 2222, 5000, 123456789)
+	gap := time.Since(sentSecond)
+	third := readRTP(t, recv)
+	if third.SSRC != first.SSRC || third.SequenceNumber != second.SequenceNumber+1 {
+		t.Fatalf("stream not continuous after reconnect: %d/%d", third.SSRC, third.SequenceNumber)
+	}
+	// timestamps continue by the time the publisher was away
+	if d := third.Timestamp - second.Timestamp; d < 150*90 || d > uint32(gap.Milliseconds()+10)*90 {
+		t.Fatalf("timestamp jumped by %d after reconnect (%s)", d, gap)
+	}
+	publish(t, m, 2222, 5001, 123456789+3000)
+	if fourth := readRTP(t, recv); fourth.Timestamp-third.Timestamp != 3000 {
+		t.Fatalf("timestamps of the new publisher not kept relative: %d", fourth.Timestamp-third.Timestamp)
+	}
+
+	sdp, err := em.SDP("cam1", "wall")
+	if err != nil {
+		t.Fatalf("sdp: %v", err)
+	}
+	port := recv.LocalAddr().(*net.UDPAddr).Port
+	if !strings.Contains(string(sdp), "c=IN IP4 127.0.0.1") || !strings.Contains(string(sdp), "m=video "+strconv.Itoa(port)+" RTP/AVP 96") || strings.Contains(string(sdp), "control") {
+		t.Fatalf("unexpected SDP:\n%s", sdp)
+	}
+
+	st := em.List()
+	if len(st) != 1 || st[0].PacketsSent != 4 || st[0].BytesSent == 0 || st[0].State != "active" {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	if err := em.Remove("cam1", "wall"); err != nil || len(em.List()) != 0 {
+		t.Fatalf("remove failed: %v", err)
+	}
+}
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0, 0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00, 0x00, 0x03, 0x00, 0x3d, 0x08}
+	testPPS = []byte{0x68, 0xee, 0x3c, 0x80}
+)
+
+// publishH264 sets up a publisher with an H.264 track and sends a keyframe
+// followed by n-1 P frames.
+func publishH264(t *testing.T, m *topic.Manager, id string, n int) {
+	t.Helper()
+	if err := m.RegisterPublisher(context.Background(), "cam1", topic.NewPublisherSession(id)); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	track := &gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1, SPS: testSPS, PPS: testPPS}
+	m.SetTopicStream("cam1", gortsplib.NewServerStream(gortsplib.Tracks{track}))
+	enc := track.CreateEncoder()
+	for i := 0; i < n; i++ {
+		nalu := []byte{0x41, 0x9a, byte(i)}
+		if i == 0 {
+			nalu = []byte{0x65, 0x88, byte(i)}
+		}
+		pkts, err := enc.Encode([][]byte{nalu}, time.Duration(i)*40*time.Millisecond)
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		for _, p := range pkts {
+			m.WritePacketRTP("cam1", 0, p)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTSEgressSurvivesReconnect(t *testing.T) {
+	recv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer recv.Close()
+
+	m := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	em := NewManager(m)
+	defer em.Close()
+	rules, err := ParseRules("cam1/stb=ts://" + recv.LocalAddr().String())
+	if err != nil || len(rules) != 1 || rules[0].Format != FormatTS {
+		t.Fatalf("unexpected rules %+v: %v", rules, err)
+	}
+	if err := em.Add(rules[0]); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if _, err := em.SDP("cam1", "stb"); err != ErrNoSDP {
+		t.Fatalf("expected ErrNoSDP, got %v", err)
+	}
+
+	d := mpegts.NewDemuxer()
+	var pmts [][]mpegts.ElementaryStream
+	var pes []*mpegts.PES
+	d.OnPMT = func(s []mpegts.ElementaryStream) { pmts = append(pmts, s) }
+	d.OnPES = func(p *mpegts.PES) {
+		cp := *p
+		cp.Data = append([]byte(nil), p.Data...)
+		pes = append(pes, &cp)
+	}
+	receive := func(want int) {
+		t.Helper()
+		buf := make([]byte, 2048)
+		for len(pes) < want {
+			recv.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := recv.Read(buf)
+			if err != nil {
+				t.Fatalf("read after %d PES: %v", len(pes), err)
+			}
+			if n%mpegts.PacketSize != 0 {
+				t.Fatalf("datagram of %d bytes is not whole packets", n)
+			}
+			if err := d.Feed(buf[:n], time.Now()); err != nil {
+				t.Fatalf("feed: %v", err)
+			}
+		}
+	}
+
+	// a PES is complete once the next one starts
+	publishH264(t, m, "p1", 4)
+	receive(3)
+	if len(pmts) != 1 || len(pmts[0]) != 1 || pmts[0][0].Type != mpegts.StreamTypeH264 {
+		t.Fatalf("unexpected PMT %+v", pmts)
+	}
+	if !bytes.Contains(pes[0].Data, testSPS) || !bytes.Contains(pes[0].Data, []byte{0x65, 0x88, 0}) {
+		t.Fatalf("first PES is not a keyframe with parameters")
+	}
+	lastPTS := pes[2].PTS
+
+	m.UnregisterPublisher("cam1")
+	publishH264(t, m, "p2", 3)
+	receive(5)
+	if len(pmts) != 2 {
+		t.Fatalf("expected a new PMT version after reconnect, got %d", len(pmts))
+	}
+	if d.ContinuityErrors() != 0 {
+		t.Fatalf("unexpected continuity errors: %d", d.ContinuityErrors())
+	}
+	if mpegts.PTSDiff(pes[4].PTS, lastPTS) <= 0 {
+		t.Fatalf("clock went back after reconnect: %d -> %d", lastPTS, pes[4].PTS)
+	}
+
+	st := em.List()
+	if len(st) != 1 || st[0].Format != FormatTS || st[0].PacketsSent == 0 || st[0].State != "active" {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestTSTimestampAfterLongRuns(t *testing.T) {
+	e := &tsEgress{startWall: time.Now(), startTS: tsStartTime}
+	tr := &tsTrack{synced: true}
+	// int64 nanoseconds times 90 kHz overflows after about 28.5h
+	for _, d := range []time.Duration{time.Second, 31 * time.Hour, 1000*time.Hour + 500*time.Millisecond} {
+		want := tsStartTime + int64(d/time.Second)*90000 + int64(d%time.Second)/(int64(time.Second)/90000)
+		if got := e.timestamp(tr, d); got != want {
+			t.Fatalf("timestamp after %s = %d, want %d", d, got, want)
+		}
+	}
+}
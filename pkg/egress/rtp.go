@@ -0,0 +1,310 @@
+package egress
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	psdp "github.com/pion/sdp/v3"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// ErrNoStream is returned for SDP requests before the topic ever had a
+// publisher.
+var ErrNoStream = errors.New("topic has no stream yet")
+
+// rtpTrack keeps the outgoing SSRC, sequence numbers and timestamps
+// stable across publisher reconnects, so receivers see a single continuous
+// stream.
+type rtpTrack struct {
+	ssrc    uint32
+	srcSSRC uint32
+	lastSeq uint16
+	outSeq  uint16
+	// tsOffset is added to the publisher's timestamps; lastTS is the last
+	// timestamp sent, at lastTime
+	tsOffset uint32
+	lastTS   uint32
+	lastTime time.Time
+	started  bool
+}
+
+// rtpEgress forwards a topic's RTP/RTCP to a UDP destination.
+type rtpEgress struct {
+	mgr  *topic.Manager
+	rule Rule
+	dest *net.UDPAddr
+	conn *net.UDPConn
+
+	ch        chan *topic.InboundPacket
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	// tracks is only used by the send loop
+	tracks map[int]*rtpTrack
+
+	packets  atomic.Int64
+	bytes    atomic.Int64
+	dropped  atomic.Int64
+	lastSent atomic.Int64 // unix nanoseconds
+	lastErr  atomic.Value // string
+
+	sdpMu   sync.Mutex
+	lastSDP []byte
+}
+
+func newRTPEgress(mgr *topic.Manager, r Rule, dest *net.UDPAddr) (*rtpEgress, error) {
+	conn, err := listenUDP(r, dest)
+	if err != nil {
+		return nil, err
+	}
+	e := &rtpEgress{
+		mgr:    mgr,
+		rule:   r,
+		dest:   dest,
+		conn:   conn,
+		ch:     make(chan *topic.InboundPacket, queueSize),
+		done:   make(chan struct{}),
+		tracks: make(map[int]*rtpTrack),
+	}
+	e.lastErr.Store("")
+	e.wg.Add(1)
+	go e.run()
+	plog.Info("egress: %s/%s pushing RTP to %s", r.Topic, r.Name, dest)
+	return e, nil
+}
+
+// tap is the topic packet tap; it never blocks.
+func (e *rtpEgress) tap(pkt *topic.InboundPacket) {
+	select {
+	case e.ch <- pkt:
+	default:
+		e.dropped.Add(1)
+		metrics.IncEgressDropped(e.rule.Topic, e.rule.Name)
+	}
+}
+
+func (e *rtpEgress) run() {
+	defer e.wg.Done()
+	for {
+		select {
+		case pkt := <-e.ch:
+			e.send(pkt)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *rtpEgress) send(pkt *topic.InboundPacket) {
+	port := e.dest.Port + 2*pkt.Track
+	var buf []byte
+	if pkt.RTCP {
+		buf = e.rewriteRTCP(pkt)
+		port++
+	} else {
+		buf = e.rewriteRTP(pkt)
+	}
+	if buf == nil {
+		return
+	}
+	if _, err := e.conn.WriteToUDP(buf, &net.UDPAddr{IP: e.dest.IP, Port: port}); err != nil {
+		e.dropped.Add(1)
+		e.lastErr.Store(err.Error())
+		metrics.IncEgressDropped(e.rule.Topic, e.rule.Name)
+		return
+	}
+	e.packets.Add(1)
+	e.bytes.Add(int64(len(buf)))
+	e.lastSent.Store(time.Now().UnixNano())
+	metrics.AddEgressSent(e.rule.Topic, e.rule.Name, len(buf))
+}
+
+func (e *rtpEgress) rewriteRTP(pkt *topic.InboundPacket) []byte {
+	var p rtp.Packet
+	if err := p.Unmarshal(pkt.Raw); err != nil {
+		return nil
+	}
+	t, ok := e.tracks[pkt.Track]
+	if !ok {
+		t = &rtpTrack{ssrc: rand.Uint32(), outSeq: uint16(rand.Uint32())}
+		e.tracks[pkt.Track] = t
+	}
+	switch {
+	case !t.started || p.SSRC != t.srcSSRC:
+		// new publisher: continue our own numbering, and our timestamps
+		// from the last one sent plus the time that passed since
+		if t.started {
+			elapsed := uint32(clockTicks(time.Since(t.lastTime), e.clockRate(pkt.Track)))
+			t.tsOffset = t.lastTS + elapsed - p.Timestamp
+		}
+		t.srcSSRC = p.SSRC
+		e.refreshSDP()
+		t.outSeq++
+		t.started = true
+	default:
+		t.outSeq += p.SequenceNumber - t.lastSeq
+	}
+	t.lastSeq = p.SequenceNumber
+	p.SSRC = t.ssrc
+	p.SequenceNumber = t.outSeq
+	p.Timestamp += t.tsOffset
+	t.lastTS, t.lastTime = p.Timestamp, time.Now()
+	b, err := p.Marshal()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// clockRate returns the RTP clock rate of a track of the topic, 90 kHz when
+// it is not known.
+func (e *rtpEgress) clockRate(track int) int {
+	if st := e.mgr.GetTopicStream(e.rule.Topic); st != nil {
+		if tracks := st.Tracks(); track < len(tracks) && tracks[track].ClockRate() > 0 {
+			return tracks[track].ClockRate()
+		}
+	}
+	return 90000
+}
+
+// clockTicks converts d to units of a clock rate. Whole seconds and the
+// rest are scaled separately, so that long durations do not overflow.
+func clockTicks(d time.Duration, rate int) int64 {
+	sec, rem := int64(d/time.Second), int64(d%time.Second)
+	return sec*int64(rate) + rem*int64(rate)/int64(time.Second)
+}
+
+// rewriteRTCP forwards the publisher's sender reports under the outgoing
+// SSRC; other RTCP is specific to the publisher's session and dropped.
+func (e *rtpEgress) rewriteRTCP(pkt *topic.InboundPacket) []byte {
+	t, ok := e.tracks[pkt.Track]
+	if !ok || !t.started {
+		return nil
+	}
+	pkts, err := rtcp.Unmarshal(pkt.Raw)
+	if err != nil {
+		return nil
+	}
+	for _, p := range pkts {
+		if sr, ok := p.(*rtcp.SenderReport); ok && sr.SSRC == t.srcSSRC {
+			out := *sr
+			out.SSRC = t.ssrc
+			out.RTPTime += t.tsOffset
+			out.Reports = nil
+			b, err := out.Marshal()
+			if err != nil {
+				return nil
+			}
+			return b
+		}
+	}
+	return nil
+}
+
+// refreshSDP rebuilds the description from the topic's current tracks. The
+// last description is kept so that receivers can still fetch it while the
+// publisher is reconnecting.
+func (e *rtpEgress) refreshSDP() {
+	st := e.mgr.GetTopicStream(e.rule.Topic)
+	if st == nil {
+		return
+	}
+	b, err := buildSDP(e.rule, e.dest, st.Tracks())
+	if err != nil {
+		plog.Warn("egress: %s/%s: build SDP: %v", e.rule.Topic, e.rule.Name, err)
+		return
+	}
+	e.sdpMu.Lock()
+	e.lastSDP = b
+	e.sdpMu.Unlock()
+}
+
+// sdp describes the pushed session.
+func (e *rtpEgress) sdp() ([]byte, error) {
+	e.refreshSDP()
+	e.sdpMu.Lock()
+	defer e.sdpMu.Unlock()
+	if e.lastSDP == nil {
+		return nil, ErrNoStream
+	}
+	return e.lastSDP, nil
+}
+
+func buildSDP(r Rule, dest *net.UDPAddr, tracks gortsplib.Tracks) ([]byte, error) {
+	addr := &psdp.Address{Address: dest.IP.String()}
+	if dest.IP.IsMulticast() {
+		ttl := r.TTL
+		if ttl <= 0 {
+			ttl = 1
+		}
+		addr.TTL = &ttl
+	}
+	sd := &psdp.SessionDescription{
+		Origin: psdp.Origin{
+			Username:       "-",
+			SessionID:      0,
+			SessionVersion: 0,
+			NetworkType:    "IN",
+			AddressType:    "IP4",
+			UnicastAddress: "0.0.0.0",
+		},
+		SessionName:           psdp.SessionName("rtsper " + r.Topic + "/" + r.Name),
+		ConnectionInformation: &psdp.ConnectionInformation{NetworkType: "IN", AddressType: "IP4", Address: addr},
+		TimeDescriptions:      []psdp.TimeDescription{{Timing: psdp.Timing{}}},
+	}
+	for i, t := range tracks {
+		md := t.MediaDescription()
+		md.MediaName.Port = psdp.RangedPort{Value: dest.Port + 2*i}
+		attrs := md.Attributes[:0]
+		for _, a := range md.Attributes {
+			if a.Key != "control" {
+				attrs = append(attrs, a)
+			}
+		}
+		md.Attributes = attrs
+		sd.MediaDescriptions = append(sd.MediaDescriptions, md)
+	}
+	return sd.Marshal()
+}
+
+func (e *rtpEgress) status() Status {
+	st := Status{
+		Name:        e.rule.Name,
+		Topic:       e.rule.Topic,
+		Destination: e.dest.String(),
+		Format:      FormatRTP,
+		State:       "idle",
+		PacketsSent: e.packets.Load(),
+		BytesSent:   e.bytes.Load(),
+		Dropped:     e.dropped.Load(),
+		LastError:   e.lastErr.Load().(string),
+	}
+	if ns := e.lastSent.Load(); ns != 0 {
+		last := time.Unix(0, ns)
+		st.LastSent = &last
+		if time.Since(last) < activeWindow {
+			st.State = "active"
+		}
+	}
+	return st
+}
+
+func (e *rtpEgress) close() {
+	e.closeOnce.Do(func() {
+		close(e.done)
+		e.wg.Wait()
+		e.conn.Close()
+		plog.Info("egress: %s/%s stopped", e.rule.Topic, e.rule.Name)
+	})
+}
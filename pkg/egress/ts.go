@@ -0,0 +1,439 @@
+package egress
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/h264"
+	"github.com/aler9/gortsplib/pkg/mpeg4audio"
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtph264"
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtph265"
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtpmpeg4audio"
+	"github.com/pion/rtp"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/mpegts"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// tsPacketsPerDatagram is the usual 7 x 188 bytes that fit an Ethernet MTU.
+const tsPacketsPerDatagram = 7
+
+// tsFlushInterval is how long packets may wait for a datagram to fill up.
+const tsFlushInterval = 10 * time.Millisecond
+
+// tsFirstPID is the PID of the first elementary stream.
+const tsFirstPID = 0x100
+
+// tsStartTime is where the output clock starts; tsRestartGap is how far it
+// jumps ahead when a new publisher takes over, so timestamps never go back.
+const (
+	tsStartTime  = 90000
+	tsRestartGap = 9000
+)
+
+// H.265 NAL unit types used when remuxing.
+const (
+	h265NALUTypeVPS = 32
+	h265NALUTypeSPS = 33
+	h265NALUTypePPS = 34
+	h265NALUTypeAUD = 35
+)
+
+var (
+	h264AUD = []byte{0x09, 0xf0}
+	h265AUD = []byte{h265NALUTypeAUD << 1, 0x01, 0x50}
+)
+
+// tsTrack remuxes one track of the topic stream into an elementary stream.
+type tsTrack struct {
+	pid uint16
+
+	h264    *gortsplib.TrackH264
+	h264Dec *rtph264.Decoder
+	dtsExt  *h264.DTSExtractor
+
+	h265    *gortsplib.TrackH265
+	h265Dec *rtph265.Decoder
+	// NAL units of the H.265 access unit being collected
+	h265AU  [][]byte
+	h265PTS time.Duration
+
+	aac    *gortsplib.TrackMPEG4Audio
+	aacDec *rtpmpeg4audio.Decoder
+
+	// offset maps the track's timestamps onto the time since the output
+	// (re)started; tracks have independent RTP clocks, so they are lined up
+	// on arrival
+	offset time.Duration
+	synced bool
+}
+
+func (t *tsTrack) video() bool { return t.h264 != nil || t.h265 != nil }
+
+// tsEgress remuxes a topic into an MPEG transport stream sent to a UDP
+// destination. PIDs, continuity counters and the clock carry on across
+// publisher reconnects so set-top boxes keep playing.
+type tsEgress struct {
+	mgr  *topic.Manager
+	rule Rule
+	dest *net.UDPAddr
+	conn *net.UDPConn
+
+	ch        chan *topic.InboundPacket
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	// owned by run
+	stream    *gortsplib.ServerStream
+	tracks    map[int]*tsTrack
+	hasVideo  bool
+	mux       *mpegts.Muxer
+	out       []byte
+	started   bool
+	startWall time.Time
+	startTS   int64
+	lastTS    int64
+
+	packets  atomic.Int64
+	bytes    atomic.Int64
+	dropped  atomic.Int64
+	lastSent atomic.Int64 // unix nanoseconds
+	lastErr  atomic.Value // string
+}
+
+func newTSEgress(mgr *topic.Manager, r Rule, dest *net.UDPAddr) (*tsEgress, error) {
+	conn, err := listenUDP(r, dest)
+	if err != nil {
+		return nil, err
+	}
+	e := &tsEgress{
+		mgr:    mgr,
+		rule:   r,
+		dest:   dest,
+		conn:   conn,
+		ch:     make(chan *topic.InboundPacket, queueSize),
+		done:   make(chan struct{}),
+		out:    make([]byte, 0, tsPacketsPerDatagram*mpegts.PacketSize),
+		lastTS: tsStartTime - tsRestartGap,
+	}
+	e.mux = mpegts.NewMuxer(tsWriter{e})
+	e.lastErr.Store("")
+	e.wg.Add(1)
+	go e.run()
+	plog.Info("egress: %s/%s pushing MPEG-TS to %s", r.Topic, r.Name, dest)
+	return e, nil
+}
+
+// tsWriter collects muxer packets into datagrams.
+type tsWriter struct{ e *tsEgress }
+
+func (w tsWriter) Write(p []byte) (int, error) {
+	w.e.out = append(w.e.out, p...)
+	if len(w.e.out) >= tsPacketsPerDatagram*mpegts.PacketSize {
+		w.e.flush()
+	}
+	return len(p), nil
+}
+
+// tap is the topic packet tap; it never blocks.
+func (e *tsEgress) tap(pkt *topic.InboundPacket) {
+	select {
+	case e.ch <- pkt:
+	default:
+		e.dropped.Add(1)
+		metrics.IncEgressDropped(e.rule.Topic, e.rule.Name)
+	}
+}
+
+func (e *tsEgress) run() {
+	defer e.wg.Done()
+	// full datagrams are sent by tsWriter, the rest on the ticker
+	ticker := time.NewTicker(tsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case pkt := <-e.ch:
+			if !pkt.RTCP {
+				e.handle(pkt)
+			}
+		case <-ticker.C:
+			e.flush()
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *tsEgress) handle(pkt *topic.InboundPacket) {
+	if st := e.mgr.GetTopicStream(e.rule.Topic); st != e.stream {
+		if st == nil {
+			return
+		}
+		e.setStream(st)
+	}
+	t, ok := e.tracks[pkt.Track]
+	if !ok {
+		return
+	}
+	var p rtp.Packet
+	if err := p.Unmarshal(pkt.Raw); err != nil {
+		return
+	}
+	switch {
+	case t.h264 != nil:
+		e.onH264(t, &p)
+	case t.h265 != nil:
+		e.onH265(t, &p)
+	case t.aac != nil:
+		e.onAAC(t, &p)
+	}
+}
+
+// setStream switches to a new publisher's tracks. The program is rebuilt,
+// while the muxer keeps its continuity counters and the clock continues
+// from the last timestamp sent.
+func (e *tsEgress) setStream(st *gortsplib.ServerStream) {
+	e.stream = st
+	e.tracks = make(map[int]*tsTrack)
+	e.hasVideo = false
+	var streams []mpegts.ElementaryStream
+	for i, tr := range st.Tracks() {
+		t := &tsTrack{pid: tsFirstPID + uint16(len(streams))}
+		var typ uint8
+		switch tt := tr.(type) {
+		case *gortsplib.TrackH264:
+			t.h264, t.h264Dec, t.dtsExt = tt, tt.CreateDecoder(), h264.NewDTSExtractor()
+			typ = mpegts.StreamTypeH264
+		case *gortsplib.TrackH265:
+			t.h265, t.h265Dec = tt, tt.CreateDecoder()
+			typ = mpegts.StreamTypeH265
+		case *gortsplib.TrackMPEG4Audio:
+			t.aac, t.aacDec = tt, tt.CreateDecoder()
+			typ = mpegts.StreamTypeAAC
+		default:
+			plog.Debug("egress: %s/%s: skipping %s track, not supported in MPEG-TS", e.rule.Topic, e.rule.Name, tr)
+			continue
+		}
+		e.hasVideo = e.hasVideo || t.video()
+		e.tracks[i] = t
+		streams = append(streams, mpegts.ElementaryStream{PID: t.pid, Type: typ})
+	}
+	e.mux.SetStreams(streams)
+	e.started = false
+	plog.Info("egress: %s/%s: remuxing %d tracks", e.rule.Topic, e.rule.Name, len(streams))
+}
+
+// start begins output on the first keyframe (or audio frame for audio-only
+// topics), continuing the clock after what was sent before.
+func (e *tsEgress) start() {
+	e.started = true
+	e.startWall = time.Now()
+	e.startTS = e.lastTS + tsRestartGap
+	for _, t := range e.tracks {
+		t.synced = false
+	}
+}
+
+// timestamp converts a track time to the 90 kHz output clock.
+func (e *tsEgress) timestamp(t *tsTrack, d time.Duration) int64 {
+	if !t.synced {
+		t.offset = time.Since(e.startWall) - d
+		t.synced = true
+	}
+	return e.startTS + clockTicks(d+t.offset, 90000)
+}
+
+func (e *tsEgress) onH264(t *tsTrack, p *rtp.Packet) {
+	nalus, pts, err := t.h264Dec.DecodeUntilMarker(p)
+	if err != nil {
+		return
+	}
+	idr := h264.IDRPresent(nalus)
+	filtered := make([][]byte, 0, len(nalus)+3)
+	filtered = append(filtered, h264AUD)
+	hasParams := false
+	for _, n := range nalus {
+		switch h264.NALUType(n[0] & 0x1f) {
+		case h264.NALUTypeSPS, h264.NALUTypePPS:
+			hasParams = true
+		case h264.NALUTypeAccessUnitDelimiter:
+			continue
+		}
+		filtered = append(filtered, n)
+	}
+	if idr && !hasParams {
+		// receivers tune in at keyframes, which need the parameters in-band
+		sps, pps := t.h264.SafeSPS(), t.h264.SafePPS()
+		if sps == nil || pps == nil {
+			return
+		}
+		filtered = append([][]byte{h264AUD, sps, pps}, filtered[1:]...)
+	}
+	if !e.started {
+		if !idr {
+			return
+		}
+		e.start()
+	}
+	dts, err := t.dtsExt.Extract(filtered, pts)
+	if err != nil {
+		plog.Debug("egress: %s/%s: %v", e.rule.Topic, e.rule.Name, err)
+		return
+	}
+	data, err := h264.AnnexBMarshal(filtered)
+	if err != nil {
+		return
+	}
+	e.writePES(t, e.timestamp(t, pts), e.timestamp(t, dts), idr, data)
+}
+
+func (e *tsEgress) onH265(t *tsTrack, p *rtp.Packet) {
+	nalus, pts, err := t.h265Dec.Decode(p)
+	if err != nil {
+		return
+	}
+	if len(t.h265AU) > 0 && pts != t.h265PTS {
+		// the marker of the previous access unit was lost
+		t.h265AU = t.h265AU[:0]
+	}
+	t.h265AU = append(t.h265AU, nalus...)
+	t.h265PTS = pts
+	if !p.Marker {
+		return
+	}
+	nalus, t.h265AU = t.h265AU, nil
+
+	irap, hasParams := false, false
+	filtered := make([][]byte, 0, len(nalus)+4)
+	filtered = append(filtered, h265AUD)
+	for _, n := range nalus {
+		if len(n) < 2 {
+			continue
+		}
+		switch typ := (n[0] >> 1) & 0x3f; {
+		case typ == h265NALUTypeVPS || typ == h265NALUTypeSPS || typ == h265NALUTypePPS:
+			hasParams = true
+		case typ == h265NALUTypeAUD:
+			continue
+		case typ >= 16 && typ <= 21:
+			irap = true
+		}
+		filtered = append(filtered, n)
+	}
+	if irap && !hasParams {
+		vps, sps, pps := t.h265.SafeVPS(), t.h265.SafeSPS(), t.h265.SafePPS()
+		if vps == nil || sps == nil || pps == nil {
+			return
+		}
+		filtered = append([][]byte{h265AUD, vps, sps, pps}, filtered[1:]...)
+	}
+	if !e.started {
+		if !irap {
+			return
+		}
+		e.start()
+	}
+	data, err := h264.AnnexBMarshal(filtered)
+	if err != nil {
+		return
+	}
+	// without parsing the slice headers the decode order is unknown; DTS
+	// equal to PTS suits streams without B-frames
+	ts := e.timestamp(t, pts)
+	e.writePES(t, ts, ts, irap, data)
+}
+
+func (e *tsEgress) onAAC(t *tsTrack, p *rtp.Packet) {
+	aus, pts, err := t.aacDec.Decode(p)
+	if err != nil {
+		return
+	}
+	if !e.started {
+		if e.hasVideo {
+			return
+		}
+		e.start()
+	}
+	cfg := t.aac.Config
+	pkts := make(mpeg4audio.ADTSPackets, len(aus))
+	for i, au := range aus {
+		pkts[i] = &mpeg4audio.ADTSPacket{Type: cfg.Type, SampleRate: cfg.SampleRate, ChannelCount: cfg.ChannelCount, AU: au}
+	}
+	data, err := pkts.Marshal()
+	if err != nil {
+		return
+	}
+	ts := e.timestamp(t, pts)
+	e.writePES(t, ts, ts, true, data)
+}
+
+func (e *tsEgress) writePES(t *tsTrack, pts, dts int64, randomAccess bool, data []byte) {
+	if err := e.mux.WritePES(t.pid, pts, dts, randomAccess, data); err != nil {
+		e.lastErr.Store(err.Error())
+		return
+	}
+	if dts > e.lastTS {
+		e.lastTS = dts
+	}
+}
+
+// flush sends the collected packets as one datagram.
+func (e *tsEgress) flush() {
+	if len(e.out) == 0 {
+		return
+	}
+	defer func() { e.out = e.out[:0] }()
+	if _, err := e.conn.WriteToUDP(e.out, e.dest); err != nil {
+		e.dropped.Add(1)
+		e.lastErr.Store(err.Error())
+		metrics.IncEgressDropped(e.rule.Topic, e.rule.Name)
+		return
+	}
+	e.packets.Add(1)
+	e.bytes.Add(int64(len(e.out)))
+	e.lastSent.Store(time.Now().UnixNano())
+	metrics.AddEgressSent(e.rule.Topic, e.rule.Name, len(e.out))
+}
+
+// sdp is not available: receivers of a transport stream only need the
+// address.
+func (e *tsEgress) sdp() ([]byte, error) {
+	return nil, ErrNoSDP
+}
+
+func (e *tsEgress) status() Status {
+	st := Status{
+		Name:        e.rule.Name,
+		Topic:       e.rule.Topic,
+		Destination: e.dest.String(),
+		Format:      FormatTS,
+		State:       "idle",
+		PacketsSent: e.packets.Load(),
+		BytesSent:   e.bytes.Load(),
+		Dropped:     e.dropped.Load(),
+		LastError:   e.lastErr.Load().(string),
+	}
+	if ns := e.lastSent.Load(); ns != 0 {
+		last := time.Unix(0, ns)
+		st.LastSent = &last
+		if time.Since(last) < activeWindow {
+			st.State = "active"
+		}
+	}
+	return st
+}
+
+func (e *tsEgress) close() {
+	e.closeOnce.Do(func() {
+		close(e.done)
+		e.wg.Wait()
+		e.conn.Close()
+		plog.Info("egress: %s/%s stopped", e.rule.Topic, e.rule.Name)
+	})
+}
@@ -0,0 +1,245 @@
+// Package fmp4 writes fragmented MP4 (ISO BMFF) as used by Media Source
+// Extensions: an init segment (ftyp+moov) followed by moof+mdat fragments.
+package fmp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/aler9/gortsplib/pkg/h264"
+	"github.com/aler9/gortsplib/pkg/mpeg4audio"
+)
+
+// sample flags (ISO/IEC 14496-12 8.8.3.1)
+const (
+	flagsSync    = 0x02000000 // sample_depends_on=2 (I-frame)
+	flagsNonSync = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample
+)
+
+// Track describes one track of the init segment. Exactly one of H264 and
+// MPEG4Audio is set.
+type Track struct {
+	ID        int
+	TimeScale uint32
+
+	H264       *H264Config
+	MPEG4Audio *mpeg4audio.Config
+}
+
+// H264Config carries the parameter sets of an H.264 track.
+type H264Config struct {
+	SPS []byte
+	PPS []byte
+}
+
+// Codec returns the RFC 6381 codecs parameter of the track, e.g.
+// "avc1.64001f" or "mp4a.40.2".
+func (t *Track) Codec() string {
+	switch {
+	case t.H264 != nil && len(t.H264.SPS) >= 4:
+		return fmt.Sprintf("avc1.%02x%02x%02x", t.H264.SPS[1], t.H264.SPS[2], t.H264.SPS[3])
+	case t.MPEG4Audio != nil:
+		return fmt.Sprintf("mp4a.40.%d", t.MPEG4Audio.Type)
+	}
+	return ""
+}
+
+// Sample is one access unit of a fragment. Video samples are AVCC encoded
+// (4-byte length prefixed NAL units).
+type Sample struct {
+	Duration  uint32
+	PTSOffset int32
+	IsSync    bool
+	Data      []byte
+}
+
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	out := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(out, uint32(size))
+	copy(out[4:], typ)
+	for _, p := range payload {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func fullBox(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	hdr := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{hdr}, payload...)...)
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// unity transformation matrix
+var matrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+// Init builds the init segment for the given tracks.
+func Init(tracks []*Track) ([]byte, error) {
+	if len(tracks) == 0 {
+		return nil, errors.New("no tracks")
+	}
+	ftyp := box("ftyp", []byte("iso5"), u32(1), []byte("iso5iso6mp41"))
+
+	nextID := 0
+	var traks, trexs [][]byte
+	for _, t := range tracks {
+		trak, err := t.trak()
+		if err != nil {
+			return nil, err
+		}
+		traks = append(traks, trak)
+		trexs = append(trexs, fullBox("trex", 0, 0, u32(uint32(t.ID)), u32(1), u32(0), u32(0), u32(0)))
+		nextID = max(nextID, t.ID+1)
+	}
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(1000), u32(0), // times, timescale, duration
+		u32(0x00010000), u16(0x0100), make([]byte, 10), // rate, volume, reserved
+		matrix, make([]byte, 24), u32(uint32(nextID)))
+	moov := box("moov", append([][]byte{mvhd}, append(traks, box("mvex", trexs...))...)...)
+	return append(ftyp, moov...), nil
+}
+
+func (t *Track) trak() ([]byte, error) {
+	var (
+		width, height int
+		handler, name string
+		mediaHeader   []byte
+		entry         []byte
+		volume        uint16
+	)
+	switch {
+	case t.H264 != nil:
+		var sps h264.SPS
+		if err := sps.Unmarshal(t.H264.SPS); err != nil {
+			return nil, fmt.Errorf("track %d: invalid SPS: %w", t.ID, err)
+		}
+		width, height = sps.Width(), sps.Height()
+		handler, name = "vide", "VideoHandler"
+		mediaHeader = fullBox("vmhd", 0, 1, make([]byte, 8))
+		entry = t.avc1(width, height)
+	case t.MPEG4Audio != nil:
+		handler, name = "soun", "SoundHandler"
+		mediaHeader = fullBox("smhd", 0, 0, make([]byte, 4))
+		volume = 0x0100
+		var err error
+		if entry, err = t.mp4a(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("track %d: unsupported codec", t.ID)
+	}
+
+	tkhd := fullBox("tkhd", 0, 3,
+		u32(0), u32(0), u32(uint32(t.ID)), u32(0), u32(0), // times, id, reserved, duration
+		make([]byte, 8), u16(0), u16(0), u16(volume), u16(0), // reserved, layer, group, volume, reserved
+		matrix, u32(uint32(width)<<16), u32(uint32(height)<<16))
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(t.TimeScale), u32(0), u16(0x55c4), u16(0)) // language "und"
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), []byte(name), []byte{0})
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), entry),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)))
+	mdia := box("mdia", mdhd, hdlr, box("minf", mediaHeader, dinf, stbl))
+	return box("trak", tkhd, mdia), nil
+}
+
+func (t *Track) avc1(width, height int) []byte {
+	sps, pps := t.H264.SPS, t.H264.PPS
+	avcC := box("avcC",
+		[]byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1}, // version, profile, compat, level, 4-byte lengths, 1 SPS
+		u16(uint16(len(sps))), sps,
+		[]byte{1}, u16(uint16(len(pps))), pps)
+	return box("avc1",
+		make([]byte, 6), u16(1), // reserved, data_reference_index
+		make([]byte, 16), u16(uint16(width)), u16(uint16(height)),
+		u32(0x00480000), u32(0x00480000), u32(0), u16(1), // resolution, reserved, frame_count
+		make([]byte, 32), u16(0x0018), u16(0xffff), // compressorname, depth, pre_defined
+		avcC)
+}
+
+func (t *Track) mp4a() ([]byte, error) {
+	asc, err := t.MPEG4Audio.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("track %d: %w", t.ID, err)
+	}
+	dsi := descriptor(0x05, asc)
+	dcd := descriptor(0x04, []byte{0x40, 0x15, 0, 0, 0}, u32(0), u32(0), dsi) // AAC, audio stream
+	es := descriptor(0x03, u16(uint16(t.ID)), []byte{0}, dcd, descriptor(0x06, []byte{0x02}))
+	rate := uint32(t.MPEG4Audio.SampleRate)
+	if rate > 0xffff {
+		rate = 0
+	}
+	return box("mp4a",
+		make([]byte, 6), u16(1), make([]byte, 8), // reserved, data_reference_index, reserved
+		u16(uint16(t.MPEG4Audio.ChannelCount)), u16(16), u16(0), u16(0),
+		u32(rate<<16),
+		fullBox("esds", 0, 0, es)), nil
+}
+
+// descriptor writes an MPEG-4 descriptor with a 4-byte size field.
+func descriptor(tag byte, payload ...[]byte) []byte {
+	size := 0
+	for _, p := range payload {
+		size += len(p)
+	}
+	out := []byte{tag, 0x80 | byte(size>>21&0x7f), 0x80 | byte(size>>14&0x7f), 0x80 | byte(size>>7&0x7f), byte(size & 0x7f)}
+	for _, p := range payload {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// Fragment builds a moof+mdat pair carrying samples of one track, starting
+// at decode time baseTime (in the track's timescale).
+func Fragment(seq uint32, trackID int, baseTime uint64, samples []Sample) []byte {
+	const trunFlags = 0x01 | 0x100 | 0x200 | 0x400 | 0x800 // data offset, duration, size, flags, cts offset
+	entries := make([]byte, 0, 16*len(samples))
+	mdatSize := 8
+	for _, s := range samples {
+		flags := uint32(flagsNonSync)
+		if s.IsSync {
+			flags = flagsSync
+		}
+		entries = binary.BigEndian.AppendUint32(entries, s.Duration)
+		entries = binary.BigEndian.AppendUint32(entries, uint32(len(s.Data)))
+		entries = binary.BigEndian.AppendUint32(entries, flags)
+		entries = binary.BigEndian.AppendUint32(entries, uint32(s.PTSOffset))
+		mdatSize += len(s.Data)
+	}
+
+	// the data offset depends on the size of moof, which is fixed once the
+	// entries are known
+	build := func(dataOffset uint32) []byte {
+		trun := fullBox("trun", 1, trunFlags, u32(uint32(len(samples))), u32(dataOffset), entries)
+		traf := box("traf",
+			fullBox("tfhd", 0, 0x020000, u32(uint32(trackID))), // default-base-is-moof
+			fullBox("tfdt", 1, 0, u64(baseTime)),
+			trun)
+		return box("moof", fullBox("mfhd", 0, 0, u32(seq)), traf)
+	}
+	moof := build(0)
+	moof = build(uint32(len(moof) + 8))
+
+	out := make([]byte, 0, len(moof)+mdatSize)
+	out = append(out, moof...)
+	out = binary.BigEndian.AppendUint32(out, uint32(mdatSize))
+	out = append(out, "mdat"...)
+	for _, s := range samples {
+		out = append(out, s.Data...)
+	}
+	return out
+}
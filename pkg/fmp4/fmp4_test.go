@@ -0,0 +1,91 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/aler9/gortsplib/pkg/mpeg4audio"
+)
+
+var testSPS = []byte{
+	0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+	0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+	0x00, 0x03, 0x00, 0x3d, 0x08,
+}
+
+// boxes splits buf into top-level boxes keyed by type, in order.
+func boxes(t *testing.T, buf []byte) ([]string, map[string][]byte) {
+	t.Helper()
+	var order []string
+	out := make(map[string][]byte)
+	for len(buf) > 0 {
+		if len(buf) < 8 {
+			t.Fatalf("truncated box header")
+		}
+		size := int(binary.BigEndian.Uint32(buf))
+		if size < 8 || size > len(buf) {
+			t.Fatalf("invalid box size %d (have %d)", size, len(buf))
+		}
+		typ := string(buf[4:8])
+		order = append(order, typ)
+		out[typ] = buf[8:size]
+		buf = buf[size:]
+	}
+	return order, out
+}
+
+func TestInitSegment(t *testing.T) {
+	tracks := []*Track{
+		{ID: 1, TimeScale: 90000, H264: &H264Config{SPS: testSPS, PPS: []byte{0x68, 0xee, 0x3c, 0x80}}},
+		{ID: 2, TimeScale: 48000, MPEG4Audio: &mpeg4audio.Config{Type: 2, SampleRate: 48000, ChannelCount: 2}},
+	}
+	init, err := Init(tracks)
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	order, top := boxes(t, init)
+	if len(order) != 2 || order[0] != "ftyp" || order[1] != "moov" {
+		t.Fatalf("unexpected top-level boxes %v", order)
+	}
+	order, moov := boxes(t, top["moov"])
+	if len(order) != 4 || order[0] != "mvhd" || order[1] != "trak" || order[3] != "mvex" {
+		t.Fatalf("unexpected moov children %v", order)
+	}
+	if _, ok := moov["mvex"]; !ok || !bytes.Contains(init, []byte("avcC")) || !bytes.Contains(init, []byte("esds")) {
+		t.Fatalf("missing codec configuration")
+	}
+	if c := tracks[0].Codec(); c != "avc1.64000c" {
+		t.Fatalf("unexpected video codec %q", c)
+	}
+	if c := tracks[1].Codec(); c != "mp4a.40.2" {
+		t.Fatalf("unexpected audio codec %q", c)
+	}
+}
+
+func TestFragmentDataOffset(t *testing.T) {
+	samples := []Sample{
+		{Duration: 3000, IsSync: true, Data: []byte{0, 0, 0, 2, 0x65, 0x88}},
+		{Duration: 3000, PTSOffset: -3000, Data: []byte{0, 0, 0, 1, 0x41}},
+	}
+	frag := Fragment(7, 1, 90000, samples)
+	order, top := boxes(t, frag)
+	if len(order) != 2 || order[0] != "moof" || order[1] != "mdat" {
+		t.Fatalf("unexpected boxes %v", order)
+	}
+	moofSize := len(top["moof"]) + 8
+	// trun: fullbox header, sample count, data offset
+	i := bytes.Index(frag, []byte("trun"))
+	count := binary.BigEndian.Uint32(frag[i+8:])
+	offset := int(binary.BigEndian.Uint32(frag[i+12:]))
+	if count != 2 || offset != moofSize+8 {
+		t.Fatalf("unexpected trun count=%d offset=%d (moof %d)", count, offset, moofSize)
+	}
+	if !bytes.Equal(frag[offset:offset+6], samples[0].Data) {
+		t.Fatalf("data offset does not point at the first sample")
+	}
+	i = bytes.Index(frag, []byte("tfdt"))
+	if binary.BigEndian.Uint64(frag[i+8:]) != 90000 {
+		t.Fatalf("unexpected base media decode time")
+	}
+}
@@ -0,0 +1,176 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// cluster peer health metrics are labelled per peer node
+var (
+	promPeerHealthy      *prometheus.GaugeVec
+	promPeerHealthChecks *prometheus.CounterVec
+)
+
+func init() {
+	promPeerHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rtsper_cluster_peer_healthy",
+		Help: "Whether a cluster peer passes health checks (1) or is excluded from ownership (0)",
+	}, []string{"node"})
+	promPeerHealthChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtsper_cluster_peer_health_checks_total",
+		Help: "Total health checks of cluster peers by result (ok, fail)",
+	}, []string{"node", "result"})
+	prometheus.MustRegister(promPeerHealthy, promPeerHealthChecks)
+}
+
+// SetPeerHealthy records the health state of a cluster peer.
+func SetPeerHealthy(node string, healthy bool) {
+	v := 0.0
+	if healthy {
+		v = 1
+	}
+	promPeerHealthy.WithLabelValues(node).Set(v)
+}
+
+// IncPeerHealthCheck records one health check of a cluster peer.
+func IncPeerHealthCheck(node string, ok bool) {
+	result := "fail"
+	if ok {
+		result = "ok"
+	}
+	promPeerHealthChecks.WithLabelValues(node, result).Inc()
+}
+
+// DeletePeerHealth removes the series of a peer that left the cluster.
+func DeletePeerHealth(node string) {
+	promPeerHealthy.DeleteLabelValues(node)
+	promPeerHealthChecks.DeletePartialMatch(prometheus.Labels{"node": node})
+}
+
+// edge relay metrics: pulls of remote topics served to local subscribers
+var (
+	promEdgePulls       prometheus.Gauge
+	promEdgeSubscribers *prometheus.GaugeVec
+)
+
+func init() {
+	promEdgePulls = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rtsper_edge_pulls",
+		Help: "Number of topics currently pulled from their owner node",
+	})
+	promEdgeSubscribers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rtsper_edge_subscribers",
+		Help: "Local subscribers served from an edge pull",
+	}, []string{"topic"})
+	prometheus.MustRegister(promEdgePulls, promEdgeSubscribers)
+}
+
+// SetEdgePulls records the number of active edge pulls.
+func SetEdgePulls(n int) {
+	promEdgePulls.Set(float64(n))
+}
+
+// SetEdgeSubscribers records the local subscribers of an edge pull.
+func SetEdgeSubscribers(topic string, n int) {
+	promEdgeSubscribers.WithLabelValues(topic).Set(float64(n))
+}
+
+// DeleteEdgeSubscribers removes the series of a dropped edge pull.
+func DeleteEdgeSubscribers(topic string) {
+	promEdgeSubscribers.DeleteLabelValues(topic)
+}
+
+// admission control metrics
+var (
+	promOverloaded         prometheus.Gauge
+	promOverloadRejections *prometheus.CounterVec
+)
+
+func init() {
+	promOverloaded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rtsper_cluster_overloaded",
+		Help: "Whether this node is over a load threshold and refuses new sessions (1) or not (0)",
+	})
+	promOverloadRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtsper_overload_rejections_total",
+		Help: "Total new sessions refused or redirected because this node was overloaded",
+	}, []string{"action"})
+	prometheus.MustRegister(promOverloaded, promOverloadRejections)
+}
+
+// SetOverloaded records whether this node is overloaded.
+func SetOverloaded(overloaded bool) {
+	v := 0.0
+	if overloaded {
+		v = 1
+	}
+	promOverloaded.Set(v)
+}
+
+// IncOverloadRejections records a session refused ("503") or redirected
+// ("redirect") while overloaded.
+func IncOverloadRejections(action string) {
+	promOverloadRejections.WithLabelValues(action).Inc()
+}
+
+// topic migration metrics
+var promMigrations *prometheus.CounterVec
+
+func init() {
+	promMigrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtsper_migrations_total",
+		Help: "Total topic migrations started by this node, by result",
+	}, []string{"result"})
+	prometheus.MustRegister(promMigrations)
+}
+
+// IncMigrations records a finished migration ("done" or "failed").
+func IncMigrations(result string) {
+	promMigrations.WithLabelValues(result).Inc()
+}
+
+// inter-node TLS metrics
+var promClusterTLSFailures *prometheus.CounterVec
+
+func init() {
+	promClusterTLSFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtsper_cluster_tls_failures_total",
+		Help: "Total failed TLS handshakes between nodes, by direction (inbound or outbound)",
+	}, []string{"direction"})
+	prometheus.MustRegister(promClusterTLSFailures)
+}
+
+// IncClusterTLSFailures records a failed TLS handshake with a peer, dialled
+// by this node ("outbound") or accepted from it ("inbound").
+func IncClusterTLSFailures(direction string) {
+	promClusterTLSFailures.WithLabelValues(direction).Inc()
+}
+
+// topic replication metrics
+var promReplicaPromotions prometheus.Counter
+
+func init() {
+	promReplicaPromotions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rtsper_replica_promotions_total",
+		Help: "Total topic replicas promoted by this node after their owner failed",
+	})
+	prometheus.MustRegister(promReplicaPromotions)
+}
+
+// IncReplicaPromotions records a replica promoted to the topic's stream.
+func IncReplicaPromotions() {
+	promReplicaPromotions.Inc()
+}
+
+// lease metrics
+var promLeaseEvents *prometheus.CounterVec
+
+func init() {
+	promLeaseEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtsper_lease_events_total",
+		Help: "Total lease changes of this node's tasks, by event (acquired, released or lost)",
+	}, []string{"event"})
+	prometheus.MustRegister(promLeaseEvents)
+}
+
+// IncLeaseEvents records a lease acquired, released or lost by this node.
+func IncLeaseEvents(event string) {
+	promLeaseEvents.WithLabelValues(event).Inc()
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// egress metrics are labelled per topic and egress rule
+var (
+	promEgressPackets *prometheus.CounterVec
+	promEgressBytes   *prometheus.CounterVec
+	promEgressDropped *prometheus.CounterVec
+)
+
+func init() {
+	promEgressPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtsper_egress_packets_total",
+		Help: "Total packets pushed by egress rules",
+	}, []string{"topic", "egress"})
+	promEgressBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtsper_egress_bytes_total",
+		Help: "Total bytes pushed by egress rules",
+	}, []string{"topic", "egress"})
+	promEgressDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtsper_egress_dropped_total",
+		Help: "Total packets dropped by egress rules (queue full or send error)",
+	}, []string{"topic", "egress"})
+	prometheus.MustRegister(promEgressPackets, promEgressBytes, promEgressDropped)
+}
+
+// AddEgressSent records one packet of n bytes sent by an egress rule.
+func AddEgressSent(topic, egress string, n int) {
+	promEgressPackets.WithLabelValues(topic, egress).Inc()
+	promEgressBytes.WithLabelValues(topic, egress).Add(float64(n))
+}
+
+// IncEgressDropped records a packet an egress rule could not send.
+func IncEgressDropped(topic, egress string) {
+	promEgressDropped.WithLabelValues(topic, egress).Inc()
+}
+
+// DeleteEgress removes the series of a removed egress rule.
+func DeleteEgress(topic, egress string) {
+	promEgressPackets.DeleteLabelValues(topic, egress)
+	promEgressBytes.DeleteLabelValues(topic, egress)
+	promEgressDropped.DeleteLabelValues(topic, egress)
+}
@@ -44,6 +44,9 @@ var (
 	promForwardedConnections prometheus.Counter
 	promForwardedBytes       prometheus.Counter
 	promForwardFailed        prometheus.Counter
+	promRedirects            prometheus.Counter
+	// RTSP-over-HTTP tunnels
+	promHTTPTunnels prometheus.Counter
 )
 
 func init() {
@@ -101,6 +104,16 @@ func init() {
 		Help: "Total failed attempts to forward connections to other nodes",
 	})
 
+	promRedirects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rtsper_redirects_total",
+		Help: "Total connections redirected to the owner node with RTSP 302",
+	})
+
+	promHTTPTunnels = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rtsper_http_tunnels_total",
+		Help: "Total RTSP-over-HTTP tunnels accepted for subscribers",
+	})
+
 	// Register metrics
 	prometheus.MustRegister(
 		promActivePublishers,
@@ -115,6 +128,8 @@ func init() {
 		promForwardedConnections,
 		promForwardedBytes,
 		promForwardFailed,
+		promRedirects,
+		promHTTPTunnels,
 	)
 }
 
@@ -131,12 +146,25 @@ func AddForwardedBytes(n int64) {
 	}
 }
 
+func IncRedirects() {
+	if promRedirects != nil {
+		promRedirects.Inc()
+	}
+}
+
 func IncForwardFailed() {
 	if promForwardFailed != nil {
 		promForwardFailed.Inc()
 	}
 }
 
+// IncHTTPTunnels counts an accepted RTSP-over-HTTP tunnel.
+func IncHTTPTunnels() {
+	if promHTTPTunnels != nil {
+		promHTTPTunnels.Inc()
+	}
+}
+
 // InitOTLP initializes an OTLP exporter to the provided endpoint (host:port)
 // and configures a MeterProvider that exports periodically. If endpoint is
 // empty, InitOTLP is a no-op and returns nil. This avoids attempting to
@@ -0,0 +1,52 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// push relay metrics are labelled per topic and target
+var (
+	promRelayUp         *prometheus.GaugeVec
+	promRelayPackets    *prometheus.CounterVec
+	promRelayReconnects *prometheus.CounterVec
+)
+
+func init() {
+	promRelayUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rtsper_relay_up",
+		Help: "Whether a push relay target is currently recording (1) or not (0)",
+	}, []string{"topic", "target"})
+	promRelayPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtsper_relay_packets_total",
+		Help: "Total RTP packets pushed to relay targets",
+	}, []string{"topic", "target"})
+	promRelayReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtsper_relay_reconnects_total",
+		Help: "Total reconnect attempts of relay targets",
+	}, []string{"topic", "target"})
+	prometheus.MustRegister(promRelayUp, promRelayPackets, promRelayReconnects)
+}
+
+// SetRelayUp records whether a relay target is connected.
+func SetRelayUp(topic, target string, up bool) {
+	v := 0.0
+	if up {
+		v = 1
+	}
+	promRelayUp.WithLabelValues(topic, target).Set(v)
+}
+
+// IncRelayPackets records one packet pushed to a relay target.
+func IncRelayPackets(topic, target string) {
+	promRelayPackets.WithLabelValues(topic, target).Inc()
+}
+
+// IncRelayReconnects records a reconnect attempt of a relay target.
+func IncRelayReconnects(topic, target string) {
+	promRelayReconnects.WithLabelValues(topic, target).Inc()
+}
+
+// DeleteRelay removes the series of a removed relay target.
+func DeleteRelay(topic, target string) {
+	promRelayUp.DeleteLabelValues(topic, target)
+	promRelayPackets.DeleteLabelValues(topic, target)
+	promRelayReconnects.DeleteLabelValues(topic, target)
+}
@@ -0,0 +1,323 @@
+// Package mpegts implements the subset of MPEG transport streams rtsper needs
+// to carry H.264, H.265 and AAC: PAT/PMT parsing, PES reassembly and
+// continuity/PCR monitoring.
+package mpegts
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// PacketSize is the size of a transport stream packet.
+const PacketSize = 188
+
+// Stream types carried in the PMT.
+const (
+	StreamTypeAAC  = 0x0f
+	StreamTypeH264 = 0x1b
+	StreamTypeH265 = 0x24
+)
+
+const (
+	syncByte  = 0x47
+	pidPAT    = 0x0000
+	pidNull   = 0x1fff
+	pcrClock  = 27000000
+	ptsModulo = 1 << 33
+)
+
+// ErrSync is returned when data does not start with a sync byte.
+var ErrSync = errors.New("mpegts: lost sync")
+
+// ElementaryStream is one entry of the PMT.
+type ElementaryStream struct {
+	PID  uint16
+	Type uint8
+}
+
+// PES is a reassembled packetized elementary stream packet. PTS and DTS are
+// in 90 kHz units; DTS equals PTS when the stream does not carry it.
+type PES struct {
+	PID        uint16
+	StreamType uint8
+	PTS        int64
+	DTS        int64
+	HasPTS     bool
+	Data       []byte
+}
+
+type pesState struct {
+	streamType uint8
+	buf        []byte
+	// broken is set after a continuity error until the next unit start
+	broken  bool
+	started bool
+}
+
+// Demuxer splits a transport stream into PES packets. It is not safe for
+// concurrent use except for the statistics accessors.
+type Demuxer struct {
+	// OnPMT is called whenever the program's elementary streams change.
+	OnPMT func(streams []ElementaryStream)
+	// OnPES is called for every complete PES packet of a PMT stream.
+	OnPES func(pes *PES)
+
+	pmtPID     int
+	pmtVersion int
+	pcrPID     int
+	streams    map[uint16]*pesState
+	lastCC     map[uint16]uint8
+
+	lastPCR     int64
+	lastArrival time.Time
+	jitter      float64 // seconds, RFC 3550 style smoothing
+
+	packets  atomic.Int64
+	ccErrors atomic.Int64
+	jitterNs atomic.Int64
+}
+
+// NewDemuxer returns a demuxer waiting for a PAT.
+func NewDemuxer() *Demuxer {
+	return &Demuxer{pmtPID: -1, pmtVersion: -1, pcrPID: -1, streams: make(map[uint16]*pesState), lastCC: make(map[uint16]uint8)}
+}
+
+// Packets returns the number of transport packets processed.
+func (d *Demuxer) Packets() int64 { return d.packets.Load() }
+
+// ContinuityErrors returns the number of continuity counter discontinuities.
+func (d *Demuxer) ContinuityErrors() int64 { return d.ccErrors.Load() }
+
+// PCRJitter returns the smoothed deviation between PCR progress and packet
+// arrival times.
+func (d *Demuxer) PCRJitter() time.Duration { return time.Duration(d.jitterNs.Load()) }
+
+// Feed processes one or more whole transport packets received at arrival.
+func (d *Demuxer) Feed(b []byte, arrival time.Time) error {
+	for len(b) >= PacketSize {
+		if b[0] != syncByte {
+			return ErrSync
+		}
+		d.packet(b[:PacketSize], arrival)
+		b = b[PacketSize:]
+	}
+	return nil
+}
+
+// Flush emits any pending PES packets (e.g. at end of input).
+func (d *Demuxer) Flush() {
+	for pid, st := range d.streams {
+		d.emit(pid, st)
+	}
+}
+
+func (d *Demuxer) packet(p []byte, arrival time.Time) {
+	d.packets.Add(1)
+	pid := uint16(p[1]&0x1f)<<8 | uint16(p[2])
+	if pid == pidNull {
+		return
+	}
+	unitStart := p[1]&0x40 != 0
+	afc := (p[3] >> 4) & 0x3
+	cc := p[3] & 0x0f
+
+	payload := p[4:]
+	discontinuity := false
+	if afc&0x2 != 0 {
+		afLen := int(p[4])
+		if afLen > PacketSize-5 {
+			return
+		}
+		if afLen > 0 {
+			flags := p[5]
+			discontinuity = flags&0x80 != 0
+			if flags&0x10 != 0 && afLen >= 7 && int(pid) == d.pcrPID {
+				d.onPCR(p[6:12], arrival, discontinuity)
+			}
+		}
+		payload = p[5+afLen:]
+	}
+	if afc&0x1 == 0 {
+		return
+	}
+
+	// continuity counter only advances on packets with payload
+	if last, ok := d.lastCC[pid]; ok && !discontinuity {
+		if cc == last {
+			return // duplicate packet
+		}
+		if cc != (last+1)&0x0f {
+			d.ccErrors.Add(1)
+			if st, ok := d.streams[pid]; ok {
+				st.broken = true
+			}
+		}
+	}
+	d.lastCC[pid] = cc
+
+	switch {
+	case pid == pidPAT:
+		d.parsePAT(psiSection(payload, unitStart))
+	case int(pid) == d.pmtPID:
+		d.parsePMT(psiSection(payload, unitStart))
+	default:
+		st, ok := d.streams[pid]
+		if !ok {
+			return
+		}
+		if unitStart {
+			d.emit(pid, st)
+			st.buf = append(st.buf[:0], payload...)
+			st.broken = false
+			st.started = true
+		} else if st.started && !st.broken {
+			st.buf = append(st.buf, payload...)
+		}
+	}
+}
+
+func (d *Demuxer) onPCR(b []byte, arrival time.Time, discontinuity bool) {
+	base := int64(b[0])<<25 | int64(b[1])<<17 | int64(b[2])<<9 | int64(b[3])<<1 | int64(b[4])>>7
+	pcr := base*300 + (int64(b[4]&0x01)<<8 | int64(b[5]))
+	if !d.lastArrival.IsZero() && !discontinuity {
+		pcrDelta := float64(pcr-d.lastPCR) / pcrClock
+		diff := arrival.Sub(d.lastArrival).Seconds() - pcrDelta
+		if diff < 0 {
+			diff = -diff
+		}
+		// a jump of more than a second is a PCR reset, not jitter
+		if pcrDelta >= 0 && diff < 1 {
+			d.jitter += (diff - d.jitter) / 16
+			d.jitterNs.Store(int64(d.jitter * float64(time.Second)))
+		}
+	}
+	d.lastPCR = pcr
+	d.lastArrival = arrival
+}
+
+// psiSection returns the section following the pointer field; sections are
+// assumed to fit in a single packet, which holds for PAT/PMT in practice.
+func psiSection(payload []byte, unitStart bool) []byte {
+	if !unitStart || len(payload) < 1 {
+		return nil
+	}
+	ptr := int(payload[0])
+	if 1+ptr >= len(payload) {
+		return nil
+	}
+	s := payload[1+ptr:]
+	if len(s) < 3 {
+		return nil
+	}
+	l := int(s[1]&0x0f)<<8 | int(s[2])
+	if 3+l > len(s) || l < 9 {
+		return nil
+	}
+	return s[:3+l]
+}
+
+func (d *Demuxer) parsePAT(s []byte) {
+	if s == nil || s[0] != 0x00 {
+		return
+	}
+	// 8 byte header, 4 byte CRC
+	for i := 8; i+4 <= len(s)-4; i += 4 {
+		program := uint16(s[i])<<8 | uint16(s[i+1])
+		pid := int(s[i+2]&0x1f)<<8 | int(s[i+3])
+		if program != 0 {
+			if pid != d.pmtPID {
+				d.pmtPID = pid
+				d.pmtVersion = -1
+			}
+			return
+		}
+	}
+}
+
+func (d *Demuxer) parsePMT(s []byte) {
+	if s == nil || s[0] != 0x02 || len(s) < 16 {
+		return
+	}
+	version := int(s[5]>>1) & 0x1f
+	if version == d.pmtVersion {
+		return
+	}
+	d.pcrPID = int(s[8]&0x1f)<<8 | int(s[9])
+	infoLen := int(s[10]&0x0f)<<8 | int(s[11])
+	var streams []ElementaryStream
+	for i := 12 + infoLen; i+5 <= len(s)-4; {
+		es := ElementaryStream{Type: s[i], PID: uint16(s[i+1]&0x1f)<<8 | uint16(s[i+2])}
+		esLen := int(s[i+3]&0x0f)<<8 | int(s[i+4])
+		streams = append(streams, es)
+		i += 5 + esLen
+	}
+	d.pmtVersion = version
+	d.streams = make(map[uint16]*pesState)
+	for _, es := range streams {
+		d.streams[es.PID] = &pesState{streamType: es.Type}
+	}
+	d.lastPCR = 0
+	d.lastArrival = time.Time{}
+	if d.OnPMT != nil {
+		d.OnPMT(streams)
+	}
+}
+
+// emit parses and delivers the buffered PES of a stream.
+func (d *Demuxer) emit(pid uint16, st *pesState) {
+	if !st.started || st.broken || len(st.buf) == 0 {
+		st.buf = st.buf[:0]
+		return
+	}
+	pes, ok := parsePES(st.buf)
+	st.buf = nil
+	if !ok || d.OnPES == nil {
+		return
+	}
+	pes.PID = pid
+	pes.StreamType = st.streamType
+	d.OnPES(pes)
+}
+
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+func parsePES(b []byte) (*PES, bool) {
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+		return nil, false
+	}
+	hdrLen := int(b[8])
+	if 9+hdrLen > len(b) {
+		return nil, false
+	}
+	pes := &PES{Data: b[9+hdrLen:]}
+	flags := b[7] >> 6
+	if flags&0x2 != 0 && hdrLen >= 5 {
+		pes.PTS = parseTimestamp(b[9:14])
+		pes.DTS = pes.PTS
+		pes.HasPTS = true
+		if flags&0x1 != 0 && hdrLen >= 10 {
+			pes.DTS = parseTimestamp(b[14:19])
+		}
+	}
+	// a bounded PES length may leave stuffing after the payload; a length
+	// that ends inside the header is bogus and ignored
+	if l := int(b[4])<<8 | int(b[5]); l != 0 && 6+l >= 9+hdrLen && 6+l < len(b) {
+		pes.Data = b[9+hdrLen : 6+l]
+	}
+	return pes, true
+}
+
+// PTSDiff returns a-b in 90 kHz units, accounting for the 33 bit wrap.
+func PTSDiff(a, b int64) int64 {
+	d := (a - b) % ptsModulo
+	if d < 0 {
+		d += ptsModulo
+	}
+	if d >= ptsModulo/2 {
+		d -= ptsModulo
+	}
+	return d
+}
@@ -0,0 +1,135 @@
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// tsPacket builds a transport packet, stuffing the adaptation field so that
+// payload fills the rest of the packet. pcr < 0 omits the PCR.
+func tsPacket(pid uint16, pusi bool, cc uint8, pcr int64, payload []byte) []byte {
+	p := make([]byte, 4, PacketSize)
+	p[0] = syncByte
+	p[1] = byte(pid >> 8 & 0x1f)
+	if pusi {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+	var af []byte
+	if pcr >= 0 {
+		base := pcr / 300
+		af = []byte{0x10, byte(base >> 25), byte(base >> 17), byte(base >> 9), byte(base >> 1), byte(base<<7) | 0x7e, byte(pcr % 300)}
+	}
+	if free := PacketSize - 4 - len(payload); free > 0 {
+		// adaptation field: length byte, flags (+PCR), stuffing
+		if af == nil && free > 1 {
+			af = []byte{0x00}
+		} else if af == nil {
+			af = []byte{} // length byte only
+		}
+		af = append(af, bytes.Repeat([]byte{0xff}, max(free-1-len(af), 0))...)
+	}
+	p[3] = 0x10 | cc&0x0f
+	if af != nil {
+		p[3] |= 0x20
+		p = append(p, byte(len(af)))
+		p = append(p, af...)
+	}
+	p = append(p, payload...)
+	return p[:PacketSize]
+}
+
+func psi(tableID byte, body []byte) []byte {
+	l := len(body) + 5 + 4 // header after length + CRC
+	s := []byte{0x00, tableID, 0xb0 | byte(l>>8), byte(l), 0x00, 0x01, 0xc1, 0x00, 0x00}
+	s = append(s, body...)
+	return append(s, 0, 0, 0, 0)
+}
+
+func pesHeader(pts int64, size int) []byte {
+	return []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5,
+		byte(0x21 | (pts>>29)&0x0e), byte(pts >> 22), byte((pts>>14)&0xfe | 1), byte(pts >> 7), byte(pts<<1 | 1)}
+}
+
+func TestDemuxPESAndStats(t *testing.T) {
+	var stream []byte
+	stream = append(stream, tsPacket(0, true, 0, -1, psi(0x00, []byte{0x00, 0x01, 0xf0, 0x00}))...)
+	stream = append(stream, tsPacket(0x1000, true, 0, -1, psi(0x02, []byte{0xe1, 0x00, 0xf0, 0x00, StreamTypeH264, 0xe1, 0x00, 0xf0, 0x00}))...)
+
+	frame := bytes.Repeat([]byte{0xab}, 300)
+	pes := append(pesHeader(90000, len(frame)), frame...)
+	stream = append(stream, tsPacket(0x100, true, 0, 27000000, pes[:170])...)
+	stream = append(stream, tsPacket(0x100, false, 1, -1, pes[170:])...)
+	// the next unit start flushes the first PES
+	stream = append(stream, tsPacket(0x100, true, 2, -1, pesHeader(93000, 4))...)
+	// a lost packet (cc 3) drops the second PES
+	stream = append(stream, tsPacket(0x100, true, 4, -1, pesHeader(96000, 4))...)
+
+	d := NewDemuxer()
+	var streams []ElementaryStream
+	var got []*PES
+	d.OnPMT = func(s []ElementaryStream) { streams = s }
+	d.OnPES = func(p *PES) { got = append(got, p) }
+	if err := d.Feed(stream, time.Now()); err != nil {
+		t.Fatalf("feed: %v", err)
+	}
+	if len(streams) != 1 || streams[0].PID != 0x100 || streams[0].Type != StreamTypeH264 {
+		t.Fatalf("unexpected PMT %v", streams)
+	}
+	if len(got) != 1 || got[0].PTS != 90000 || !bytes.Equal(got[0].Data, frame) {
+		t.Fatalf("unexpected PES output: %d packets", len(got))
+	}
+	if d.ContinuityErrors() != 1 {
+		t.Fatalf("expected 1 continuity error, got %d", d.ContinuityErrors())
+	}
+	if d.Packets() != 6 {
+		t.Fatalf("expected 6 packets, got %d", d.Packets())
+	}
+}
+
+func TestParsePESLength(t *testing.T) {
+	frame := []byte{1, 2, 3, 4}
+	b := append(pesHeader(90000, len(frame)), frame...)
+	// the declared length trims stuffing after the payload
+	b[4], b[5] = 0, byte(3+5+len(frame))
+	b = append(b, 0xff, 0xff)
+	pes, ok := parsePES(b)
+	if !ok || !bytes.Equal(pes.Data, frame) {
+		t.Fatalf("unexpected payload %v %v", pes, ok)
+	}
+	// a length shorter than the header data is ignored
+	b[4], b[5] = 0, 3
+	pes, ok = parsePES(b)
+	if !ok || pes.PTS != 90000 || len(pes.Data) != len(frame)+2 {
+		t.Fatalf("unexpected payload %v %v", pes, ok)
+	}
+}
+
+func TestPCRJitter(t *testing.T) {
+	d := NewDemuxer()
+	d.pcrPID = 0x100
+	start := time.Now()
+	// PCR advances 40ms per packet while arrivals alternate 30ms/50ms
+	arrival := start
+	for n := 0; n < 50; n++ {
+		d.packet(tsPacket(0x100, false, uint8(n), int64(n)*40*27000, nil), arrival)
+		if n%2 == 0 {
+			arrival = arrival.Add(30 * time.Millisecond)
+		} else {
+			arrival = arrival.Add(50 * time.Millisecond)
+		}
+	}
+	if j := d.PCRJitter(); j < 8*time.Millisecond || j > 11*time.Millisecond {
+		t.Fatalf("expected ~10ms jitter, got %s", j)
+	}
+}
+
+func TestPTSDiffWraps(t *testing.T) {
+	if d := PTSDiff(10, ptsModulo-10); d != 20 {
+		t.Fatalf("expected 20 across wrap, got %d", d)
+	}
+	if d := PTSDiff(100, 200); d != -100 {
+		t.Fatalf("expected -100, got %d", d)
+	}
+}
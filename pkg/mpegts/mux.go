@@ -0,0 +1,236 @@
+package mpegts
+
+import (
+	"errors"
+	"io"
+)
+
+// PMTPID is the PID the muxer uses for the program map table.
+const PMTPID = 0x1000
+
+// psiInterval is the maximum distance between PAT/PMT repetitions in 90 kHz
+// units (100 ms), so receivers joining mid-stream start quickly.
+const psiInterval = 9000
+
+// PCRDelay is how far the PCR runs behind the DTS of the PES it is carried
+// with (700 ms, as common muxers do), giving decoders room to buffer.
+const PCRDelay = 63000
+
+// Muxer writes a single-program transport stream. Every Write to the
+// underlying writer is exactly one 188 byte packet. It is not safe for
+// concurrent use.
+type Muxer struct {
+	w       io.Writer
+	streams []ElementaryStream
+	pcrPID  uint16
+	version uint8
+	cc      map[uint16]uint8
+
+	psiWritten bool
+	lastPSI    int64
+	// discontinuity is signalled with the next PCR after SetStreams
+	discontinuity bool
+	buf           [PacketSize]byte
+}
+
+// NewMuxer creates a muxer writing to w.
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{w: w, cc: make(map[uint16]uint8)}
+}
+
+// SetStreams sets the program's elementary streams. The first video stream
+// (or the first stream) carries the PCR. Calling it again, e.g. when the
+// source changes, bumps the PMT version and marks a discontinuity while
+// continuity counters carry on.
+func (m *Muxer) SetStreams(streams []ElementaryStream) {
+	if m.streams != nil {
+		m.version = (m.version + 1) & 0x1f
+		m.discontinuity = true
+	}
+	m.streams = append([]ElementaryStream(nil), streams...)
+	m.pcrPID = 0
+	for _, es := range streams {
+		if es.Type == StreamTypeH264 || es.Type == StreamTypeH265 {
+			m.pcrPID = es.PID
+			break
+		}
+	}
+	if m.pcrPID == 0 && len(streams) > 0 {
+		m.pcrPID = streams[0].PID
+	}
+	m.psiWritten = false
+}
+
+// WritePES writes one PES packet. pts and dts are in 90 kHz units;
+// randomAccess marks keyframes (and every audio frame).
+func (m *Muxer) WritePES(pid uint16, pts, dts int64, randomAccess bool, data []byte) error {
+	var es *ElementaryStream
+	for i := range m.streams {
+		if m.streams[i].PID == pid {
+			es = &m.streams[i]
+		}
+	}
+	if es == nil {
+		return errors.New("mpegts: unknown PID")
+	}
+	pts, dts = pts&(ptsModulo-1), dts&(ptsModulo-1)
+	isPCR := pid == m.pcrPID
+	if !m.psiWritten || (isPCR && (randomAccess || PTSDiff(dts, m.lastPSI) >= psiInterval)) {
+		if err := m.writePSI(); err != nil {
+			return err
+		}
+		m.lastPSI = dts
+	}
+
+	payload := newPESHeader(es.Type, pts, dts, len(data))
+	payload = append(payload, data...)
+	first := true
+	for len(payload) > 0 {
+		var af []byte
+		if first && (isPCR || randomAccess) {
+			flags := byte(0)
+			if randomAccess {
+				flags |= 0x40
+			}
+			af = []byte{0, flags}
+			if isPCR {
+				if m.discontinuity {
+					af[1] |= 0x80
+					m.discontinuity = false
+				}
+				af[1] |= 0x10
+				af = appendPCR(af, (dts-PCRDelay)&(ptsModulo-1))
+			}
+		}
+		n, err := m.writePacket(pid, first, af, payload)
+		if err != nil {
+			return err
+		}
+		payload = payload[n:]
+		first = false
+	}
+	return nil
+}
+
+// writePacket writes one packet carrying as much of payload as fits, with
+// stuffing in the adaptation field. af holds length placeholder and flags.
+func (m *Muxer) writePacket(pid uint16, unitStart bool, af []byte, payload []byte) (int, error) {
+	p := m.buf[:0]
+	p = append(p, syncByte, byte(pid>>8)&0x1f, byte(pid), 0x10|m.cc[pid])
+	if unitStart {
+		p[1] |= 0x40
+	}
+	m.cc[pid] = (m.cc[pid] + 1) & 0x0f
+
+	room := PacketSize - 4 - len(af)
+	n := min(len(payload), room)
+	if af != nil || n < room {
+		if af == nil {
+			af = []byte{0}
+			room--
+			n = min(len(payload), room)
+			if n < room {
+				// a one byte adaptation field is just the length; longer
+				// ones need the flags byte
+				af = append(af, 0)
+				room--
+			}
+		}
+		p[3] |= 0x20
+		stuffing := room - n
+		af[0] = byte(len(af) - 1 + stuffing)
+		p = append(p, af...)
+		for i := 0; i < stuffing; i++ {
+			p = append(p, 0xff)
+		}
+	}
+	p = append(p, payload[:n]...)
+	_, err := m.w.Write(p)
+	return n, err
+}
+
+func (m *Muxer) writePSI() error {
+	pat := []byte{0x00, 0xb0, 0, 0x00, 0x01, 0xc1 | m.version<<1, 0, 0, 0x00, 0x01, 0xe0 | PMTPID>>8, PMTPID & 0xff}
+	if err := m.writeSection(pidPAT, pat); err != nil {
+		return err
+	}
+	pmt := []byte{0x02, 0xb0, 0, 0x00, 0x01, 0xc1 | m.version<<1, 0, 0, 0xe0 | byte(m.pcrPID>>8), byte(m.pcrPID), 0xf0, 0}
+	for _, es := range m.streams {
+		pmt = append(pmt, es.Type, 0xe0|byte(es.PID>>8), byte(es.PID), 0xf0, 0)
+	}
+	if err := m.writeSection(PMTPID, pmt); err != nil {
+		return err
+	}
+	m.psiWritten = true
+	return nil
+}
+
+// writeSection completes the section length and CRC and writes it in one
+// packet.
+func (m *Muxer) writeSection(pid uint16, s []byte) error {
+	l := len(s) - 3 + 4
+	s[1] = 0xb0 | byte(l>>8)
+	s[2] = byte(l)
+	crc := crc32MPEG2(s)
+	s = append(s, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	p := m.buf[:0]
+	p = append(p, syncByte, 0x40|byte(pid>>8)&0x1f, byte(pid), 0x10|m.cc[pid], 0)
+	m.cc[pid] = (m.cc[pid] + 1) & 0x0f
+	p = append(p, s...)
+	for len(p) < PacketSize {
+		p = append(p, 0xff)
+	}
+	_, err := m.w.Write(p)
+	return err
+}
+
+func newPESHeader(streamType uint8, pts, dts int64, size int) []byte {
+	streamID := byte(0xe0)
+	if streamType == StreamTypeAAC {
+		streamID = 0xc0
+	}
+	h := []byte{0, 0, 1, streamID, 0, 0, 0x80}
+	if pts != dts {
+		h = append(h, 0xc0, 10)
+		h = appendTimestamp(h, 0x3, pts)
+		h = appendTimestamp(h, 0x1, dts)
+	} else {
+		h = append(h, 0x80, 5)
+		h = appendTimestamp(h, 0x2, pts)
+	}
+	// video PES may be unbounded (length 0)
+	if l := len(h) - 6 + size; l <= 0xffff && streamID != 0xe0 {
+		h[4], h[5] = byte(l>>8), byte(l)
+	}
+	return h
+}
+
+func appendTimestamp(b []byte, prefix byte, ts int64) []byte {
+	return append(b,
+		prefix<<4|byte(ts>>29)&0x0e|1,
+		byte(ts>>22),
+		byte(ts>>14)&0xfe|1,
+		byte(ts>>7),
+		byte(ts<<1)|1)
+}
+
+func appendPCR(b []byte, base int64) []byte {
+	return append(b, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1), byte(base<<7)|0x7e, 0)
+}
+
+// crc32MPEG2 is the CRC used by PSI sections (polynomial 0x04c11db7, no
+// reflection).
+func crc32MPEG2(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, v := range b {
+		crc ^= uint32(v) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
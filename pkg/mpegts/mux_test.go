@@ -0,0 +1,84 @@
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCRC32MPEG2(t *testing.T) {
+	// the PAT every common muxer emits for program 1 on PID 0x1000
+	pat := []byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00}
+	if crc := crc32MPEG2(pat); crc != 0x2ab104b2 {
+		t.Fatalf("unexpected CRC %08x", crc)
+	}
+}
+
+func TestMuxDemuxRoundTrip(t *testing.T) {
+	var out bytes.Buffer
+	m := NewMuxer(&out)
+	m.SetStreams([]ElementaryStream{{PID: 0x100, Type: StreamTypeH264}, {PID: 0x101, Type: StreamTypeAAC}})
+
+	video := bytes.Repeat([]byte{0, 0, 0, 1, 0x65, 0x88}, 100) // spans several packets
+	if err := m.WritePES(0x100, 93000, 90000, true, video); err != nil {
+		t.Fatalf("write video: %v", err)
+	}
+	if err := m.WritePES(0x101, 90000, 90000, true, []byte{0xff, 0xf1, 1, 2, 3}); err != nil {
+		t.Fatalf("write audio: %v", err)
+	}
+	if out.Len()%PacketSize != 0 {
+		t.Fatalf("output is not whole packets: %d", out.Len())
+	}
+
+	d := NewDemuxer()
+	var pmts [][]ElementaryStream
+	var pes []*PES
+	d.OnPMT = func(s []ElementaryStream) { pmts = append(pmts, s) }
+	d.OnPES = func(p *PES) {
+		cp := *p
+		cp.Data = append([]byte(nil), p.Data...)
+		pes = append(pes, &cp)
+	}
+	if err := d.Feed(out.Bytes(), time.Now()); err != nil {
+		t.Fatalf("feed: %v", err)
+	}
+	d.Flush()
+
+	// the source changes; a new PMT resets the demuxer's streams
+	out.Reset()
+	// new PMT version, counters continue
+	m.SetStreams([]ElementaryStream{{PID: 0x100, Type: StreamTypeH265}})
+	if err := m.WritePES(0x100, 96000, 96000, true, []byte{0, 0, 0, 1, 0x26, 0x01}); err != nil {
+		t.Fatalf("write after change: %v", err)
+	}
+	if err := m.WritePES(0x101, 0, 0, true, nil); err == nil {
+		t.Fatalf("expected unknown PID to fail")
+	}
+	if err := d.Feed(out.Bytes(), time.Now()); err != nil {
+		t.Fatalf("feed: %v", err)
+	}
+	d.Flush()
+	if d.ContinuityErrors() != 0 {
+		t.Fatalf("unexpected continuity errors: %d", d.ContinuityErrors())
+	}
+	if len(pmts) != 2 || len(pmts[0]) != 2 || pmts[1][0].Type != StreamTypeH265 {
+		t.Fatalf("unexpected PMTs %+v", pmts)
+	}
+	if len(pes) != 3 {
+		t.Fatalf("expected 3 PES, got %d", len(pes))
+	}
+	// Flush emits in map order
+	v, a := pes[0], pes[1]
+	if v.PID != 0x100 {
+		v, a = a, v
+	}
+	if !bytes.Equal(v.Data, video) || v.PTS != 93000 || v.DTS != 90000 {
+		t.Fatalf("unexpected video PES pts=%d dts=%d len=%d", v.PTS, v.DTS, len(v.Data))
+	}
+	if !bytes.Equal(a.Data, []byte{0xff, 0xf1, 1, 2, 3}) || a.StreamType != StreamTypeAAC {
+		t.Fatalf("unexpected audio PES %+v", a)
+	}
+	if pes[2].StreamType != StreamTypeH265 || pes[2].PTS != 96000 {
+		t.Fatalf("unexpected PES after change %+v", pes[2])
+	}
+}
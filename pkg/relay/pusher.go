@@ -0,0 +1,240 @@
+package relay
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtp"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// pollInterval is how often a pusher checks the topic for a (new) stream.
+const pollInterval = 500 * time.Millisecond
+
+// errStreamChanged ends a push session when the topic's publisher went away
+// or was replaced; the pusher reconnects with the new tracks right away.
+var errStreamChanged = errors.New("topic stream changed")
+
+// pusher keeps one push target connected while its topic is live.
+type pusher struct {
+	mgr    *topic.Manager
+	target Target
+	u      *url.URL
+
+	ch        chan *topic.InboundPacket
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	// active gates the tap so that packets are only queued while recording
+	active atomic.Bool
+
+	packets    atomic.Int64
+	dropped    atomic.Int64
+	reconnects atomic.Int64
+
+	mu          sync.Mutex
+	state       string
+	since       time.Time
+	lastErr     string
+	lastErrTime time.Time
+}
+
+func newPusher(mgr *topic.Manager, t Target, u *url.URL) *pusher {
+	p := &pusher{
+		mgr:    mgr,
+		target: t,
+		u:      u,
+		ch:     make(chan *topic.InboundPacket, queueSize),
+		done:   make(chan struct{}),
+		state:  "waiting",
+	}
+	p.wg.Add(1)
+	go p.run()
+	plog.Info("relay: %s/%s pushing to %s (%s)", t.Topic, t.Name, u.Redacted(), t.Transport)
+	return p
+}
+
+// tap is the topic packet tap; it never blocks.
+func (p *pusher) tap(pkt *topic.InboundPacket) {
+	if pkt.RTCP || !p.active.Load() {
+		return
+	}
+	select {
+	case p.ch <- pkt:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+func (p *pusher) setState(state string) {
+	p.mu.Lock()
+	p.state = state
+	p.mu.Unlock()
+}
+
+func (p *pusher) setError(err error) {
+	p.mu.Lock()
+	p.lastErr = err.Error()
+	p.lastErrTime = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *pusher) run() {
+	defer p.wg.Done()
+	backoff := minBackoff
+	attempts := 0
+	for {
+		st := p.waitStream()
+		if st == nil {
+			return
+		}
+		if attempts > 0 {
+			p.reconnects.Add(1)
+			metrics.IncRelayReconnects(p.target.Topic, p.target.Name)
+		}
+		attempts++
+		recorded, err := p.session(st)
+		switch {
+		case err == nil:
+			// closed
+			return
+		case errors.Is(err, errStreamChanged):
+			backoff = minBackoff
+			continue
+		}
+		if recorded {
+			backoff = minBackoff
+		}
+		p.setError(err)
+		plog.Warn("relay: %s/%s: %v; retrying in %s", p.target.Topic, p.target.Name, err, backoff)
+		p.setState("backoff")
+		select {
+		case <-time.After(backoff):
+		case <-p.done:
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// waitStream returns the topic's stream once it has a publisher, or nil when
+// the pusher is closed.
+func (p *pusher) waitStream() *gortsplib.ServerStream {
+	p.setState("waiting")
+	for {
+		if st := p.mgr.GetTopicStream(p.target.Topic); st != nil {
+			return st
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-p.done:
+			return nil
+		}
+	}
+}
+
+// session announces st's tracks to the target and forwards packets until
+// the connection fails, the stream changes or the pusher is closed (nil
+// error). recorded reports whether RECORD succeeded.
+func (p *pusher) session(st *gortsplib.ServerStream) (recorded bool, err error) {
+	p.setState("connecting")
+	tr := gortsplib.TransportTCP
+	if p.target.Transport == "udp" {
+		tr = gortsplib.TransportUDP
+	}
+	c := &gortsplib.Client{Transport: &tr, UserAgent: "rtsper"}
+	if err := c.StartPublishing(p.u.String(), st.Tracks()); err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	// discard anything queued by a previous session
+	for len(p.ch) > 0 {
+		<-p.ch
+	}
+	p.active.Store(true)
+	p.mu.Lock()
+	p.state = "recording"
+	p.since = time.Now()
+	p.mu.Unlock()
+	metrics.SetRelayUp(p.target.Topic, p.target.Name, true)
+	plog.Info("relay: %s/%s recording to %s", p.target.Topic, p.target.Name, p.u.Redacted())
+	defer func() {
+		p.active.Store(false)
+		p.mu.Lock()
+		p.since = time.Time{}
+		p.mu.Unlock()
+		metrics.SetRelayUp(p.target.Topic, p.target.Name, false)
+	}()
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- c.Wait() }()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case pkt := <-p.ch:
+			var rp rtp.Packet
+			if err := rp.Unmarshal(pkt.Raw); err != nil {
+				continue
+			}
+			if err := c.WritePacketRTP(pkt.Track, &rp); err != nil {
+				return true, err
+			}
+			p.packets.Add(1)
+			metrics.IncRelayPackets(p.target.Topic, p.target.Name)
+		case err := <-waitErr:
+			if err == nil {
+				err = errors.New("connection closed")
+			}
+			return true, err
+		case <-ticker.C:
+			if p.mgr.GetTopicStream(p.target.Topic) != st {
+				return true, errStreamChanged
+			}
+		case <-p.done:
+			return true, nil
+		}
+	}
+}
+
+func (p *pusher) status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := Status{
+		Name:        p.target.Name,
+		Topic:       p.target.Topic,
+		URL:         p.u.Redacted(),
+		Transport:   p.target.Transport,
+		State:       p.state,
+		Reconnects:  p.reconnects.Load(),
+		PacketsSent: p.packets.Load(),
+		Dropped:     p.dropped.Load(),
+		LastError:   p.lastErr,
+	}
+	if !p.since.IsZero() {
+		since := p.since
+		s.ConnectedSince = &since
+	}
+	if !p.lastErrTime.IsZero() {
+		at := p.lastErrTime
+		s.LastErrorAt = &at
+	}
+	return s
+}
+
+func (p *pusher) close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.wg.Wait()
+		plog.Info("relay: %s/%s stopped", p.target.Topic, p.target.Name)
+	})
+}
@@ -0,0 +1,167 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/auth"
+	"github.com/aler9/gortsplib/pkg/base"
+	"github.com/aler9/gortsplib/pkg/headers"
+	"github.com/pion/rtp"
+
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// remoteHandler is a minimal RTSP server accepting ANNOUNCE/RECORD with
+// basic authentication.
+type remoteHandler struct {
+	va        *auth.Validator
+	announces chan string
+	packets   chan *rtp.Packet
+}
+
+func (h *remoteHandler) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*base.Response, error) {
+	if err := h.va.ValidateRequest(ctx.Request); err != nil {
+		return &base.Response{StatusCode: base.StatusUnauthorized, Header: base.Header{"WWW-Authenticate": h.va.Header()}}, nil
+	}
+	h.announces <- ctx.Path
+	return &base.Response{StatusCode: base.StatusOK}, nil
+}
+
+func (h *remoteHandler) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	return &base.Response{StatusCode: base.StatusOK}, nil, nil
+}
+
+func (h *remoteHandler) OnRecord(ctx *gortsplib.ServerHandlerOnRecordCtx) (*base.Response, error) {
+	return &base.Response{StatusCode: base.StatusOK}, nil
+}
+
+func (h *remoteHandler) OnPacketRTP(ctx *gortsplib.ServerHandlerOnPacketRTPCtx) {
+	select {
+	case h.packets <- ctx.Packet:
+	default:
+	}
+}
+
+func startPublisher(t *testing.T, m *topic.Manager, id string) {
+	t.Helper()
+	if err := m.RegisterPublisher(context.Background(), "cam1", topic.NewPublisherSession(id)); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	m.SetTopicStream("cam1", gortsplib.NewServerStream(gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1}}))
+}
+
+// waitAnnounce waits for the remote to accept an ANNOUNCE.
+func waitAnnounce(t *testing.T, h *remoteHandler) {
+	t.Helper()
+	select {
+	case path := <-h.announces:
+		if path != "partner/cam1" {
+			t.Fatalf("unexpected announce path %q", path)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("remote saw no ANNOUNCE")
+	}
+}
+
+func waitPacket(t *testing.T, m *topic.Manager, h *remoteHandler) {
+	t.Helper()
+	deadline := time.After(10 * time.Second)
+	for seq := uint16(0); ; seq++ {
+		m.WritePacketRTP("cam1", 0, &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Marker: true}, Payload: []byte{0x05, 1, 2}})
+		select {
+		case <-h.packets:
+			return
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("remote received no RTP")
+		}
+	}
+}
+
+func TestPushTargetFollowsPublisher(t *testing.T) {
+	h := &remoteHandler{
+		va:        auth.NewValidator("user", "secret", []headers.AuthMethod{headers.AuthBasic}),
+		announces: make(chan string, 4),
+		packets:   make(chan *rtp.Packet, 16),
+	}
+	var addr net.Addr
+	srv := &gortsplib.Server{
+		Handler:     h,
+		RTSPAddress: "127.0.0.1:0",
+		Listen: func(network, address string) (net.Listener, error) {
+			ln, err := net.Listen(network, address)
+			if err == nil {
+				addr = ln.Addr()
+			}
+			return ln, err
+		},
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("start remote: %v", err)
+	}
+	defer srv.Close()
+
+	m := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	rm := NewManager(m)
+	defer rm.Close()
+	target := Target{Name: "partner", Topic: "cam1", URL: "rtsp://" + addr.String() + "/partner/cam1", Username: "user", Password: "secret"}
+	if err := rm.Add(target); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := rm.Add(target); err != ErrExists {
+		t.Fatalf("expected duplicate target to fail, got %v", err)
+	}
+	if st := rm.List(); len(st) != 1 || st[0].State != "waiting" || st[0].Transport != "tcp" {
+		t.Fatalf("unexpected status before publishing: %+v", st)
+	}
+
+	startPublisher(t, m, "p1")
+	waitAnnounce(t, h)
+	waitPacket(t, m, h)
+	st := rm.List()[0]
+	if st.State != "recording" || st.ConnectedSince == nil || st.PacketsSent == 0 {
+		t.Fatalf("unexpected status while recording: %+v", st)
+	}
+
+	// a new publisher means new tracks: the target announces again
+	m.UnregisterPublisher("cam1")
+	startPublisher(t, m, "p2")
+	waitAnnounce(t, h)
+	waitPacket(t, m, h)
+	if st := rm.List()[0]; st.Reconnects == 0 {
+		t.Fatalf("expected reconnect to be counted: %+v", st)
+	}
+
+	if err := rm.Remove("cam1", "partner"); err != nil || len(rm.List()) != 0 {
+		t.Fatalf("remove failed: %v", err)
+	}
+}
+
+func TestAddValidatesTarget(t *testing.T) {
+	rm := NewManager(topic.NewManager(topic.Config{}))
+	defer rm.Close()
+	for _, tg := range []Target{
+		{Name: "x", Topic: "cam1", URL: "http://host/path"},
+		{Name: "x", Topic: "cam1", URL: "rtsp://host/path", Transport: "sctp"},
+		{Name: "x", Topic: "cam1", URL: "rtsps://host/path", Transport: "udp"},
+		{Name: "../x", Topic: "cam1", URL: "rtsp://host/path"},
+	} {
+		if err := rm.Add(tg); err == nil {
+			t.Fatalf("expected %+v to be rejected", tg)
+		}
+	}
+}
+
+func TestParseTargets(t *testing.T) {
+	tg, err := ParseTargets("cam1/partner=rtsp://u:p@host:554/a, cam2/vms=rtsp://vms/b")
+	if err != nil || len(tg) != 2 || tg[0].Name != "partner" || tg[1].URL != "rtsp://vms/b" {
+		t.Fatalf("unexpected targets %v %v", tg, err)
+	}
+	if _, err := ParseTargets("cam1=rtsp://host/a"); err == nil {
+		t.Fatalf("expected error without target name")
+	}
+}
@@ -0,0 +1,219 @@
+package rtmpsrv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Minimal AMF0 codec covering what encoders send in RTMP commands and
+// onMetaData: numbers, booleans, strings, objects, ECMA/strict arrays and null.
+
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0ECMAArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0a
+	amf0LongString  = 0x0c
+)
+
+// amfMaxDepth limits how deeply objects and arrays may nest, so that a
+// crafted message cannot exhaust the stack.
+const amfMaxDepth = 32
+
+// amfObject is an AMF0 object or ECMA array.
+type amfObject map[string]interface{}
+
+var (
+	errAMFShort = errors.New("amf0: short buffer")
+	errAMFDepth = errors.New("amf0: nesting too deep")
+)
+
+// amfDecode decodes all values in buf.
+func amfDecode(buf []byte) ([]interface{}, error) {
+	r := bytes.NewReader(buf)
+	var out []interface{}
+	for r.Len() > 0 {
+		v, err := amfReadValue(r, 0)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func amfReadString(r *bytes.Reader, long bool) (string, error) {
+	var n int
+	if long {
+		var l uint32
+		if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+			return "", errAMFShort
+		}
+		n = int(l)
+	} else {
+		var l uint16
+		if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+			return "", errAMFShort
+		}
+		n = int(l)
+	}
+	if n > r.Len() {
+		return "", errAMFShort
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b), nil
+}
+
+func amfReadObject(r *bytes.Reader, depth int) (amfObject, error) {
+	if depth >= amfMaxDepth {
+		return nil, errAMFDepth
+	}
+	obj := amfObject{}
+	for {
+		key, err := amfReadString(r, false)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			marker, err := r.ReadByte()
+			if err != nil {
+				return nil, errAMFShort
+			}
+			if marker == amf0ObjectEnd {
+				return obj, nil
+			}
+			r.UnreadByte()
+		}
+		v, err := amfReadValue(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		obj[key] = v
+	}
+}
+
+// amfReadValue reads one value; depth counts the enclosing objects and
+// arrays.
+func amfReadValue(r *bytes.Reader, depth int) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, errAMFShort
+	}
+	switch marker {
+	case amf0Number:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, errAMFShort
+		}
+		return math.Float64frombits(bits), nil
+	case amf0Boolean:
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errAMFShort
+		}
+		return b != 0, nil
+	case amf0String:
+		return amfReadString(r, false)
+	case amf0LongString:
+		return amfReadString(r, true)
+	case amf0Object:
+		return amfReadObject(r, depth)
+	case amf0Null, amf0Undefined:
+		return nil, nil
+	case amf0ECMAArray:
+		// the count is advisory; the array is terminated like an object
+		if _, err := r.Seek(4, 1); err != nil {
+			return nil, errAMFShort
+		}
+		return amfReadObject(r, depth)
+	case amf0StrictArray:
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, errAMFShort
+		}
+		// every element takes at least its marker byte
+		if int64(n) > int64(r.Len()) {
+			return nil, errAMFShort
+		}
+		if depth >= amfMaxDepth {
+			return nil, errAMFDepth
+		}
+		arr := make([]interface{}, 0, n)
+		for i := uint32(0); i < n; i++ {
+			v, err := amfReadValue(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("amf0: unsupported marker 0x%02x", marker)
+}
+
+// amfEncode encodes values; supported types are float64, int, bool, string,
+// amfObject, nil and []interface{}.
+func amfEncode(values ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, v := range values {
+		amfWriteValue(&b, v)
+	}
+	return b.Bytes()
+}
+
+func amfWriteString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
+
+func amfWriteValue(b *bytes.Buffer, v interface{}) {
+	switch vv := v.(type) {
+	case float64:
+		b.WriteByte(amf0Number)
+		binary.Write(b, binary.BigEndian, math.Float64bits(vv))
+	case int:
+		amfWriteValue(b, float64(vv))
+	case bool:
+		b.WriteByte(amf0Boolean)
+		if vv {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+	case string:
+		b.WriteByte(amf0String)
+		amfWriteString(b, vv)
+	case amfObject:
+		b.WriteByte(amf0Object)
+		// sort keys for deterministic output
+		keys := make([]string, 0, len(vv))
+		for k := range vv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			amfWriteString(b, k)
+			amfWriteValue(b, vv[k])
+		}
+		amfWriteString(b, "")
+		b.WriteByte(amf0ObjectEnd)
+	case []interface{}:
+		b.WriteByte(amf0StrictArray)
+		binary.Write(b, binary.BigEndian, uint32(len(vv)))
+		for _, e := range vv {
+			amfWriteValue(b, e)
+		}
+	default:
+		b.WriteByte(amf0Null)
+	}
+}
@@ -0,0 +1,91 @@
+package rtmpsrv
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAMF0RoundTrip(t *testing.T) {
+	in := []interface{}{
+		"connect",
+		float64(1),
+		amfObject{"app": "live", "tcUrl": "rtmp://localhost/live", "fpad": false, "capabilities": float64(15)},
+		nil,
+		[]interface{}{"a", float64(2)},
+	}
+	out, err := amfDecode(amfEncode(in...))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip mismatch:\n in=%#v\nout=%#v", in, out)
+	}
+
+	// ECMA arrays (onMetaData) decode like objects
+	ecma := []byte{amf0ECMAArray, 0, 0, 0, 1, 0, 5, 'w', 'i', 'd', 't', 'h', amf0Number, 0x40, 0x94, 0, 0, 0, 0, 0, 0, 0, 0, amf0ObjectEnd}
+	vals, err := amfDecode(ecma)
+	if err != nil || len(vals) != 1 || vals[0].(amfObject)["width"] != float64(1280) {
+		t.Fatalf("unexpected ECMA array decode %v %v", vals, err)
+	}
+}
+
+func TestAMF0RejectsHostileInput(t *testing.T) {
+	// a strict array claiming 4G elements must not be allocated up front
+	huge := []byte{amf0StrictArray, 0xff, 0xff, 0xff, 0xff, amf0Null}
+	if _, err := amfDecode(huge); err != errAMFShort {
+		t.Fatalf("expected short buffer for oversized array count, got %v", err)
+	}
+
+	// deeply nested objects and arrays are refused
+	var nested []byte
+	for i := 0; i < 10000; i++ {
+		nested = append(nested, amf0Object, 0, 1, 'k')
+	}
+	if _, err := amfDecode(nested); err != errAMFDepth {
+		t.Fatalf("expected depth error for nested objects, got %v", err)
+	}
+	nested = nested[:0]
+	for i := 0; i < 10000; i++ {
+		nested = append(nested, amf0StrictArray, 0, 0, 0, 1)
+	}
+	nested = append(nested, amf0Null)
+	if _, err := amfDecode(nested); err != errAMFDepth {
+		t.Fatalf("expected depth error for nested arrays, got %v", err)
+	}
+
+	// nesting within the limit still decodes
+	v := interface{}(float64(1))
+	for i := 0; i < amfMaxDepth-1; i++ {
+		v = []interface{}{v}
+	}
+	if _, err := amfDecode(amfEncode(v)); err != nil {
+		t.Fatalf("decode of allowed nesting: %v", err)
+	}
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := newChunkWriter(&buf)
+	w.chunkSize = 100
+	msgs := []*message{
+		{Type: msgVideo, StreamID: 1, Timestamp: 40, Payload: bytes.Repeat([]byte{1}, 250)},
+		{Type: msgAudio, StreamID: 1, Timestamp: 0x1000000, Payload: bytes.Repeat([]byte{2}, 230)},
+	}
+	for _, m := range msgs {
+		if err := w.writeMessage(6, m); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	r := newChunkReader(&buf)
+	r.chunkSize = 100
+	for i, want := range msgs {
+		got, err := r.readMessage()
+		if err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("message %d mismatch: got type=%d ts=%d len=%d", i, got.Type, got.Timestamp, len(got.Payload))
+		}
+	}
+}
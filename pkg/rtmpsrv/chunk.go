@@ -0,0 +1,308 @@
+package rtmpsrv
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// RTMP message types used by publishers.
+const (
+	msgSetChunkSize     = 1
+	msgAbort            = 2
+	msgAck              = 3
+	msgUserControl      = 4
+	msgWindowAckSize    = 5
+	msgSetPeerBandwidth = 6
+	msgAudio            = 8
+	msgVideo            = 9
+	msgDataAMF3         = 15
+	msgCommandAMF3      = 17
+	msgDataAMF0         = 18
+	msgCommandAMF0      = 20
+)
+
+const (
+	handshakeSize = 1536
+	// maxMessageSize bounds a single reassembled message (a large keyframe
+	// at high bitrates still fits comfortably).
+	maxMessageSize = 16 << 20
+	// outChunkSize is announced to the peer right after connect.
+	outChunkSize = 4096
+	// windowAckSize is announced to the peer; it is also the default window
+	// after which we acknowledge received bytes.
+	windowAckSize = 2500000
+)
+
+// message is a reassembled RTMP message.
+type message struct {
+	Type      uint8
+	StreamID  uint32
+	Timestamp uint32
+	Payload   []byte
+}
+
+// serverHandshake performs the plain (unsigned) RTMP handshake: S1 is random
+// and S2 echoes C1. Encoders such as OBS and FFmpeg accept this form.
+func serverHandshake(rw io.ReadWriter) error {
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(rw, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("unsupported rtmp version %d", c0c1[0])
+	}
+	s := make([]byte, 1+2*handshakeSize)
+	s[0] = 3
+	rand.Read(s[1+8 : 1+handshakeSize])
+	copy(s[1+handshakeSize:], c0c1[1:])
+	if _, err := rw.Write(s); err != nil {
+		return err
+	}
+	c2 := make([]byte, handshakeSize)
+	_, err := io.ReadFull(rw, c2)
+	return err
+}
+
+// clientHandshake is the publisher side of serverHandshake.
+func clientHandshake(rw io.ReadWriter) error {
+	c := make([]byte, 1+handshakeSize)
+	c[0] = 3
+	rand.Read(c[1+8:])
+	if _, err := rw.Write(c); err != nil {
+		return err
+	}
+	s := make([]byte, 1+2*handshakeSize)
+	if _, err := io.ReadFull(rw, s); err != nil {
+		return err
+	}
+	_, err := rw.Write(s[1 : 1+handshakeSize])
+	return err
+}
+
+// chunkStream is the per chunk-stream-id header state used to decode the
+// compressed (fmt 1-3) chunk headers.
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typ       uint8
+	streamID  uint32
+	extended  bool
+	buf       []byte
+}
+
+// chunkReader reassembles RTMP messages from chunks.
+type chunkReader struct {
+	r         *bufio.Reader
+	chunkSize uint32
+	streams   map[uint32]*chunkStream
+	// bytesRead counts every byte consumed, for acknowledgements
+	bytesRead uint64
+}
+
+func newChunkReader(r io.Reader) *chunkReader {
+	return &chunkReader{r: bufio.NewReaderSize(r, 64<<10), chunkSize: 128, streams: make(map[uint32]*chunkStream)}
+}
+
+func (cr *chunkReader) readFull(b []byte) error {
+	n, err := io.ReadFull(cr.r, b)
+	cr.bytesRead += uint64(n)
+	return err
+}
+
+func uint24(b []byte) uint32 { return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]) }
+
+// readMessage returns the next complete message. Protocol control messages
+// are returned too so that the caller can react to them, except Set Chunk
+// Size and Abort which are applied here.
+func (cr *chunkReader) readMessage() (*message, error) {
+	for {
+		var hdr [11]byte
+		if err := cr.readFull(hdr[:1]); err != nil {
+			return nil, err
+		}
+		format := hdr[0] >> 6
+		csid := uint32(hdr[0] & 0x3f)
+		switch csid {
+		case 0:
+			if err := cr.readFull(hdr[:1]); err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(hdr[0])
+		case 1:
+			if err := cr.readFull(hdr[:2]); err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(hdr[0]) + uint32(hdr[1])<<8
+		}
+		cs, ok := cr.streams[csid]
+		if !ok {
+			if format != 0 {
+				return nil, fmt.Errorf("chunk stream %d starts with fmt %d", csid, format)
+			}
+			cs = &chunkStream{}
+			cr.streams[csid] = cs
+		}
+
+		var ts uint32
+		switch format {
+		case 0:
+			if err := cr.readFull(hdr[:11]); err != nil {
+				return nil, err
+			}
+			ts = uint24(hdr[0:3])
+			cs.length = uint24(hdr[3:6])
+			cs.typ = hdr[6]
+			cs.streamID = binary.LittleEndian.Uint32(hdr[7:11])
+		case 1:
+			if err := cr.readFull(hdr[:7]); err != nil {
+				return nil, err
+			}
+			ts = uint24(hdr[0:3])
+			cs.length = uint24(hdr[3:6])
+			cs.typ = hdr[6]
+		case 2:
+			if err := cr.readFull(hdr[:3]); err != nil {
+				return nil, err
+			}
+			ts = uint24(hdr[0:3])
+		}
+		if format != 3 {
+			cs.extended = ts == 0xffffff
+		}
+		if cs.extended {
+			var ext [4]byte
+			if err := cr.readFull(ext[:]); err != nil {
+				return nil, err
+			}
+			ts = binary.BigEndian.Uint32(ext[:])
+		}
+		// a new message starts when the buffer is empty; fmt 3 continuation
+		// chunks of the same message leave the timestamp unchanged
+		if len(cs.buf) == 0 {
+			switch format {
+			case 0:
+				cs.timestamp = ts
+				cs.delta = 0
+			case 1, 2:
+				cs.delta = ts
+				cs.timestamp += ts
+			case 3:
+				cs.timestamp += cs.delta
+			}
+		}
+		if cs.length > maxMessageSize {
+			return nil, fmt.Errorf("message of %d bytes exceeds limit", cs.length)
+		}
+
+		n := cs.length - uint32(len(cs.buf))
+		if n > cr.chunkSize {
+			n = cr.chunkSize
+		}
+		start := len(cs.buf)
+		cs.buf = append(cs.buf, make([]byte, n)...)
+		if err := cr.readFull(cs.buf[start:]); err != nil {
+			return nil, err
+		}
+		if uint32(len(cs.buf)) < cs.length {
+			continue
+		}
+
+		msg := &message{Type: cs.typ, StreamID: cs.streamID, Timestamp: cs.timestamp, Payload: cs.buf}
+		cs.buf = nil
+		switch msg.Type {
+		case msgSetChunkSize:
+			if len(msg.Payload) < 4 {
+				return nil, errors.New("short set chunk size")
+			}
+			size := binary.BigEndian.Uint32(msg.Payload) & 0x7fffffff
+			if size == 0 || size > maxMessageSize {
+				return nil, fmt.Errorf("invalid chunk size %d", size)
+			}
+			cr.chunkSize = size
+			continue
+		case msgAbort:
+			if len(msg.Payload) >= 4 {
+				if s, ok := cr.streams[binary.BigEndian.Uint32(msg.Payload)]; ok {
+					s.buf = nil
+				}
+			}
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// chunkWriter writes messages using fmt 0 for the first chunk and fmt 3 for
+// continuations.
+type chunkWriter struct {
+	w         *bufio.Writer
+	chunkSize int
+}
+
+func newChunkWriter(w io.Writer) *chunkWriter {
+	return &chunkWriter{w: bufio.NewWriter(w), chunkSize: 128}
+}
+
+func (cw *chunkWriter) writeMessage(csid uint8, msg *message) error {
+	var hdr [16]byte
+	hdr[0] = csid & 0x3f
+	ts := msg.Timestamp
+	extended := ts >= 0xffffff
+	if extended {
+		ts = 0xffffff
+	}
+	hdr[1], hdr[2], hdr[3] = byte(ts>>16), byte(ts>>8), byte(ts)
+	l := len(msg.Payload)
+	hdr[4], hdr[5], hdr[6] = byte(l>>16), byte(l>>8), byte(l)
+	hdr[7] = msg.Type
+	binary.LittleEndian.PutUint32(hdr[8:12], msg.StreamID)
+	n := 12
+	if extended {
+		binary.BigEndian.PutUint32(hdr[12:16], msg.Timestamp)
+		n = 16
+	}
+	if _, err := cw.w.Write(hdr[:n]); err != nil {
+		return err
+	}
+	payload := msg.Payload
+	for {
+		c := len(payload)
+		if c > cw.chunkSize {
+			c = cw.chunkSize
+		}
+		if _, err := cw.w.Write(payload[:c]); err != nil {
+			return err
+		}
+		payload = payload[c:]
+		if len(payload) == 0 {
+			break
+		}
+		cont := []byte{0xc0 | csid&0x3f}
+		if extended {
+			cont = binary.BigEndian.AppendUint32(cont, msg.Timestamp)
+		}
+		if _, err := cw.w.Write(cont); err != nil {
+			return err
+		}
+	}
+	return cw.w.Flush()
+}
+
+// writeControl sends a protocol control message carrying a single uint32.
+func (cw *chunkWriter) writeControl(typ uint8, v uint32) error {
+	return cw.writeMessage(2, &message{Type: typ, Payload: binary.BigEndian.AppendUint32(nil, v)})
+}
+
+// setChunkSize announces and applies a new outgoing chunk size.
+func (cw *chunkWriter) setChunkSize(size int) error {
+	if err := cw.writeControl(msgSetChunkSize, uint32(size)); err != nil {
+		return err
+	}
+	cw.chunkSize = size
+	return nil
+}
@@ -0,0 +1,291 @@
+package rtmpsrv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/h264"
+	"github.com/aler9/gortsplib/pkg/mpeg4audio"
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtph264"
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtpmpeg4audio"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// FLV codec identifiers.
+const (
+	flvCodecAVC = 7
+	flvCodecAAC = 10
+)
+
+// trackWait bounds how long (in stream time) frames are dropped while the
+// sequence headers announced by onMetaData have not all arrived yet.
+const trackWait = 2 * time.Second
+
+// flvPublisher converts FLV-wrapped H.264/AAC into RTP packets for a topic.
+// The topic's tracks are created once the codec configuration is known.
+type flvPublisher struct {
+	mgr   *topic.Manager
+	topic string
+
+	// codec configuration from the sequence headers
+	sps, pps    []byte
+	nalLenSize  int
+	aacConfig   *mpeg4audio.Config
+	expectVideo bool
+	expectAudio bool
+	firstFrame  time.Duration
+	seenFrame   bool
+
+	// set once the tracks were published
+	ready      bool
+	videoTrack *gortsplib.TrackH264
+	videoID    int
+	videoEnc   *rtph264.Encoder
+	audioID    int
+	audioEnc   *rtpmpeg4audio.Encoder
+
+	warned map[string]bool
+}
+
+func newFLVPublisher(mgr *topic.Manager, topicName string) *flvPublisher {
+	return &flvPublisher{mgr: mgr, topic: topicName, nalLenSize: 4, videoID: -1, audioID: -1, warned: make(map[string]bool)}
+}
+
+// warnOnce logs a problem with the incoming stream only the first time.
+func (p *flvPublisher) warnOnce(key, format string, v ...interface{}) {
+	if p.warned[key] {
+		return
+	}
+	p.warned[key] = true
+	plog.Warn("rtmp: topic %s: "+format, append([]interface{}{p.topic}, v...)...)
+}
+
+// onMetadata records which media the encoder announced so that track
+// creation can wait for both sequence headers.
+func (p *flvPublisher) onMetadata(md amfObject) {
+	if v, ok := md["videocodecid"].(float64); ok && v != 0 {
+		p.expectVideo = true
+	}
+	if v, ok := md["audiocodecid"].(float64); ok && v != 0 {
+		p.expectAudio = true
+	}
+}
+
+// tracks returns the codecs of the published tracks.
+func (p *flvPublisher) tracks() []string {
+	var out []string
+	if p.videoID >= 0 {
+		out = append(out, "H264")
+	}
+	if p.audioID >= 0 {
+		out = append(out, "MPEG4-audio")
+	}
+	return out
+}
+
+// setup creates the topic stream once the expected codec configurations are
+// known, or when waiting any longer would only delay the stream.
+func (p *flvPublisher) setup(now time.Duration) bool {
+	if p.ready {
+		return true
+	}
+	if !p.seenFrame {
+		p.seenFrame = true
+		p.firstFrame = now
+	}
+	complete := (!p.expectVideo || p.sps != nil) && (!p.expectAudio || p.aacConfig != nil)
+	if !complete && now-p.firstFrame < trackWait {
+		return false
+	}
+	var tracks gortsplib.Tracks
+	if p.sps != nil && p.pps != nil {
+		p.videoTrack = &gortsplib.TrackH264{PayloadType: 96, SPS: p.sps, PPS: p.pps, PacketizationMode: 1}
+		p.videoID = len(tracks)
+		p.videoEnc = p.videoTrack.CreateEncoder()
+		tracks = append(tracks, p.videoTrack)
+	}
+	if p.aacConfig != nil {
+		t := &gortsplib.TrackMPEG4Audio{PayloadType: 97, Config: p.aacConfig, SizeLength: 13, IndexLength: 3, IndexDeltaLength: 3}
+		p.audioID = len(tracks)
+		p.audioEnc = t.CreateEncoder()
+		tracks = append(tracks, t)
+	}
+	if len(tracks) == 0 {
+		return false
+	}
+	// a topic held during a migration keeps its stream and subscribers if
+	// the tracks are the same
+	if p.mgr.OpenTopicStream(p.topic, tracks) {
+		plog.Info("rtmp: publisher for topic %s took over its stream", p.topic)
+	}
+	p.ready = true
+	plog.Info("rtmp: topic %s tracks ready: %v", p.topic, p.tracks())
+	return true
+}
+
+// onVideo handles an FLV video tag body.
+func (p *flvPublisher) onVideo(ts uint32, data []byte) error {
+	if len(data) < 5 {
+		return nil
+	}
+	if codec := data[0] & 0x0f; codec != flvCodecAVC {
+		p.warnOnce("video", "unsupported video codec id %d (only H.264 is supported)", codec)
+		return nil
+	}
+	cts := int32(uint24(data[2:5])<<8) >> 8 // signed 24 bit
+	body := data[5:]
+	if data[1] == 0 { // AVCDecoderConfigurationRecord
+		sps, pps, lenSize, err := parseAVCConfig(body)
+		if err != nil {
+			return err
+		}
+		p.sps, p.pps, p.nalLenSize = sps, pps, lenSize
+		if p.videoTrack != nil {
+			p.videoTrack.SafeSetSPS(sps)
+			p.videoTrack.SafeSetPPS(pps)
+		}
+		return nil
+	}
+	if data[1] != 1 { // end of sequence
+		return nil
+	}
+
+	dts := time.Duration(ts) * time.Millisecond
+	if !p.setup(dts) || p.videoEnc == nil {
+		return nil
+	}
+	nalus, err := splitNALUs(body, p.nalLenSize)
+	if err != nil {
+		return err
+	}
+	if len(nalus) == 0 {
+		return nil
+	}
+	// most RTMP encoders only send parameter sets in the sequence header;
+	// repeat them in-band so RTSP clients can join at any keyframe
+	if h264.IDRPresent(nalus) && !hasParameterSets(nalus) {
+		nalus = append([][]byte{p.videoTrack.SafeSPS(), p.videoTrack.SafePPS()}, nalus...)
+	}
+	pkts, err := p.videoEnc.Encode(nalus, dts+time.Duration(cts)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	for _, pkt := range pkts {
+		p.mgr.WritePacketRTP(p.topic, p.videoID, pkt)
+	}
+	return nil
+}
+
+// onAudio handles an FLV audio tag body.
+func (p *flvPublisher) onAudio(ts uint32, data []byte) error {
+	if len(data) < 2 {
+		return nil
+	}
+	if format := data[0] >> 4; format != flvCodecAAC {
+		p.warnOnce("audio", "unsupported audio format %d (only AAC is supported)", format)
+		return nil
+	}
+	if data[1] == 0 { // AudioSpecificConfig
+		var conf mpeg4audio.Config
+		if err := conf.Unmarshal(data[2:]); err != nil {
+			return fmt.Errorf("invalid AAC config: %w", err)
+		}
+		if p.audioEnc == nil {
+			p.aacConfig = &conf
+		}
+		return nil
+	}
+	pts := time.Duration(ts) * time.Millisecond
+	if !p.setup(pts) || p.audioEnc == nil || len(data) == 2 {
+		return nil
+	}
+	pkts, err := p.audioEnc.Encode([][]byte{data[2:]}, pts)
+	if err != nil {
+		return err
+	}
+	for _, pkt := range pkts {
+		p.mgr.WritePacketRTP(p.topic, p.audioID, pkt)
+	}
+	return nil
+}
+
+// parseAVCConfig extracts the first SPS and PPS and the NALU length size from
+// an AVCDecoderConfigurationRecord.
+func parseAVCConfig(b []byte) (sps, pps []byte, lenSize int, err error) {
+	errInvalid := errors.New("invalid AVC decoder configuration record")
+	if len(b) < 6 {
+		return nil, nil, 0, errInvalid
+	}
+	lenSize = int(b[4]&0x03) + 1
+	pos := 6 // after numOfSequenceParameterSets
+	readSets := func(count int) ([]byte, error) {
+		var first []byte
+		for i := 0; i < count; i++ {
+			if pos+2 > len(b) {
+				return nil, errInvalid
+			}
+			l := int(binary.BigEndian.Uint16(b[pos:]))
+			pos += 2
+			if pos+l > len(b) {
+				return nil, errInvalid
+			}
+			if first == nil {
+				first = append([]byte(nil), b[pos:pos+l]...)
+			}
+			pos += l
+		}
+		return first, nil
+	}
+	if sps, err = readSets(int(b[5] & 0x1f)); err != nil {
+		return nil, nil, 0, err
+	}
+	if pos >= len(b) {
+		return nil, nil, 0, errInvalid
+	}
+	numPPS := int(b[pos])
+	pos++
+	if pps, err = readSets(numPPS); err != nil {
+		return nil, nil, 0, err
+	}
+	if sps == nil || pps == nil {
+		return nil, nil, 0, errInvalid
+	}
+	return sps, pps, lenSize, nil
+}
+
+// splitNALUs splits length-prefixed NAL units.
+func splitNALUs(b []byte, lenSize int) ([][]byte, error) {
+	var out [][]byte
+	for len(b) > 0 {
+		if len(b) < lenSize {
+			return nil, errors.New("truncated NALU length")
+		}
+		l := 0
+		for i := 0; i < lenSize; i++ {
+			l = l<<8 | int(b[i])
+		}
+		b = b[lenSize:]
+		if l > len(b) {
+			return nil, errors.New("truncated NALU")
+		}
+		if l > 0 {
+			out = append(out, b[:l])
+		}
+		b = b[l:]
+	}
+	return out, nil
+}
+
+func hasParameterSets(nalus [][]byte) bool {
+	for _, n := range nalus {
+		if h264.NALUType(n[0]&0x1f) == h264.NALUTypeSPS {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,393 @@
+package rtmpsrv
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"redalf.de/rtsper/pkg/cluster"
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+const (
+	// appName is the only RTMP application accepted: rtmp://host/live/{topic}
+	appName          = "live"
+	handshakeTimeout = 10 * time.Second
+	// readTimeout closes publishers that stop sending anything at all
+	readTimeout = 30 * time.Second
+)
+
+// Config configures the RTMP listener.
+type Config struct {
+	Port int
+	// StreamKeys maps topic names to the key that must be passed as
+	// "{topic}?key=..." when publishing; the "*" entry applies to every
+	// topic without its own entry. When the map is empty no key is required,
+	// otherwise topics without a matching entry are refused.
+	StreamKeys map[string]string
+}
+
+// ParseStreamKeys parses "topic:key" pairs separated by commas, e.g.
+// "cam1:s3cret,*:global".
+func ParseStreamKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, key, ok := strings.Cut(item, ":")
+		if !ok || name == "" || key == "" {
+			return nil, fmt.Errorf("invalid stream key entry %q (want topic:key)", item)
+		}
+		keys[name] = key
+	}
+	return keys, nil
+}
+
+// Server accepts RTMP publishers and feeds their streams into topics, so
+// that encoders such as OBS or FFmpeg can publish without speaking RTSP.
+type Server struct {
+	mgr     *topic.Manager
+	cluster *cluster.Cluster
+	cfg     Config
+	ln      net.Listener
+
+	mu    sync.Mutex
+	conns map[*conn]struct{}
+	wg    sync.WaitGroup
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewServer creates an RTMP server; cl may be nil when clustering is not
+// configured.
+func NewServer(mgr *topic.Manager, cl *cluster.Cluster, cfg Config) *Server {
+	return &Server{mgr: mgr, cluster: cl, cfg: cfg, conns: make(map[*conn]struct{}), done: make(chan struct{})}
+}
+
+// Start opens the listener and accepts connections in the background until
+// ctx is cancelled or Close is called.
+func (s *Server) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", s.cfg.Port))
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	plog.Info("rtmp: listening on %s", ln.Addr())
+	s.wg.Add(1)
+	go s.acceptLoop()
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+	return nil
+}
+
+// Addr returns the listener address once started.
+func (s *Server) Addr() net.Addr {
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				plog.Error("rtmp: accept: %v", err)
+			}
+			return
+		}
+		c := &conn{s: s, nc: nc, r: newChunkReader(nc), w: newChunkWriter(nc)}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c.run()
+		}()
+	}
+}
+
+// Close stops accepting connections and disconnects all publishers.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	s.mu.Lock()
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// keyAllowed validates the stream key presented for a topic.
+func (s *Server) keyAllowed(topicName, key string) bool {
+	if len(s.cfg.StreamKeys) == 0 {
+		return true
+	}
+	want, ok := s.cfg.StreamKeys[topicName]
+	if !ok {
+		want, ok = s.cfg.StreamKeys["*"]
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(key)) == 1
+}
+
+// conn is one RTMP client connection.
+type conn struct {
+	s  *Server
+	nc net.Conn
+	r  *chunkReader
+	w  *chunkWriter
+
+	peerWindow uint32
+	lastAck    uint64
+
+	// set while publishing
+	topic string
+	pub   *topic.PublisherSession
+	flv   *flvPublisher
+}
+
+// errPublishRefused closes the connection after the refusal was reported.
+var errPublishRefused = errors.New("publish refused")
+
+func (c *conn) run() {
+	remote := c.nc.RemoteAddr().String()
+	defer func() {
+		c.unpublish()
+		c.nc.Close()
+		c.s.mu.Lock()
+		delete(c.s.conns, c)
+		c.s.mu.Unlock()
+		plog.Debug("rtmp: connection %s closed", remote)
+	}()
+
+	c.nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := serverHandshake(c.nc); err != nil {
+		plog.Debug("rtmp: handshake with %s failed: %v", remote, err)
+		return
+	}
+	c.nc.SetDeadline(time.Time{})
+	for {
+		c.nc.SetReadDeadline(time.Now().Add(readTimeout))
+		msg, err := c.r.readMessage()
+		if err != nil {
+			plog.Debug("rtmp: read from %s: %v", remote, err)
+			return
+		}
+		if err := c.acknowledge(); err != nil {
+			return
+		}
+		if err := c.handle(msg); err != nil {
+			if !errors.Is(err, errPublishRefused) {
+				plog.Info("rtmp: closing %s: %v", remote, err)
+			}
+			return
+		}
+	}
+}
+
+// acknowledge reports received bytes once the peer's window is exhausted.
+func (c *conn) acknowledge() error {
+	if c.peerWindow == 0 || c.r.bytesRead-c.lastAck < uint64(c.peerWindow) {
+		return nil
+	}
+	c.lastAck = c.r.bytesRead
+	return c.w.writeControl(msgAck, uint32(c.r.bytesRead))
+}
+
+func (c *conn) handle(msg *message) error {
+	switch msg.Type {
+	case msgWindowAckSize:
+		if len(msg.Payload) >= 4 {
+			c.peerWindow = binary.BigEndian.Uint32(msg.Payload)
+		}
+	case msgCommandAMF0, msgCommandAMF3:
+		payload := msg.Payload
+		if msg.Type == msgCommandAMF3 && len(payload) > 0 {
+			payload = payload[1:]
+		}
+		vals, err := amfDecode(payload)
+		if err != nil {
+			return err
+		}
+		return c.handleCommand(msg.StreamID, vals)
+	case msgDataAMF0:
+		vals, err := amfDecode(msg.Payload)
+		if err != nil || c.flv == nil {
+			return nil
+		}
+		if len(vals) > 1 && vals[0] == "@setDataFrame" {
+			vals = vals[1:]
+		}
+		if len(vals) > 1 && vals[0] == "onMetaData" {
+			if md, ok := vals[1].(amfObject); ok {
+				c.flv.onMetadata(md)
+			}
+		}
+	case msgVideo:
+		if c.flv != nil {
+			return c.flv.onVideo(msg.Timestamp, msg.Payload)
+		}
+	case msgAudio:
+		if c.flv != nil {
+			return c.flv.onAudio(msg.Timestamp, msg.Payload)
+		}
+	}
+	return nil
+}
+
+func (c *conn) handleCommand(streamID uint32, vals []interface{}) error {
+	if len(vals) < 2 {
+		return nil
+	}
+	name, _ := vals[0].(string)
+	txn, _ := vals[1].(float64)
+	switch name {
+	case "connect":
+		var app string
+		if len(vals) > 2 {
+			if obj, ok := vals[2].(amfObject); ok {
+				app, _ = obj["app"].(string)
+			}
+		}
+		app, _, _ = strings.Cut(strings.Trim(app, "/"), "?")
+		if app != appName {
+			c.sendCommand(0, "_error", txn, nil, amfObject{"level": "error", "code": "NetConnection.Connect.Rejected", "description": "unknown application " + app})
+			return errPublishRefused
+		}
+		if err := c.w.writeControl(msgWindowAckSize, windowAckSize); err != nil {
+			return err
+		}
+		// Set Peer Bandwidth: window size plus limit type 2 (dynamic)
+		bw := append(binary.BigEndian.AppendUint32(nil, windowAckSize), 2)
+		if err := c.w.writeMessage(2, &message{Type: msgSetPeerBandwidth, Payload: bw}); err != nil {
+			return err
+		}
+		if err := c.w.setChunkSize(outChunkSize); err != nil {
+			return err
+		}
+		return c.sendCommand(0, "_result", txn,
+			amfObject{"fmsVer": "FMS/3,0,1,123", "capabilities": 31},
+			amfObject{"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded.", "objectEncoding": 0})
+	case "releaseStream", "FCPublish":
+		return c.sendCommand(0, "_result", txn, nil, nil)
+	case "createStream":
+		return c.sendCommand(0, "_result", txn, nil, 1)
+	case "publish":
+		var name string
+		if len(vals) > 3 {
+			name, _ = vals[3].(string)
+		}
+		return c.publish(streamID, name)
+	case "FCUnpublish", "deleteStream", "closeStream":
+		c.unpublish()
+	}
+	return nil
+}
+
+// publish validates the stream name and key and registers the publisher.
+func (c *conn) publish(streamID uint32, name string) error {
+	if c.flv != nil {
+		return c.refuse(streamID, "NetStream.Publish.BadName", "already publishing")
+	}
+	topicName, query, _ := strings.Cut(name, "?")
+	key := ""
+	if q, err := url.ParseQuery(query); err == nil {
+		key = q.Get("key")
+	}
+	if !topic.ValidName(topicName) {
+		return c.refuse(streamID, "NetStream.Publish.BadName", "invalid topic name")
+	}
+	if !c.s.keyAllowed(topicName, key) {
+		plog.Info("rtmp: rejected publish for topic %s from %s: invalid stream key", topicName, c.nc.RemoteAddr())
+		return c.refuse(streamID, "NetStream.Publish.Unauthorized", "invalid stream key")
+	}
+	// publishers must connect to the owner, exactly like RTSP ANNOUNCE
+	if cl := c.s.cluster; cl != nil {
+		a := cl.Admit(topicName, true)
+		if !cl.IsSelf(a.Owner) {
+			plog.Info("rtmp: publish for topic %s routed to owner %s (not local)", topicName, a.Owner)
+			return c.refuse(streamID, "NetStream.Publish.Denied", "topic owned by "+a.Owner)
+		}
+		if a.Overloaded != "" {
+			plog.Info("rtmp: publish for topic %s refused: node is overloaded", topicName)
+			metrics.IncOverloadRejections("503")
+			return c.refuse(streamID, "NetStream.Publish.Denied", "node is overloaded")
+		}
+	}
+	pub := topic.NewPublisherSession(fmt.Sprintf("rtmp-%p", c))
+	if err := c.s.mgr.RegisterPublisher(context.Background(), topicName, pub); err != nil {
+		plog.Info("rtmp: register publisher for %s failed: %v", topicName, err)
+		code := "NetStream.Publish.Denied"
+		if errors.Is(err, topic.ErrTopicHasPublisher) {
+			code = "NetStream.Publish.BadName"
+		}
+		return c.refuse(streamID, code, err.Error())
+	}
+	// a kicked publisher (e.g. while draining) is disconnected so that it
+	// reconnects to the new owner
+	go func() {
+		<-pub.Done()
+		c.nc.Close()
+	}()
+	c.topic = topicName
+	c.pub = pub
+	c.flv = newFLVPublisher(c.s.mgr, topicName)
+	plog.Info("rtmp: %s publishing topic %s", c.nc.RemoteAddr(), topicName)
+
+	// User Control: Stream Begin
+	begin := []byte{0, 0, byte(streamID >> 24), byte(streamID >> 16), byte(streamID >> 8), byte(streamID)}
+	if err := c.w.writeMessage(2, &message{Type: msgUserControl, Payload: begin}); err != nil {
+		return err
+	}
+	return c.sendStatus(streamID, "status", "NetStream.Publish.Start", topicName+" is now published.")
+}
+
+// refuse reports a failed publish and ends the connection.
+func (c *conn) refuse(streamID uint32, code, description string) error {
+	c.sendStatus(streamID, "error", code, description)
+	return errPublishRefused
+}
+
+func (c *conn) unpublish() {
+	if c.flv == nil {
+		return
+	}
+	c.s.mgr.UnregisterPublisherSession(c.topic, c.pub)
+	plog.Info("rtmp: topic %s unpublished", c.topic)
+	c.flv = nil
+	c.pub = nil
+	c.topic = ""
+}
+
+func (c *conn) sendCommand(streamID uint32, name string, txn float64, args ...interface{}) error {
+	payload := amfEncode(append([]interface{}{name, txn}, args...)...)
+	return c.w.writeMessage(3, &message{Type: msgCommandAMF0, StreamID: streamID, Payload: payload})
+}
+
+func (c *conn) sendStatus(streamID uint32, level, code, description string) error {
+	payload := amfEncode("onStatus", 0, nil, amfObject{"level": level, "code": code, "description": description})
+	return c.w.writeMessage(5, &message{Type: msgCommandAMF0, StreamID: streamID, Payload: payload})
+}
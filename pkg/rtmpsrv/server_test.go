@@ -0,0 +1,213 @@
+package rtmpsrv
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"redalf.de/rtsper/pkg/topic"
+)
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0, 0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00, 0x00, 0x03, 0x00, 0x3d, 0x08}
+	testPPS = []byte{0x68, 0xee, 0x3c, 0x80}
+)
+
+// testClient is a minimal RTMP publisher built on the package's chunk layer.
+type testClient struct {
+	nc net.Conn
+	r  *chunkReader
+	w  *chunkWriter
+}
+
+func dialClient(t *testing.T, addr net.Addr, app string) (*testClient, []interface{}) {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	nc.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := clientHandshake(nc); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	tc := &testClient{nc: nc, r: newChunkReader(nc), w: newChunkWriter(nc)}
+	tc.command(0, "connect", 1, amfObject{"app": app, "tcUrl": "rtmp://localhost/" + app})
+	return tc, tc.readCommand(t)
+}
+
+func (tc *testClient) command(streamID uint32, args ...interface{}) error {
+	return tc.w.writeMessage(3, &message{Type: msgCommandAMF0, StreamID: streamID, Payload: amfEncode(args...)})
+}
+
+// readCommand returns the next command message, skipping control messages.
+func (tc *testClient) readCommand(t *testing.T) []interface{} {
+	t.Helper()
+	for {
+		msg, err := tc.r.readMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if msg.Type != msgCommandAMF0 {
+			continue
+		}
+		vals, err := amfDecode(msg.Payload)
+		if err != nil {
+			t.Fatalf("decode command: %v", err)
+		}
+		return vals
+	}
+}
+
+// publish runs createStream + publish and returns the onStatus code.
+func (tc *testClient) publish(t *testing.T, name string) string {
+	t.Helper()
+	tc.command(0, "createStream", 2, nil)
+	if vals := tc.readCommand(t); vals[0] != "_result" {
+		t.Fatalf("createStream failed: %v", vals)
+	}
+	tc.command(1, "publish", 3, nil, name, "live")
+	vals := tc.readCommand(t)
+	if vals[0] != "onStatus" || len(vals) < 4 {
+		t.Fatalf("unexpected publish reply %v", vals)
+	}
+	return vals[3].(amfObject)["code"].(string)
+}
+
+func (tc *testClient) media(typ uint8, ts uint32, payload []byte) {
+	tc.w.writeMessage(6, &message{Type: typ, StreamID: 1, Timestamp: ts, Payload: payload})
+}
+
+func startServer(t *testing.T, m *topic.Manager, cfg Config) *Server {
+	t.Helper()
+	s := NewServer(m, nil, cfg)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestPublishH264AAC(t *testing.T) {
+	m := topic.NewManager(topic.Config{MaxPublishers: 2, MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	s := startServer(t, m, Config{StreamKeys: map[string]string{"cam1": "s3cret"}})
+
+	received := make(chan *topic.InboundPacket, 64)
+	m.AddTap("cam1", "test", func(p *topic.InboundPacket) {
+		select {
+		case received <- p:
+		default:
+		}
+	})
+
+	tc, vals := dialClient(t, s.Addr(), "live")
+	defer tc.nc.Close()
+	if vals[0] != "_result" {
+		t.Fatalf("connect failed: %v", vals)
+	}
+	if code := tc.publish(t, "cam1?key=s3cret"); code != "NetStream.Publish.Start" {
+		t.Fatalf("publish: %s", code)
+	}
+
+	tc.w.writeMessage(4, &message{Type: msgDataAMF0, StreamID: 1, Payload: amfEncode("@setDataFrame", "onMetaData", amfObject{"videocodecid": 7, "audiocodecid": 10})})
+	avcC := []byte{1, testSPS[1], testSPS[2], testSPS[3], 0xff, 0xe1}
+	avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(testSPS)))
+	avcC = append(avcC, testSPS...)
+	avcC = append(avcC, 1)
+	avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(testPPS)))
+	avcC = append(avcC, testPPS...)
+	tc.media(msgVideo, 0, append([]byte{0x17, 0, 0, 0, 0}, avcC...))
+	tc.media(msgAudio, 0, []byte{0xaf, 0, 0x12, 0x10})
+
+	idr := []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+	frame := append([]byte{0x17, 1, 0, 0, 0}, binary.BigEndian.AppendUint32(nil, uint32(len(idr)))...)
+	tc.media(msgVideo, 40, append(frame, idr...))
+	tc.media(msgAudio, 40, []byte{0xaf, 1, 0x21, 0x10, 0x04})
+
+	seen := map[int]bool{}
+	deadline := time.After(5 * time.Second)
+	for !seen[0] || !seen[1] {
+		select {
+		case p := <-received:
+			seen[p.Track] = true
+		case <-deadline:
+			t.Fatalf("tracks with packets: %v", seen)
+		}
+	}
+	st := m.GetTopicStream("cam1")
+	if st == nil || len(st.Tracks()) != 2 || st.Tracks()[0].String() != "H264" || st.Tracks()[1].String() != "MPEG4-audio" {
+		t.Fatalf("unexpected topic tracks")
+	}
+	if m.Status().PublisherCount != 1 {
+		t.Fatalf("expected one registered publisher")
+	}
+
+	// disconnecting unregisters the publisher
+	tc.nc.Close()
+	for i := 0; m.Status().PublisherCount != 0; i++ {
+		if i > 100 {
+			t.Fatalf("publisher not unregistered after disconnect")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPublishRefused(t *testing.T) {
+	m := topic.NewManager(topic.Config{MaxPublishers: 1, MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	s := startServer(t, m, Config{StreamKeys: map[string]string{"*": "global"}})
+
+	tc, vals := dialClient(t, s.Addr(), "other")
+	tc.nc.Close()
+	if vals[0] != "_error" {
+		t.Fatalf("expected connect to unknown app to fail, got %v", vals)
+	}
+
+	tc, _ = dialClient(t, s.Addr(), "live")
+	if code := tc.publish(t, "cam1?key=wrong"); code != "NetStream.Publish.Unauthorized" {
+		t.Fatalf("expected unauthorized, got %s", code)
+	}
+	tc.nc.Close()
+
+	if err := m.RegisterPublisher(context.Background(), "cam0", topic.NewPublisherSession("p0")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	tc, _ = dialClient(t, s.Addr(), "live")
+	if code := tc.publish(t, "cam1?key=global"); code != "NetStream.Publish.Denied" {
+		t.Fatalf("expected max publishers to deny, got %s", code)
+	}
+	tc.nc.Close()
+}
+
+func TestParseStreamKeys(t *testing.T) {
+	keys, err := ParseStreamKeys("cam1:a, *:b")
+	if err != nil || keys["cam1"] != "a" || keys["*"] != "b" {
+		t.Fatalf("unexpected keys %v %v", keys, err)
+	}
+	if _, err := ParseStreamKeys("cam1"); err == nil {
+		t.Fatalf("expected error for entry without key")
+	}
+}
+
+func TestStopsWhenContextCancelled(t *testing.T) {
+	s := NewServer(topic.NewManager(topic.Config{}), nil, Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer s.Close()
+	addr := s.Addr().String()
+	cancel()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("listener still open after the context was cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
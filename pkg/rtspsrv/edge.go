@@ -0,0 +1,376 @@
+package rtspsrv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/base"
+	"github.com/aler9/gortsplib/pkg/liberrors"
+	"github.com/aler9/gortsplib/pkg/url"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+const (
+	// edgeIdleTimeout is how long a pull started by a DESCRIBE waits for a
+	// session to play it before it is dropped.
+	edgeIdleTimeout = 10 * time.Second
+	// edgeOwnerCheck is how often a pull checks that its source still owns
+	// the topic.
+	edgeOwnerCheck = time.Second
+)
+
+var (
+	// errEdgeNotFound is returned when the owner has no such topic.
+	errEdgeNotFound = errors.New("topic not found on owner")
+	// errEdgeFull is returned when the topic's subscriber limit is reached.
+	errEdgeFull = errors.New("subscriber limit reached")
+	// errTracksChanged is returned when a node serves a topic with other
+	// tracks than the local stream.
+	errTracksChanged = errors.New("topic tracks changed")
+)
+
+// EdgeStatus describes one pull of a remote topic for the admin API.
+type EdgeStatus struct {
+	Topic       string     `json:"topic"`
+	Owner       string     `json:"owner"`
+	State       string     `json:"state"`
+	Subscribers int        `json:"subscribers"`
+	Since       *time.Time `json:"since,omitempty"`
+	Packets     int64      `json:"packets"`
+}
+
+// edgePull is a single RTSP read of a topic from its owner, republished as
+// a local stream.
+type edgePull struct {
+	topic string
+	owner string
+
+	// ready is closed once stream is set or err is known
+	ready  chan struct{}
+	stream *gortsplib.ServerStream
+	err    error
+	since  time.Time
+
+	done     chan struct{}
+	stopOnce sync.Once
+	packets  atomic.Int64
+
+	// guarded by edgeRelay.mu
+	sessions map[*gortsplib.ServerSession]struct{}
+	idle     *time.Timer
+}
+
+func (p *edgePull) stop() {
+	p.stopOnce.Do(func() { close(p.done) })
+}
+
+// edgeRelay serves subscribers of topics owned by other nodes from a single
+// pull per topic instead of proxying every connection to the owner.
+type edgeRelay struct {
+	srv *Server
+
+	mu    sync.Mutex
+	pulls map[string]*edgePull
+}
+
+func newEdgeRelay(s *Server) *edgeRelay {
+	return &edgeRelay{srv: s, pulls: make(map[string]*edgePull)}
+}
+
+// stream returns the local stream of topic, starting a pull from owner if
+// there is none yet.
+func (e *edgeRelay) stream(topicName, owner string) (*edgePull, error) {
+	e.mu.Lock()
+	p, ok := e.pulls[topicName]
+	if !ok {
+		p = &edgePull{
+			topic:    topicName,
+			owner:    owner,
+			ready:    make(chan struct{}),
+			done:     make(chan struct{}),
+			sessions: make(map[*gortsplib.ServerSession]struct{}),
+		}
+		e.pulls[topicName] = p
+		// nobody plays it yet; drop it unless a session attaches
+		p.idle = time.AfterFunc(edgeIdleTimeout, func() { e.dropIdle(p) })
+		metrics.SetEdgePulls(len(e.pulls))
+		go e.run(p)
+	}
+	e.mu.Unlock()
+
+	<-p.ready
+	if p.err != nil {
+		return nil, p.err
+	}
+	select {
+	case <-p.done:
+		return nil, errors.New("edge pull stopped")
+	default:
+	}
+	return p, nil
+}
+
+// attach registers sess as a reader of topic and returns the stream.
+func (e *edgeRelay) attach(topicName, owner string, sess *gortsplib.ServerSession) (*gortsplib.ServerStream, error) {
+	p, err := e.stream(topicName, owner)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pulls[topicName] != p {
+		return nil, errors.New("edge pull stopped")
+	}
+	if _, ok := p.sessions[sess]; !ok {
+		if max := e.srv.mgr.Config().MaxSubscribersPerTopic; max > 0 && len(p.sessions) >= max {
+			return nil, errEdgeFull
+		}
+		p.sessions[sess] = struct{}{}
+		metrics.SetEdgeSubscribers(topicName, len(p.sessions))
+	}
+	if p.idle != nil {
+		p.idle.Stop()
+		p.idle = nil
+	}
+	return p.stream, nil
+}
+
+// detach removes sess and drops the pull when it was the last reader.
+func (e *edgeRelay) detach(topicName string, sess *gortsplib.ServerSession) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	p, ok := e.pulls[topicName]
+	if !ok {
+		return
+	}
+	if _, ok := p.sessions[sess]; !ok {
+		return
+	}
+	delete(p.sessions, sess)
+	metrics.SetEdgeSubscribers(topicName, len(p.sessions))
+	if len(p.sessions) == 0 {
+		plog.Info("edge: topic %s: last local subscriber left, dropping pull from %s", topicName, p.owner)
+		p.stop()
+	}
+}
+
+func (e *edgeRelay) dropIdle(p *edgePull) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(p.sessions) == 0 {
+		p.stop()
+	}
+}
+
+// run reads the topic from its owner until the pull is stopped or the
+// owner ends the stream. When ownership moves, the pull follows the new
+// owner if it serves the topic with the same tracks, e.g. after a
+// migration; otherwise local readers are disconnected and reconnect
+// through the new owner.
+func (e *edgeRelay) run(p *edgePull) {
+	var st *gortsplib.ServerStream
+	var c *gortsplib.Client
+	defer func() {
+		e.mu.Lock()
+		if e.pulls[p.topic] == p {
+			delete(e.pulls, p.topic)
+			metrics.DeleteEdgeSubscribers(p.topic)
+		}
+		if p.idle != nil {
+			p.idle.Stop()
+		}
+		metrics.SetEdgePulls(len(e.pulls))
+		e.mu.Unlock()
+		p.stop()
+		if c != nil {
+			c.Close()
+		}
+		if p.stream != nil {
+			p.stream.Close()
+		}
+	}()
+
+	c, err := e.open(p, p.owner, &st)
+	if err != nil {
+		if errors.Is(err, errEdgeNotFound) {
+			plog.Debug("edge: topic %s: %v", p.topic, err)
+		} else {
+			plog.Warn("edge: topic %s: pull from %s failed: %v", p.topic, p.owner, err)
+			metrics.IncForwardFailed()
+		}
+		p.err = err
+		close(p.ready)
+		return
+	}
+	p.stream = st
+	p.since = time.Now()
+	close(p.ready)
+	plog.Info("edge: topic %s: pulling from owner %s", p.topic, p.owner)
+
+	waitErr := clientWait(c)
+	ticker := time.NewTicker(edgeOwnerCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-waitErr:
+			plog.Info("edge: topic %s: pull from %s ended: %v", p.topic, p.owner, err)
+			return
+		case <-ticker.C:
+			cl := e.srv.cluster
+			if cl == nil {
+				continue
+			}
+			owner := cl.Owner(p.topic)
+			if owner == p.owner {
+				continue
+			}
+			if owner != "" && !cl.IsSelf(owner) {
+				nc, err := e.open(p, owner, &st)
+				if err == nil {
+					plog.Info("edge: topic %s: owner moved from %s to %s, now pulling from it", p.topic, p.owner, owner)
+					c.Close()
+					c = nc
+					waitErr = clientWait(c)
+					e.mu.Lock()
+					p.owner = owner
+					e.mu.Unlock()
+					continue
+				}
+				plog.Debug("edge: topic %s: cannot follow new owner %s: %v", p.topic, owner, err)
+			}
+			plog.Info("edge: topic %s: owner moved from %s to %s, restarting readers", p.topic, p.owner, owner)
+			return
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// clientWait returns a channel that receives the result of c.Wait.
+func clientWait(c *gortsplib.Client) <-chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- c.Wait() }()
+	return ch
+}
+
+// open describes and plays the topic on owner. A new *st is set before
+// playback starts so that no packet is lost; an existing one is kept if
+// owner serves the same tracks.
+func (e *edgeRelay) open(p *edgePull, owner string, st **gortsplib.ServerStream) (*gortsplib.Client, error) {
+	tr := gortsplib.TransportTCP
+	c := &gortsplib.Client{
+		Transport:   &tr,
+		UserAgent:   "rtsper-edge",
+		ReadTimeout: e.srv.proxyIOTimeout,
+		OnPacketRTP: func(ctx *gortsplib.ClientOnPacketRTPCtx) {
+			(*st).WritePacketRTP(ctx.TrackID, ctx.Packet)
+			p.packets.Add(1)
+		},
+	}
+	tracks, baseURL, err := e.srv.describe(c, owner, p.topic)
+	if err != nil {
+		return nil, err
+	}
+	created := false
+	switch {
+	case *st == nil:
+		*st = gortsplib.NewServerStream(tracks)
+		created = true
+	case !topic.SameTracks((*st).Tracks(), tracks):
+		c.Close()
+		return nil, errTracksChanged
+	}
+	if err := c.SetupAndPlay(tracks, baseURL); err != nil {
+		c.Close()
+		if created {
+			(*st).Close()
+			*st = nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// subscribeAddr returns the address of node's subscriber listener, taken
+// from its membership entry if it has one.
+func (s *Server) subscribeAddr(node string) string {
+	if s.cluster == nil {
+		return net.JoinHostPort(node, strconv.Itoa(s.subPort))
+	}
+	return s.cluster.SubscribeAddr(node, s.subPort)
+}
+
+// describe connects c to the subscriber listener of node, over TLS when
+// peer TLS is configured, and describes topic.
+func (s *Server) describe(c *gortsplib.Client, node string, topicName string) (gortsplib.Tracks, *url.URL, error) {
+	c.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return s.dialPeer(ctx, node, addr)
+	}
+	u, err := url.Parse("rtsp://" + s.subscribeAddr(node) + "/" + topicName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := c.Start(u.Scheme, u.Host); err != nil {
+		return nil, nil, err
+	}
+	tracks, baseURL, _, err := c.Describe(u)
+	if err != nil {
+		c.Close()
+		var bad liberrors.ErrClientBadStatusCode
+		if errors.As(err, &bad) && bad.Code == base.StatusNotFound {
+			return nil, nil, errEdgeNotFound
+		}
+		return nil, nil, err
+	}
+	return tracks, baseURL, nil
+}
+
+// close stops all pulls.
+func (e *edgeRelay) close() {
+	e.mu.Lock()
+	pulls := make([]*edgePull, 0, len(e.pulls))
+	for _, p := range e.pulls {
+		pulls = append(pulls, p)
+	}
+	e.mu.Unlock()
+	for _, p := range pulls {
+		p.stop()
+	}
+}
+
+func (e *edgeRelay) list() []EdgeStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]EdgeStatus, 0, len(e.pulls))
+	for _, p := range e.pulls {
+		s := EdgeStatus{
+			Topic:       p.topic,
+			Owner:       p.owner,
+			State:       "connecting",
+			Subscribers: len(p.sessions),
+			Packets:     p.packets.Load(),
+		}
+		select {
+		case <-p.ready:
+			if p.err == nil {
+				s.State = "playing"
+				since := p.since
+				s.Since = &since
+			}
+		default:
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Topic < out[j].Topic })
+	return out
+}
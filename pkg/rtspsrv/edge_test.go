@@ -0,0 +1,117 @@
+package rtspsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtp"
+
+	"redalf.de/rtsper/pkg/cluster"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// remoteTopic returns a topic name owned by the peer of cl.
+func remoteTopic(t *testing.T, cl *cluster.Cluster) string {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("cam%d", i)
+		if !cl.IsSelf(cl.Owner(name)) {
+			return name
+		}
+	}
+	t.Fatalf("no topic owned by peer")
+	return ""
+}
+
+func TestEdgePullServesLocalSubscribers(t *testing.T) {
+	// the owner is a plain server; the edge reaches it as node 127.0.0.1
+	pubPort, subPort := freePort(t), freePort(t)
+	m := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	owner := NewServer(m, pubPort, subPort, nil, nil, false, time.Second, 5*time.Second)
+	if err := owner.Start(context.Background()); err != nil {
+		t.Fatalf("start owner: %v", err)
+	}
+	defer owner.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	cl, err := cluster.NewFromCSV("edge,127.0.0.1", "edge")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	name := remoteTopic(t, cl)
+	// the edge is not started: it only needs the owner's subscriber port
+	edge := NewServer(topic.NewManager(topic.Config{MaxSubscribersPerTopic: 1}), 0, subPort, nil, cl, true, time.Second, 5*time.Second)
+	edge.SetEdgeRelay(true)
+	defer edge.Close()
+
+	if _, err := edge.edge.attach(name, "127.0.0.1", &gortsplib.ServerSession{}); !errors.Is(err, errEdgeNotFound) {
+		t.Fatalf("expected not found before publishing, got %v", err)
+	}
+
+	tracks := gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1}}
+	pub := &gortsplib.Client{}
+	if err := pub.StartPublishing(fmt.Sprintf("rtsp://127.0.0.1:%d/%s", pubPort, name), tracks); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	defer pub.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for seq := uint16(0); ; seq++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			pub.WritePacketRTP(0, &rtp.Packet{
+				Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, SSRC: 1},
+				Payload: []byte{0x05, 0x01},
+			})
+		}
+	}()
+
+	s1, s2 := &gortsplib.ServerSession{}, &gortsplib.ServerSession{}
+	st, err := edge.edge.attach(name, "127.0.0.1", s1)
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	if len(st.Tracks()) != 1 {
+		t.Fatalf("expected the owner's track, got %d", len(st.Tracks()))
+	}
+	if _, err := edge.edge.attach(name, "127.0.0.1", s2); !errors.Is(err, errEdgeFull) {
+		t.Fatalf("expected subscriber limit, got %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pulls := edge.EdgePulls()
+		if len(pulls) == 1 && pulls[0].State == "playing" && pulls[0].Packets > 0 {
+			if pulls[0].Subscribers != 1 || pulls[0].Owner != "127.0.0.1" {
+				t.Fatalf("unexpected pull status %+v", pulls[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pull never received packets: %+v", pulls)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// the owner serves one reader however many local subscribers there are
+	if n := m.Status().Topics[0].SubscriberCount; n != 1 {
+		t.Fatalf("owner has %d subscribers, want 1", n)
+	}
+
+	edge.edge.detach(name, s1)
+	deadline = time.Now().Add(5 * time.Second)
+	for len(edge.EdgePulls()) != 0 || m.Status().Topics[0].SubscriberCount != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pull not dropped after the last subscriber left")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,363 @@
+package rtspsrv
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+)
+
+// tunnelContentType marks both halves of a QuickTime-style RTSP-over-HTTP
+// tunnel.
+const tunnelContentType = "application/x-rtsp-tunnelled"
+
+// tunnelPairTimeout is how long a GET channel waits for its POST channel.
+const tunnelPairTimeout = 10 * time.Second
+
+var errListenerClosed = errors.New("listener closed")
+
+// tunnelListener accepts RTSP-over-HTTP tunnels: a client opens a GET
+// connection that carries server→client RTSP and a POST connection carrying
+// base64 encoded client→server RTSP, both tagged with the same
+// x-sessioncookie. Each tunnel is returned from Accept as one net.Conn so the
+// gortsplib server (and serverHandler) treat it like a direct connection.
+type tunnelListener struct {
+	ln    net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+
+	mu       sync.Mutex
+	sessions map[string]*tunnelConn
+	closed   bool
+}
+
+func newTunnelListener(ln net.Listener) *tunnelListener {
+	t := &tunnelListener{
+		ln:       ln,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		sessions: make(map[string]*tunnelConn),
+	}
+	go t.acceptLoop()
+	return t
+}
+
+func (t *tunnelListener) acceptLoop() {
+	for {
+		nconn, err := t.ln.Accept()
+		if err != nil {
+			t.Close()
+			return
+		}
+		go t.handle(nconn)
+	}
+}
+
+func (t *tunnelListener) handle(nconn net.Conn) {
+	nconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(nconn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		nconn.Close()
+		return
+	}
+	nconn.SetReadDeadline(time.Time{})
+	cookie := req.Header.Get("x-sessioncookie")
+	if cookie == "" {
+		nconn.Write([]byte("HTTP/1.0 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		nconn.Close()
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		t.handleGet(nconn, cookie)
+	case http.MethodPost:
+		t.handlePost(nconn, br, cookie)
+	default:
+		nconn.Write([]byte("HTTP/1.0 405 Method Not Allowed\r\nConnection: close\r\n\r\n"))
+		nconn.Close()
+	}
+}
+
+func (t *tunnelListener) handleGet(nconn net.Conn, cookie string) {
+	t.mu.Lock()
+	if _, ok := t.sessions[cookie]; ok || t.closed {
+		t.mu.Unlock()
+		nconn.Write([]byte("HTTP/1.0 409 Conflict\r\nConnection: close\r\n\r\n"))
+		nconn.Close()
+		return
+	}
+	tc := newTunnelConn(nconn)
+	t.sessions[cookie] = tc
+	t.mu.Unlock()
+
+	_, err := nconn.Write([]byte("HTTP/1.0 200 OK\r\n" +
+		"Server: rtsper\r\n" +
+		"Connection: close\r\n" +
+		"Cache-Control: no-store\r\n" +
+		"Pragma: no-cache\r\n" +
+		"Content-Type: " + tunnelContentType + "\r\n\r\n"))
+	if err != nil {
+		t.remove(cookie, tc)
+		tc.Close()
+		return
+	}
+
+	// the session is handed to the RTSP server once its POST channel arrives
+	select {
+	case <-tc.paired:
+	case <-time.After(tunnelPairTimeout):
+		plog.Info("http tunnel from %s: no POST channel, closing", nconn.RemoteAddr())
+		t.remove(cookie, tc)
+		tc.Close()
+		return
+	case <-t.done:
+		tc.Close()
+		return
+	}
+	select {
+	case t.conns <- tc:
+		metrics.IncHTTPTunnels()
+		plog.Info("http tunnel opened from %s", nconn.RemoteAddr())
+	case <-t.done:
+		tc.Close()
+		return
+	}
+	<-tc.closed
+	t.remove(cookie, tc)
+}
+
+func (t *tunnelListener) handlePost(nconn net.Conn, br *bufio.Reader, cookie string) {
+	t.mu.Lock()
+	tc, ok := t.sessions[cookie]
+	t.mu.Unlock()
+	if !ok {
+		nconn.Write([]byte("HTTP/1.0 404 Not Found\r\nConnection: close\r\n\r\n"))
+		nconn.Close()
+		return
+	}
+	// clients may re-open the POST channel; the RTSP connection stays up
+	tc.feed(nconn, br)
+}
+
+func (t *tunnelListener) remove(cookie string, tc *tunnelConn) {
+	t.mu.Lock()
+	if t.sessions[cookie] == tc {
+		delete(t.sessions, cookie)
+	}
+	t.mu.Unlock()
+}
+
+func (t *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-t.conns:
+		return c, nil
+	case <-t.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (t *tunnelListener) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	close(t.done)
+	return t.ln.Close()
+}
+
+func (t *tunnelListener) Addr() net.Addr { return t.ln.Addr() }
+
+// tunnelConn joins the two halves of a tunnel. Reads return the decoded POST
+// data through an in-memory pipe (which provides deadlines), writes go to the
+// GET connection unencoded.
+type tunnelConn struct {
+	get net.Conn
+	// r is read by the RTSP server, w is written by the POST decoder
+	r, w net.Conn
+
+	paired     chan struct{}
+	pairOnce   sync.Once
+	closed     chan struct{}
+	closeOnce  sync.Once
+	feedMu     sync.Mutex
+	postMu     sync.Mutex
+	activePost net.Conn
+}
+
+func newTunnelConn(get net.Conn) *tunnelConn {
+	r, w := net.Pipe()
+	tc := &tunnelConn{get: get, r: r, w: w, paired: make(chan struct{}), closed: make(chan struct{})}
+	// the GET channel carries no more client data; a read error means the
+	// client went away
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := get.Read(buf); err != nil {
+				tc.Close()
+				return
+			}
+		}
+	}()
+	return tc
+}
+
+// feed decodes one POST channel into the pipe until it ends.
+func (tc *tunnelConn) feed(post net.Conn, br *bufio.Reader) {
+	tc.postMu.Lock()
+	if tc.activePost != nil {
+		tc.activePost.Close()
+	}
+	tc.activePost = post
+	tc.postMu.Unlock()
+	tc.pairOnce.Do(func() { close(tc.paired) })
+
+	tc.feedMu.Lock()
+	defer tc.feedMu.Unlock()
+	defer post.Close()
+	dec := &base64Stream{}
+	buf := make([]byte, 4096)
+	for {
+		n, err := br.Read(buf)
+		if n > 0 {
+			out, derr := dec.decode(buf[:n])
+			if derr != nil {
+				plog.Info("http tunnel from %s: %v", post.RemoteAddr(), derr)
+				tc.Close()
+				return
+			}
+			if len(out) > 0 {
+				if _, err := tc.w.Write(out); err != nil {
+					return
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (tc *tunnelConn) Read(p []byte) (int, error)  { return tc.r.Read(p) }
+func (tc *tunnelConn) Write(p []byte) (int, error) { return tc.get.Write(p) }
+
+func (tc *tunnelConn) Close() error {
+	tc.closeOnce.Do(func() {
+		close(tc.closed)
+		tc.r.Close()
+		tc.w.Close()
+		tc.get.Close()
+		tc.postMu.Lock()
+		if tc.activePost != nil {
+			tc.activePost.Close()
+		}
+		tc.postMu.Unlock()
+	})
+	return nil
+}
+
+// RemoteAddr is the address of the GET channel, so logs and session
+// listings show the real client.
+func (tc *tunnelConn) RemoteAddr() net.Addr               { return tc.get.RemoteAddr() }
+func (tc *tunnelConn) LocalAddr() net.Addr                { return tc.get.LocalAddr() }
+func (tc *tunnelConn) SetReadDeadline(t time.Time) error  { return tc.r.SetReadDeadline(t) }
+func (tc *tunnelConn) SetWriteDeadline(t time.Time) error { return tc.get.SetWriteDeadline(t) }
+func (tc *tunnelConn) SetDeadline(t time.Time) error {
+	tc.r.SetReadDeadline(t)
+	return tc.get.SetWriteDeadline(t)
+}
+
+// base64Stream decodes the POST body. Clients encode each RTSP message on
+// its own, so padding may appear in the middle of the stream; decoding is
+// done in padded quantums.
+type base64Stream struct {
+	pending []byte
+}
+
+func (d *base64Stream) decode(in []byte) ([]byte, error) {
+	for _, c := range in {
+		if c != '\r' && c != '\n' && c != ' ' && c != '\t' {
+			d.pending = append(d.pending, c)
+		}
+	}
+	n := len(d.pending) - len(d.pending)%4
+	out := make([]byte, 0, n/4*3)
+	for start := 0; start < n; {
+		// decode up to and including the next quantum carrying padding
+		end := start
+		for end < n {
+			end += 4
+			if d.pending[end-1] == '=' {
+				break
+			}
+		}
+		chunk := make([]byte, base64.StdEncoding.DecodedLen(end-start))
+		m, err := base64.StdEncoding.Decode(chunk, d.pending[start:end])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunk[:m]...)
+		start = end
+	}
+	d.pending = append(d.pending[:0], d.pending[n:]...)
+	return out, nil
+}
+
+// multiListener merges several listeners into one.
+type multiListener struct {
+	lns   []net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newMultiListener(lns ...net.Listener) *multiListener {
+	m := &multiListener{lns: lns, conns: make(chan net.Conn), done: make(chan struct{})}
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					m.Close()
+					return
+				}
+				select {
+				case m.conns <- c:
+				case <-m.done:
+					c.Close()
+					return
+				}
+			}
+		}(ln)
+	}
+	return m
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-m.conns:
+		return c, nil
+	case <-m.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+		for _, ln := range m.lns {
+			ln.Close()
+		}
+	})
+	return nil
+}
+
+func (m *multiListener) Addr() net.Addr { return m.lns[0].Addr() }
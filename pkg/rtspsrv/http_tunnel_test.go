@@ -0,0 +1,165 @@
+package rtspsrv
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtp"
+
+	"redalf.de/rtsper/pkg/topic"
+)
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// readRTSPResponse reads one RTSP response (headers and body) from the GET channel.
+func readRTSPResponse(t *testing.T, br *bufio.Reader) (string, string) {
+	t.Helper()
+	var head strings.Builder
+	length := 0
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		head.WriteString(line)
+		if k, v, ok := strings.Cut(line, ":"); ok && strings.EqualFold(k, "Content-Length") {
+			fmt.Sscanf(strings.TrimSpace(v), "%d", &length)
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(br, body); err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return head.String(), string(body)
+}
+
+func TestHTTPTunnelSubscriber(t *testing.T) {
+	m := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	if err := m.RegisterPublisher(context.Background(), "cam1", topic.NewPublisherSession("p1")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	m.SetTopicStream("cam1", gortsplib.NewServerStream(gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1}}))
+
+	s := NewServer(m, freePort(t), freePort(t), nil, nil, false, time.Second, 5*time.Second)
+	s.SetHTTPTunnelPort(freePort(t))
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer s.Close()
+	addr := s.HTTPTunnelAddr().(*net.TCPAddr)
+	tunnelAddr := fmt.Sprintf("127.0.0.1:%d", addr.Port)
+
+	get, err := net.Dial("tcp", tunnelAddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer get.Close()
+	get.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(get, "GET /cam1 HTTP/1.0\r\nx-sessioncookie: abc123\r\nAccept: application/x-rtsp-tunnelled\r\n\r\n")
+	br := bufio.NewReader(get)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != tunnelContentType {
+		t.Fatalf("unexpected GET response: %v %v", res, err)
+	}
+
+	post, err := net.Dial("tcp", tunnelAddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer post.Close()
+	fmt.Fprintf(post, "POST /cam1 HTTP/1.0\r\nx-sessioncookie: abc123\r\nContent-Type: application/x-rtsp-tunnelled\r\nContent-Length: 32767\r\n\r\n")
+	send := func(req string) {
+		// each request is encoded separately, as QuickTime does
+		if _, err := post.Write([]byte(base64.StdEncoding.EncodeToString([]byte(req)))); err != nil {
+			t.Fatalf("post: %v", err)
+		}
+	}
+
+	base := "rtsp://" + tunnelAddr + "/cam1"
+	send("DESCRIBE " + base + " RTSP/1.0\r\nCSeq: 1\r\nAccept: application/sdp\r\n\r\n")
+	head, body := readRTSPResponse(t, br)
+	if !strings.HasPrefix(head, "RTSP/1.0 200") || !strings.Contains(body, "H264/90000") {
+		t.Fatalf("unexpected DESCRIBE response:\n%s\n%s", head, body)
+	}
+
+	send("SETUP " + base + "/trackID=0 RTSP/1.0\r\nCSeq: 2\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n\r\n")
+	head, _ = readRTSPResponse(t, br)
+	if !strings.HasPrefix(head, "RTSP/1.0 200") {
+		t.Fatalf("unexpected SETUP response:\n%s", head)
+	}
+	var session string
+	for _, line := range strings.Split(head, "\r\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok && strings.EqualFold(k, "Session") {
+			session, _, _ = strings.Cut(strings.TrimSpace(v), ";")
+		}
+	}
+
+	send("PLAY " + base + " RTSP/1.0\r\nCSeq: 3\r\nSession: " + session + "\r\n\r\n")
+	head, _ = readRTSPResponse(t, br)
+	if !strings.HasPrefix(head, "RTSP/1.0 200") {
+		t.Fatalf("unexpected PLAY response:\n%s", head)
+	}
+	if st := m.Status(); len(st.Topics) != 1 || st.Topics[0].SubscriberCount != 1 {
+		t.Fatalf("expected tunneled subscriber to be registered: %+v", st.Topics)
+	}
+
+	// RTP arrives interleaved on the GET channel
+	m.WritePacketRTP("cam1", 0, &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: 7, Marker: true}, Payload: []byte{0x05, 1, 2}})
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			t.Fatalf("read interleaved: %v", err)
+		}
+		if b != '$' {
+			continue
+		}
+		hdr := make([]byte, 3)
+		io.ReadFull(br, hdr)
+		frame := make([]byte, int(hdr[1])<<8|int(hdr[2]))
+		io.ReadFull(br, frame)
+		if hdr[0] != 0 {
+			continue
+		}
+		var p rtp.Packet
+		if err := p.Unmarshal(frame); err != nil || p.SequenceNumber != 7 {
+			t.Fatalf("unexpected RTP frame: %v %+v", err, p.Header)
+		}
+		return
+	}
+}
+
+func TestBase64StreamPaddedChunks(t *testing.T) {
+	var d base64Stream
+	enc := base64.StdEncoding.EncodeToString([]byte("a")) + base64.StdEncoding.EncodeToString([]byte("bcde"))
+	var out []byte
+	for i := 0; i < len(enc); i += 3 {
+		b, err := d.decode([]byte(enc[i:min(i+3, len(enc))]))
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		out = append(out, b...)
+	}
+	if string(out) != "abcde" {
+		t.Fatalf("got %q", out)
+	}
+}
@@ -0,0 +1,222 @@
+package rtspsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// errNotMigrating is returned by StopPull for topics without a pull.
+var errNotMigrating = errors.New("topic is not being pulled")
+
+const (
+	// migrationStandbyTimeout is how long a migrated topic waits for its
+	// publisher once the pull that fed it was stopped.
+	migrationStandbyTimeout = 30 * time.Second
+	// migrationCheck is how often a handed-over topic checks whether it
+	// still has local subscribers.
+	migrationCheck = time.Second
+)
+
+// migrationPull feeds a local topic from another node while the topic is
+// migrated (see PullTopic and HandOver).
+type migrationPull struct {
+	topic string
+	from  string
+	pub   *topic.PublisherSession
+	// handover pulls serve the subscribers left on the previous owner
+	handover bool
+	// keep is set when the pull is stopped but its publisher should hold
+	// the topic for the real one
+	keep     bool
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func (p *migrationPull) stop() {
+	p.stopOnce.Do(func() { close(p.stopped) })
+}
+
+// PullTopic starts feeding topicName from node from, the current owner, so
+// that this node can take the topic over: the topic is held by a standby
+// publisher with the owner's tracks, and the real publisher replaces it on
+// ANNOUNCE without disconnecting local subscribers.
+func (s *Server) PullTopic(topicName, from string) error {
+	return s.startMigrationPull(topicName, from, false)
+}
+
+// StopPull stops the pull started by PullTopic. With keep, the topic stays
+// held for its publisher for a while; otherwise it is removed.
+func (s *Server) StopPull(topicName string, keep bool) error {
+	s.mu.Lock()
+	p, ok := s.migrations[topicName]
+	if ok && !p.handover {
+		p.keep = keep
+	}
+	s.mu.Unlock()
+	if !ok || p.handover {
+		return errNotMigrating
+	}
+	p.stop()
+	return nil
+}
+
+// HandOver moves the local publisher of topicName to node to, which already
+// pulls the topic and owns it now: the local stream is fed from to instead,
+// so that local subscribers stay connected, and the publisher is asked to
+// reconnect. The pull ends when the last local subscriber leaves.
+func (s *Server) HandOver(topicName, to string) error {
+	return s.startMigrationPull(topicName, to, true)
+}
+
+func (s *Server) startMigrationPull(topicName, from string, handover bool) error {
+	if !handover {
+		// the migration replaces a replica held by this node
+		s.stopReplica(topicName)
+	}
+	p := &migrationPull{topic: topicName, from: from, handover: handover, stopped: make(chan struct{})}
+	s.mu.Lock()
+	if s.migrations == nil {
+		s.migrations = make(map[string]*migrationPull)
+	}
+	if _, ok := s.migrations[topicName]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("topic %s is already being migrated", topicName)
+	}
+	s.migrations[topicName] = p
+	s.mu.Unlock()
+
+	c, err := s.openMigrationPull(p)
+	if err != nil {
+		s.mu.Lock()
+		delete(s.migrations, topicName)
+		s.mu.Unlock()
+		return err
+	}
+	go s.runMigrationPull(c, p)
+	return nil
+}
+
+// openMigrationPull plays the topic on p.from and installs its standby
+// publisher.
+func (s *Server) openMigrationPull(p *migrationPull) (*gortsplib.Client, error) {
+	tr := gortsplib.TransportTCP
+	c := &gortsplib.Client{
+		Transport:   &tr,
+		UserAgent:   "rtsper-migrate",
+		ReadTimeout: s.proxyIOTimeout,
+		OnPacketRTP: func(ctx *gortsplib.ClientOnPacketRTPCtx) {
+			s.mgr.WritePacketRTP(p.topic, ctx.TrackID, ctx.Packet)
+		},
+	}
+	tracks, baseURL, err := s.describe(c, p.from, p.topic)
+	if err != nil {
+		return nil, err
+	}
+	p.pub = topic.NewStandbyPublisherSession("migrate-" + p.from)
+	if p.handover {
+		// the previous owner keeps its stream and subscribers; the new
+		// owner's stream was created from it, so the tracks match
+		st := s.mgr.GetTopicStream(p.topic)
+		if st == nil || !topic.SameTracks(st.Tracks(), tracks) {
+			c.Close()
+			return nil, errTracksChanged
+		}
+		if err := s.mgr.ReplacePublisher(p.topic, p.pub); err != nil {
+			c.Close()
+			return nil, err
+		}
+	} else {
+		if err := s.mgr.RegisterPublisher(context.Background(), p.topic, p.pub); err != nil {
+			c.Close()
+			return nil, err
+		}
+		s.mgr.SetTopicStream(p.topic, gortsplib.NewServerStream(tracks))
+	}
+	if err := c.SetupAndPlay(tracks, baseURL); err != nil {
+		c.Close()
+		s.mgr.UnregisterPublisherSession(p.topic, p.pub)
+		return nil, err
+	}
+	if p.handover {
+		plog.Info("migrate: topic %s handed over to %s, serving local subscribers from it", p.topic, p.from)
+	} else {
+		plog.Info("migrate: topic %s: pulling from owner %s", p.topic, p.from)
+	}
+	return c, nil
+}
+
+func (s *Server) runMigrationPull(c *gortsplib.Client, p *migrationPull) {
+	defer func() {
+		s.mu.Lock()
+		if s.migrations[p.topic] == p {
+			delete(s.migrations, p.topic)
+		}
+		s.mu.Unlock()
+	}()
+
+	waitErr := clientWait(c)
+	ticker := time.NewTicker(migrationCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-waitErr:
+			plog.Info("migrate: topic %s: pull from %s ended: %v", p.topic, p.from, err)
+		case <-p.pub.Done():
+			// replaced by the real publisher, or kicked
+			plog.Debug("migrate: topic %s: standby publisher left", p.topic)
+			c.Close()
+		case <-p.stopped:
+			c.Close()
+			s.mu.Lock()
+			keep := p.keep
+			s.mu.Unlock()
+			if keep {
+				s.awaitPublisher(p)
+				return
+			}
+		case <-ticker.C:
+			if !p.handover || s.subscribers(p.topic) > 0 {
+				continue
+			}
+			plog.Info("migrate: topic %s: last local subscriber left, dropping pull from %s", p.topic, p.from)
+			c.Close()
+		}
+		s.mgr.UnregisterPublisherSession(p.topic, p.pub)
+		return
+	}
+}
+
+// awaitPublisher holds the topic for its publisher, which replaces the
+// standby one, until migrationStandbyTimeout.
+func (s *Server) awaitPublisher(p *migrationPull) {
+	s.mu.Lock()
+	if s.migrations[p.topic] == p {
+		delete(s.migrations, p.topic)
+	}
+	s.mu.Unlock()
+	plog.Info("migrate: topic %s: waiting for its publisher", p.topic)
+	select {
+	case <-p.pub.Done():
+	case <-time.After(migrationStandbyTimeout):
+		plog.Warn("migrate: topic %s: publisher did not connect within %s", p.topic, migrationStandbyTimeout)
+	}
+	s.mgr.UnregisterPublisherSession(p.topic, p.pub)
+}
+
+// subscribers returns the number of local subscribers of topicName.
+func (s *Server) subscribers(topicName string) int {
+	for _, t := range s.mgr.Status().Topics {
+		if t.Name == topicName {
+			return t.SubscriberCount
+		}
+	}
+	return 0
+}
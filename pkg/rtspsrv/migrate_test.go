@@ -0,0 +1,101 @@
+package rtspsrv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtp"
+
+	"redalf.de/rtsper/pkg/topic"
+)
+
+func TestMigrationPullHoldsTopicForPublisher(t *testing.T) {
+	// the owner is a plain server; the target reaches it as node 127.0.0.1
+	pubPort, subPort := freePort(t), freePort(t)
+	m := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	owner := NewServer(m, pubPort, subPort, nil, nil, false, time.Second, 5*time.Second)
+	if err := owner.Start(context.Background()); err != nil {
+		t.Fatalf("start owner: %v", err)
+	}
+	defer owner.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	tracks := gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1}}
+	pub := &gortsplib.Client{}
+	if err := pub.StartPublishing(fmt.Sprintf("rtsp://127.0.0.1:%d/cam1", pubPort), tracks); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	defer pub.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for seq := uint16(0); ; seq++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			pub.WritePacketRTP(0, &rtp.Packet{
+				Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, SSRC: 1},
+				Payload: []byte{0x05, 0x01},
+			})
+		}
+	}()
+
+	// the target is not started: it only needs the owner's subscriber port
+	tm := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	target := NewServer(tm, 0, subPort, nil, nil, false, time.Second, 5*time.Second)
+	defer target.Close()
+	if err := target.StopPull("cam1", true); err == nil {
+		t.Fatalf("expected an error stopping a pull that was not started")
+	}
+	if err := target.PullTopic("cam1", "127.0.0.1"); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if err := target.PullTopic("cam1", "127.0.0.1"); err == nil {
+		t.Fatalf("expected an error pulling the topic twice")
+	}
+	st := tm.GetTopicStream("cam1")
+	if st == nil || len(st.Tracks()) != 1 {
+		t.Fatalf("expected the owner's track on the target")
+	}
+	waitFor(t, "packets on the target", func() bool {
+		ts := tm.Status().Topics
+		return len(ts) == 1 && ts[0].Standby && ts[0].BytesIn > 0
+	})
+
+	// the pull stops reading from the owner but holds the topic
+	if err := target.StopPull("cam1", true); err != nil {
+		t.Fatalf("stop pull: %v", err)
+	}
+	waitFor(t, "the pull to leave the owner", func() bool { return m.Status().Topics[0].SubscriberCount == 0 })
+	if ts := tm.Status().Topics; len(ts) != 1 || !ts[0].Standby {
+		t.Fatalf("topic not held after the pull stopped: %+v", ts)
+	}
+
+	// the real publisher takes the stream over
+	if err := tm.RegisterPublisher(context.Background(), "cam1", topic.NewPublisherSession("p1")); err != nil {
+		t.Fatalf("register publisher: %v", err)
+	}
+	if tm.GetTopicStream("cam1") != st {
+		t.Fatalf("stream not kept for the publisher")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if ts := tm.Status().Topics; len(ts) != 1 || !ts[0].HasPublisher || ts[0].Standby {
+		t.Fatalf("publisher removed by the pull: %+v", ts)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
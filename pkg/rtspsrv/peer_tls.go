@@ -0,0 +1,89 @@
+package rtspsrv
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"redalf.de/rtsper/pkg/cluster"
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+)
+
+// errPeerTLS is returned by dialPeer when the TLS handshake with the peer
+// fails.
+var errPeerTLS = errors.New("peer tls handshake failed")
+
+// peerTLSHandshakeTimeout bounds the TLS handshake of accepted peer
+// connections.
+const peerTLSHandshakeTimeout = 2 * time.Second
+
+// SetPeerTLS secures the connections between the nodes with mutual TLS:
+// proxied connections and edge and migration pulls to other nodes are
+// wrapped in TLS, and both RTSP ports accept TLS from members besides
+// plain RTSP from clients. Must be called before Start.
+func (s *Server) SetPeerTLS(pt *cluster.PeerTLS) {
+	s.peerTLS = pt
+}
+
+// dialPeer connects to node at addr, over TLS when peer TLS is configured.
+func (s *Server) dialPeer(ctx context.Context, node, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: s.proxyDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil || s.peerTLS == nil {
+		return conn, err
+	}
+	if s.proxyDialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.proxyDialTimeout)
+		defer cancel()
+	}
+	tc := tls.Client(conn, s.peerTLS.ClientConfig(node))
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		metrics.IncClusterTLSFailures("outbound")
+		return nil, fmt.Errorf("%w with %s: %v", errPeerTLS, node, err)
+	}
+	return tc, nil
+}
+
+// peerTLSListener accepts TLS connections from members and plain RTSP
+// connections on the same port; TLS is recognized by its first byte, the
+// handshake record type, which no RTSP request starts with.
+type peerTLSListener struct {
+	cfg *tls.Config
+}
+
+func newPeerTLSListener(ln net.Listener, pt *cluster.PeerTLS) net.Listener {
+	l := &peerTLSListener{cfg: pt.ServerConfig()}
+	return newPreparingListener(ln, l.handshake)
+}
+
+// handshake tells plain RTSP from TLS connections and runs the handshake
+// of the latter.
+func (l *peerTLSListener) handshake(nconn net.Conn) (net.Conn, bool) {
+	nconn.SetReadDeadline(time.Now().Add(peerTLSHandshakeTimeout))
+	var first [1]byte
+	if _, err := io.ReadFull(nconn, first[:]); err != nil {
+		nconn.Close()
+		return nil, false
+	}
+	conn := &bufferedConn{Conn: nconn, buf: first[:]}
+	if first[0] != 0x16 {
+		nconn.SetReadDeadline(time.Time{})
+		return conn, true
+	}
+	tc := tls.Server(conn, l.cfg)
+	if err := tc.Handshake(); err != nil {
+		plog.Warn("cluster: tls handshake with %s failed: %v", nconn.RemoteAddr(), err)
+		metrics.IncClusterTLSFailures("inbound")
+		nconn.Close()
+		return nil, false
+	}
+	nconn.SetReadDeadline(time.Time{})
+	return tc, true
+}
@@ -0,0 +1,260 @@
+package rtspsrv
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"redalf.de/rtsper/pkg/cluster"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// testCA issues node certificates for peer TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ca key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rtsper cluster ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("ca certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// peerTLS returns the peer TLS of node in cl with a certificate from ca.
+func (ca *testCA) peerTLS(t *testing.T, cl *cluster.Cluster, node string) *cluster.PeerTLS {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: node},
+		DNSNames:     []string{node},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	pt, err := cluster.NewPeerTLS(cl, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, ca.pool)
+	if err != nil {
+		t.Fatalf("peer tls %s: %v", node, err)
+	}
+	return pt
+}
+
+// tlsOwner is a fake owner that answers one request over peer TLS and
+// reports the member it came from.
+func tlsOwner(t *testing.T, pt *cluster.PeerTLS) (int, <-chan string) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", pt.ServerConfig())
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	peers := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tc := conn.(*tls.Conn)
+		if err := tc.Handshake(); err != nil {
+			peers <- "error: " + err.Error()
+			return
+		}
+		peer, _ := pt.Peer(tc.ConnectionState())
+		peers <- peer
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		fmt.Fprint(conn, "RTSP/1.0 200 OK\r\nCSeq: 2\r\nServer: owner\r\n\r\n")
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, peers
+}
+
+func TestProxyOverPeerTLS(t *testing.T) {
+	ca := newTestCA(t)
+	ownerCl, _ := cluster.NewFromCSV("self,owner", "owner")
+	ownerPort, peers := tlsOwner(t, ca.peerTLS(t, ownerCl, "owner"))
+
+	cl, err := cluster.NewFromCSV(fmt.Sprintf("self,owner;host=127.0.0.1;subscribe=%d", ownerPort), "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	name := remoteTopic(t, cl)
+	subPort := freePort(t)
+	s := NewServer(topic.NewManager(topic.Config{}), freePort(t), subPort, nil, cl, true, time.Second, 5*time.Second)
+	s.SetPeerTLS(ca.peerTLS(t, cl, "self"))
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	res := rtspRequest(t, subPort, fmt.Sprintf("DESCRIBE rtsp://self:%d/%s RTSP/1.0\r\nCSeq: 2\r\n\r\n", subPort, name))
+	if !strings.HasPrefix(res, "RTSP/1.0 200 ") || !strings.Contains(res, "Server: owner\r\n") {
+		t.Fatalf("request not proxied over tls:\n%s", res)
+	}
+	if peer := <-peers; peer != "self" {
+		t.Fatalf("owner saw peer %q, want self", peer)
+	}
+}
+
+func TestProxyOverPeerTLSRejectsForeignOwner(t *testing.T) {
+	// the owner's certificate comes from another CA
+	ownerCl, _ := cluster.NewFromCSV("self,owner", "owner")
+	ownerPort, _ := tlsOwner(t, newTestCA(t).peerTLS(t, ownerCl, "owner"))
+
+	cl, err := cluster.NewFromCSV(fmt.Sprintf("self,owner;host=127.0.0.1;subscribe=%d", ownerPort), "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	name := remoteTopic(t, cl)
+	subPort := freePort(t)
+	s := NewServer(topic.NewManager(topic.Config{}), freePort(t), subPort, nil, cl, true, time.Second, 5*time.Second)
+	s.SetPeerTLS(newTestCA(t).peerTLS(t, cl, "self"))
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	res := rtspRequest(t, subPort, fmt.Sprintf("DESCRIBE rtsp://self:%d/%s RTSP/1.0\r\nCSeq: 2\r\n\r\n", subPort, name))
+	if !strings.HasPrefix(res, "RTSP/1.0 503 ") {
+		t.Fatalf("expected 503 for an untrusted owner:\n%s", res)
+	}
+}
+
+func TestPeerTLSListenerAcceptsMembersAndClients(t *testing.T) {
+	ca := newTestCA(t)
+	cl, err := cluster.NewFromCSV("self,peer", "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	pubPort := freePort(t)
+	s := NewServer(topic.NewManager(topic.Config{}), pubPort, freePort(t), nil, cl, false, time.Second, 5*time.Second)
+	s.SetPeerTLS(ca.peerTLS(t, cl, "self"))
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// plain clients are served as before
+	if res := rtspRequest(t, pubPort, "OPTIONS rtsp://self/cam1 RTSP/1.0\r\nCSeq: 1\r\n\r\n"); !strings.HasPrefix(res, "RTSP/1.0 200 ") {
+		t.Fatalf("plain request failed:\n%s", res)
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", pubPort)
+	peerCl, _ := cluster.NewFromCSV("self,peer", "peer")
+	conn, err := tls.Dial("tcp", addr, ca.peerTLS(t, peerCl, "peer").ClientConfig("self"))
+	if err != nil {
+		t.Fatalf("member handshake: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "OPTIONS rtsp://self/cam1 RTSP/1.0\r\nCSeq: 1\r\n\r\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if err != nil || !strings.HasPrefix(line, "RTSP/1.0 200 ") {
+		t.Fatalf("member request failed: %q %v", line, err)
+	}
+
+	// a certificate of the cluster CA that names no member is refused
+	outsiderCl, _ := cluster.NewFromCSV("outsider", "outsider")
+	conn, err = tls.Dial("tcp", addr, ca.peerTLS(t, outsiderCl, "outsider").ClientConfig("self"))
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// TLS 1.3 reports the client certificate rejection on first read
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("non-member was accepted")
+	}
+}
+
+func TestPeerTLSListenerNotBlockedBySilentClient(t *testing.T) {
+	ca := newTestCA(t)
+	cl, _ := cluster.NewFromCSV("self,peer", "self")
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ln := newPeerTLSListener(inner, ca.peerTLS(t, cl, "self"))
+	defer ln.Close()
+
+	// a client that sends nothing waits for its handshake timeout alone
+	silent, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer silent.Close()
+	time.Sleep(50 * time.Millisecond)
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	fmt.Fprint(client, "OPTIONS rtsp://self/cam1 RTSP/1.0\r\nCSeq: 1\r\n\r\n")
+
+	start := time.Now()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+	if d := time.Since(start); d > peerTLSHandshakeTimeout/2 {
+		t.Fatalf("accept waited %s behind a silent client", d)
+	}
+	if conn.LocalAddr().String() != inner.Addr().String() || conn.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Fatalf("accepted the wrong connection from %s", conn.RemoteAddr())
+	}
+
+	// Accept fails once the listener is closed
+	ln.Close()
+	if _, err := ln.Accept(); err == nil {
+		t.Fatal("accept after close succeeded")
+	}
+}
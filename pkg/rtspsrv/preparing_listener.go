@@ -0,0 +1,53 @@
+package rtspsrv
+
+import "net"
+
+// preparingListener accepts connections in the background and prepares
+// each one in its own goroutine, e.g. with a TLS handshake, so that a slow
+// or silent client does not hold up the connections after it. Accept
+// returns the prepared connections; prepare closes the ones it rejects.
+type preparingListener struct {
+	net.Listener
+	prepare func(net.Conn) (net.Conn, bool)
+	conns   chan net.Conn
+	// done is closed with err once the listener fails or is closed
+	done chan struct{}
+	err  error
+}
+
+func newPreparingListener(ln net.Listener, prepare func(net.Conn) (net.Conn, bool)) *preparingListener {
+	l := &preparingListener{Listener: ln, prepare: prepare, conns: make(chan net.Conn), done: make(chan struct{})}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *preparingListener) acceptLoop() {
+	for {
+		nconn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go func() {
+			conn, ok := l.prepare(nconn)
+			if !ok {
+				return
+			}
+			select {
+			case l.conns <- conn:
+			case <-l.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (l *preparingListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
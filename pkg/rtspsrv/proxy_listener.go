@@ -3,126 +3,200 @@ package rtspsrv
 import (
 	"bufio"
 	"bytes"
-	"fmt"
+	"context"
+	"errors"
 	"io"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"redalf.de/rtsper/pkg/cluster"
 	plog "redalf.de/rtsper/pkg/log"
 	"redalf.de/rtsper/pkg/metrics"
 )
 
+// proxyListener routes connections for topics owned by other nodes before
+// they reach the local RTSP server: they are redirected to the owner with
+// RTSP 302 when redirect is set and the client follows redirects, served
+// locally by the edge relay (subscribers), or proxied byte by byte. Routing
+// waits for the client's first request and may dial the owner, so it runs
+// per connection behind a preparingListener.
 type proxyListener struct {
-	ln          net.Listener
 	server      *Server
 	isPublisher bool
+	redirect    bool
 }
 
-func (p *proxyListener) Accept() (net.Conn, error) {
-	for {
-		nconn, err := p.ln.Accept()
+func newProxyListener(ln net.Listener, s *Server, isPublisher, redirect bool) net.Listener {
+	p := &proxyListener{server: s, isPublisher: isPublisher, redirect: redirect}
+	return newPreparingListener(ln, p.route)
+}
+
+// route returns connections the local server handles; the others are
+// answered or proxied here.
+func (p *proxyListener) route(nconn net.Conn) (net.Conn, bool) {
+	// peek initial request bytes (up to 8KB or until blank line)
+	nconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(nconn)
+	var buf bytes.Buffer
+	// read until double CRLF or up to limit
+	for buf.Len() < 8192 {
+		line, err := reader.ReadBytes('\n')
 		if err != nil {
-			return nil, err
+			break
 		}
-
-		// peek initial request bytes (up to 8KB or until blank line)
-		nconn.SetReadDeadline(time.Now().Add(2 * time.Second))
-		reader := bufio.NewReader(nconn)
-		var buf bytes.Buffer
-		// read until double CRLF or up to limit
-		for buf.Len() < 8192 {
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				break
-			}
-			buf.Write(line)
-			if bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")) {
-				break
-			}
+		buf.Write(line)
+		if bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")) {
+			break
 		}
-		// clear deadline
-		nconn.SetReadDeadline(time.Time{})
+	}
+	// clear deadline
+	nconn.SetReadDeadline(time.Time{})
 
-		// parse first request line to extract path
-		b := buf.Bytes()
-		// fallback: if empty, just return connection to be handled locally
-		if len(b) == 0 {
-			return &bufferedConn{Conn: nconn, buf: buf.Bytes()}, nil
-		}
-		// first line
-		firstLineEnd := bytes.IndexByte(b, '\n')
-		if firstLineEnd < 0 {
-			firstLineEnd = len(b)
-		}
-		firstLine := strings.TrimSpace(string(b[:firstLineEnd]))
-		parts := strings.SplitN(firstLine, " ", 3)
-		path := ""
-		if len(parts) >= 2 {
-			// parts[1] may be absolute URL or absolute path
-			u := parts[1]
-			if strings.HasPrefix(u, "rtsp://") {
-				if parsed, err := url.Parse(u); err == nil {
-					path = parsed.Path
-				}
-			} else {
-				// may be "/topic"
-				path = u
+	// parse first request line to extract path
+	b := buf.Bytes()
+	// fallback: if empty, just return connection to be handled locally
+	if len(b) == 0 {
+		return &bufferedConn{Conn: nconn, buf: buf.Bytes()}, true
+	}
+	// first line
+	firstLineEnd := bytes.IndexByte(b, '\n')
+	if firstLineEnd < 0 {
+		firstLineEnd = len(b)
+	}
+	firstLine := strings.TrimSpace(string(b[:firstLineEnd]))
+	parts := strings.SplitN(firstLine, " ", 3)
+	path := ""
+	if len(parts) >= 2 {
+		// parts[1] may be absolute URL or absolute path
+		u := parts[1]
+		if strings.HasPrefix(u, "rtsp://") {
+			if parsed, err := url.Parse(u); err == nil {
+				path = parsed.Path
 			}
+		} else {
+			// may be "/topic"
+			path = u
 		}
-		topic := strings.TrimPrefix(path, "/")
+	}
+	topic := strings.TrimPrefix(path, "/")
+
+	// determine owner
+	var a cluster.Admission
+	if p.server != nil && p.server.cluster != nil {
+		a = p.server.admit(topic, p.isPublisher)
+	}
+	owner := a.Owner
+	// if owner is self or cluster not configured, hand over connection to local server;
+	// subscribers of topics replicated here are served locally too
+	if owner == "" || p.server.cluster == nil || p.server.cluster.IsSelf(owner) || (!p.isPublisher && p.server.replicating(topic)) {
+		return &bufferedConn{Conn: nconn, buf: buf.Bytes()}, true
+	}
 
-		// determine owner
-		owner := ""
-		if p.server != nil && p.server.cluster != nil {
-			owner = p.server.cluster.Owner(topic)
+	// the owner's ports from its membership entry, else ours
+	na := p.server.cluster.Addr(owner)
+	port := p.server.pubPort
+	if p.isPublisher && na.PublishPort > 0 {
+		port = na.PublishPort
+	}
+	if !p.isPublisher {
+		port = p.server.subPort
+		if na.SubscribePort > 0 {
+			port = na.SubscribePort
 		}
-		// if owner is self or cluster not configured, hand over connection to local server
-		if owner == "" || p.server.cluster == nil || p.server.cluster.IsSelf(owner) {
-			return &bufferedConn{Conn: nconn, buf: buf.Bytes()}, nil
+	}
+	_, tunneled := nconn.(*tunnelConn)
+	canRedirect := !tunneled && !p.server.proxiedAgent(headerValue(b, "User-Agent"))
+	overloaded := a.Overloaded != ""
+	if overloaded && !canRedirect {
+		// relaying would add load; let the client retry elsewhere
+		metrics.IncOverloadRejections("503")
+		nconn.Write([]byte("RTSP/1.0 503 Service Unavailable\r\nServer: rtsper-proxy\r\n\r\n"))
+		nconn.Close()
+		return nil, false
+	}
+	if (p.redirect || overloaded) && canRedirect {
+		if overloaded {
+			metrics.IncOverloadRejections("redirect")
 		}
-
-		// else proxy to owner
-		port := p.server.pubPort
-		if !p.isPublisher {
-			port = p.server.subPort
+		loc := redirectLocation(parts[1], p.server.cluster.Advertised(owner), port)
+		plog.Debug("redirecting %s for topic %s to %s", nconn.RemoteAddr(), topic, loc)
+		metrics.IncRedirects()
+		msg := "RTSP/1.0 302 Moved Temporarily\r\n"
+		if cseq := headerValue(b, "CSeq"); cseq != "" {
+			msg += "CSeq: " + cseq + "\r\n"
 		}
-		targetAddr := fmt.Sprintf("%s:%d", owner, port)
-		dialer := net.Dialer{Timeout: p.server.proxyDialTimeout}
-		targetConn, err := dialer.Dial("tcp", targetAddr)
-		if err != nil {
-			plog.Info("failed to dial owner %s: %v", targetAddr, err)
+		msg += "Location: " + loc + "\r\nServer: rtsper-proxy\r\n\r\n"
+		nconn.Write([]byte(msg))
+		nconn.Close()
+		return nil, false
+	}
+	if !p.server.enableProxy || (!p.isPublisher && p.server.edge != nil) {
+		// served (or refused) locally
+		return &bufferedConn{Conn: nconn, buf: buf.Bytes()}, true
+	}
+
+	// else proxy to owner
+	targetAddr := net.JoinHostPort(na.Host, strconv.Itoa(port))
+	targetConn, err := p.server.dialPeer(context.Background(), owner, targetAddr)
+	if err != nil {
+		plog.Info("failed to dial owner %s: %v", targetAddr, err)
+		if !errors.Is(err, errPeerTLS) {
+			// TLS failures have their own counter
 			metrics.IncForwardFailed()
-			// respond with RTSP 503 Service Unavailable
-			msg := "RTSP/1.0 503 Service Unavailable\r\nServer: rtsper-proxy\r\n\r\n"
-			nconn.Write([]byte(msg))
-			nconn.Close()
-			continue // accept next connection
 		}
+		// respond with RTSP 503 Service Unavailable
+		msg := "RTSP/1.0 503 Service Unavailable\r\nServer: rtsper-proxy\r\n\r\n"
+		nconn.Write([]byte(msg))
+		nconn.Close()
+		return nil, false
+	}
 
-		// write buffered bytes to target then start bidirectional copy
-		if len(b) > 0 {
-			targetConn.Write(b)
-		}
-		metrics.IncForwardedConnections()
+	// tell the owner who the client is, then replay the buffered
+	// bytes and start bidirectional copy
+	if p.server.proxyProtoSend {
+		targetConn.Write(proxyHeaderV2(nconn.RemoteAddr(), nconn.LocalAddr()))
+	}
+	if len(b) > 0 {
+		targetConn.Write(b)
+	}
+	metrics.IncForwardedConnections()
+
+	// copy both ways
+	go func() {
+		n, _ := io.Copy(targetConn, nconn)
+		metrics.AddForwardedBytes(n)
+		targetConn.Close()
+		nconn.Close()
+	}()
+	go func() {
+		n, _ := io.Copy(nconn, targetConn)
+		metrics.AddForwardedBytes(n)
+		targetConn.Close()
+		nconn.Close()
+	}()
+	return nil, false
+}
 
-		// copy both ways
-		go func() {
-			n, _ := io.Copy(targetConn, nconn)
-			metrics.AddForwardedBytes(n)
-			targetConn.Close()
-			nconn.Close()
-		}()
-		go func() {
-			n, _ := io.Copy(nconn, targetConn)
-			metrics.AddForwardedBytes(n)
-			targetConn.Close()
-			nconn.Close()
-		}()
-		// continue loop to accept next connection
+// headerValue returns the value of the named header in a buffered request.
+func headerValue(req []byte, name string) string {
+	for _, line := range strings.Split(string(req), "\n")[1:] {
+		k, v, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(k), name) {
+			return strings.TrimSpace(v)
+		}
 	}
+	return ""
 }
 
-func (p *proxyListener) Close() error   { return p.ln.Close() }
-func (p *proxyListener) Addr() net.Addr { return p.ln.Addr() }
+// redirectLocation builds the URL of the requested resource on host:port.
+func redirectLocation(requestURL, host string, port int) string {
+	u := &url.URL{Scheme: "rtsp", Host: net.JoinHostPort(host, strconv.Itoa(port)), Path: requestURL}
+	if parsed, err := url.Parse(requestURL); err == nil {
+		u.Path = parsed.Path
+		u.RawQuery = parsed.RawQuery
+	}
+	return u.String()
+}
@@ -0,0 +1,175 @@
+package rtspsrv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"redalf.de/rtsper/pkg/cluster"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// rtspRequest sends one request on a new connection and returns the response head.
+func rtspRequest(t *testing.T, port int, req string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, req)
+	br := bufio.NewReader(conn)
+	var head strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		if line == "\r\n" {
+			return head.String()
+		}
+		head.WriteString(line)
+	}
+}
+
+func TestRedirectToOwner(t *testing.T) {
+	cl, err := cluster.NewFromCSV("self,owner", "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	cl.SetAdvertised(map[string]string{"owner": "cam.example.com"})
+	name := remoteTopic(t, cl)
+
+	subPort := freePort(t)
+	// proxying is disabled, so clients that are not redirected are served locally
+	s := NewServer(topic.NewManager(topic.Config{}), freePort(t), subPort, nil, cl, false, time.Second, 5*time.Second)
+	s.SetRedirect(false, true, []string{"OldPlayer"})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	res := rtspRequest(t, subPort, fmt.Sprintf("DESCRIBE rtsp://self:%d/%s?token=x RTSP/1.0\r\nCSeq: 2\r\nUser-Agent: ffplay\r\n\r\n", subPort, name))
+	want := fmt.Sprintf("Location: rtsp://cam.example.com:%d/%s?token=x\r\n", subPort, name)
+	if !strings.HasPrefix(res, "RTSP/1.0 302 ") || !strings.Contains(res, "CSeq: 2\r\n") || !strings.Contains(res, want) {
+		t.Fatalf("unexpected redirect response:\n%s", res)
+	}
+
+	res = rtspRequest(t, subPort, fmt.Sprintf("DESCRIBE rtsp://self:%d/%s RTSP/1.0\r\nCSeq: 2\r\nUser-Agent: OldPlayer/1.0\r\n\r\n", subPort, name))
+	if strings.HasPrefix(res, "RTSP/1.0 302 ") {
+		t.Fatalf("client without redirect support was redirected:\n%s", res)
+	}
+}
+
+func TestProxyToOwnerEntry(t *testing.T) {
+	// the owner listens on another host and port than this node
+	owner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer owner.Close()
+	go func() {
+		conn, err := owner.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		fmt.Fprint(conn, "RTSP/1.0 200 OK\r\nCSeq: 2\r\nServer: owner\r\n\r\n")
+	}()
+	ownerPort := owner.Addr().(*net.TCPAddr).Port
+
+	cl, err := cluster.NewFromCSV(fmt.Sprintf("self,owner;host=127.0.0.1;subscribe=%d", ownerPort), "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	name := remoteTopic(t, cl)
+
+	subPort := freePort(t)
+	s := NewServer(topic.NewManager(topic.Config{}), freePort(t), subPort, nil, cl, true, time.Second, 5*time.Second)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	res := rtspRequest(t, subPort, fmt.Sprintf("DESCRIBE rtsp://self:%d/%s RTSP/1.0\r\nCSeq: 2\r\n\r\n", subPort, name))
+	if !strings.HasPrefix(res, "RTSP/1.0 200 ") || !strings.Contains(res, "Server: owner\r\n") {
+		t.Fatalf("request not proxied to the owner's entry:\n%s", res)
+	}
+}
+
+func TestProxyListenerNotBlockedBySlowOwner(t *testing.T) {
+	// the owner accepts TCP but never answers the TLS handshake
+	owner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer owner.Close()
+	go func() {
+		for {
+			conn, err := owner.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	ownerPort := owner.Addr().(*net.TCPAddr).Port
+
+	ca := newTestCA(t)
+	cl, err := cluster.NewFromCSV(fmt.Sprintf("self,owner;host=127.0.0.1;subscribe=%d", ownerPort), "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	remote := remoteTopic(t, cl)
+	local := ""
+	for i := 0; local == ""; i++ {
+		if name := fmt.Sprintf("cam%d", i); cl.IsSelf(cl.Owner(name)) {
+			local = name
+		}
+	}
+	subPort := freePort(t)
+	s := NewServer(topic.NewManager(topic.Config{}), freePort(t), subPort, nil, cl, true, 3*time.Second, 5*time.Second)
+	s.SetPeerTLS(ca.peerTLS(t, cl, "self"))
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// a request proxied to the stalled owner and a client that sends nothing
+	stalled, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", subPort))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer stalled.Close()
+	fmt.Fprintf(stalled, "DESCRIBE rtsp://self:%d/%s RTSP/1.0\r\nCSeq: 2\r\n\r\n", subPort, remote)
+	silent, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", subPort))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer silent.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	res := rtspRequest(t, subPort, fmt.Sprintf("DESCRIBE rtsp://self:%d/%s RTSP/1.0\r\nCSeq: 2\r\n\r\n", subPort, local))
+	if !strings.HasPrefix(res, "RTSP/1.0 ") {
+		t.Fatalf("unexpected response:\n%s", res)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("local request waited %s behind a slow owner dial", d)
+	}
+}
@@ -0,0 +1,246 @@
+package rtspsrv
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	plog "redalf.de/rtsper/pkg/log"
+)
+
+// proxyProtoSig starts every PROXY protocol v2 header.
+var proxyProtoSig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// proxyProtoTimeout bounds reading a PROXY protocol header.
+	proxyProtoTimeout = 2 * time.Second
+	// proxyProtoV1Max is the longest v1 header including CRLF.
+	proxyProtoV1Max = 107
+)
+
+// SetProxyProtocol makes both RTSP ports accept an optional PROXY protocol
+// v1 or v2 header from load balancers in trusted, and from members over
+// peer TLS when send is set; the client address of the header replaces the
+// connection's. With send, connections proxied to the owner start with a
+// v2 header carrying the client address. Must be called before Start.
+func (s *Server) SetProxyProtocol(trusted []*net.IPNet, send bool) {
+	s.proxyProtoTrusted = trusted
+	s.proxyProtoSend = send
+}
+
+// ParseTrustedNets parses comma-separated CIDRs or IP addresses.
+func ParseTrustedNets(s string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", part)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// proxyProtoListener reads the PROXY protocol header of connections from
+// trusted sources. The header is optional, so direct clients and pulls of
+// other nodes keep working.
+type proxyProtoListener struct {
+	trusted []*net.IPNet
+	// peers trusts connections over peer TLS, whose members are verified
+	peers bool
+}
+
+func newProxyProtoListener(ln net.Listener, trusted []*net.IPNet, peers bool) net.Listener {
+	l := &proxyProtoListener{trusted: trusted, peers: peers}
+	return newPreparingListener(ln, l.readHeader)
+}
+
+// readHeader consumes the header of connections from trusted sources.
+func (l *proxyProtoListener) readHeader(nconn net.Conn) (net.Conn, bool) {
+	if !l.trusts(nconn) {
+		return nconn, true
+	}
+	nconn.SetReadDeadline(time.Now().Add(proxyProtoTimeout))
+	conn, err := readProxyHeader(nconn)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			// e.g. a TCP health check of the balancer
+			plog.Debug("proxy protocol: %s closed before sending a header", nconn.RemoteAddr())
+		} else {
+			plog.Info("proxy protocol header from %s: %v", nconn.RemoteAddr(), err)
+		}
+		nconn.Close()
+		return nil, false
+	}
+	nconn.SetReadDeadline(time.Time{})
+	return conn, true
+}
+
+func (l *proxyProtoListener) trusts(c net.Conn) bool {
+	if _, ok := c.(*tls.Conn); ok && l.peers {
+		return true
+	}
+	a, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(a.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxiedConn is a connection whose client address came from a PROXY
+// protocol header.
+type proxiedConn struct {
+	net.Conn
+	remote *net.TCPAddr
+}
+
+// RemoteAddr is the client's address; gortsplib requires a *net.TCPAddr.
+func (c *proxiedConn) RemoteAddr() net.Addr { return c.remote }
+
+// readProxyHeader consumes the PROXY protocol header at the start of c, if
+// any, and returns c with the client address it carries. Bytes read from
+// connections without a header are replayed.
+func readProxyHeader(c net.Conn) (net.Conn, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(c, b[:1]); err != nil {
+		return nil, err
+	}
+	var n int
+	switch b[0] {
+	case 'P':
+		// "PROXY " or an RTSP request such as PLAY
+		n = 6
+	case '\r':
+		n = 16
+	default:
+		return &bufferedConn{Conn: c, buf: []byte{b[0]}}, nil
+	}
+	if _, err := io.ReadFull(c, b[1:n]); err != nil {
+		return nil, err
+	}
+	var remote *net.TCPAddr
+	var err error
+	switch {
+	case n == 6 && string(b[:6]) == "PROXY ":
+		remote, err = readProxyV1(c)
+	case n == 16 && bytes.Equal(b[:12], proxyProtoSig):
+		remote, err = readProxyV2(c, b[12:16])
+	default:
+		return &bufferedConn{Conn: c, buf: append([]byte(nil), b[:n]...)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		// LOCAL or unknown protocol: keep the connection's address
+		return c, nil
+	}
+	return &proxiedConn{Conn: c, remote: remote}, nil
+}
+
+// readProxyV1 reads the rest of a v1 header after "PROXY ".
+func readProxyV1(c net.Conn) (*net.TCPAddr, error) {
+	var line []byte
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtoV1Max-6 {
+			return nil, errors.New("v1 header too long")
+		}
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	f := strings.Fields(string(line))
+	if len(f) > 0 && f[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 5 || (f[0] != "TCP4" && f[0] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(f[1])
+	port, err := strconv.Atoi(f[3])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid v1 source %s:%s", f[1], f[3])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads the rest of a v2 header given its version/command,
+// family and length bytes.
+func readProxyV2(c net.Conn, h []byte) (*net.TCPAddr, error) {
+	if h[0]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", h[0]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(h[2:4]))
+	if _, err := io.ReadFull(c, payload); err != nil {
+		return nil, err
+	}
+	if h[0]&0x0f == 0 {
+		// LOCAL: health checks of the balancer itself
+		return nil, nil
+	}
+	switch h[1] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("short v2 ipv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]).To16(), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("short v2 ipv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+// proxyHeaderV2 returns a v2 header for a connection from src to dst, or a
+// LOCAL one when they are not TCP addresses. Mixed families are sent as
+// IPv6.
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	b := append([]byte(nil), proxyProtoSig...)
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	switch {
+	case ok1 && ok2 && s.IP.To4() != nil && d.IP.To4() != nil:
+		b = append(b, 0x21, 0x11, 0, 12)
+		b = append(b, s.IP.To4()...)
+		b = append(b, d.IP.To4()...)
+	case ok1 && ok2:
+		b = append(b, 0x21, 0x21, 0, 36)
+		b = append(b, s.IP.To16()...)
+		b = append(b, d.IP.To16()...)
+	default:
+		return append(b, 0x20, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(b, uint16(s.Port)), uint16(d.Port))
+}
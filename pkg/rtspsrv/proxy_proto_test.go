@@ -0,0 +1,192 @@
+package rtspsrv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+
+	"redalf.de/rtsper/pkg/cluster"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5555}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 6666}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9191}
+	for _, tc := range []struct {
+		name   string
+		header string
+		remote string // empty: the connection's own address
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 10.0.0.1 5555 9191\r\n", "203.0.113.7:5555"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 6666 9191\r\n", "[2001:db8::7]:6666"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", ""},
+		{"v2 tcp4", string(proxyHeaderV2(v4, dst)), "203.0.113.7:5555"},
+		{"v2 tcp6", string(proxyHeaderV2(v6, dst)), "[2001:db8::7]:6666"},
+		{"v2 local", string(proxyHeaderV2(&net.UDPAddr{}, dst)), ""},
+		{"no header, P", "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			// the request must reach the server unchanged after the header
+			const req = "PLAY rtsp://node/cam1 RTSP/1.0\r\nCSeq: 3\r\n\r\n"
+			go client.Write([]byte(tc.header + req))
+			conn, err := readProxyHeader(server)
+			if err != nil {
+				t.Fatalf("read header: %v", err)
+			}
+			want := tc.remote
+			if want == "" {
+				want = server.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != want {
+				t.Fatalf("remote %s, want %s", got, want)
+			}
+			if _, ok := conn.RemoteAddr().(*net.TCPAddr); tc.remote != "" && !ok {
+				t.Fatalf("remote is a %T, gortsplib needs a *net.TCPAddr", conn.RemoteAddr())
+			}
+			b := make([]byte, len(req))
+			if _, err := io.ReadFull(conn, b); err != nil || string(b) != req {
+				t.Fatalf("request after header: %q %v", b, err)
+			}
+		})
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("PROXY TCP4 not-an-ip 10.0.0.1 5555 9191\r\n"))
+	if _, err := readProxyHeader(server); err == nil {
+		t.Fatal("expected error for an invalid v1 header")
+	}
+}
+
+func TestProxyProtocolClientAddress(t *testing.T) {
+	pubPort := freePort(t)
+	s := NewServer(topic.NewManager(topic.Config{}), pubPort, freePort(t), nil, nil, false, time.Second, 5*time.Second)
+	trusted, err := ParseTrustedNets("127.0.0.1")
+	if err != nil {
+		t.Fatalf("trusted: %v", err)
+	}
+	s.SetProxyProtocol(trusted, false)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// a balancer in front of the publisher
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5555}
+	pub := &gortsplib.Client{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			_, err = conn.Write(proxyHeaderV2(client, conn.RemoteAddr()))
+			return conn, err
+		},
+	}
+	tracks := gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1}}
+	if err := pub.StartPublishing(fmt.Sprintf("rtsp://127.0.0.1:%d/cam1", pubPort), tracks); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	defer pub.Close()
+
+	sessions := s.Sessions()
+	if len(sessions) != 1 || !sessions[0].Publisher || sessions[0].Topic != "cam1" || sessions[0].Remote != client.String() {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+}
+
+func TestProxyListenerSendsHeader(t *testing.T) {
+	owner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer owner.Close()
+	remotes := make(chan net.Addr, 1)
+	go func() {
+		nconn, err := owner.Accept()
+		if err != nil {
+			return
+		}
+		defer nconn.Close()
+		conn, err := readProxyHeader(nconn)
+		if err != nil {
+			remotes <- nil
+			return
+		}
+		if _, ok := conn.(*proxiedConn); !ok {
+			remotes <- nil
+			return
+		}
+		remotes <- conn.RemoteAddr()
+		fmt.Fprint(conn, "RTSP/1.0 200 OK\r\nCSeq: 2\r\n\r\n")
+	}()
+
+	cl, err := cluster.NewFromCSV(fmt.Sprintf("self,owner;host=127.0.0.1;subscribe=%d", owner.Addr().(*net.TCPAddr).Port), "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	name := remoteTopic(t, cl)
+	subPort := freePort(t)
+	s := NewServer(topic.NewManager(topic.Config{}), freePort(t), subPort, nil, cl, true, time.Second, 5*time.Second)
+	s.SetProxyProtocol(nil, true)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	rtspRequest(t, subPort, fmt.Sprintf("DESCRIBE rtsp://self:%d/%s RTSP/1.0\r\nCSeq: 2\r\n\r\n", subPort, name))
+	remote := <-remotes
+	if a, ok := remote.(*net.TCPAddr); !ok || !a.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("owner saw client %v, want the proxied client's address", remote)
+	}
+}
+
+func TestProxyProtoListenerNotBlockedBySilentBalancer(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	trusted, _ := ParseTrustedNets("127.0.0.1")
+	ln := newProxyProtoListener(inner, trusted, false)
+	defer ln.Close()
+
+	// a balancer connection without a header waits for its timeout alone
+	silent, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer silent.Close()
+	time.Sleep(50 * time.Millisecond)
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5555}
+	conn.Write(proxyHeaderV2(client, conn.RemoteAddr()))
+
+	start := time.Now()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer accepted.Close()
+	if d := time.Since(start); d > proxyProtoTimeout/2 {
+		t.Fatalf("accept waited %s behind a silent balancer", d)
+	}
+	if accepted.RemoteAddr().String() != client.String() {
+		t.Fatalf("unexpected client address %s", accepted.RemoteAddr())
+	}
+}
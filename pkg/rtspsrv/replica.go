@@ -0,0 +1,345 @@
+package rtspsrv
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+const (
+	// replicaCheck is how often replicated topics are compared with the
+	// cluster's owners and standbys.
+	replicaCheck = time.Second
+	// replicaRetry is how long a standby waits before pulling a topic
+	// again that its owner did not serve.
+	replicaRetry = 5 * time.Second
+)
+
+// ReplicaStatus describes a replicated topic held by this node for the
+// admin API.
+type ReplicaStatus struct {
+	Topic string `json:"topic"`
+	// Owner is the node the replica is pulled from
+	Owner string `json:"owner"`
+	// State is "waiting" before the topic is pulled, "pulling", "lost"
+	// while the owner is unreachable and "promoted" once this node owns
+	// the topic and waits for its publisher
+	State   string     `json:"state"`
+	Since   *time.Time `json:"since,omitempty"`
+	Packets int64      `json:"packets"`
+}
+
+// replica keeps a hot copy of a topic on the standby node: the topic is
+// pulled from its owner into a local stream held by a standby publisher,
+// so that local subscribers keep watching and the real publisher takes it
+// over when the owner fails.
+type replica struct {
+	topic string
+
+	// guarded by Server.mu
+	from  string
+	state string
+	since time.Time
+	// pub holds the local topic while there is a replica
+	pub *topic.PublisherSession
+
+	packets  atomic.Int64
+	stopped  chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func (r *replica) stop() {
+	r.stopOnce.Do(func() { close(r.stopped) })
+}
+
+// SetReplication keeps a replica of topics on the node next in rendezvous
+// order after their owner (see cluster.Standby). When the owner fails and
+// the standby becomes the owner, the replica is promoted: it holds the
+// topic, and its local subscribers, for up to hold until the publisher
+// reconnects. Every node should replicate the same topics. Must be called
+// before Start.
+func (s *Server) SetReplication(topics []string, hold time.Duration) {
+	if s.cluster == nil {
+		return
+	}
+	s.replTopics = topics
+	s.replHold = hold
+}
+
+// Replicas lists the replicated topics held by this node.
+func (s *Server) Replicas() []ReplicaStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ReplicaStatus, 0, len(s.replicas))
+	for _, r := range s.replicas {
+		rs := ReplicaStatus{Topic: r.topic, Owner: r.from, State: r.state, Packets: r.packets.Load()}
+		if !r.since.IsZero() {
+			since := r.since
+			rs.Since = &since
+		}
+		out = append(out, rs)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Topic < out[j].Topic })
+	return out
+}
+
+// replicating reports whether local subscribers of topicName are served
+// from a replica instead of the remote owner.
+func (s *Server) replicating(topicName string) bool {
+	if len(s.replTopics) == 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.replicas[topicName]
+	return ok && r.pub != nil
+}
+
+// runReplication starts and stops replicas as owners and standbys change,
+// until Close.
+func (s *Server) runReplication() {
+	ticker := time.NewTicker(replicaCheck)
+	defer ticker.Stop()
+	for {
+		s.reconcileReplicas()
+		select {
+		case <-ticker.C:
+		case <-s.replDone:
+			return
+		}
+	}
+}
+
+func (s *Server) reconcileReplicas() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replicas == nil {
+		s.replicas = make(map[string]*replica)
+	}
+	for _, t := range s.replTopics {
+		standby := s.cluster.IsSelf(s.cluster.Standby(t))
+		r, ok := s.replicas[t]
+		switch {
+		case !ok && standby:
+			r = &replica{topic: t, state: "waiting", stopped: make(chan struct{}), done: make(chan struct{})}
+			s.replicas[t] = r
+			go s.runReplica(r)
+		case ok && !standby && r.state != "promoted" && !s.cluster.IsSelf(s.cluster.Owner(t)):
+			// another node is the standby now
+			r.stop()
+		}
+	}
+}
+
+// stopReplica drops the replica of topicName, if any, and waits until the
+// topic is released.
+func (s *Server) stopReplica(topicName string) {
+	s.mu.Lock()
+	r, ok := s.replicas[topicName]
+	s.mu.Unlock()
+	if ok {
+		r.stop()
+		<-r.done
+	}
+}
+
+// runReplica pulls the topic from its owner while this node is its
+// standby, and promotes the replica when this node becomes the owner.
+func (s *Server) runReplica(r *replica) {
+	var c *gortsplib.Client
+	var waitErr <-chan error
+	// lost is when the pull from the owner ended, or the replica was
+	// promoted; the topic is held for replHold from then on
+	var lost time.Time
+	var retry time.Time
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+		s.mu.Lock()
+		if s.replicas[r.topic] == r {
+			delete(s.replicas, r.topic)
+		}
+		pub := r.pub
+		s.mu.Unlock()
+		if pub != nil {
+			// a no-op once the real publisher took the topic over
+			s.mgr.UnregisterPublisherSession(r.topic, pub)
+		}
+		close(r.done)
+	}()
+	// drop releases the local topic but keeps the replica waiting
+	drop := func() {
+		if c != nil {
+			c.Close()
+			c, waitErr = nil, nil
+		}
+		s.mu.Lock()
+		pub := r.pub
+		r.pub, r.state, r.since = nil, "waiting", time.Time{}
+		s.mu.Unlock()
+		if pub != nil {
+			s.mgr.UnregisterPublisherSession(r.topic, pub)
+		}
+		retry = time.Now().Add(replicaRetry)
+	}
+
+	ticker := time.NewTicker(replicaCheck)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		pub, state := r.pub, r.state
+		s.mu.Unlock()
+		var pubDone <-chan struct{}
+		if pub != nil {
+			pubDone = pub.Done()
+		}
+		select {
+		case <-r.stopped:
+			return
+		case <-pubDone:
+			if state == "promoted" {
+				plog.Info("replica: topic %s: publisher took over the promoted replica", r.topic)
+				return
+			}
+			// kicked, e.g. by a migration
+			plog.Info("replica: topic %s: standby publisher left", r.topic)
+			drop()
+			continue
+		case err := <-waitErr:
+			plog.Info("replica: topic %s: pull from %s ended: %v", r.topic, r.from, err)
+			c.Close()
+			c, waitErr = nil, nil
+			lost = time.Now()
+			s.setReplicaState(r, "lost")
+		case <-ticker.C:
+		}
+
+		owner := s.cluster.Owner(r.topic)
+		if s.cluster.IsSelf(owner) {
+			switch {
+			case pub == nil:
+				// nothing to promote; the publisher connects here anyway
+				return
+			case state != "promoted":
+				if c != nil {
+					c.Close()
+					c, waitErr = nil, nil
+				}
+				lost = time.Now()
+				s.setReplicaState(r, "promoted")
+				metrics.IncReplicaPromotions()
+				plog.Info("replica: topic %s: promoted after owner %s failed, waiting %s for its publisher", r.topic, r.from, s.replHold)
+			case time.Since(lost) > s.replHold:
+				plog.Warn("replica: topic %s: publisher did not connect within %s", r.topic, s.replHold)
+				return
+			}
+			continue
+		}
+		if state == "promoted" {
+			// the topic moved on before its publisher returned
+			plog.Info("replica: topic %s: owner is %s again, dropping promoted replica", r.topic, owner)
+			return
+		}
+		if owner == "" {
+			continue
+		}
+		if c != nil && owner != r.from {
+			plog.Info("replica: topic %s: owner moved from %s to %s", r.topic, r.from, owner)
+			c.Close()
+			c, waitErr = nil, nil
+			lost = time.Now()
+			s.setReplicaState(r, "lost")
+		}
+		if c != nil {
+			continue
+		}
+		if pub != nil && time.Since(lost) > s.replHold {
+			plog.Info("replica: topic %s: owner %s unreachable for %s, dropping replica", r.topic, r.from, s.replHold)
+			drop()
+			continue
+		}
+		if pub == nil && time.Now().Before(retry) {
+			continue
+		}
+		nc, err := s.openReplica(r, owner)
+		if err != nil {
+			if errors.Is(err, errEdgeNotFound) || errors.Is(err, errTracksChanged) {
+				// the topic ended on its owner, or restarted with other
+				// tracks; the local copy goes with it
+				plog.Debug("replica: topic %s: %v", r.topic, err)
+				drop()
+			} else {
+				plog.Debug("replica: topic %s: pull from %s failed: %v", r.topic, owner, err)
+				if pub == nil {
+					retry = time.Now().Add(replicaRetry)
+				}
+			}
+			continue
+		}
+		c, waitErr = nc, clientWait(nc)
+	}
+}
+
+func (s *Server) setReplicaState(r *replica, state string) {
+	s.mu.Lock()
+	r.state = state
+	s.mu.Unlock()
+}
+
+// openReplica plays the topic on owner into the local topic. The first
+// pull installs a standby publisher with the owner's tracks; later ones
+// resume the stream if the tracks are the same.
+func (s *Server) openReplica(r *replica, owner string) (*gortsplib.Client, error) {
+	tr := gortsplib.TransportTCP
+	c := &gortsplib.Client{
+		Transport:   &tr,
+		UserAgent:   "rtsper-replica",
+		ReadTimeout: s.proxyIOTimeout,
+		OnPacketRTP: func(ctx *gortsplib.ClientOnPacketRTPCtx) {
+			s.mgr.WritePacketRTP(r.topic, ctx.TrackID, ctx.Packet)
+			r.packets.Add(1)
+		},
+	}
+	tracks, baseURL, err := s.describe(c, owner, r.topic)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	pub := r.pub
+	s.mu.Unlock()
+	created := pub == nil
+	if created {
+		pub = topic.NewStandbyPublisherSession("replica-" + owner)
+		if err := s.mgr.RegisterPublisher(context.Background(), r.topic, pub); err != nil {
+			c.Close()
+			return nil, err
+		}
+		s.mgr.SetTopicStream(r.topic, gortsplib.NewServerStream(tracks))
+	} else if st := s.mgr.GetTopicStream(r.topic); st == nil || !topic.SameTracks(st.Tracks(), tracks) {
+		c.Close()
+		return nil, errTracksChanged
+	}
+	if err := c.SetupAndPlay(tracks, baseURL); err != nil {
+		c.Close()
+		if created {
+			s.mgr.UnregisterPublisherSession(r.topic, pub)
+		}
+		return nil, err
+	}
+	s.mu.Lock()
+	r.pub, r.from, r.state, r.since = pub, owner, "pulling", time.Now()
+	s.mu.Unlock()
+	plog.Info("replica: topic %s: pulling from owner %s", r.topic, owner)
+	return c, nil
+}
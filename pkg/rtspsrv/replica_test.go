@@ -0,0 +1,121 @@
+package rtspsrv
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/url"
+	"github.com/pion/rtp"
+
+	"redalf.de/rtsper/pkg/cluster"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// publishLoop writes packets to pub until stop is closed.
+func publishLoop(pub *gortsplib.Client, stop <-chan struct{}) {
+	for seq := uint16(0); ; seq++ {
+		select {
+		case <-stop:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		pub.WritePacketRTP(0, &rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, SSRC: 1},
+			Payload: []byte{0x05, 0x01},
+		})
+	}
+}
+
+func TestReplicaPromotedOnOwnerFailure(t *testing.T) {
+	// the owner is a plain server; the standby reaches it as node 127.0.0.1
+	ownerPub, ownerSub := freePort(t), freePort(t)
+	owner := NewServer(topic.NewManager(topic.Config{MaxSubscribersPerTopic: 5, PublisherQueueSize: 64}), ownerPub, ownerSub, nil, nil, false, time.Second, 5*time.Second)
+	if err := owner.Start(context.Background()); err != nil {
+		t.Fatalf("start owner: %v", err)
+	}
+	defer owner.Close()
+
+	cl, err := cluster.NewFromCSV(fmt.Sprintf("standby,127.0.0.1;subscribe=%d", ownerSub), "standby")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	name := remoteTopic(t, cl)
+	if cl.Standby(name) != "standby" {
+		t.Fatalf("standby of %s is %s", name, cl.Standby(name))
+	}
+	pubPort, subPort := freePort(t), freePort(t)
+	tm := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	s := NewServer(tm, pubPort, subPort, nil, cl, true, time.Second, 5*time.Second)
+	s.SetReplication([]string{name}, 10*time.Second)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start standby: %v", err)
+	}
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	tracks := gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1}}
+	pub := &gortsplib.Client{}
+	if err := pub.StartPublishing(fmt.Sprintf("rtsp://127.0.0.1:%d/%s", ownerPub, name), tracks); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	stop := make(chan struct{})
+	go publishLoop(pub, stop)
+	waitFor(t, "the replica", func() bool {
+		r := s.Replicas()
+		return len(r) == 1 && r[0].State == "pulling" && r[0].Packets > 0
+	})
+
+	// a player on the standby is served from the replica, not the owner
+	var received atomic.Int64
+	sub := &gortsplib.Client{OnPacketRTP: func(*gortsplib.ClientOnPacketRTPCtx) { received.Add(1) }}
+	u, _ := url.Parse(fmt.Sprintf("rtsp://127.0.0.1:%d/%s", subPort, name))
+	if err := sub.Start(u.Scheme, u.Host); err != nil {
+		t.Fatalf("connect to standby: %v", err)
+	}
+	if st, baseURL, _, err := sub.Describe(u); err != nil {
+		t.Fatalf("describe on standby: %v", err)
+	} else if err := sub.SetupAndPlay(st, baseURL); err != nil {
+		t.Fatalf("play on standby: %v", err)
+	}
+	defer sub.Close()
+	subErr := clientWait(sub)
+	waitFor(t, "packets on the standby", func() bool { return received.Load() > 0 })
+
+	// the owner fails and the standby becomes the owner
+	close(stop)
+	pub.Close()
+	owner.Close()
+	cl.SetHealthy("127.0.0.1", false)
+	if cl.Owner(name) != "standby" {
+		t.Fatalf("owner %s after failure, want standby", cl.Owner(name))
+	}
+	waitFor(t, "promotion", func() bool {
+		r := s.Replicas()
+		return len(r) == 1 && r[0].State == "promoted"
+	})
+
+	// the publisher returns to the new owner and takes the stream over
+	pub = &gortsplib.Client{}
+	if err := pub.StartPublishing(fmt.Sprintf("rtsp://127.0.0.1:%d/%s", pubPort, name), tracks); err != nil {
+		t.Fatalf("publish to standby: %v", err)
+	}
+	defer pub.Close()
+	stop = make(chan struct{})
+	defer close(stop)
+	go publishLoop(pub, stop)
+	before := received.Load()
+	waitFor(t, "packets of the returned publisher", func() bool { return received.Load() > before+5 })
+	select {
+	case err := <-subErr:
+		t.Fatalf("player disconnected: %v", err)
+	default:
+	}
+	waitFor(t, "the replica to end", func() bool { return len(s.Replicas()) == 0 })
+	if ts := tm.Status().Topics; len(ts) != 1 || !ts[0].HasPublisher || ts[0].Standby {
+		t.Fatalf("topic not taken over by the publisher: %+v", ts)
+	}
+}
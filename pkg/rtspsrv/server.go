@@ -2,9 +2,10 @@ package rtspsrv
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -36,18 +37,185 @@ type Server struct {
 	enableProxy      bool
 	proxyDialTimeout time.Duration
 	proxyIOTimeout   time.Duration
+	// tunnelPort accepts RTSP-over-HTTP tunnels for subscribers (0 = off)
+	tunnelPort int
+	tunnelLn   net.Listener
+	// edge serves subscribers of remote topics from one pull per topic
+	// instead of proxying their connections (nil = proxy)
+	edge *edgeRelay
+	// redirect connections for remote topics with RTSP 302 instead of
+	// proxying them, except for clients matching proxyAgents
+	pubRedirect bool
+	subRedirect bool
+	proxyAgents []string
+	// lb places new topics and reports overload (nil = rendezvous only)
+	lb LoadBalancer
+	// multicast settings of the subscriber server (empty = disabled)
+	multicastIPRange string
+	multicastRTPPort int
+	// migrations are the topics pulled from or handed over to another
+	// node while they are migrated, guarded by mu
+	migrations map[string]*migrationPull
+	// peerTLS secures connections between the nodes (nil = plain)
+	peerTLS *cluster.PeerTLS
+	// PROXY protocol headers are read from connections of trusted
+	// sources, and sent to owners with proxyProtoSend
+	proxyProtoTrusted []*net.IPNet
+	proxyProtoSend    bool
+	// replTopics are kept as replicas on their standby node for replHold
+	// after a failure (see SetReplication); replicas is guarded by mu
+	replTopics []string
+	replHold   time.Duration
+	replicas   map[string]*replica
+	replDone   chan struct{}
 }
 
 func NewServer(mgr *topic.Manager, pubPort, subPort int, alloc *udpalloc.Allocator, cl *cluster.Cluster, enableProxy bool, dialTO, ioTO time.Duration) *Server {
 	return &Server{mgr: mgr, pubPort: pubPort, subPort: subPort, allocator: alloc, cluster: cl, enableProxy: enableProxy, proxyDialTimeout: dialTO, proxyIOTimeout: ioTO}
 }
 
+// SetHTTPTunnelPort enables RTSP-over-HTTP tunneling for subscribers on the
+// given port. Tunneled sessions are handled by the subscriber server, with
+// the same limits and cluster routing as direct connections. Must be called
+// before Start.
+func (s *Server) SetHTTPTunnelPort(port int) {
+	s.tunnelPort = port
+}
+
+// SetEdgeRelay makes the subscriber server act as an edge for topics owned
+// by other cluster nodes: the topic is pulled once from its owner and served
+// to all local subscribers, over any transport, instead of proxying each
+// connection. The pull is dropped when the last local subscriber leaves.
+// Must be called before Start.
+func (s *Server) SetEdgeRelay(enable bool) {
+	if enable && s.cluster != nil {
+		s.edge = newEdgeRelay(s)
+	} else {
+		s.edge = nil
+	}
+}
+
+// SetRedirect makes the publisher and/or subscriber port answer requests
+// for topics owned by other nodes with a 302 redirect to the owner's
+// advertised address instead of proxying the connection. Clients whose
+// User-Agent contains one of proxyAgents do not follow redirects and are
+// still proxied (or served by the edge relay). Must be called before Start.
+func (s *Server) SetRedirect(publish, subscribe bool, proxyAgents []string) {
+	s.pubRedirect = publish
+	s.subRedirect = subscribe
+	s.proxyAgents = proxyAgents
+}
+
+// proxiedAgent reports whether a client must be proxied instead of
+// redirected.
+func (s *Server) proxiedAgent(ua string) bool {
+	for _, a := range s.proxyAgents {
+		if a != "" && strings.Contains(ua, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadBalancer places new topics on cluster nodes and admits new sessions
+// (see cluster.LoadMonitor).
+type LoadBalancer interface {
+	// Admit returns the node that should serve a new session of a topic,
+	// placing new topics for publishers, and the exceeded load threshold.
+	Admit(topic string, publish bool) cluster.Admission
+}
+
+// SetLoadBalancer enables load-aware placement of new topics and admission
+// control: while this node is overloaded, new sessions for remote topics
+// are redirected to the owner and new local sessions are refused with 503.
+// Must be called before Start.
+func (s *Server) SetLoadBalancer(lb LoadBalancer) {
+	s.lb = lb
+}
+
+// admit returns the admission of a new session of the given kind; the
+// cluster must be configured.
+func (s *Server) admit(topicName string, isPublisher bool) cluster.Admission {
+	if s.lb != nil {
+		return s.lb.Admit(topicName, isPublisher)
+	}
+	return s.cluster.Admit(topicName, isPublisher)
+}
+
+// SetMulticast lets subscribers play over UDP multicast, with groups
+// allocated from ipRange (CIDR) on rtpPort and rtpPort+1. Must be called
+// before Start.
+func (s *Server) SetMulticast(ipRange string, rtpPort int) {
+	s.multicastIPRange = ipRange
+	s.multicastRTPPort = rtpPort
+}
+
+// EdgePulls lists the topics pulled from other nodes for local subscribers.
+func (s *Server) EdgePulls() []EdgeStatus {
+	if s.edge == nil {
+		return []EdgeStatus{}
+	}
+	return s.edge.list()
+}
+
+// SessionStatus describes an RTSP session of a topic.
+type SessionStatus struct {
+	ID        string `json:"id"`
+	Topic     string `json:"topic"`
+	Publisher bool   `json:"publisher"`
+	// Edge is set for subscribers served from an edge pull
+	Edge bool `json:"edge,omitempty"`
+	// Remote is the client address, taken from the PROXY protocol header
+	// if there was one
+	Remote string `json:"remote"`
+}
+
+// Sessions lists the RTSP sessions of publishers and subscribers ordered
+// by topic.
+func (s *Server) Sessions() []SessionStatus {
+	out := []SessionStatus{}
+	if s.h == nil {
+		return out
+	}
+	h := s.h
+	h.mu.Lock()
+	for sess, topicName := range h.sessTopic {
+		out = append(out, SessionStatus{
+			ID:        fmt.Sprintf("%p", sess),
+			Topic:     topicName,
+			Publisher: h.sessIsPub[sess],
+			Edge:      h.sessEdge[sess],
+			Remote:    h.sessRemote[sess],
+		})
+	}
+	h.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Topic != out[j].Topic {
+			return out[i].Topic < out[j].Topic
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// HTTPTunnelAddr returns the address of the tunnel listener, or nil.
+func (s *Server) HTTPTunnelAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tunnelLn == nil {
+		return nil
+	}
+	return s.tunnelLn.Addr()
+}
+
 func (s *Server) Start(ctx context.Context) error {
 	h := &serverHandler{
 		mgr:           s.mgr,
 		sessTopic:     make(map[*gortsplib.ServerSession]string),
 		sessIsPub:     make(map[*gortsplib.ServerSession]bool),
-		topicNameRe:   regexp.MustCompile(`^[A-Za-z0-9_-]+$`),
+		sessEdge:      make(map[*gortsplib.ServerSession]bool),
+		sessPub:       make(map[*gortsplib.ServerSession]*topic.PublisherSession),
+		sessRemote:    make(map[*gortsplib.ServerSession]string),
 		subscriberQSz: 256,
 		serverRef:     s,
 	}
@@ -56,13 +224,18 @@ func (s *Server) Start(ctx context.Context) error {
 	// configure UDP addresses if enabled
 	mgrCfg := s.mgr.Config()
 	pubSrv := &gortsplib.Server{Handler: h, RTSPAddress: fmt.Sprintf(":%d", s.pubPort)}
-	if s.cluster != nil && s.enableProxy {
+	proxyPubs := s.cluster != nil && (s.enableProxy || s.pubRedirect || s.lb != nil)
+	if proxyPubs || s.wrapsListeners() {
 		pubSrv.Listen = func(network string, address string) (net.Listener, error) {
 			ln, err := net.Listen(network, address)
 			if err != nil {
 				return nil, err
 			}
-			return &proxyListener{ln: ln, server: s, isPublisher: true}, nil
+			ln = s.wrapListener(ln)
+			if proxyPubs {
+				return newProxyListener(ln, s, true, s.pubRedirect), nil
+			}
+			return ln, nil
 		}
 	}
 	if mgrCfg.EnableUDP && mgrCfg.PublisherUDPBase > 0 {
@@ -95,13 +268,38 @@ func (s *Server) Start(ctx context.Context) error {
 	}
 
 	subSrv := &gortsplib.Server{Handler: h, RTSPAddress: fmt.Sprintf(":%d", s.subPort)}
-	if s.cluster != nil && s.enableProxy {
+	if s.multicastIPRange != "" {
+		subSrv.MulticastIPRange = s.multicastIPRange
+		subSrv.MulticastRTPPort = s.multicastRTPPort
+		subSrv.MulticastRTCPPort = s.multicastRTPPort + 1
+	}
+	// edges serve remote topics locally, so subscribers are not proxied
+	proxySubs := s.cluster != nil && ((s.enableProxy && s.edge == nil) || s.subRedirect || s.lb != nil)
+	if s.tunnelPort > 0 {
+		tln, err := net.Listen("tcp", fmt.Sprintf(":%d", s.tunnelPort))
+		if err != nil {
+			return fmt.Errorf("http tunnel listen: %w", err)
+		}
+		s.mu.Lock()
+		s.tunnelLn = tln
+		s.mu.Unlock()
+	}
+	if proxySubs || s.tunnelLn != nil || s.wrapsListeners() {
 		subSrv.Listen = func(network string, address string) (net.Listener, error) {
 			ln, err := net.Listen(network, address)
 			if err != nil {
 				return nil, err
 			}
-			return &proxyListener{ln: ln, server: s, isPublisher: false}, nil
+			ln = s.wrapListener(ln)
+			// tunneled sessions join the direct connections before cluster
+			// routing, so they are proxied to the owner like any other
+			if s.tunnelLn != nil {
+				ln = newMultiListener(ln, newTunnelListener(s.tunnelLn))
+			}
+			if proxySubs {
+				return newProxyListener(ln, s, false, s.subRedirect), nil
+			}
+			return ln, nil
 		}
 	}
 	if mgrCfg.EnableUDP && mgrCfg.SubscriberUDPBase > 0 {
@@ -140,6 +338,15 @@ func (s *Server) Start(ctx context.Context) error {
 			plog.Info("pub server error: %v", err)
 		}
 	}()
+	if s.tunnelLn != nil {
+		plog.Info("accepting RTSP-over-HTTP tunnels (subscribers) on %s", s.tunnelLn.Addr())
+	}
+	if len(s.replTopics) > 0 {
+		s.mu.Lock()
+		s.replDone = make(chan struct{})
+		s.mu.Unlock()
+		go s.runReplication()
+	}
 	go func() {
 		plog.Info("starting RTSP server (subscribers) on :%d", s.subPort)
 		if err := subSrv.Start(); err != nil {
@@ -157,21 +364,60 @@ func (s *Server) Close() {
 	if s.subSrv != nil {
 		s.subSrv.Close()
 	}
+	if s.tunnelLn != nil {
+		s.tunnelLn.Close()
+	}
+	for _, p := range s.migrations {
+		p.stop()
+	}
+	if s.replDone != nil {
+		close(s.replDone)
+		s.replDone = nil
+	}
+	for _, r := range s.replicas {
+		r.stop()
+	}
 	s.mu.Unlock()
+	if s.edge != nil {
+		s.edge.close()
+	}
 }
 
 // serverHandler implements gortsplib.ServerHandler and routes publishers and subscribers to topics
 type serverHandler struct {
-	mgr           *topic.Manager
-	mu            sync.Mutex
-	sessTopic     map[*gortsplib.ServerSession]string
-	sessIsPub     map[*gortsplib.ServerSession]bool
-	topicNameRe   *regexp.Regexp
+	mgr       *topic.Manager
+	mu        sync.Mutex
+	sessTopic map[*gortsplib.ServerSession]string
+	sessIsPub map[*gortsplib.ServerSession]bool
+	// sessEdge marks subscriber sessions reading an edge pull
+	sessEdge map[*gortsplib.ServerSession]bool
+	// sessPub is the topic publisher of publisher sessions
+	sessPub map[*gortsplib.ServerSession]*topic.PublisherSession
+	// sessRemote is the client address of a session, as seen through
+	// PROXY protocol headers
+	sessRemote    map[*gortsplib.ServerSession]string
 	subscriberQSz int
 	// cluster-related helpers
 	serverRef *Server
 }
 
+// wrapsListeners reports whether wrapListener changes the RTSP listeners.
+func (s *Server) wrapsListeners() bool {
+	return s.peerTLS != nil || len(s.proxyProtoTrusted) > 0 || s.proxyProtoSend
+}
+
+// wrapListener adds peer TLS and PROXY protocol handling to an RTSP
+// listener, before cluster routing sees its connections.
+func (s *Server) wrapListener(ln net.Listener) net.Listener {
+	if s.peerTLS != nil {
+		ln = newPeerTLSListener(ln, s.peerTLS)
+	}
+	if len(s.proxyProtoTrusted) > 0 || (s.proxyProtoSend && s.peerTLS != nil) {
+		ln = newProxyProtoListener(ln, s.proxyProtoTrusted, s.proxyProtoSend)
+	}
+	return ln
+}
+
 func (h *serverHandler) OnConnOpen(ctx *gortsplib.ServerHandlerOnConnOpenCtx) {
 	plog.Debug("conn open %v", ctx.Conn.NetConn().RemoteAddr())
 }
@@ -185,6 +431,22 @@ func (h *serverHandler) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (*
 	plog.Debug("describe %s", topicName)
 	// if cluster configured, ensure owner is local or let proxy handle it
 	// describe handled normally; proxying happens at connection accept layer
+	if h.serverRef != nil && h.serverRef.cluster != nil && h.serverRef.cluster.IsDraining(h.serverRef.cluster.Self()) {
+		plog.Info("describe for topic %s refused: node is draining", topicName)
+		return &base.Response{StatusCode: base.StatusServiceUnavailable}, nil, nil
+	}
+	if h.serverRef != nil && h.serverRef.cluster != nil && h.serverRef.admit(topicName, false).Overloaded != "" {
+		plog.Info("describe for topic %s refused: node is overloaded", topicName)
+		metrics.IncOverloadRejections("503")
+		return &base.Response{StatusCode: base.StatusServiceUnavailable}, nil, nil
+	}
+	if owner, ok := h.edgeOwner(topicName); ok {
+		p, err := h.serverRef.edge.stream(topicName, owner)
+		if err != nil {
+			return edgeErrorResponse(err), nil, nil
+		}
+		return &base.Response{StatusCode: base.StatusOK}, p.stream, nil
+	}
 	st := h.mgr.GetTopicStream(topicName)
 	if st != nil {
 		return &base.Response{StatusCode: base.StatusOK}, st, nil
@@ -198,13 +460,18 @@ func (h *serverHandler) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*
 	// ensure owner is local when announcing (publisher). If cluster configured and owner != self,
 	// return ServiceUnavailable so client can retry to correct node. Proxying is handled at TCP accept.
 	if h.serverRef != nil && h.serverRef.cluster != nil {
-		owner := h.serverRef.cluster.Owner(topicName)
-		if !h.serverRef.cluster.IsSelf(owner) {
-			plog.Info("announce for topic %s routed to owner %s (not local)", topicName, owner)
+		a := h.serverRef.admit(topicName, true)
+		if !h.serverRef.cluster.IsSelf(a.Owner) {
+			plog.Info("announce for topic %s routed to owner %s (not local)", topicName, a.Owner)
+			return &base.Response{StatusCode: base.StatusServiceUnavailable}, nil
+		}
+		if a.Overloaded != "" {
+			plog.Info("announce for topic %s refused: node is overloaded", topicName)
+			metrics.IncOverloadRejections("503")
 			return &base.Response{StatusCode: base.StatusServiceUnavailable}, nil
 		}
 	}
-	if !h.topicNameRe.MatchString(topicName) {
+	if !topic.ValidName(topicName) {
 		plog.Debug("invalid topic name: %s", topicName)
 		return &base.Response{StatusCode: base.StatusBadRequest}, nil
 	}
@@ -215,13 +482,23 @@ func (h *serverHandler) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*
 		plog.Info("register publisher failed: %v", err)
 		return &base.Response{StatusCode: base.StatusBadRequest}, nil
 	}
-	// create ServerStream from tracks and set in topic
-	st := gortsplib.NewServerStream(ctx.Tracks)
-	h.mgr.SetTopicStream(topicName, st)
+	// a kicked publisher (e.g. while draining) is disconnected so that it
+	// reconnects to the new owner
+	go func(sess *gortsplib.ServerSession) {
+		<-pub.Done()
+		sess.Close()
+	}(ctx.Session)
+	// a topic held by a standby publisher (see Server.PullTopic) keeps its
+	// stream and subscribers if the tracks are the same
+	if h.mgr.OpenTopicStream(topicName, ctx.Tracks) {
+		plog.Info("publisher for topic %s took over its stream", topicName)
+	}
 	// store session -> topic mapping and mark as publisher
 	h.mu.Lock()
 	h.sessTopic[ctx.Session] = topicName
 	h.sessIsPub[ctx.Session] = true
+	h.sessPub[ctx.Session] = pub
+	h.sessRemote[ctx.Session] = ctx.Conn.NetConn().RemoteAddr().String()
 	h.mu.Unlock()
 	return &base.Response{StatusCode: base.StatusOK}, nil
 }
@@ -242,38 +519,54 @@ func (h *serverHandler) OnPacketRTP(ctx *gortsplib.ServerHandlerOnPacketRTPCtx)
 	if topicName == "" {
 		return
 	}
-	st := h.mgr.GetTopicStream(topicName)
-	if st == nil {
-		return
-	}
 	plog.Debug("OnPacketRTP for topic %s track %d", topicName, ctx.TrackID)
-	// increment received metric
-	metrics.IncPacketsReceived()
-	// write directly to ServerStream (this will reach readers)
-	st.WritePacketRTP(ctx.TrackID, ctx.Packet)
-	// increment dispatched metric
-	metrics.IncPacketsDispatched()
+	if !h.mgr.WritePacketRTP(topicName, ctx.TrackID, ctx.Packet) {
+		// drop counted inside PublishPacket as needed
+		plog.Debug("drop packet for topic %s", topicName)
+	}
+}
 
-	// marshal packet and publish into topic manager so topic dispatcher handles fanout and metrics
+func (h *serverHandler) OnPacketRTCP(ctx *gortsplib.ServerHandlerOnPacketRTCPCtx) {
+	// only publisher RTCP (sender reports) is of interest; receiver reports
+	// from subscribers are handled by gortsplib itself.
+	h.mu.Lock()
+	topicName := h.sessTopic[ctx.Session]
+	isPub := h.sessIsPub[ctx.Session]
+	h.mu.Unlock()
+	if topicName == "" || !isPub {
+		return
+	}
 	b, err := ctx.Packet.Marshal()
 	if err != nil {
-		plog.Info("failed to marshal RTP packet: %v", err)
+		plog.Debug("failed to marshal RTCP packet: %v", err)
 		return
 	}
-	pkt := &topic.InboundPacket{Track: ctx.TrackID, Raw: b}
-	if !h.mgr.PublishPacket(topicName, pkt) {
-		// drop counted inside PublishPacket as needed
-		plog.Debug("drop packet for topic %s", topicName)
-	}
+	h.mgr.PublishRTCP(topicName, &topic.InboundPacket{Track: ctx.TrackID, Raw: b})
 }
 
 func (h *serverHandler) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
 	topicName := strings.TrimPrefix(ctx.Path, "/")
 	plog.Debug("setup %s", topicName)
+	h.mu.Lock()
+	h.sessRemote[ctx.Session] = ctx.Conn.NetConn().RemoteAddr().String()
+	h.mu.Unlock()
+	// edges serve remote topics from a local pull, over any transport
+	if owner, ok := h.edgeOwner(topicName); ok {
+		st, err := h.serverRef.edge.attach(topicName, owner, ctx.Session)
+		if err != nil {
+			return edgeErrorResponse(err), nil, nil
+		}
+		h.mu.Lock()
+		h.sessTopic[ctx.Session] = topicName
+		h.sessIsPub[ctx.Session] = false
+		h.sessEdge[ctx.Session] = true
+		h.mu.Unlock()
+		return &base.Response{StatusCode: base.StatusOK}, st, nil
+	}
 	// If cluster configured, and owner is remote, reject UDP transports and otherwise return service unavailable.
 	if h.serverRef != nil && h.serverRef.cluster != nil {
 		owner := h.serverRef.cluster.Owner(topicName)
-		if !h.serverRef.cluster.IsSelf(owner) {
+		if !h.serverRef.cluster.IsSelf(owner) && !h.serverRef.replicating(topicName) {
 			// check requested transport; ctx.Transport.Protocol uses the headers.TransportProtocol constants
 			// compare against UDP and reject with Unsupported Transport to encourage TCP interleaved
 			// Note: for proxied connections, the listener forwards TCP directly to the owner so this
@@ -301,6 +594,13 @@ func (h *serverHandler) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.R
 func (h *serverHandler) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
 	topicName := strings.TrimPrefix(ctx.Path, "/")
 	plog.Debug("play %s", topicName)
+	h.mu.Lock()
+	edge := h.sessEdge[ctx.Session]
+	h.mu.Unlock()
+	if edge {
+		// registered with the edge pull on SETUP
+		return &base.Response{StatusCode: base.StatusOK}, nil
+	}
 	// create subscriber session with a reasonable queue size
 	subID := fmt.Sprintf("%p", ctx.Session)
 	sub := topic.NewSubscriberSession(subID, h.subscriberQSz)
@@ -321,16 +621,48 @@ func (h *serverHandler) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionClos
 	h.mu.Lock()
 	topicName := h.sessTopic[ctx.Session]
 	isPub := h.sessIsPub[ctx.Session]
+	edge := h.sessEdge[ctx.Session]
+	pub := h.sessPub[ctx.Session]
 	delete(h.sessTopic, ctx.Session)
 	delete(h.sessIsPub, ctx.Session)
+	delete(h.sessEdge, ctx.Session)
+	delete(h.sessPub, ctx.Session)
+	delete(h.sessRemote, ctx.Session)
 	h.mu.Unlock()
 	if topicName == "" {
 		return
 	}
 	plog.Debug("session close for topic %s (isPublisher=%v)", topicName, isPub)
-	if isPub {
-		h.mgr.UnregisterPublisher(topicName)
+	if edge {
+		h.serverRef.edge.detach(topicName, ctx.Session)
+	} else if isPub {
+		// a no-op if the topic was handed to another publisher
+		h.mgr.UnregisterPublisherSession(topicName, pub)
 	} else {
 		h.mgr.UnregisterSubscriber(topicName, fmt.Sprintf("%p", ctx.Session))
 	}
 }
+
+// edgeOwner returns the remote owner of topicName when this node serves it
+// as an edge.
+func (h *serverHandler) edgeOwner(topicName string) (string, bool) {
+	if h.serverRef == nil || h.serverRef.edge == nil || !topic.ValidName(topicName) {
+		return "", false
+	}
+	cl := h.serverRef.cluster
+	owner := cl.Owner(topicName)
+	if owner == "" || cl.IsSelf(owner) || h.serverRef.replicating(topicName) {
+		return "", false
+	}
+	return owner, true
+}
+
+func edgeErrorResponse(err error) *base.Response {
+	switch {
+	case errors.Is(err, errEdgeNotFound):
+		return &base.Response{StatusCode: base.StatusNotFound}
+	case errors.Is(err, errEdgeFull):
+		return &base.Response{StatusCode: base.StatusServiceUnavailable, Body: []byte(err.Error())}
+	}
+	return &base.Response{StatusCode: base.StatusServiceUnavailable, Body: []byte("topic owner unreachable")}
+}
@@ -0,0 +1,612 @@
+package srt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLatency is the receive latency used when Config.Latency is 0.
+	DefaultLatency = 120 * time.Millisecond
+
+	// tickInterval paces ACKs, loss reports and too-late drops.
+	tickInterval = 10 * time.Millisecond
+	// handshakeInterval spaces out caller handshake attempts.
+	handshakeInterval = 250 * time.Millisecond
+	// keepaliveInterval keeps idle sessions (and NAT bindings) open.
+	keepaliveInterval = time.Second
+	// peerIdleTimeout ends a session when nothing arrives from the peer.
+	peerIdleTimeout = 5 * time.Second
+
+	mtu        = 1500
+	flowWindow = 8192
+	// maxLossRanges bounds the loss list of one NAK to fit the MTU.
+	maxLossRanges = 150
+)
+
+// Config tunes a connection.
+type Config struct {
+	// Latency is how long a missing packet is waited for before the data
+	// after it is delivered without it. The larger of this and the
+	// sender's latency is used.
+	Latency time.Duration
+	// StreamID is sent by callers. When set on a listener, callers must
+	// present the same stream ID.
+	StreamID string
+}
+
+// Conn receives one SRT stream. A listener accepts one caller at a time and
+// takes the next one once the current one has shut down or gone silent; a
+// caller connects in the background and reconnects when the session ends.
+// Read returns one payload (usually seven transport stream packets) per
+// call, in order.
+type Conn struct {
+	udp      *net.UDPConn
+	cfg      Config
+	remote   *net.UDPAddr // nil for listeners
+	socketID uint32
+	secret   [16]byte
+	start    time.Time
+
+	data      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	mu       sync.Mutex
+	deadline time.Time
+
+	// owned by run
+	sess      *session
+	isn       uint32
+	cookie    uint32
+	attemptAt time.Time
+}
+
+// session is the state of one connected peer.
+type session struct {
+	addr    *net.UDPAddr
+	peerID  uint32
+	latency time.Duration
+
+	// next is the next sequence number to deliver and highest the
+	// highest one received. buf holds packets received ahead of next,
+	// with nil entries for packets the sender dropped, and loss the
+	// missing ones with the time they were found missing.
+	next    uint32
+	highest uint32
+	buf     map[uint32][]byte
+	loss    map[uint32]time.Time
+
+	lastRecv time.Time
+	lastSend time.Time
+	lastNAK  time.Time
+	ackNo    uint32
+	ackSeq   uint32
+	acks     map[uint32]time.Time
+	rtt      time.Duration
+	rttVar   time.Duration
+
+	// receive rates, updated every second
+	rateAt            time.Time
+	pkts, bytes       uint32
+	pktRate, byteRate uint32
+}
+
+// Listen accepts callers on a local UDP address, e.g. ":9000".
+func Listen(addr string, cfg Config) (*Conn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(udp, nil, cfg), nil
+}
+
+// Dial connects to an SRT listener. It does not wait for the handshake:
+// the connection is (re)established in the background and Read blocks until
+// data arrives.
+func Dial(addr string, cfg Config) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(udp, raddr, cfg), nil
+}
+
+func newConn(udp *net.UDPConn, remote *net.UDPAddr, cfg Config) *Conn {
+	if cfg.Latency <= 0 {
+		cfg.Latency = DefaultLatency
+	}
+	// contribution feeds are bursty; a larger buffer avoids drops
+	udp.SetReadBuffer(4 << 20)
+	c := &Conn{
+		udp:      udp,
+		cfg:      cfg,
+		remote:   remote,
+		socketID: randUint32()&0x3fffffff | 1,
+		start:    time.Now(),
+		data:     make(chan []byte, 1024),
+		done:     make(chan struct{}),
+	}
+	rand.Read(c.secret[:])
+	c.wg.Add(1)
+	go c.run()
+	return c
+}
+
+// LocalAddr returns the local UDP address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.udp.LocalAddr()
+}
+
+// SetReadDeadline sets the deadline for Read; a zero value disables it.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// Read copies the next payload into b. It returns os.ErrDeadlineExceeded
+// when the read deadline passes and net.ErrClosed after Close.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case p := <-c.data:
+		return copy(b, p), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Close shuts the session down and releases the socket.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	c.wg.Wait()
+	return nil
+}
+
+func (c *Conn) run() {
+	defer c.wg.Done()
+	defer c.udp.Close()
+	buf := make([]byte, 64<<10)
+	next := time.Now()
+	for {
+		select {
+		case <-c.done:
+			if s := c.sess; s != nil {
+				c.send(s, marshalControl(ctrlShutdown, 0, c.now(), s.peerID, make([]byte, 4)))
+			}
+			return
+		default:
+		}
+		c.udp.SetReadDeadline(next)
+		n, addr, err := c.udp.ReadFromUDP(buf)
+		now := time.Now()
+		if err != nil {
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				return
+			}
+		} else if p, err := parsePacket(buf[:n]); err == nil {
+			c.handle(p, addr, now)
+		}
+		if !now.Before(next) {
+			c.tick(now)
+			next = now.Add(tickInterval)
+		}
+	}
+}
+
+// now returns the packet timestamp, in microseconds since the start.
+func (c *Conn) now() uint32 {
+	return uint32(time.Since(c.start).Microseconds())
+}
+
+func (c *Conn) send(s *session, b []byte) {
+	c.udp.WriteToUDP(b, s.addr)
+	s.lastSend = time.Now()
+}
+
+func (c *Conn) handle(p *packet, addr *net.UDPAddr, now time.Time) {
+	if c.remote != nil && !sameAddr(addr, c.remote) {
+		return
+	}
+	if p.control && p.typ == ctrlHandshake {
+		h, err := parseHandshake(p.payload)
+		if err != nil {
+			return
+		}
+		if c.remote != nil {
+			c.callerHandshake(h, p.dest, now)
+		} else {
+			c.listenerHandshake(h, addr, now)
+		}
+		return
+	}
+	s := c.sess
+	if s == nil || p.dest != c.socketID || !sameAddr(addr, s.addr) {
+		return
+	}
+	s.lastRecv = now
+	if !p.control {
+		c.receive(s, p, now)
+		return
+	}
+	switch p.typ {
+	case ctrlACKACK:
+		if sent, ok := s.acks[p.info]; ok {
+			delete(s.acks, p.info)
+			sample := now.Sub(sent)
+			diff := s.rtt - sample
+			if diff < 0 {
+				diff = -diff
+			}
+			s.rttVar = (3*s.rttVar + diff) / 4
+			s.rtt = (7*s.rtt + sample) / 8
+		}
+	case ctrlDropReq:
+		if len(p.payload) >= 8 {
+			c.dropRange(s, binary.BigEndian.Uint32(p.payload)&(maxSeq-1), binary.BigEndian.Uint32(p.payload[4:])&(maxSeq-1))
+		}
+	case ctrlShutdown:
+		c.endSession(now)
+	}
+}
+
+// receive delivers in-order data and reports gaps to the sender.
+func (c *Conn) receive(s *session, p *packet, now time.Time) {
+	s.pkts++
+	s.bytes += uint32(len(p.payload))
+	if p.key != 0 {
+		// encryption is refused in the handshake
+		return
+	}
+	d := seqDiff(s.next, p.seq)
+	switch {
+	case d < 0:
+		return
+	case d > flowWindow:
+		// far ahead of anything we wait for, e.g. after a long outage
+		s.buf = make(map[uint32][]byte)
+		s.loss = make(map[uint32]time.Time)
+		s.next, s.highest = p.seq, seqAdd(p.seq, -1)
+	}
+	if _, ok := s.buf[p.seq]; ok {
+		return
+	}
+	if h := seqDiff(s.highest, p.seq); h > 1 {
+		first, last := seqAdd(s.highest, 1), seqAdd(p.seq, -1)
+		for q := first; q != p.seq; q = seqAdd(q, 1) {
+			s.loss[q] = now
+		}
+		c.sendNAK(s, [][2]uint32{{first, last}})
+	}
+	if seqDiff(s.highest, p.seq) > 0 {
+		s.highest = p.seq
+	}
+	delete(s.loss, p.seq)
+	s.buf[p.seq] = append([]byte(nil), p.payload...)
+	c.deliver(s)
+}
+
+// deliver hands consecutive packets from next on to Read.
+func (c *Conn) deliver(s *session) {
+	for {
+		b, ok := s.buf[s.next]
+		if !ok {
+			return
+		}
+		delete(s.buf, s.next)
+		s.next = seqAdd(s.next, 1)
+		if b == nil {
+			continue
+		}
+		select {
+		case c.data <- b:
+		default:
+			// the reader is behind; drop like a full socket buffer
+		}
+	}
+}
+
+// dropRange skips packets the sender will not retransmit.
+func (c *Conn) dropRange(s *session, first, last uint32) {
+	n := seqDiff(first, last)
+	if n < 0 || n > flowWindow {
+		return
+	}
+	for q := first; ; q = seqAdd(q, 1) {
+		if _, lost := s.loss[q]; lost {
+			delete(s.loss, q)
+			s.buf[q] = nil
+		}
+		if q == last {
+			break
+		}
+	}
+	c.deliver(s)
+}
+
+func (c *Conn) tick(now time.Time) {
+	if c.remote != nil && c.sess == nil && !now.Before(c.attemptAt) {
+		c.sendCallerHandshake(now)
+	}
+	s := c.sess
+	if s == nil {
+		return
+	}
+	if now.Sub(s.lastRecv) > peerIdleTimeout {
+		c.endSession(now)
+		return
+	}
+
+	// give up on the head of line packet once the latency has passed
+	if t, ok := s.loss[s.next]; ok && now.Sub(t) > s.latency {
+		for {
+			if _, lost := s.loss[s.next]; !lost {
+				break
+			}
+			delete(s.loss, s.next)
+			s.next = seqAdd(s.next, 1)
+		}
+		c.deliver(s)
+	}
+
+	if now.Sub(s.rateAt) >= time.Second {
+		s.pktRate, s.byteRate = s.pkts, s.bytes
+		s.pkts, s.bytes = 0, 0
+		s.rateAt = now
+	}
+	if s.next != s.ackSeq {
+		c.sendACK(s, now)
+	}
+	if len(s.loss) > 0 && now.Sub(s.lastNAK) > max(s.rtt+4*s.rttVar, 2*tickInterval) {
+		c.sendNAK(s, lossRanges(s))
+	}
+	if now.Sub(s.lastSend) >= keepaliveInterval {
+		c.send(s, marshalControl(ctrlKeepalive, 0, c.now(), s.peerID, make([]byte, 4)))
+	}
+}
+
+func (c *Conn) sendACK(s *session, now time.Time) {
+	s.ackNo++
+	s.ackSeq = s.next
+	if len(s.acks) > 64 {
+		s.acks = make(map[uint32]time.Time)
+	}
+	s.acks[s.ackNo] = now
+	cif := make([]byte, 28)
+	binary.BigEndian.PutUint32(cif, s.next)
+	binary.BigEndian.PutUint32(cif[4:], uint32(s.rtt.Microseconds()))
+	binary.BigEndian.PutUint32(cif[8:], uint32(s.rttVar.Microseconds()))
+	binary.BigEndian.PutUint32(cif[12:], uint32(max(flowWindow-len(s.buf), 2)))
+	binary.BigEndian.PutUint32(cif[16:], s.pktRate)
+	binary.BigEndian.PutUint32(cif[20:], s.pktRate)
+	binary.BigEndian.PutUint32(cif[24:], s.byteRate)
+	c.send(s, marshalControl(ctrlACK, s.ackNo, c.now(), s.peerID, cif))
+}
+
+// sendNAK reports missing ranges; single packets are one entry, ranges a
+// pair with the high bit set on the first.
+func (c *Conn) sendNAK(s *session, ranges [][2]uint32) {
+	var cif []byte
+	for _, r := range ranges {
+		if r[0] == r[1] {
+			cif = binary.BigEndian.AppendUint32(cif, r[0])
+		} else {
+			cif = binary.BigEndian.AppendUint32(cif, r[0]|0x80000000)
+			cif = binary.BigEndian.AppendUint32(cif, r[1])
+		}
+	}
+	c.send(s, marshalControl(ctrlNAK, 0, c.now(), s.peerID, cif))
+	s.lastNAK = time.Now()
+}
+
+// lossRanges returns the missing packets as ranges, oldest first.
+func lossRanges(s *session) [][2]uint32 {
+	seqs := make([]uint32, 0, len(s.loss))
+	for q := range s.loss {
+		seqs = append(seqs, q)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqDiff(seqs[i], seqs[j]) > 0 })
+	var out [][2]uint32
+	for _, q := range seqs {
+		if n := len(out); n > 0 && seqAdd(out[n-1][1], 1) == q {
+			out[n-1][1] = q
+			continue
+		}
+		if len(out) == maxLossRanges {
+			break
+		}
+		out = append(out, [2]uint32{q, q})
+	}
+	return out
+}
+
+func (c *Conn) endSession(now time.Time) {
+	c.sess = nil
+	c.cookie = 0
+	c.attemptAt = now.Add(handshakeInterval)
+}
+
+func (c *Conn) newSession(addr *net.UDPAddr, peerID, isn uint32, peerLatency time.Duration, now time.Time) *session {
+	return &session{
+		addr:     addr,
+		peerID:   peerID,
+		latency:  max(c.cfg.Latency, peerLatency),
+		next:     isn,
+		highest:  seqAdd(isn, -1),
+		ackSeq:   isn,
+		buf:      make(map[uint32][]byte),
+		loss:     make(map[uint32]time.Time),
+		acks:     make(map[uint32]time.Time),
+		rtt:      100 * time.Millisecond,
+		rttVar:   50 * time.Millisecond,
+		lastRecv: now,
+		rateAt:   now,
+	}
+}
+
+// listenerHandshake answers inductions with a cookie and accepts
+// conclusions that echo it.
+func (c *Conn) listenerHandshake(h *handshake, addr *net.UDPAddr, now time.Time) {
+	resp := &handshake{
+		version:    5,
+		initSeq:    h.initSeq,
+		mtu:        h.mtu,
+		flowWindow: h.flowWindow,
+		typ:        h.typ,
+		socketID:   c.socketID,
+		peerIP:     h.peerIP,
+	}
+	switch h.typ {
+	case hsInduction:
+		resp.extension = srtMagic
+		resp.cookie = c.makeCookie(addr, now)
+		c.udp.WriteToUDP(marshalControl(ctrlHandshake, 0, c.now(), h.socketID, resp.marshal()), addr)
+		return
+	case hsConclusion:
+	default:
+		return
+	}
+	if h.cookie != c.makeCookie(addr, now) && h.cookie != c.makeCookie(addr, now.Add(-time.Minute)) {
+		return
+	}
+	resp.cookie = h.cookie
+	reject := func(reason uint32) {
+		resp.typ = hsRejectBase + reason
+		c.udp.WriteToUDP(marshalControl(ctrlHandshake, 0, c.now(), h.socketID, resp.marshal()), addr)
+	}
+	switch {
+	case h.version < 5:
+		reject(rejectVersion)
+		return
+	case h.encryption != 0 || h.kmRequest:
+		reject(rejectUnsecure)
+		return
+	case !h.hasSRT || h.srtFlags&flagStream != 0 || h.srtFlags&flagTSBPDSnd == 0:
+		// only live mode senders are supported
+		reject(rejectPeer)
+		return
+	case c.cfg.StreamID != "" && h.streamID != c.cfg.StreamID:
+		reject(rejectPeer)
+		return
+	}
+	s := c.sess
+	switch {
+	case s == nil:
+		s = c.newSession(addr, h.socketID, h.initSeq, time.Duration(h.sndDelay)*time.Millisecond, now)
+		c.sess = s
+	case s.peerID == h.socketID && sameAddr(s.addr, addr):
+		// our response was lost; answer again
+	default:
+		reject(rejectBacklog)
+		return
+	}
+	resp.extension = extFlagHSREQ
+	b := appendSRTExtension(resp.marshal(), extHSRSP, flagTSBPDRcv|flagTLPktDrop|flagRexmit, uint16(s.latency/time.Millisecond), 0)
+	c.send(s, marshalControl(ctrlHandshake, 0, c.now(), h.socketID, b))
+}
+
+// sendCallerHandshake sends an induction, or the conclusion once the
+// listener's cookie is known.
+func (c *Conn) sendCallerHandshake(now time.Time) {
+	h := &handshake{
+		version:    4,
+		extension:  2, // UDT datagram socket
+		initSeq:    c.isn,
+		mtu:        mtu,
+		flowWindow: flowWindow,
+		typ:        hsInduction,
+		socketID:   c.socketID,
+	}
+	if c.cookie == 0 {
+		c.isn = randUint32() & (maxSeq - 1)
+		h.initSeq = c.isn
+	} else {
+		h.version = 5
+		h.extension = extFlagHSREQ
+		if c.cfg.StreamID != "" {
+			h.extension |= extFlagConfig
+		}
+		h.typ = hsConclusion
+		h.cookie = c.cookie
+	}
+	b := h.marshal()
+	if h.typ == hsConclusion {
+		b = appendSRTExtension(b, extHSREQ, flagTSBPDRcv|flagTLPktDrop|flagRexmit, uint16(c.cfg.Latency/time.Millisecond), 0)
+		if c.cfg.StreamID != "" {
+			b = appendStreamID(b, c.cfg.StreamID)
+		}
+	}
+	c.udp.WriteToUDP(marshalControl(ctrlHandshake, 0, c.now(), 0, b), c.remote)
+	c.attemptAt = now.Add(handshakeInterval)
+}
+
+func (c *Conn) callerHandshake(h *handshake, dest uint32, now time.Time) {
+	if c.sess != nil || dest != c.socketID {
+		return
+	}
+	switch {
+	case h.typ == hsInduction && h.version >= 5 && h.extension == srtMagic:
+		c.cookie = h.cookie
+		c.sendCallerHandshake(now)
+	case h.typ == hsConclusion && h.version >= 5:
+		if !h.hasSRT || h.srtFlags&flagTSBPDSnd == 0 {
+			// the listener does not send; try again later
+			c.cookie = 0
+			c.attemptAt = now.Add(time.Second)
+			return
+		}
+		c.sess = c.newSession(c.remote, h.socketID, h.initSeq, time.Duration(max(h.rcvDelay, h.sndDelay))*time.Millisecond, now)
+	case h.typ >= hsRejectBase:
+		c.cookie = 0
+		c.attemptAt = now.Add(time.Second)
+	}
+}
+
+// makeCookie derives the SYN cookie for addr from a per-connection secret
+// and the current minute, so listeners keep no state for inductions.
+func (c *Conn) makeCookie(addr *net.UDPAddr, t time.Time) uint32 {
+	h := sha256.New()
+	h.Write(c.secret[:])
+	h.Write([]byte(addr.String()))
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(t.Unix()/60)))
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+func randUint32() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
@@ -0,0 +1,260 @@
+// Package srt implements the receiving side of SRT live mode, enough to take
+// MPEG-TS contribution feeds from encoders and srt-live-transmit: the v5
+// caller/listener handshake, in-order delivery with loss reports (NAK) and
+// ACKs, and too-late packet drop after the negotiated latency. Encryption,
+// rendezvous mode, packet filters and sending are not supported.
+package srt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const headerSize = 16
+
+// Control packet types.
+const (
+	ctrlHandshake = 0x0000
+	ctrlKeepalive = 0x0001
+	ctrlACK       = 0x0002
+	ctrlNAK       = 0x0003
+	ctrlShutdown  = 0x0005
+	ctrlACKACK    = 0x0006
+	ctrlDropReq   = 0x0007
+)
+
+// Handshake types; values of 1000 and above are rejections (1000 + reason).
+const (
+	hsInduction  = 0x00000001
+	hsConclusion = 0xffffffff
+	hsRejectBase = 1000
+)
+
+// Rejection reasons sent to peers.
+const (
+	rejectPeer     = 2
+	rejectBacklog  = 5
+	rejectVersion  = 8
+	rejectUnsecure = 11
+)
+
+const (
+	// srtMagic is the extension field of a v5 induction response.
+	srtMagic = 0x4a17
+	// srtVersion is the protocol version announced in HSREQ/HSRSP (1.4.0).
+	srtVersion = 0x00010400
+)
+
+// Handshake extension flags and block types.
+const (
+	extFlagHSREQ  = 0x1
+	extFlagKMREQ  = 0x2
+	extFlagConfig = 0x4
+
+	extHSREQ = 1
+	extHSRSP = 2
+	extKMREQ = 3
+	extSID   = 5
+)
+
+// SRT option flags carried in HSREQ/HSRSP.
+const (
+	flagTSBPDSnd  = 0x01
+	flagTSBPDRcv  = 0x02
+	flagCrypt     = 0x04
+	flagTLPktDrop = 0x08
+	flagRexmit    = 0x20
+	flagStream    = 0x40
+)
+
+// maxSeq is the sequence number space; sequence numbers wrap at 2^31.
+const maxSeq = 1 << 31
+
+var errShortPacket = errors.New("srt: short packet")
+
+// packet is one SRT packet. Data packets set seq and key, control packets
+// typ and info; payload is the data or the control information field.
+type packet struct {
+	control bool
+	typ     uint16
+	info    uint32
+	seq     uint32
+	// key is the encryption key field of data packets; 0 means plain text
+	key       uint8
+	timestamp uint32
+	dest      uint32
+	payload   []byte
+}
+
+func parsePacket(b []byte) (*packet, error) {
+	if len(b) < headerSize {
+		return nil, errShortPacket
+	}
+	p := &packet{
+		timestamp: binary.BigEndian.Uint32(b[8:]),
+		dest:      binary.BigEndian.Uint32(b[12:]),
+		payload:   b[headerSize:],
+	}
+	w0 := binary.BigEndian.Uint32(b)
+	if w0&0x80000000 != 0 {
+		p.control = true
+		p.typ = uint16(w0>>16) & 0x7fff
+		p.info = binary.BigEndian.Uint32(b[4:])
+	} else {
+		p.seq = w0
+		p.key = uint8(b[4]>>3) & 0x3
+	}
+	return p, nil
+}
+
+// marshalControl encodes a control packet.
+func marshalControl(typ uint16, info, timestamp, dest uint32, cif []byte) []byte {
+	b := make([]byte, headerSize+len(cif))
+	binary.BigEndian.PutUint32(b, 0x80000000|uint32(typ)<<16)
+	binary.BigEndian.PutUint32(b[4:], info)
+	binary.BigEndian.PutUint32(b[8:], timestamp)
+	binary.BigEndian.PutUint32(b[12:], dest)
+	copy(b[headerSize:], cif)
+	return b
+}
+
+// marshalData encodes a data packet carrying a whole message.
+func marshalData(seq, msgno, timestamp, dest uint32, payload []byte) []byte {
+	b := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(b, seq&(maxSeq-1))
+	// PP=11 (solo packet), in order
+	binary.BigEndian.PutUint32(b[4:], 0xe0000000|msgno&0x03ffffff)
+	binary.BigEndian.PutUint32(b[8:], timestamp)
+	binary.BigEndian.PutUint32(b[12:], dest)
+	copy(b[headerSize:], payload)
+	return b
+}
+
+// handshake is the control information field of a handshake packet.
+type handshake struct {
+	version    uint32
+	encryption uint16
+	extension  uint16
+	initSeq    uint32
+	mtu        uint32
+	flowWindow uint32
+	typ        uint32
+	socketID   uint32
+	cookie     uint32
+	peerIP     [16]byte
+
+	// extensions of conclusion handshakes
+	hasSRT    bool
+	srtFlags  uint32
+	rcvDelay  uint16
+	sndDelay  uint16
+	streamID  string
+	kmRequest bool
+}
+
+const handshakeSize = 48
+
+func parseHandshake(b []byte) (*handshake, error) {
+	if len(b) < handshakeSize {
+		return nil, errShortPacket
+	}
+	h := &handshake{
+		version:    binary.BigEndian.Uint32(b),
+		encryption: binary.BigEndian.Uint16(b[4:]),
+		extension:  binary.BigEndian.Uint16(b[6:]),
+		initSeq:    binary.BigEndian.Uint32(b[8:]),
+		mtu:        binary.BigEndian.Uint32(b[12:]),
+		flowWindow: binary.BigEndian.Uint32(b[16:]),
+		typ:        binary.BigEndian.Uint32(b[20:]),
+		socketID:   binary.BigEndian.Uint32(b[24:]),
+		cookie:     binary.BigEndian.Uint32(b[28:]),
+	}
+	copy(h.peerIP[:], b[32:48])
+	if h.version < 5 || h.typ != hsConclusion {
+		return h, nil
+	}
+	for ext := b[handshakeSize:]; len(ext) >= 4; {
+		typ := binary.BigEndian.Uint16(ext)
+		n := int(binary.BigEndian.Uint16(ext[2:])) * 4
+		if len(ext) < 4+n {
+			return nil, errShortPacket
+		}
+		body := ext[4 : 4+n]
+		switch typ {
+		case extHSREQ, extHSRSP:
+			if n < 12 {
+				return nil, errShortPacket
+			}
+			h.hasSRT = true
+			h.srtFlags = binary.BigEndian.Uint32(body[4:])
+			h.rcvDelay = binary.BigEndian.Uint16(body[8:])
+			h.sndDelay = binary.BigEndian.Uint16(body[10:])
+		case extSID:
+			h.streamID = unpackString(body)
+		case extKMREQ:
+			h.kmRequest = true
+		}
+		ext = ext[4+n:]
+	}
+	return h, nil
+}
+
+func (h *handshake) marshal() []byte {
+	b := make([]byte, handshakeSize)
+	binary.BigEndian.PutUint32(b, h.version)
+	binary.BigEndian.PutUint16(b[4:], h.encryption)
+	binary.BigEndian.PutUint16(b[6:], h.extension)
+	binary.BigEndian.PutUint32(b[8:], h.initSeq)
+	binary.BigEndian.PutUint32(b[12:], h.mtu)
+	binary.BigEndian.PutUint32(b[16:], h.flowWindow)
+	binary.BigEndian.PutUint32(b[20:], h.typ)
+	binary.BigEndian.PutUint32(b[24:], h.socketID)
+	binary.BigEndian.PutUint32(b[28:], h.cookie)
+	copy(b[32:], h.peerIP[:])
+	return b
+}
+
+// appendSRTExtension appends an HSREQ or HSRSP block.
+func appendSRTExtension(b []byte, typ uint16, flags uint32, rcvDelay, sndDelay uint16) []byte {
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, 3)
+	b = binary.BigEndian.AppendUint32(b, srtVersion)
+	b = binary.BigEndian.AppendUint32(b, flags)
+	b = binary.BigEndian.AppendUint16(b, rcvDelay)
+	return binary.BigEndian.AppendUint16(b, sndDelay)
+}
+
+// appendStreamID appends a stream ID block. SRT packs strings into 32 bit
+// words with the bytes of each word reversed.
+func appendStreamID(b []byte, id string) []byte {
+	s := []byte(id)
+	for len(s)%4 != 0 {
+		s = append(s, 0)
+	}
+	for i := 0; i < len(s); i += 4 {
+		s[i], s[i+1], s[i+2], s[i+3] = s[i+3], s[i+2], s[i+1], s[i]
+	}
+	b = binary.BigEndian.AppendUint16(b, extSID)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)/4))
+	return append(b, s...)
+}
+
+func unpackString(b []byte) string {
+	s := make([]byte, 0, len(b))
+	for i := 0; i+4 <= len(b); i += 4 {
+		s = append(s, b[i+3], b[i+2], b[i+1], b[i])
+	}
+	for len(s) > 0 && s[len(s)-1] == 0 {
+		s = s[:len(s)-1]
+	}
+	return string(s)
+}
+
+// seqDiff returns b - a in the wrapping 31 bit sequence space.
+func seqDiff(a, b uint32) int32 {
+	return int32((b-a)<<1) >> 1
+}
+
+func seqAdd(s uint32, n int32) uint32 {
+	return (s + uint32(n)) & (maxSeq - 1)
+}
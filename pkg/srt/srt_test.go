@@ -0,0 +1,230 @@
+package srt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// testPeer is the sending side of a session, driven by hand.
+type testPeer struct {
+	t    *testing.T
+	conn *net.UDPConn
+	to   *net.UDPAddr
+	id   uint32
+	// dest is the socket ID of the Conn under test
+	dest uint32
+}
+
+func (p *testPeer) write(b []byte) {
+	p.t.Helper()
+	var err error
+	if p.to != nil {
+		_, err = p.conn.WriteToUDP(b, p.to)
+	} else {
+		_, err = p.conn.Write(b)
+	}
+	if err != nil {
+		p.t.Fatalf("write: %v", err)
+	}
+}
+
+// readControl returns the next control packet of type typ, skipping others
+// such as ACKs and keepalives.
+func (p *testPeer) readControl(typ uint16) (*packet, *net.UDPAddr) {
+	p.t.Helper()
+	buf := make([]byte, 2048)
+	p.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			p.t.Fatalf("waiting for control type %d: %v", typ, err)
+		}
+		pkt, err := parsePacket(append([]byte(nil), buf[:n]...))
+		if err == nil && pkt.control && pkt.typ == typ {
+			return pkt, addr
+		}
+	}
+}
+
+func (p *testPeer) readHandshake() *handshake {
+	p.t.Helper()
+	pkt, _ := p.readControl(ctrlHandshake)
+	if pkt.dest != p.id {
+		p.t.Fatalf("handshake for socket %d, want %d", pkt.dest, p.id)
+	}
+	h, err := parseHandshake(pkt.payload)
+	if err != nil {
+		p.t.Fatalf("parse handshake: %v", err)
+	}
+	return h
+}
+
+// connect runs the caller side of the handshake and returns the response
+// to the conclusion.
+func (p *testPeer) connect(isn uint32, streamID string, flags uint32) *handshake {
+	p.t.Helper()
+	h := &handshake{version: 4, extension: 2, initSeq: isn, mtu: mtu, flowWindow: flowWindow, typ: hsInduction, socketID: p.id}
+	p.write(marshalControl(ctrlHandshake, 0, 0, 0, h.marshal()))
+	resp := p.readHandshake()
+	if resp.version != 5 || resp.extension != srtMagic || resp.cookie == 0 {
+		p.t.Fatalf("unexpected induction response %+v", resp)
+	}
+	h.version, h.extension, h.typ, h.cookie = 5, extFlagHSREQ|extFlagConfig, hsConclusion, resp.cookie
+	b := appendSRTExtension(h.marshal(), extHSREQ, flags, 0, 200)
+	b = appendStreamID(b, streamID)
+	p.write(marshalControl(ctrlHandshake, 0, 0, 0, b))
+	resp = p.readHandshake()
+	p.dest = resp.socketID
+	return resp
+}
+
+func (p *testPeer) data(seq uint32, payload string) {
+	p.t.Helper()
+	p.write(marshalData(seq, seq, 0, p.dest, []byte(payload)))
+}
+
+func readPayload(t *testing.T, c *Conn) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestListenerReceivesInOrder(t *testing.T) {
+	c, err := Listen("127.0.0.1:0", Config{Latency: 50 * time.Millisecond, StreamID: "cam1"})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer c.Close()
+	udp, err := net.DialUDP("udp", nil, c.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer udp.Close()
+
+	// a wrong stream ID and file mode are refused
+	other := &testPeer{t: t, conn: udp, id: 7}
+	if resp := other.connect(100, "cam2", flagTSBPDSnd); resp.typ != hsRejectBase+rejectPeer {
+		t.Fatalf("expected stream ID rejection, got handshake type %d", resp.typ)
+	}
+	if resp := other.connect(100, "cam1", flagStream); resp.typ != hsRejectBase+rejectPeer {
+		t.Fatalf("expected stream mode rejection, got handshake type %d", resp.typ)
+	}
+
+	// start just below the sequence number wrap
+	isn := uint32(maxSeq - 2)
+	p := &testPeer{t: t, conn: udp, id: 42}
+	resp := p.connect(isn, "cam1", flagTSBPDSnd|flagTLPktDrop|flagRexmit)
+	if resp.typ != hsConclusion || !resp.hasSRT || resp.rcvDelay != 200 {
+		t.Fatalf("unexpected conclusion response %+v", resp)
+	}
+
+	p.data(isn, "p0")
+	p.data(seqAdd(isn, 2), "p2")
+	nak, _ := p.readControl(ctrlNAK)
+	if len(nak.payload) != 4 || binary.BigEndian.Uint32(nak.payload) != seqAdd(isn, 1) {
+		t.Fatalf("expected a NAK for %d, got %x", seqAdd(isn, 1), nak.payload)
+	}
+	p.data(seqAdd(isn, 1), "p1")
+	for i := 0; i < 3; i++ {
+		if got, want := readPayload(t, c), fmt.Sprintf("p%d", i); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	ack, _ := p.readControl(ctrlACK)
+	if got := binary.BigEndian.Uint32(ack.payload); seqDiff(seqAdd(isn, 3), got) < 0 {
+		t.Fatalf("ACK for %d, want at least %d", got, seqAdd(isn, 3))
+	}
+
+	// a packet that is never retransmitted is skipped after the latency
+	p.data(seqAdd(isn, 4), "p4")
+	start := time.Now()
+	if got := readPayload(t, c); got != "p4" {
+		t.Fatalf("got %q after a loss, want p4", got)
+	}
+	if waited := time.Since(start); waited < 150*time.Millisecond {
+		t.Fatalf("loss skipped after %s, before the negotiated latency", waited)
+	}
+
+	// another caller is refused while the session is alive
+	if resp := other.connect(500, "cam1", flagTSBPDSnd); resp.typ != hsRejectBase+rejectBacklog {
+		t.Fatalf("expected a second caller to be refused, got handshake type %d", resp.typ)
+	}
+	// after a shutdown the next caller is accepted
+	p.write(marshalControl(ctrlShutdown, 0, 0, p.dest, make([]byte, 4)))
+	time.Sleep(50 * time.Millisecond)
+	if resp := other.connect(500, "cam1", flagTSBPDSnd); resp.typ != hsConclusion {
+		t.Fatalf("expected the next caller to be accepted, got handshake type %d", resp.typ)
+	}
+	other.data(500, "next")
+	if got := readPayload(t, c); got != "next" {
+		t.Fatalf("got %q from the next caller", got)
+	}
+}
+
+func TestDialReceivesFromListener(t *testing.T) {
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	c, err := Dial(ln.LocalAddr().String(), Config{StreamID: "live/cam1"})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+
+	p := &testPeer{t: t, conn: ln, id: 99}
+	pkt, addr := p.readControl(ctrlHandshake)
+	p.to = addr
+	h, err := parseHandshake(pkt.payload)
+	if err != nil || h.typ != hsInduction {
+		t.Fatalf("expected an induction, got %+v (%v)", h, err)
+	}
+	p.dest = h.socketID
+	resp := &handshake{version: 5, extension: srtMagic, initSeq: h.initSeq, mtu: mtu, flowWindow: flowWindow, typ: hsInduction, socketID: p.id, cookie: 1234}
+	p.write(marshalControl(ctrlHandshake, 0, 0, p.dest, resp.marshal()))
+
+	for {
+		pkt, _ = p.readControl(ctrlHandshake)
+		if h, err = parseHandshake(pkt.payload); err != nil {
+			t.Fatalf("parse conclusion: %v", err)
+		}
+		if h.typ == hsConclusion {
+			break
+		}
+	}
+	if h.cookie != 1234 || !h.hasSRT || h.streamID != "live/cam1" || h.rcvDelay != uint16(DefaultLatency/time.Millisecond) {
+		t.Fatalf("unexpected conclusion %+v", h)
+	}
+	resp.typ, resp.extension = hsConclusion, extFlagHSREQ
+	p.write(marshalControl(ctrlHandshake, 0, 0, p.dest, appendSRTExtension(resp.marshal(), extHSRSP, flagTSBPDSnd|flagTSBPDRcv, 120, 120)))
+
+	p.data(h.initSeq, "hello")
+	if got := readPayload(t, c); got != "hello" {
+		t.Fatalf("got %q, want hello", got)
+	}
+}
+
+func TestStreamIDPacking(t *testing.T) {
+	for _, id := range []string{"", "a", "cam1", "#!::r=live/cam1,m=publish"} {
+		b := appendStreamID(nil, id)
+		if len(b)%4 != 0 {
+			t.Fatalf("%q: block not word aligned", id)
+		}
+		if got := unpackString(b[4:]); got != id {
+			t.Fatalf("got %q, want %q", got, id)
+		}
+	}
+	// "abcd" is sent as "dcba"
+	if b := appendStreamID(nil, "abcd"); string(b[4:]) != "dcba" {
+		t.Fatalf("unexpected packing %q", b[4:])
+	}
+}
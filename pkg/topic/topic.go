@@ -5,10 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib"
+	"github.com/pion/rtp"
 	plog "redalf.de/rtsper/pkg/log"
 	"redalf.de/rtsper/pkg/metrics"
 )
@@ -59,11 +63,74 @@ type Manager struct {
 	topics         map[string]*Topic
 	cfg            Config
 	publisherCount int
+	// taps observe inbound packets per topic name; they are keyed by name
+	// rather than attached to a Topic so they survive publisher reconnects.
+	taps map[string]map[string]PacketTap
+	// ingest reports per-topic statistics of non-RTSP inputs (e.g. MPEG-TS)
+	ingest map[string]IngestReporter
 }
 
+// PacketTap observes inbound RTP/RTCP packets of a topic. Taps are called
+// synchronously on the ingest path and must not block.
+type PacketTap func(pkt *InboundPacket)
+
 // NewManager creates a new Topic Manager
 func NewManager(cfg Config) *Manager {
-	return &Manager{topics: make(map[string]*Topic), cfg: cfg}
+	return &Manager{topics: make(map[string]*Topic), cfg: cfg, taps: make(map[string]map[string]PacketTap), ingest: make(map[string]IngestReporter)}
+}
+
+// AddTap registers a packet tap for a topic under the given id. An existing
+// tap with the same id is replaced. The topic does not need to exist yet.
+func (m *Manager) AddTap(name string, id string, fn PacketTap) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.taps[name] == nil {
+		m.taps[name] = make(map[string]PacketTap)
+	}
+	m.taps[name][id] = fn
+}
+
+// RemoveTap unregisters a packet tap.
+func (m *Manager) RemoveTap(name string, id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ts, ok := m.taps[name]; ok {
+		delete(ts, id)
+		if len(ts) == 0 {
+			delete(m.taps, name)
+		}
+	}
+}
+
+// notifyTaps calls all taps registered for a topic. Caller must hold m.mu (read).
+func (m *Manager) notifyTaps(name string, pkt *InboundPacket) {
+	for _, fn := range m.taps[name] {
+		fn(pkt)
+	}
+}
+
+// IngestStatus describes an ingest source other than an RTSP publisher.
+type IngestStatus struct {
+	Source           string  `json:"source"`
+	Packets          int64   `json:"packets"`
+	ContinuityErrors int64   `json:"cc_errors"`
+	PCRJitterMs      float64 `json:"pcr_jitter_ms"`
+}
+
+// IngestReporter returns the current ingest statistics of a topic. It is
+// called while building status and must not block.
+type IngestReporter func() IngestStatus
+
+// SetIngestReporter attaches ingest statistics to a topic's status; a nil
+// reporter removes them.
+func (m *Manager) SetIngestReporter(name string, fn IngestReporter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fn == nil {
+		delete(m.ingest, name)
+		return
+	}
+	m.ingest[name] = fn
 }
 
 // Config returns the manager's configuration
@@ -94,6 +161,13 @@ type TopicStatus struct {
 	HasPublisher    bool   `json:"has_publisher"`
 	PublisherID     string `json:"publisher_id"`
 	SubscriberCount int    `json:"subscriber_count"`
+	// BytesIn counts the RTP bytes received since the topic was created
+	BytesIn int64 `json:"bytes_in"`
+	// Standby is set while the publisher only holds the topic for one
+	// that is about to connect, e.g. during a migration
+	Standby bool `json:"standby,omitempty"`
+	// Ingest is set for topics fed by a non-RTSP input
+	Ingest *IngestStatus `json:"ingest,omitempty"`
 }
 
 // RegisterPublisher registers a publisher for a topic. Returns error if not allowed.
@@ -101,15 +175,23 @@ func (m *Manager) RegisterPublisher(ctx context.Context, name string, pub *Publi
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	t, ok := m.topics[name]
+	if ok && t.HasPublisher() {
+		// a standby publisher only holds the topic and its stream for
+		// this one (see NewStandbyPublisherSession)
+		if pub.standby || !t.standby() {
+			return ErrTopicHasPublisher
+		}
+		t.replacePublisher(pub)
+		metrics.IncTotalPublishers()
+		return nil
+	}
 	// If MaxPublishers is set (>0) enforce the global publishers limit.
 	// A value of 0 means unlimited publishers.
 	if m.cfg.MaxPublishers > 0 && m.publisherCount >= m.cfg.MaxPublishers {
 		return ErrMaxPublishers
 	}
-	if t, ok := m.topics[name]; ok {
-		if t.HasPublisher() {
-			return ErrTopicHasPublisher
-		}
+	if ok {
 		t.SetPublisher(pub)
 	} else {
 		t := NewTopic(name, m.cfg)
@@ -131,6 +213,40 @@ func (m *Manager) SetTopicStream(name string, st *gortsplib.ServerStream) {
 	}
 }
 
+// OpenTopicStream creates the stream of a publisher's tracks, unless the
+// topic already has one with the same tracks, e.g. one held for the
+// publisher by a standby publisher during a migration: its subscribers keep
+// reading that stream then. It reports whether the stream was kept.
+func (m *Manager) OpenTopicStream(name string, tracks gortsplib.Tracks) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.topics[name]
+	if !ok {
+		return false
+	}
+	if st := t.Stream(); st != nil && SameTracks(st.Tracks(), tracks) {
+		return true
+	}
+	t.SetStream(gortsplib.NewServerStream(tracks))
+	return false
+}
+
+// SameTracks reports whether a and b have the same codecs and payload
+// types in the same order, so that packets of b can be written to a stream
+// of a.
+func SameTracks(a, b gortsplib.Tracks) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() || a[i].ClockRate() != b[i].ClockRate() ||
+			!slices.Equal(a[i].MediaDescription().MediaName.Formats, b[i].MediaDescription().MediaName.Formats) {
+			return false
+		}
+	}
+	return true
+}
+
 // GetTopicStream returns the ServerStream for a topic or nil if none.
 func (m *Manager) GetTopicStream(name string) *gortsplib.ServerStream {
 	m.mu.RLock()
@@ -141,6 +257,38 @@ func (m *Manager) GetTopicStream(name string) *gortsplib.ServerStream {
 	return nil
 }
 
+// ReplacePublisher hands an existing topic over to pub, keeping its stream
+// and subscribers. The previous publisher is asked to leave like a kicked
+// one; its protocol server unregisters it with UnregisterPublisherSession,
+// which leaves pub in place.
+func (m *Manager) ReplacePublisher(name string, pub *PublisherSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.topics[name]
+	if !ok || !t.HasPublisher() || t.Stream() == nil {
+		return ErrNoActivePublisher
+	}
+	t.replacePublisher(pub)
+	return nil
+}
+
+// UnregisterPublisherSession removes pub from topic if it is still its
+// publisher, i.e. it was not replaced in the meantime.
+func (m *Manager) UnregisterPublisherSession(name string, pub *PublisherSession) {
+	m.mu.RLock()
+	t, ok := m.topics[name]
+	m.mu.RUnlock()
+	if !ok {
+		return
+	}
+	t.mu.RLock()
+	current := t.publisher == pub
+	t.mu.RUnlock()
+	if current {
+		m.UnregisterPublisher(name)
+	}
+}
+
 // UnregisterPublisher removes publisher from topic
 func (m *Manager) UnregisterPublisher(name string) {
 	m.mu.Lock()
@@ -184,18 +332,45 @@ func (m *Manager) UnregisterSubscriber(name string, id string) {
 	}
 }
 
+// KickPublishers asks all publishers to disconnect, e.g. while the node is
+// draining, and returns how many were asked. Their protocol servers close
+// the connections and unregister them as usual.
+func (m *Manager) KickPublishers() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	for _, t := range m.topics {
+		t.mu.RLock()
+		if p := t.publisher; p != nil && p.ctx.Err() == nil {
+			p.cancel()
+			n++
+		}
+		t.mu.RUnlock()
+	}
+	return n
+}
+
 // Status returns a StatusJSON for admin
 func (m *Manager) Status() StatusJSON {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	st := StatusJSON{PublisherCount: m.publisherCount}
 	for _, t := range m.topics {
-		st.Topics = append(st.Topics, TopicStatus{
+		t.mu.RLock()
+		ts := TopicStatus{
 			Name:            t.name,
 			HasPublisher:    t.HasPublisher(),
 			PublisherID:     t.PublisherID(),
+			Standby:         t.standby(),
 			SubscriberCount: len(t.subscribers),
-		})
+			BytesIn:         t.bytesIn.Load(),
+		}
+		t.mu.RUnlock()
+		if fn, ok := m.ingest[t.name]; ok {
+			is := fn()
+			ts.Ingest = &is
+		}
+		st.Topics = append(st.Topics, ts)
 	}
 	return st
 }
@@ -204,6 +379,9 @@ func (m *Manager) Status() StatusJSON {
 func (m *Manager) PublishPacket(topicName string, pkt *InboundPacket) bool {
 	m.mu.RLock()
 	t, ok := m.topics[topicName]
+	if ok {
+		m.notifyTaps(topicName, pkt)
+	}
 	m.mu.RUnlock()
 	if !ok {
 		return false
@@ -211,6 +389,7 @@ func (m *Manager) PublishPacket(topicName string, pkt *InboundPacket) bool {
 	// debug log
 	plog.Debug("PublishPacket called for topic %s", topicName)
 	metrics.IncPacketsReceived()
+	t.bytesIn.Add(int64(len(pkt.Raw)))
 
 	// ensure topic not closed to avoid sending on closed channel
 	t.mu.RLock()
@@ -240,6 +419,43 @@ func (m *Manager) PublishPacket(topicName string, pkt *InboundPacket) bool {
 	}
 }
 
+// WritePacketRTP delivers a publisher RTP packet to the topic: it is written
+// to the RTSP ServerStream (reaching RTSP readers) and queued into the topic
+// packet flow for the dispatcher and taps. Ingest paths other than RTSP
+// ANNOUNCE/RECORD use this to behave exactly like RTSP publishers.
+// Returns false if the topic has no stream.
+func (m *Manager) WritePacketRTP(topicName string, trackID int, pkt *rtp.Packet) bool {
+	st := m.GetTopicStream(topicName)
+	if st == nil {
+		return false
+	}
+	metrics.IncPacketsReceived()
+	// write directly to ServerStream (this will reach readers)
+	st.WritePacketRTP(trackID, pkt)
+	metrics.IncPacketsDispatched()
+
+	// marshal packet and publish into the topic so the dispatcher handles fanout and metrics
+	b, err := pkt.Marshal()
+	if err != nil {
+		plog.Info("failed to marshal RTP packet: %v", err)
+		return false
+	}
+	return m.PublishPacket(topicName, &InboundPacket{Track: trackID, Raw: b})
+}
+
+// PublishRTCP hands an inbound RTCP packet to the topic's taps. RTCP is not
+// fanned out to subscribers since gortsplib generates its own reports.
+func (m *Manager) PublishRTCP(topicName string, pkt *InboundPacket) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.topics[topicName]; !ok {
+		return false
+	}
+	pkt.RTCP = true
+	m.notifyTaps(topicName, pkt)
+	return true
+}
+
 // Topic represents a streaming topic
 type Topic struct {
 	name      string
@@ -253,6 +469,8 @@ type Topic struct {
 	closed      bool
 	// grace timer
 	graceTimer *time.Timer
+	// bytesIn counts inbound RTP bytes for load reporting
+	bytesIn atomic.Int64
 }
 
 // NewTopic creates a topic
@@ -311,10 +529,30 @@ func (t *Topic) SetPublisher(p *PublisherSession) {
 	}
 }
 
-// SetStream sets the gortsplib ServerStream for this topic
+// replacePublisher sets a new publisher, keeping the stream, and asks the
+// previous one to leave.
+func (t *Topic) replacePublisher(p *PublisherSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.publisher != nil && t.publisher.cancel != nil {
+		t.publisher.cancel()
+	}
+	t.publisher = p
+}
+
+// standby reports whether the publisher is a standby one.
+func (t *Topic) standby() bool {
+	return t.publisher != nil && t.publisher.standby
+}
+
+// SetStream sets the gortsplib ServerStream for this topic, closing the
+// previous one
 func (t *Topic) SetStream(st *gortsplib.ServerStream) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	if t.stream != nil && t.stream != st {
+		t.stream.Close()
+	}
 	t.stream = st
 }
 
@@ -405,6 +643,12 @@ func (t *Topic) Close() {
 	t.mu.Unlock()
 }
 
+// nameRe restricts topic names to URL- and filename-safe characters.
+var nameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidName reports whether name is an acceptable topic name.
+func ValidName(name string) bool { return nameRe.MatchString(name) }
+
 // Minimal session structs and errors
 
 var (
@@ -416,9 +660,10 @@ var (
 
 // PublisherSession is a placeholder for publisher connection
 type PublisherSession struct {
-	id     string
-	ctx    context.Context
-	cancel context.CancelFunc
+	id      string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	standby bool
 }
 
 // SubscriberSession is a placeholder for subscriber connection
@@ -433,6 +678,8 @@ type SubscriberSession struct {
 type InboundPacket struct {
 	Track int
 	Raw   []byte
+	// RTCP marks control packets; these are only delivered to taps.
+	RTCP bool
 }
 
 // NewPublisherSession creates a session
@@ -441,6 +688,20 @@ func NewPublisherSession(id string) *PublisherSession {
 	return &PublisherSession{id: id, ctx: ctx, cancel: cancel}
 }
 
+// NewStandbyPublisherSession creates a session that holds a topic and its
+// stream for a publisher that is about to connect, e.g. while a topic is
+// migrated: the first regular publisher replaces it and keeps the stream, so
+// that subscribers stay connected if its tracks match.
+func NewStandbyPublisherSession(id string) *PublisherSession {
+	p := NewPublisherSession(id)
+	p.standby = true
+	return p
+}
+
+// Done is closed when the publisher is unregistered or asked to leave (see
+// Manager.KickPublishers); protocol servers close the connection then.
+func (p *PublisherSession) Done() <-chan struct{} { return p.ctx.Done() }
+
 // NewSubscriberSession creates a session with a queue
 func NewSubscriberSession(id string, queueSize int) *SubscriberSession {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -467,6 +728,17 @@ func (s *SubscriberSession) Enqueue(pkt *InboundPacket) bool {
 	}
 }
 
+// ID returns the subscriber session id
+func (s *SubscriberSession) ID() string { return s.id }
+
+// Packets exposes the subscriber queue to consumers that drain it directly
+// (non-RTSP outputs such as WebRTC).
+func (s *SubscriberSession) Packets() <-chan *InboundPacket { return s.queue }
+
+// Done is closed when the session is cancelled, either by UnregisterSubscriber
+// or because the topic was closed.
+func (s *SubscriberSession) Done() <-chan struct{} { return s.ctx.Done() }
+
 // Dequeue helper used by writer goroutine
 func (s *SubscriberSession) Dequeue() (*InboundPacket, bool) {
 	select {
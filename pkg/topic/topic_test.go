@@ -95,3 +95,67 @@ func TestSetGetTopicStream(t *testing.T) {
 		t.Fatalf("expected same stream pointer after set/get")
 	}
 }
+
+func TestOpenTopicStreamKeepsSameTracks(t *testing.T) {
+	m := NewManager(Config{MaxPublishers: 5, PublisherGracePeriod: Duration{Duration: time.Second}})
+	if err := m.RegisterPublisher(context.Background(), "cam1", NewStandbyPublisherSession("migrate")); err != nil {
+		t.Fatalf("register standby: %v", err)
+	}
+	h264 := func(pt uint8) gortsplib.Tracks {
+		return gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: pt, PacketizationMode: 1}}
+	}
+	if m.OpenTopicStream("cam1", h264(96)) {
+		t.Fatalf("kept a stream the topic did not have")
+	}
+	held := m.GetTopicStream("cam1")
+	if err := m.RegisterPublisher(context.Background(), "cam1", NewPublisherSession("p1")); err != nil {
+		t.Fatalf("register publisher: %v", err)
+	}
+	if !m.OpenTopicStream("cam1", h264(96)) || m.GetTopicStream("cam1") != held {
+		t.Fatalf("held stream not kept for the same tracks")
+	}
+	if m.OpenTopicStream("cam1", h264(97)) || m.GetTopicStream("cam1") == held {
+		t.Fatalf("held stream kept for other tracks")
+	}
+}
+
+func TestStandbyPublisherReplaced(t *testing.T) {
+	cfg := Config{MaxPublishers: 1, PublisherGracePeriod: Duration{Duration: time.Second}}
+	m := NewManager(cfg)
+	standby := NewStandbyPublisherSession("migrate")
+	if err := m.RegisterPublisher(context.Background(), "cam1", standby); err != nil {
+		t.Fatalf("register standby: %v", err)
+	}
+	st := gortsplib.NewServerStream(gortsplib.Tracks{})
+	m.SetTopicStream("cam1", st)
+	if ts := m.Status().Topics[0]; !ts.Standby {
+		t.Fatalf("expected standby publisher in status, got %+v", ts)
+	}
+
+	// the real publisher takes over despite the publisher limit
+	pub := NewPublisherSession("p1")
+	if err := m.RegisterPublisher(context.Background(), "cam1", pub); err != nil {
+		t.Fatalf("register publisher: %v", err)
+	}
+	select {
+	case <-standby.Done():
+	default:
+		t.Fatalf("standby publisher not asked to leave")
+	}
+	if m.GetTopicStream("cam1") != st {
+		t.Fatalf("stream not kept for the new publisher")
+	}
+	if err := m.RegisterPublisher(context.Background(), "cam1", NewPublisherSession("p2")); err != ErrTopicHasPublisher {
+		t.Fatalf("expected ErrTopicHasPublisher, got %v", err)
+	}
+
+	// the replaced session no longer owns the topic
+	m.UnregisterPublisherSession("cam1", standby)
+	if ts := m.Status().Topics[0]; !ts.HasPublisher || ts.Standby || m.Status().PublisherCount != 1 {
+		t.Fatalf("publisher removed by the replaced session: %+v", m.Status())
+	}
+	m.UnregisterPublisherSession("cam1", pub)
+	if m.Status().Topics[0].HasPublisher || m.GetTopicStream("cam1") != nil {
+		t.Fatalf("publisher not removed")
+	}
+}
@@ -0,0 +1,447 @@
+package tsingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/h264"
+	"github.com/aler9/gortsplib/pkg/mpeg4audio"
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtph264"
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtph265"
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtpmpeg4audio"
+	"github.com/pion/rtp"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/mpegts"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+const (
+	// idleTimeout unregisters the publisher when the feed goes silent, so
+	// the topic follows the usual publisher grace period.
+	idleTimeout = 5 * time.Second
+	// trackWait bounds how long after the PMT we wait for every stream's
+	// codec configuration before publishing the streams that have one.
+	trackWait = 2 * time.Second
+	// retryInterval spaces out publisher registration attempts.
+	retryInterval = 5 * time.Second
+)
+
+// H.265 NAL unit types used for parameter sets.
+const (
+	h265NALUTypeVPS = 32
+	h265NALUTypeSPS = 33
+	h265NALUTypePPS = 34
+	h265NALUTypeAUD = 35
+)
+
+// esTrack is one elementary stream and, once published, its RTP track.
+type esTrack struct {
+	pid        uint16
+	streamType uint8
+
+	vps, sps, pps []byte
+	aacConfig     *mpeg4audio.Config
+
+	id       int
+	h264     *gortsplib.TrackH264
+	h264Enc  *rtph264.Encoder
+	h265     *gortsplib.TrackH265
+	h265Enc  *rtph265.Encoder
+	aacEnc   *rtpmpeg4audio.Encoder
+	selected bool
+}
+
+// configured reports whether the stream's codec configuration is known.
+func (t *esTrack) configured() bool {
+	switch t.streamType {
+	case mpegts.StreamTypeH264:
+		return t.sps != nil && t.pps != nil
+	case mpegts.StreamTypeH265:
+		return t.vps != nil && t.sps != nil && t.pps != nil
+	case mpegts.StreamTypeAAC:
+		return t.aacConfig != nil
+	}
+	return false
+}
+
+// source delivers transport stream datagrams: a UDP socket or an SRT
+// connection.
+type source interface {
+	Read(b []byte) (int, error)
+	SetReadDeadline(t time.Time) error
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// input demuxes one MPEG-TS feed into a topic.
+type input struct {
+	m    *Manager
+	cfg  Input
+	conn source
+
+	demux    *mpegts.Demuxer
+	streams  []*esTrack
+	byPID    map[uint16]*esTrack
+	pmtAt    time.Time
+	lastData time.Time
+
+	published bool
+	pub       *topic.PublisherSession
+	// lastPTS is the last PTS seen and elapsed its distance from the
+	// start of the publication, unwrapped, in 90 kHz units
+	lastPTS       int64
+	elapsed       int64
+	hasBase       bool
+	retryAt       time.Time
+	warnedRefused bool
+}
+
+func newInput(m *Manager, cfg Input, conn source) *input {
+	i := &input{m: m, cfg: cfg, conn: conn}
+	i.resetDemuxer()
+	return i
+}
+
+func (i *input) resetDemuxer() {
+	i.demux = mpegts.NewDemuxer()
+	i.demux.OnPMT = i.onPMT
+	i.demux.OnPES = i.onPES
+	i.streams = nil
+	i.byPID = make(map[uint16]*esTrack)
+}
+
+func (i *input) run() {
+	buf := make([]byte, 64<<10)
+	for {
+		i.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := i.conn.Read(buf)
+		now := time.Now()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if i.published && now.Sub(i.lastData) > idleTimeout {
+					plog.Info("tsingest: topic %s: no data from %s for %s", i.cfg.Topic, i.cfg.URL, idleTimeout)
+					i.unpublish()
+					i.resetDemuxer()
+				}
+				continue
+			}
+			i.unpublish()
+			return
+		}
+		i.lastData = now
+		if i.published && kicked(i.pub) {
+			// e.g. the node is draining; setup re-checks ownership
+			plog.Info("tsingest: topic %s: publisher asked to leave", i.cfg.Topic)
+			i.unpublish()
+			i.retryAt = now.Add(retryInterval)
+		}
+		if err := i.demux.Feed(stripRTP(buf[:n]), now); err != nil {
+			plog.Debug("tsingest: topic %s: %v", i.cfg.Topic, err)
+		}
+	}
+}
+
+// stripRTP removes an RTP header from RTP-encapsulated transport streams
+// (RFC 2250), which some contribution encoders send instead of raw UDP.
+func stripRTP(b []byte) []byte {
+	if len(b) == 0 || b[0] == 0x47 {
+		return b
+	}
+	var pkt rtp.Packet
+	if err := pkt.Unmarshal(b); err == nil && len(pkt.Payload) > 0 && pkt.Payload[0] == 0x47 {
+		return pkt.Payload
+	}
+	return b
+}
+
+func (i *input) onPMT(streams []mpegts.ElementaryStream) {
+	if i.published {
+		plog.Info("tsingest: topic %s: program changed, republishing", i.cfg.Topic)
+		i.unpublish()
+	}
+	i.streams = nil
+	i.byPID = make(map[uint16]*esTrack)
+	for _, es := range streams {
+		switch es.Type {
+		case mpegts.StreamTypeH264, mpegts.StreamTypeH265, mpegts.StreamTypeAAC:
+			t := &esTrack{pid: es.PID, streamType: es.Type, id: -1}
+			i.streams = append(i.streams, t)
+			i.byPID[es.PID] = t
+		default:
+			plog.Debug("tsingest: topic %s: ignoring stream type 0x%02x on pid %d", i.cfg.Topic, es.Type, es.PID)
+		}
+	}
+	i.pmtAt = time.Now()
+}
+
+func (i *input) onPES(pes *mpegts.PES) {
+	t, ok := i.byPID[pes.PID]
+	if !ok {
+		return
+	}
+	var nalus [][]byte
+	var aus [][]byte
+	switch t.streamType {
+	case mpegts.StreamTypeH264:
+		var err error
+		if nalus, err = h264.AnnexBUnmarshal(pes.Data); err != nil {
+			return
+		}
+		nalus = i.h264Params(t, nalus)
+	case mpegts.StreamTypeH265:
+		var err error
+		if nalus, err = h264.AnnexBUnmarshal(pes.Data); err != nil {
+			return
+		}
+		nalus = i.h265Params(t, nalus)
+	case mpegts.StreamTypeAAC:
+		var pkts mpeg4audio.ADTSPackets
+		if err := pkts.Unmarshal(pes.Data); err != nil || len(pkts) == 0 {
+			return
+		}
+		if t.aacConfig == nil {
+			t.aacConfig = &mpeg4audio.Config{Type: pkts[0].Type, SampleRate: pkts[0].SampleRate, ChannelCount: pkts[0].ChannelCount}
+		}
+		for _, p := range pkts {
+			aus = append(aus, p.AU)
+		}
+	}
+
+	if !i.published && !i.setup() {
+		return
+	}
+	if !t.selected || !pes.HasPTS {
+		return
+	}
+	pts := i.timestamp(pes.PTS)
+	var pkts []*rtp.Packet
+	var err error
+	switch {
+	case t.h264Enc != nil && len(nalus) > 0:
+		if h264.IDRPresent(nalus) && !hasNALU(nalus, func(n []byte) bool { return h264.NALUType(n[0]&0x1f) == h264.NALUTypeSPS }) {
+			nalus = append([][]byte{t.h264.SafeSPS(), t.h264.SafePPS()}, nalus...)
+		}
+		pkts, err = t.h264Enc.Encode(nalus, pts)
+	case t.h265Enc != nil && len(nalus) > 0:
+		pkts, err = t.h265Enc.Encode(nalus, pts)
+	case t.aacEnc != nil && len(aus) > 0:
+		pkts, err = t.aacEnc.Encode(aus, pts)
+	}
+	if err != nil {
+		plog.Debug("tsingest: topic %s: packetize pid %d: %v", i.cfg.Topic, t.pid, err)
+		return
+	}
+	for _, pkt := range pkts {
+		i.m.mgr.WritePacketRTP(i.cfg.Topic, t.id, pkt)
+	}
+}
+
+// h264Params records in-band parameter sets and drops access unit
+// delimiters, which carry no information over RTP.
+func (i *input) h264Params(t *esTrack, nalus [][]byte) [][]byte {
+	out := nalus[:0]
+	for _, n := range nalus {
+		if len(n) == 0 {
+			continue
+		}
+		switch h264.NALUType(n[0] & 0x1f) {
+		case h264.NALUTypeSPS:
+			t.sps = append([]byte(nil), n...)
+			if t.h264 != nil {
+				t.h264.SafeSetSPS(t.sps)
+			}
+		case h264.NALUTypePPS:
+			t.pps = append([]byte(nil), n...)
+			if t.h264 != nil {
+				t.h264.SafeSetPPS(t.pps)
+			}
+		case h264.NALUTypeAccessUnitDelimiter:
+			continue
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+func (i *input) h265Params(t *esTrack, nalus [][]byte) [][]byte {
+	out := nalus[:0]
+	for _, n := range nalus {
+		if len(n) < 2 {
+			continue
+		}
+		switch (n[0] >> 1) & 0x3f {
+		case h265NALUTypeVPS:
+			t.vps = append([]byte(nil), n...)
+			if t.h265 != nil {
+				t.h265.SafeSetVPS(t.vps)
+			}
+		case h265NALUTypeSPS:
+			t.sps = append([]byte(nil), n...)
+			if t.h265 != nil {
+				t.h265.SafeSetSPS(t.sps)
+			}
+		case h265NALUTypePPS:
+			t.pps = append([]byte(nil), n...)
+			if t.h265 != nil {
+				t.h265.SafeSetPPS(t.pps)
+			}
+		case h265NALUTypeAUD:
+			continue
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+func kicked(pub *topic.PublisherSession) bool {
+	select {
+	case <-pub.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func hasNALU(nalus [][]byte, match func([]byte) bool) bool {
+	for _, n := range nalus {
+		if match(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// setup registers the publisher and creates the topic stream once the codec
+// configurations are known.
+func (i *input) setup() bool {
+	now := time.Now()
+	if len(i.streams) == 0 || now.Before(i.retryAt) {
+		return false
+	}
+	complete := true
+	for _, t := range i.streams {
+		complete = complete && t.configured()
+	}
+	if !complete && now.Sub(i.pmtAt) < trackWait {
+		return false
+	}
+	if cl := i.m.cluster; cl != nil {
+		// the input runs here, so its topic is not placed on another node
+		a := cl.Admit(i.cfg.Topic, false)
+		if !cl.IsSelf(a.Owner) {
+			if !i.warnedRefused {
+				plog.Warn("tsingest: topic %s is owned by %s; configure the input on that node", i.cfg.Topic, a.Owner)
+				i.warnedRefused = true
+			}
+			i.retryAt = now.Add(retryInterval)
+			return false
+		}
+		if a.Overloaded != "" {
+			if !i.warnedRefused {
+				plog.Warn("tsingest: topic %s not published: node is overloaded (%s)", i.cfg.Topic, a.Overloaded)
+				metrics.IncOverloadRejections("503")
+				i.warnedRefused = true
+			}
+			i.retryAt = now.Add(retryInterval)
+			return false
+		}
+	}
+
+	var tracks gortsplib.Tracks
+	for _, t := range i.streams {
+		if !t.configured() {
+			continue
+		}
+		pt := uint8(96 + len(tracks))
+		switch t.streamType {
+		case mpegts.StreamTypeH264:
+			t.h264 = &gortsplib.TrackH264{PayloadType: pt, SPS: t.sps, PPS: t.pps, PacketizationMode: 1}
+			t.h264Enc = t.h264.CreateEncoder()
+			tracks = append(tracks, t.h264)
+		case mpegts.StreamTypeH265:
+			t.h265 = &gortsplib.TrackH265{PayloadType: pt, VPS: t.vps, SPS: t.sps, PPS: t.pps}
+			t.h265Enc = t.h265.CreateEncoder()
+			tracks = append(tracks, t.h265)
+		case mpegts.StreamTypeAAC:
+			track := &gortsplib.TrackMPEG4Audio{PayloadType: pt, Config: t.aacConfig, SizeLength: 13, IndexLength: 3, IndexDeltaLength: 3}
+			t.aacEnc = track.CreateEncoder()
+			tracks = append(tracks, track)
+		}
+		t.id = len(tracks) - 1
+		t.selected = true
+	}
+	if len(tracks) == 0 {
+		return false
+	}
+
+	pub := topic.NewPublisherSession(fmt.Sprintf("ts-%p", i))
+	if err := i.m.mgr.RegisterPublisher(context.Background(), i.cfg.Topic, pub); err != nil {
+		plog.Warn("tsingest: topic %s: register publisher failed: %v", i.cfg.Topic, err)
+		for _, t := range i.streams {
+			t.selected = false
+		}
+		i.retryAt = now.Add(retryInterval)
+		return false
+	}
+	// a topic held during a migration keeps its stream and subscribers if
+	// the tracks are the same
+	if i.m.mgr.OpenTopicStream(i.cfg.Topic, tracks) {
+		plog.Info("tsingest: publisher for topic %s took over its stream", i.cfg.Topic)
+	}
+	d := i.demux
+	source := i.cfg.URL
+	i.m.mgr.SetIngestReporter(i.cfg.Topic, func() topic.IngestStatus {
+		return topic.IngestStatus{
+			Source:           source,
+			Packets:          d.Packets(),
+			ContinuityErrors: d.ContinuityErrors(),
+			PCRJitterMs:      float64(d.PCRJitter()) / float64(time.Millisecond),
+		}
+	})
+	i.published = true
+	i.pub = pub
+	i.hasBase = false
+	i.warnedRefused = false
+	var codecs []string
+	for _, t := range tracks {
+		codecs = append(codecs, t.String())
+	}
+	plog.Info("tsingest: topic %s publishing from %s: %v", i.cfg.Topic, i.cfg.URL, codecs)
+	return true
+}
+
+func (i *input) unpublish() {
+	if !i.published {
+		return
+	}
+	i.m.mgr.SetIngestReporter(i.cfg.Topic, nil)
+	i.m.mgr.UnregisterPublisherSession(i.cfg.Topic, i.pub)
+	i.published = false
+	for _, t := range i.streams {
+		t.selected = false
+	}
+	plog.Info("tsingest: topic %s unpublished", i.cfg.Topic)
+}
+
+// timestamp converts a 90 kHz PTS into a duration relative to the start of
+// the publication. The start is one second before the first PTS so that
+// streams whose first PTS is slightly behind the first one seen stay
+// positive. PTS are followed step by step, so the clock keeps counting
+// across the 33 bit wrap of always-on feeds.
+func (i *input) timestamp(pts int64) time.Duration {
+	if !i.hasBase {
+		i.lastPTS, i.elapsed = pts, 90000
+		i.hasBase = true
+	}
+	i.elapsed += mpegts.PTSDiff(pts, i.lastPTS)
+	i.lastPTS = pts
+	d := max(i.elapsed, 0)
+	return time.Duration(d/90000)*time.Second + time.Duration(d%90000)*time.Second/90000
+}
@@ -0,0 +1,165 @@
+// Package tsingest publishes MPEG-TS contribution feeds (UDP unicast or
+// multicast, SRT listener or caller) into topics.
+package tsingest
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"redalf.de/rtsper/pkg/cluster"
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/srt"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// Input is a configured MPEG-TS source for a topic. URL is
+// udp://[group]:port with optional ?iface=<name> for multicast groups, or
+// srt://[host]:port with optional ?mode=listener|caller, streamid=<id> and
+// latency=<ms>. SRT inputs listen when the host is empty and call the host
+// otherwise, unless mode says differently.
+type Input struct {
+	Topic string
+	URL   string
+}
+
+// ParseInputs parses comma-separated "topic=url" pairs, e.g.
+// "cam1=udp://239.1.1.1:5000,cam2=udp://:5002".
+func ParseInputs(s string) ([]Input, error) {
+	var out []Input
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, u, ok := strings.Cut(item, "=")
+		if !ok || name == "" || u == "" {
+			return nil, fmt.Errorf("invalid ts input %q (want topic=url)", item)
+		}
+		out = append(out, Input{Topic: name, URL: u})
+	}
+	return out, nil
+}
+
+// Manager runs the configured inputs.
+type Manager struct {
+	mgr     *topic.Manager
+	cluster *cluster.Cluster
+
+	mu     sync.Mutex
+	inputs []*input
+	wg     sync.WaitGroup
+}
+
+// NewManager creates an input manager; cl may be nil when clustering is not
+// configured.
+func NewManager(mgr *topic.Manager, cl *cluster.Cluster) *Manager {
+	return &Manager{mgr: mgr, cluster: cl}
+}
+
+// Add validates and starts an input.
+func (m *Manager) Add(in Input) error {
+	if !topic.ValidName(in.Topic) {
+		return fmt.Errorf("invalid topic name %q", in.Topic)
+	}
+	u, err := url.Parse(in.URL)
+	if err != nil {
+		return fmt.Errorf("invalid ts input url %q: %w", in.URL, err)
+	}
+	var conn source
+	switch u.Scheme {
+	case "udp":
+		conn, err = listenUDP(u)
+	case "srt":
+		conn, err = openSRT(u)
+	default:
+		return fmt.Errorf("unsupported ts input scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return fmt.Errorf("ts input %s: %w", in.URL, err)
+	}
+	i := newInput(m, in, conn)
+	m.mu.Lock()
+	m.inputs = append(m.inputs, i)
+	m.mu.Unlock()
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		i.run()
+	}()
+	plog.Info("tsingest: topic %s reading %s", in.Topic, in.URL)
+	return nil
+}
+
+// Close stops all inputs and unregisters their publishers.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	inputs := m.inputs
+	m.inputs = nil
+	m.mu.Unlock()
+	for _, i := range inputs {
+		i.conn.Close()
+	}
+	m.wg.Wait()
+}
+
+// listenUDP binds the input socket, joining the group for multicast
+// addresses.
+func listenUDP(u *url.URL) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp4", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	var conn *net.UDPConn
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if name := u.Query().Get("iface"); name != "" {
+			if ifi, err = net.InterfaceByName(name); err != nil {
+				return nil, err
+			}
+		}
+		conn, err = net.ListenMulticastUDP("udp4", ifi, addr)
+	} else {
+		conn, err = net.ListenUDP("udp4", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// contribution feeds are bursty; a larger buffer avoids drops
+	conn.SetReadBuffer(4 << 20)
+	return conn, nil
+}
+
+// openSRT starts an SRT listener or caller.
+func openSRT(u *url.URL) (*srt.Conn, error) {
+	q := u.Query()
+	if q.Get("passphrase") != "" {
+		return nil, fmt.Errorf("encrypted srt inputs are not supported")
+	}
+	cfg := srt.Config{StreamID: q.Get("streamid")}
+	if v := q.Get("latency"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("invalid srt latency %q (want milliseconds)", v)
+		}
+		cfg.Latency = time.Duration(ms) * time.Millisecond
+	}
+	mode := q.Get("mode")
+	if mode == "" {
+		mode = "caller"
+		if u.Hostname() == "" {
+			mode = "listener"
+		}
+	}
+	switch mode {
+	case "listener":
+		return srt.Listen(u.Host, cfg)
+	case "caller":
+		return srt.Dial(u.Host, cfg)
+	}
+	return nil, fmt.Errorf("invalid srt mode %q (want listener or caller)", mode)
+}
@@ -0,0 +1,143 @@
+package tsingest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// tsPackets splits payload into transport packets of one PID, padding the
+// last one with adaptation field stuffing.
+func tsPackets(pid uint16, cc *uint8, payload []byte) []byte {
+	var out []byte
+	first := true
+	for len(payload) > 0 {
+		p := []byte{0x47, byte(pid>>8) & 0x1f, byte(pid), 0x10 | *cc&0x0f}
+		if first {
+			p[1] |= 0x40
+			first = false
+		}
+		*cc++
+		n := min(len(payload), 184)
+		if free := 184 - n; free > 0 {
+			p[3] |= 0x20
+			p = append(p, byte(free-1))
+			if free > 1 {
+				p = append(p, 0x00)
+				for i := 2; i < free; i++ {
+					p = append(p, 0xff)
+				}
+			}
+		}
+		out = append(out, append(p, payload[:n]...)...)
+		payload = payload[n:]
+	}
+	return out
+}
+
+func TestUDPInputPublishesTopic(t *testing.T) {
+	m := topic.NewManager(topic.Config{MaxPublishers: 1, MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	ing := NewManager(m, nil)
+	defer ing.Close()
+	if err := ing.Add(Input{Topic: "feed1", URL: "udp://127.0.0.1:0"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := ing.Add(Input{Topic: "feed2", URL: "srt://127.0.0.1:0?mode=listener&latency=200"}); err != nil {
+		t.Fatalf("add srt listener: %v", err)
+	}
+	for _, u := range []string{"srt://:0?passphrase=secret", "srt://:0?mode=rendezvous", "srt://:0?latency=x"} {
+		if err := ing.Add(Input{Topic: "feed3", URL: u}); err == nil {
+			t.Fatalf("expected %s to be refused", u)
+		}
+	}
+	received := make(chan *topic.InboundPacket, 16)
+	m.AddTap("feed1", "test", func(p *topic.InboundPacket) {
+		select {
+		case received <- p:
+		default:
+		}
+	})
+
+	conn, err := net.DialUDP("udp", nil, ing.inputs[0].conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	var patCC, pmtCC, vidCC uint8
+	pat := []byte{0x00, 0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00, 0, 0, 0, 0}
+	pmt := []byte{0x00, 0x02, 0xb0, 0x12, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00, 0x1b, 0xe1, 0x00, 0xf0, 0x00, 0, 0, 0, 0}
+	au := []byte{
+		0, 0, 0, 1, 0x09, 0xf0, // AUD
+		0, 0, 0, 1, 0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0, 0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00, 0x00, 0x03, 0x00, 0x3d, 0x08,
+		0, 0, 0, 1, 0x68, 0xee, 0x3c, 0x80,
+		0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00, 0x33,
+	}
+	deadline := time.After(5 * time.Second)
+	for frame := int64(0); ; frame++ {
+		pts := 90000 + frame*3000
+		pes := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5,
+			byte(0x21 | (pts>>29)&0x0e), byte(pts >> 22), byte((pts>>14)&0xfe | 1), byte(pts >> 7), byte(pts<<1 | 1)}
+		var dgram []byte
+		dgram = append(dgram, tsPackets(0, &patCC, pat)...)
+		dgram = append(dgram, tsPackets(0x1000, &pmtCC, pmt)...)
+		dgram = append(dgram, tsPackets(0x100, &vidCC, append(pes, au...))...)
+		conn.Write(dgram)
+
+		select {
+		case p := <-received:
+			if p.Track != 0 {
+				t.Fatalf("unexpected track %d", p.Track)
+			}
+			st := m.GetTopicStream("feed1")
+			if st == nil || len(st.Tracks()) != 1 || st.Tracks()[0].String() != "H264" {
+				t.Fatalf("expected topic with one H264 track")
+			}
+			status := m.Status()
+			if len(status.Topics) != 1 || status.Topics[0].Ingest == nil || status.Topics[0].Ingest.Source != "udp://127.0.0.1:0" {
+				t.Fatalf("expected ingest stats in topic status: %+v", status.Topics)
+			}
+			if status.Topics[0].Ingest.ContinuityErrors != 0 {
+				t.Fatalf("unexpected continuity errors: %d", status.Topics[0].Ingest.ContinuityErrors)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("no RTP from the TS input reached the topic")
+		}
+	}
+}
+
+func TestTimestampAcrossPTSWrap(t *testing.T) {
+	ticks := func(n int64) time.Duration {
+		return time.Duration(n/90000)*time.Second + time.Duration(n%90000)*time.Second/90000
+	}
+	i := &input{}
+	// steps of about 1.6h starting just below the 32 bit boundary cross it
+	// and the 33 bit wrap several times
+	const step = 1 << 29
+	start := int64(1<<32 - 90000)
+	for k := int64(0); k < 40; k++ {
+		pts := (start + k*step) % (1 << 33)
+		if got, want := i.timestamp(pts), ticks(90000+k*step); got != want {
+			t.Fatalf("step %d (pts %d): got %s, want %s", k, pts, got, want)
+		}
+	}
+	// audio slightly behind video is not clamped away
+	pts := (start + 39*step - 9000) % (1 << 33)
+	if got, want := i.timestamp(pts), ticks(90000+39*step-9000); got != want {
+		t.Fatalf("earlier PTS: got %s, want %s", got, want)
+	}
+}
+
+func TestParseInputs(t *testing.T) {
+	in, err := ParseInputs("a=udp://239.1.1.1:5000?iface=eth0, b=udp://:5002")
+	if err != nil || len(in) != 2 || in[0].Topic != "a" || in[1].URL != "udp://:5002" {
+		t.Fatalf("unexpected inputs %v %v", in, err)
+	}
+	if _, err := ParseInputs("udp://:5000"); err == nil {
+		t.Fatalf("expected error without topic")
+	}
+}
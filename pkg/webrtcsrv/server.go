@@ -0,0 +1,185 @@
+package webrtcsrv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+
+	"redalf.de/rtsper/pkg/cluster"
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// maxSDPSize bounds the size of offers accepted over HTTP.
+const maxSDPSize = 64 << 10
+
+// Config configures the WebRTC endpoints.
+type Config struct {
+	// UDPPort multiplexes all ICE traffic on a single UDP port when non-zero;
+	// otherwise an ephemeral port is used per session.
+	UDPPort int
+	// PublicIPs are advertised instead of the local interface addresses
+	// (NAT 1:1), e.g. the address of a container host.
+	PublicIPs []string
+	// IncludeLoopback also gathers loopback candidates, which makes the
+	// endpoints usable from the same host without a network interface.
+	IncludeLoopback bool
+	// SubscriberQueueSize is the per-session packet queue length.
+	SubscriberQueueSize int
+	// BearerToken, when set, is required as "Authorization: Bearer <token>"
+	// on WHIP requests (publishing).
+	BearerToken string
+}
+
+// Server serves WHEP playback and WHIP ingest sessions on top of the topic
+// manager. It runs as an ICE-lite agent with host candidates only.
+type Server struct {
+	mgr       *topic.Manager
+	cluster   *cluster.Cluster
+	cfg       Config
+	api       *webrtc.API
+	ingestAPI *webrtc.API
+	udpConn   net.PacketConn
+
+	mu           sync.Mutex
+	sessions     map[string]*whepSession
+	publications map[string]*whipSession
+}
+
+// NewServer creates the WebRTC APIs (codecs, interceptors, ICE settings).
+// cl may be nil when clustering is not configured.
+func NewServer(mgr *topic.Manager, cl *cluster.Cluster, cfg Config) (*Server, error) {
+	if cfg.SubscriberQueueSize <= 0 {
+		cfg.SubscriberQueueSize = 256
+	}
+	me := &webrtc.MediaEngine{}
+	if err := me.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	ingestME, err := ingestMediaEngine()
+	if err != nil {
+		return nil, err
+	}
+	ir, err := registerInterceptors(me)
+	if err != nil {
+		return nil, err
+	}
+	ingestIR, err := registerInterceptors(ingestME)
+	if err != nil {
+		return nil, err
+	}
+	se := webrtc.SettingEngine{}
+	se.SetLite(true)
+	se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	se.SetIncludeLoopbackCandidate(cfg.IncludeLoopback)
+	if len(cfg.PublicIPs) > 0 {
+		se.SetNAT1To1IPs(cfg.PublicIPs, webrtc.ICECandidateTypeHost)
+	}
+	s := &Server{mgr: mgr, cluster: cl, cfg: cfg, sessions: make(map[string]*whepSession), publications: make(map[string]*whipSession)}
+	if cfg.UDPPort != 0 {
+		pc, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", cfg.UDPPort))
+		if err != nil {
+			return nil, fmt.Errorf("listen webrtc udp port %d: %w", cfg.UDPPort, err)
+		}
+		s.udpConn = pc
+		se.SetICEUDPMux(webrtc.NewICEUDPMux(nil, pc))
+	}
+	s.api = webrtc.NewAPI(webrtc.WithMediaEngine(me), webrtc.WithSettingEngine(se), webrtc.WithInterceptorRegistry(ir))
+	s.ingestAPI = webrtc.NewAPI(webrtc.WithMediaEngine(ingestME), webrtc.WithSettingEngine(se), webrtc.WithInterceptorRegistry(ingestIR))
+	return s, nil
+}
+
+// Register mounts the WebRTC endpoints on mux.
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /whep", s.handleWHEPList)
+	mux.HandleFunc("POST /whep/{topic}", s.handleWHEPOffer)
+	mux.HandleFunc("DELETE /whep/{topic}/{id}", s.handleWHEPDelete)
+	mux.HandleFunc("OPTIONS /whep/", s.handleOptions)
+	mux.HandleFunc("GET /whip", s.handleWHIPList)
+	mux.HandleFunc("POST /whip/{topic}", s.handleWHIPOffer)
+	mux.HandleFunc("DELETE /whip/{topic}/{id}", s.handleWHIPDelete)
+	mux.HandleFunc("OPTIONS /whip/", s.handleOptions)
+}
+
+// Close terminates all sessions and releases the shared UDP port.
+func (s *Server) Close() {
+	s.mu.Lock()
+	sessions := make([]*whepSession, 0, len(s.sessions))
+	for _, ws := range s.sessions {
+		sessions = append(sessions, ws)
+	}
+	pubs := make([]*whipSession, 0, len(s.publications))
+	for _, ps := range s.publications {
+		pubs = append(pubs, ps)
+	}
+	s.mu.Unlock()
+	for _, ws := range sessions {
+		ws.close()
+	}
+	for _, ps := range pubs {
+		ps.close()
+	}
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+}
+
+// handleOptions answers CORS preflight requests from browser players.
+func (s *Server) handleOptions(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+}
+
+// readOffer validates and returns the SDP offer carried in the request body.
+func readOffer(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/sdp") {
+		http.Error(w, "content type must be application/sdp", http.StatusUnsupportedMediaType)
+		return "", false
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+	if err != nil || len(b) == 0 {
+		http.Error(w, "missing SDP offer", http.StatusBadRequest)
+		return "", false
+	}
+	return string(b), true
+}
+
+// negotiate applies the offer, waits for ICE gathering (no trickle) and
+// returns the answer SDP.
+func negotiate(pc *webrtc.PeerConnection, offer string) (string, error) {
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", fmt.Errorf("invalid offer: %w", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gathered
+	return pc.LocalDescription().SDP, nil
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		plog.Warn("webrtc: random session id: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
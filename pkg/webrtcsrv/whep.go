@@ -0,0 +1,267 @@
+package webrtcsrv
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/webrtc/v3"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// whepSession is a single WebRTC playback session fed from a topic.
+type whepSession struct {
+	s       *Server
+	id      string
+	topic   string
+	remote  string
+	created time.Time
+	pc      *webrtc.PeerConnection
+	sub     *topic.SubscriberSession
+	tracks  map[int]*webrtc.TrackLocalStaticRTP
+
+	closeOnce sync.Once
+	packets   atomic.Int64
+	bytes     atomic.Int64
+	errors    atomic.Int64
+	state     atomic.Value // webrtc.PeerConnectionState
+}
+
+// SessionStats is the per-session view returned by GET /whep.
+type SessionStats struct {
+	ID          string    `json:"id"`
+	Topic       string    `json:"topic"`
+	Remote      string    `json:"remote"`
+	Created     time.Time `json:"created"`
+	State       string    `json:"state"`
+	Tracks      []string  `json:"tracks"`
+	PacketsSent int64     `json:"packets_sent"`
+	BytesSent   int64     `json:"bytes_sent"`
+	WriteErrors int64     `json:"write_errors"`
+}
+
+// localTrackFor maps a topic track to a WebRTC track without transcoding.
+// Only H.264 and Opus can be forwarded as-is to browsers.
+func localTrackFor(t gortsplib.Track, topicName string) (*webrtc.TrackLocalStaticRTP, error) {
+	switch tt := t.(type) {
+	case *gortsplib.TrackH264:
+		fmtp := "level-asymmetry-allowed=1;packetization-mode=1"
+		if sps := tt.SafeSPS(); len(sps) >= 4 {
+			fmtp += ";profile-level-id=" + hex.EncodeToString(sps[1:4])
+		}
+		return webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: fmtp}, "video", topicName)
+	case *gortsplib.TrackOpus:
+		return webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", topicName)
+	}
+	return nil, errors.New("unsupported codec")
+}
+
+func (s *Server) handleWHEPOffer(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	topicName := r.PathValue("topic")
+	if !topic.ValidName(topicName) {
+		http.Error(w, "invalid topic name", http.StatusBadRequest)
+		return
+	}
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+	// subscribers play from the owner, like RTSP DESCRIBE
+	if s.cluster != nil {
+		a := s.cluster.Admit(topicName, false)
+		if a.Overloaded != "" {
+			plog.Info("whep: play for topic %s refused: node is overloaded", topicName)
+			metrics.IncOverloadRejections("503")
+			http.Error(w, "node is overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		if !s.cluster.IsSelf(a.Owner) && s.mgr.GetTopicStream(topicName) == nil {
+			http.Error(w, "topic owned by another node; play from "+a.Owner, http.StatusServiceUnavailable)
+			return
+		}
+	}
+	st := s.mgr.GetTopicStream(topicName)
+	if st == nil {
+		http.Error(w, "topic not found", http.StatusNotFound)
+		return
+	}
+
+	pc, err := s.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		plog.Error("whep: new peer connection: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	ws := &whepSession{
+		s:       s,
+		id:      newSessionID(),
+		topic:   topicName,
+		remote:  r.RemoteAddr,
+		created: time.Now(),
+		pc:      pc,
+		tracks:  make(map[int]*webrtc.TrackLocalStaticRTP),
+	}
+	ws.state.Store(webrtc.PeerConnectionStateNew)
+	for i, t := range st.Tracks() {
+		lt, err := localTrackFor(t, topicName)
+		if err != nil {
+			plog.Debug("whep: topic %s track %d (%s) skipped: %v", topicName, i, t.String(), err)
+			continue
+		}
+		sender, err := pc.AddTrack(lt)
+		if err != nil {
+			pc.Close()
+			plog.Error("whep: add track: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		// drain RTCP so interceptors (NACK, reports) keep working
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+		ws.tracks[i] = lt
+	}
+	if len(ws.tracks) == 0 {
+		pc.Close()
+		http.Error(w, "topic has no H264 or Opus tracks", http.StatusNotAcceptable)
+		return
+	}
+
+	// subscriber limits are shared with RTSP playback
+	ws.sub = topic.NewSubscriberSession("whep-"+ws.id, s.cfg.SubscriberQueueSize)
+	if err := s.mgr.RegisterSubscriber(context.Background(), topicName, ws.sub); err != nil {
+		pc.Close()
+		plog.Info("whep: register subscriber for %s failed: %v", topicName, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// the session is listed before negotiating: a connection that fails
+	// right away removes it again in close
+	s.mu.Lock()
+	s.sessions[ws.id] = ws
+	s.mu.Unlock()
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		ws.state.Store(state)
+		plog.Debug("whep: session %s state %s", ws.id, state)
+		// Disconnected is transient (e.g. Wi-Fi loss or NAT rebinding) and
+		// turns into Failed if ICE does not recover
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			ws.close()
+		}
+	})
+
+	answer, err := negotiate(pc, offer)
+	if err != nil {
+		ws.close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	go ws.run()
+
+	plog.Info("whep: session %s started for topic %s from %s", ws.id, topicName, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whep/"+topicName+"/"+ws.id)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
+
+func (s *Server) handleWHEPDelete(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	s.mu.Lock()
+	ws, ok := s.sessions[r.PathValue("id")]
+	s.mu.Unlock()
+	if !ok || ws.topic != r.PathValue("topic") {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	ws.close()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleWHEPList(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	s.mu.Lock()
+	out := make([]SessionStats, 0, len(s.sessions))
+	for _, ws := range s.sessions {
+		out = append(out, ws.stats())
+	}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"sessions": out})
+}
+
+// run forwards topic packets to the peer until the session or topic ends.
+func (ws *whepSession) run() {
+	defer ws.close()
+	for {
+		select {
+		case <-ws.sub.Done():
+			return
+		case pkt := <-ws.sub.Packets():
+			if pkt == nil || pkt.RTCP {
+				continue
+			}
+			lt, ok := ws.tracks[pkt.Track]
+			if !ok {
+				continue
+			}
+			if _, err := lt.Write(pkt.Raw); err != nil {
+				ws.errors.Add(1)
+				continue
+			}
+			ws.packets.Add(1)
+			ws.bytes.Add(int64(len(pkt.Raw)))
+		}
+	}
+}
+
+func (ws *whepSession) close() {
+	ws.closeOnce.Do(func() {
+		ws.s.mu.Lock()
+		delete(ws.s.sessions, ws.id)
+		ws.s.mu.Unlock()
+		if ws.sub != nil {
+			ws.s.mgr.UnregisterSubscriber(ws.topic, ws.sub.ID())
+		}
+		// Close triggers OnConnectionStateChange, which re-enters close; the
+		// sync.Once makes that a no-op.
+		go ws.pc.Close()
+		plog.Info("whep: session %s for topic %s closed", ws.id, ws.topic)
+	})
+}
+
+func (ws *whepSession) stats() SessionStats {
+	tracks := make([]string, 0, len(ws.tracks))
+	for _, lt := range ws.tracks {
+		tracks = append(tracks, strings.ToLower(lt.Codec().MimeType))
+	}
+	return SessionStats{
+		ID:          ws.id,
+		Topic:       ws.topic,
+		Remote:      ws.remote,
+		Created:     ws.created,
+		State:       ws.state.Load().(webrtc.PeerConnectionState).String(),
+		Tracks:      tracks,
+		PacketsSent: ws.packets.Load(),
+		BytesSent:   ws.bytes.Load(),
+		WriteErrors: ws.errors.Load(),
+	}
+}
@@ -0,0 +1,231 @@
+package webrtcsrv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"redalf.de/rtsper/pkg/cluster"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// newLoopbackPeer creates a full (non-lite) client peer restricted to loopback.
+func newLoopbackPeer(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	me := &webrtc.MediaEngine{}
+	if err := me.RegisterDefaultCodecs(); err != nil {
+		t.Fatalf("register codecs: %v", err)
+	}
+	se := webrtc.SettingEngine{}
+	se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	se.SetIncludeLoopbackCandidate(true)
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(me), webrtc.WithSettingEngine(se)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("new peer connection: %v", err)
+	}
+	return pc
+}
+
+func TestWHEPPlayback(t *testing.T) {
+	m := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 1, PublisherQueueSize: 64, PublisherGracePeriod: topic.Duration{Duration: time.Second}})
+	if err := m.RegisterPublisher(context.Background(), "cam1", topic.NewPublisherSession("p1")); err != nil {
+		t.Fatalf("register publisher: %v", err)
+	}
+	m.SetTopicStream("cam1", gortsplib.NewServerStream(gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1}}))
+
+	srv, err := NewServer(m, nil, Config{IncludeLoopback: true})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+	mux := http.NewServeMux()
+	srv.Register(mux)
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	pc := newLoopbackPeer(t)
+	defer pc.Close()
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatalf("add transceiver: %v", err)
+	}
+	got := make(chan *rtp.Packet, 1)
+	pc.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		p, _, err := tr.ReadRTP()
+		if err == nil {
+			got <- p
+		}
+	})
+	offer, _ := pc.CreateOffer(nil)
+	gathered := webrtc.GatheringCompletePromise(pc)
+	pc.SetLocalDescription(offer)
+	<-gathered
+
+	resp, err := http.Post(hs.URL+"/whep/cam1", "application/sdp", strings.NewReader(pc.LocalDescription().SDP))
+	if err != nil {
+		t.Fatalf("post offer: %v", err)
+	}
+	answer, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", resp.StatusCode, answer)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Location"), "/whep/cam1/") {
+		t.Fatalf("unexpected Location %q", resp.Header.Get("Location"))
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		t.Fatalf("set answer: %v", err)
+	}
+
+	// second viewer must be rejected by the shared per-topic subscriber limit
+	resp2, err := http.Post(hs.URL+"/whep/cam1", "application/sdp", strings.NewReader(pc.LocalDescription().SDP))
+	if err != nil {
+		t.Fatalf("post second offer: %v", err)
+	}
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for second viewer, got %d", resp2.StatusCode)
+	}
+
+	// feed packets until the client receives one
+	deadline := time.After(10 * time.Second)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	seq := uint16(0)
+	for {
+		select {
+		case p := <-got:
+			if len(p.Payload) == 0 {
+				t.Fatalf("empty payload received")
+			}
+			return
+		case <-ticker.C:
+			raw, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, SSRC: 1, Marker: true}, Payload: []byte{0x65, 0x88, 0x84}}).Marshal()
+			m.PublishPacket("cam1", &topic.InboundPacket{Track: 0, Raw: raw})
+			seq++
+		case <-deadline:
+			t.Fatalf("no RTP received over WebRTC")
+		}
+	}
+}
+
+func TestWHEPUnknownTopic(t *testing.T) {
+	m := topic.NewManager(topic.Config{})
+	srv, err := NewServer(m, nil, Config{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+	mux := http.NewServeMux()
+	srv.Register(mux)
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	resp, err := http.Post(hs.URL+"/whep/missing", "application/sdp", strings.NewReader("v=0\r\n"))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestWHEPFailedSessionIsRemoved(t *testing.T) {
+	m := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 1, PublisherQueueSize: 64})
+	if err := m.RegisterPublisher(context.Background(), "cam1", topic.NewPublisherSession("p1")); err != nil {
+		t.Fatalf("register publisher: %v", err)
+	}
+	m.SetTopicStream("cam1", gortsplib.NewServerStream(gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1}}))
+	srv, err := NewServer(m, nil, Config{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+	mux := http.NewServeMux()
+	srv.Register(mux)
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	resp, err := http.Post(hs.URL+"/whep/cam1", "application/sdp", strings.NewReader("v=0\r\n"))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+	srv.mu.Lock()
+	n := len(srv.sessions)
+	srv.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d sessions left after a failed negotiation", n)
+	}
+	if ts := m.Status().Topics; len(ts) != 1 || ts[0].SubscriberCount != 0 {
+		t.Fatalf("subscriber left after a failed negotiation: %+v", ts)
+	}
+}
+
+func TestWHEPAndWHIPAdmission(t *testing.T) {
+	cl, err := cluster.NewFromCSV("self,owner", "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	var remote string
+	var local []string
+	for i := 0; remote == "" || len(local) < 2; i++ {
+		name := fmt.Sprintf("cam%d", i)
+		if cl.IsSelf(cl.Owner(name)) {
+			local = append(local, name)
+		} else {
+			remote = name
+		}
+	}
+	m := topic.NewManager(topic.Config{MaxPublishers: 10})
+	if err := m.RegisterPublisher(context.Background(), local[0], topic.NewPublisherSession("p")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	srv, err := NewServer(m, cl, Config{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+	mux := http.NewServeMux()
+	srv.Register(mux)
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	post := func(path string) int {
+		t.Helper()
+		resp, err := http.Post(hs.URL+path, "application/sdp", strings.NewReader("v=0\r\n"))
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// sessions for topics owned by another node go there
+	if code := post("/whep/" + remote); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 playing a remote topic, got %d", code)
+	}
+	if code := post("/whip/" + remote); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 publishing a remote topic, got %d", code)
+	}
+
+	// an overloaded node takes no new sessions, even for its own topics
+	lm := cluster.NewLoadMonitor(cl, m, cluster.LoadConfig{Thresholds: cluster.LoadThresholds{Publishers: 1}})
+	defer lm.Close()
+	for _, path := range []string{"/whep/" + local[0], "/whip/" + local[1]} {
+		if code := post(path); code != http.StatusServiceUnavailable {
+			t.Fatalf("expected 503 for %s while overloaded, got %d", path, code)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package webrtcsrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// pliInterval is how often WHIP publishers are asked for a keyframe so that
+// RTSP subscribers joining mid-stream can start decoding quickly.
+const pliInterval = 3 * time.Second
+
+// ingestMediaEngine restricts WHIP negotiation to codecs RTSP subscribers can
+// consume without transcoding: H.264 (packetization-mode 1) and Opus.
+func ingestMediaEngine() (*webrtc.MediaEngine, error) {
+	me := &webrtc.MediaEngine{}
+	videoFB := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	codecs := []struct {
+		kind   webrtc.RTPCodecType
+		params webrtc.RTPCodecParameters
+	}{
+		{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+			PayloadType:        111,
+		}},
+		{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", RTCPFeedback: videoFB},
+			PayloadType:        102,
+		}},
+		{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", RTCPFeedback: videoFB},
+			PayloadType:        104,
+		}},
+		{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032", RTCPFeedback: videoFB},
+			PayloadType:        112,
+		}},
+	}
+	for _, c := range codecs {
+		if err := me.RegisterCodec(c.params, c.kind); err != nil {
+			return nil, err
+		}
+	}
+	return me, nil
+}
+
+// registerInterceptors installs the default NACK/RTCP report interceptors.
+func registerInterceptors(me *webrtc.MediaEngine) (*interceptor.Registry, error) {
+	ir := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(me, ir); err != nil {
+		return nil, err
+	}
+	return ir, nil
+}
+
+// whipSession is a WebRTC publisher feeding a topic.
+type whipSession struct {
+	s       *Server
+	id      string
+	topic   string
+	remote  string
+	created time.Time
+	pc      *webrtc.PeerConnection
+	pub     *topic.PublisherSession
+
+	mu         sync.Mutex
+	trackIdx   map[string]int // transceiver mid -> topic track index
+	codecs     []string
+	registered bool
+	closed     bool
+
+	closeOnce sync.Once
+	packets   atomic.Int64
+	bytes     atomic.Int64
+	state     atomic.Value // webrtc.PeerConnectionState
+}
+
+// PublicationStats is the per-publisher view returned by GET /whip.
+type PublicationStats struct {
+	ID              string    `json:"id"`
+	Topic           string    `json:"topic"`
+	Remote          string    `json:"remote"`
+	Created         time.Time `json:"created"`
+	State           string    `json:"state"`
+	Tracks          []string  `json:"tracks"`
+	PacketsReceived int64     `json:"packets_received"`
+	BytesReceived   int64     `json:"bytes_received"`
+}
+
+// authorized checks the optional WHIP bearer token.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.cfg.BearerToken == "" {
+		return true
+	}
+	return r.Header.Get("Authorization") == "Bearer "+s.cfg.BearerToken
+}
+
+// tracksFromAnswer derives the topic tracks from the negotiated answer. Each
+// accepted audio/video section becomes one track, keyed by its mid.
+func tracksFromAnswer(answer string) (gortsplib.Tracks, map[string]int, error) {
+	var sd sdp.SessionDescription
+	if err := sd.Unmarshal([]byte(answer)); err != nil {
+		return nil, nil, err
+	}
+	var tracks gortsplib.Tracks
+	idx := make(map[string]int)
+	for _, md := range sd.MediaDescriptions {
+		if md.MediaName.Port.Value == 0 || len(md.MediaName.Formats) == 0 {
+			continue
+		}
+		if _, inactive := md.Attribute("inactive"); inactive {
+			continue
+		}
+		mid, _ := md.Attribute("mid")
+		pt, err := strconv.Atoi(md.MediaName.Formats[0])
+		if err != nil {
+			continue
+		}
+		codec := ""
+		for _, a := range md.Attributes {
+			if a.Key == "rtpmap" && strings.HasPrefix(a.Value, md.MediaName.Formats[0]+" ") {
+				codec = strings.ToLower(strings.TrimPrefix(a.Value, md.MediaName.Formats[0]+" "))
+			}
+		}
+		switch {
+		case strings.HasPrefix(codec, "h264/"):
+			tracks = append(tracks, &gortsplib.TrackH264{PayloadType: uint8(pt), PacketizationMode: 1})
+		case strings.HasPrefix(codec, "opus/"):
+			tracks = append(tracks, &gortsplib.TrackOpus{PayloadType: uint8(pt), SampleRate: 48000, ChannelCount: 2})
+		default:
+			continue
+		}
+		idx[mid] = len(tracks) - 1
+	}
+	if len(tracks) == 0 {
+		return nil, nil, errors.New("no H264 or Opus media negotiated")
+	}
+	return tracks, idx, nil
+}
+
+func (s *Server) handleWHIPOffer(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	topicName := r.PathValue("topic")
+	if !topic.ValidName(topicName) {
+		http.Error(w, "invalid topic name", http.StatusBadRequest)
+		return
+	}
+	// publishers must connect to the owner, exactly like RTSP ANNOUNCE
+	if s.cluster != nil {
+		a := s.cluster.Admit(topicName, true)
+		if !s.cluster.IsSelf(a.Owner) {
+			plog.Info("whip: publish for topic %s routed to owner %s (not local)", topicName, a.Owner)
+			http.Error(w, "topic owned by another node; publish to "+a.Owner, http.StatusServiceUnavailable)
+			return
+		}
+		if a.Overloaded != "" {
+			plog.Info("whip: publish for topic %s refused: node is overloaded", topicName)
+			metrics.IncOverloadRejections("503")
+			http.Error(w, "node is overloaded", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+
+	pc, err := s.ingestAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		plog.Error("whip: new peer connection: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	ps := &whipSession{
+		s:        s,
+		id:       newSessionID(),
+		topic:    topicName,
+		remote:   r.RemoteAddr,
+		created:  time.Now(),
+		pc:       pc,
+		trackIdx: make(map[string]int),
+	}
+	ps.state.Store(webrtc.PeerConnectionStateNew)
+	// the session is listed before negotiating: a connection that fails
+	// right away removes it again in close
+	s.mu.Lock()
+	s.publications[ps.id] = ps
+	s.mu.Unlock()
+	pc.OnTrack(ps.onTrack)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		ps.state.Store(state)
+		plog.Debug("whip: session %s state %s", ps.id, state)
+		// Disconnected is transient (e.g. Wi-Fi loss or NAT rebinding) and
+		// turns into Failed if ICE does not recover
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			ps.close()
+		}
+	})
+
+	answer, err := negotiate(pc, offer)
+	if err != nil {
+		ps.close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tracks, idx, err := tracksFromAnswer(answer)
+	if err != nil {
+		ps.close()
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	ps.pub = topic.NewPublisherSession("whip-" + ps.id)
+	if err := s.mgr.RegisterPublisher(context.Background(), topicName, ps.pub); err != nil {
+		ps.close()
+		plog.Info("whip: register publisher for %s failed: %v", topicName, err)
+		code := http.StatusServiceUnavailable
+		if errors.Is(err, topic.ErrTopicHasPublisher) {
+			code = http.StatusConflict
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	// a topic held during a migration keeps its stream and subscribers if
+	// the tracks are the same
+	if s.mgr.OpenTopicStream(topicName, tracks) {
+		plog.Info("whip: publisher for topic %s took over its stream", topicName)
+	}
+	ps.mu.Lock()
+	if ps.closed {
+		// the peer went away while the publisher was registered
+		ps.mu.Unlock()
+		s.mgr.UnregisterPublisherSession(topicName, ps.pub)
+		http.Error(w, "peer connection closed", http.StatusBadRequest)
+		return
+	}
+	ps.trackIdx = idx
+	ps.registered = true
+	for _, t := range tracks {
+		ps.codecs = append(ps.codecs, t.String())
+	}
+	ps.mu.Unlock()
+	go func() {
+		<-ps.pub.Done()
+		ps.close()
+	}()
+
+	plog.Info("whip: session %s publishing topic %s from %s (%d tracks)", ps.id, topicName, r.RemoteAddr, len(tracks))
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+topicName+"/"+ps.id)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
+
+func (s *Server) handleWHIPDelete(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	ps, ok := s.publications[r.PathValue("id")]
+	s.mu.Unlock()
+	if !ok || ps.topic != r.PathValue("topic") {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	ps.close()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleWHIPList(w http.ResponseWriter, r *http.Request) {
+	setCORS(w)
+	s.mu.Lock()
+	out := make([]PublicationStats, 0, len(s.publications))
+	for _, ps := range s.publications {
+		out = append(out, ps.stats())
+	}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"publications": out})
+}
+
+// onTrack forwards a remote WebRTC track into the topic.
+func (ps *whipSession) onTrack(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	mid := ""
+	for _, tr := range ps.pc.GetTransceivers() {
+		if tr.Receiver() == receiver {
+			mid = tr.Mid()
+			break
+		}
+	}
+	ps.mu.Lock()
+	idx, ok := ps.trackIdx[mid]
+	ready := ps.registered
+	ps.mu.Unlock()
+	if !ok || !ready {
+		plog.Debug("whip: session %s ignoring unmapped track mid=%q", ps.id, mid)
+		return
+	}
+
+	if remote.Kind() == webrtc.RTPCodecTypeVideo {
+		go ps.requestKeyframes(uint32(remote.SSRC()))
+	}
+	for {
+		pkt, _, err := remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		ps.packets.Add(1)
+		ps.bytes.Add(int64(len(pkt.Payload)))
+		ps.s.mgr.WritePacketRTP(ps.topic, idx, pkt)
+	}
+}
+
+// requestKeyframes sends periodic PLIs until the session closes.
+func (ps *whipSession) requestKeyframes(ssrc uint32) {
+	ticker := time.NewTicker(pliInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := ps.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}}); err != nil {
+			return
+		}
+	}
+}
+
+func (ps *whipSession) close() {
+	ps.closeOnce.Do(func() {
+		ps.s.mu.Lock()
+		delete(ps.s.publications, ps.id)
+		ps.s.mu.Unlock()
+		ps.mu.Lock()
+		registered := ps.registered
+		ps.closed = true
+		ps.mu.Unlock()
+		if registered {
+			ps.s.mgr.UnregisterPublisherSession(ps.topic, ps.pub)
+		}
+		go ps.pc.Close()
+		plog.Info("whip: session %s for topic %s closed", ps.id, ps.topic)
+	})
+}
+
+func (ps *whipSession) stats() PublicationStats {
+	ps.mu.Lock()
+	codecs := append([]string(nil), ps.codecs...)
+	ps.mu.Unlock()
+	return PublicationStats{
+		ID:              ps.id,
+		Topic:           ps.topic,
+		Remote:          ps.remote,
+		Created:         ps.created,
+		State:           ps.state.Load().(webrtc.PeerConnectionState).String(),
+		Tracks:          codecs,
+		PacketsReceived: ps.packets.Load(),
+		BytesReceived:   ps.bytes.Load(),
+	}
+}
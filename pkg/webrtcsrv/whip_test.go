@@ -0,0 +1,121 @@
+package webrtcsrv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"redalf.de/rtsper/pkg/topic"
+)
+
+func postOffer(t *testing.T, url, token, offer string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(offer))
+	req.Header.Set("Content-Type", "application/sdp")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post offer: %v", err)
+	}
+	return resp
+}
+
+func TestWHIPPublishesIntoTopic(t *testing.T) {
+	m := topic.NewManager(topic.Config{MaxPublishers: 1, MaxSubscribersPerTopic: 5, PublisherQueueSize: 64, PublisherGracePeriod: topic.Duration{Duration: time.Second}})
+	srv, err := NewServer(m, nil, Config{IncludeLoopback: true, BearerToken: "s3cret"})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+	mux := http.NewServeMux()
+	srv.Register(mux)
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	received := make(chan *topic.InboundPacket, 16)
+	m.AddTap("cam1", "test", func(p *topic.InboundPacket) {
+		select {
+		case received <- p:
+		default:
+		}
+	})
+
+	pc := newLoopbackPeer(t)
+	defer pc.Close()
+	lt, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"}, "video", "cam1")
+	if err != nil {
+		t.Fatalf("new track: %v", err)
+	}
+	if _, err := pc.AddTransceiverFromTrack(lt, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatalf("add transceiver: %v", err)
+	}
+	offer, _ := pc.CreateOffer(nil)
+	gathered := webrtc.GatheringCompletePromise(pc)
+	pc.SetLocalDescription(offer)
+	<-gathered
+
+	// missing token is rejected
+	resp := postOffer(t, hs.URL+"/whip/cam1", "", pc.LocalDescription().SDP)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", resp.StatusCode)
+	}
+
+	resp = postOffer(t, hs.URL+"/whip/cam1", "s3cret", pc.LocalDescription().SDP)
+	answer, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", resp.StatusCode, answer)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		t.Fatalf("set answer: %v", err)
+	}
+	st := m.GetTopicStream("cam1")
+	if st == nil || len(st.Tracks()) != 1 || st.Tracks()[0].String() != "H264" {
+		t.Fatalf("expected topic stream with one H264 track")
+	}
+
+	// the global publisher limit applies to WHIP too
+	resp = postOffer(t, hs.URL+"/whip/cam2", "s3cret", pc.LocalDescription().SDP)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 when max publishers reached, got %d", resp.StatusCode)
+	}
+	// the refused session is not left behind
+	srv.mu.Lock()
+	n := len(srv.publications)
+	srv.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("expected one publication, got %d", n)
+	}
+
+	deadline := time.After(10 * time.Second)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	seq := uint16(0)
+	for {
+		select {
+		case p := <-received:
+			if p.Track != 0 || len(p.Raw) == 0 {
+				t.Fatalf("unexpected packet %+v", p)
+			}
+			if m.Status().PublisherCount != 1 {
+				t.Fatalf("expected one registered publisher")
+			}
+			return
+		case <-ticker.C:
+			lt.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true}, Payload: []byte{0x65, 0x88, 0x84}})
+			seq++
+		case <-deadline:
+			t.Fatalf("no RTP from WHIP publisher reached the topic")
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Package wsplay serves topics to browsers as fragmented MP4 over
+// WebSocket, for playback with Media Source Extensions.
+package wsplay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"golang.org/x/net/websocket"
+
+	"redalf.de/rtsper/pkg/cluster"
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/metrics"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// Config configures the WebSocket playback endpoint.
+type Config struct {
+	// SubscriberQueueSize is the per-session packet queue length.
+	SubscriberQueueSize int
+	// MaxPendingFragments bounds the fragments queued for a slow client;
+	// beyond it fragments are dropped and video resumes at the next keyframe.
+	MaxPendingFragments int
+}
+
+// Server serves GET /ws/{topic}. The first message is a text message with
+// the MSE mime type, e.g. {"mime":"video/mp4; codecs=\"avc1.64001f\""},
+// followed by the init segment and one binary message per fragment.
+type Server struct {
+	mgr     *topic.Manager
+	cluster *cluster.Cluster
+	cfg     Config
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// SessionStats is the per-session view returned by GET /ws.
+type SessionStats struct {
+	ID            string    `json:"id"`
+	Topic         string    `json:"topic"`
+	Remote        string    `json:"remote"`
+	Created       time.Time `json:"created"`
+	Codecs        string    `json:"codecs"`
+	FragmentsSent int64     `json:"fragments_sent"`
+	BytesSent     int64     `json:"bytes_sent"`
+	Dropped       int64     `json:"dropped"`
+}
+
+// NewServer creates the WebSocket playback server. cl may be nil when
+// clustering is not configured.
+func NewServer(mgr *topic.Manager, cl *cluster.Cluster, cfg Config) *Server {
+	if cfg.SubscriberQueueSize <= 0 {
+		cfg.SubscriberQueueSize = 256
+	}
+	if cfg.MaxPendingFragments <= 0 {
+		cfg.MaxPendingFragments = 64
+	}
+	return &Server{mgr: mgr, cluster: cl, cfg: cfg, sessions: make(map[string]*session)}
+}
+
+// Register mounts the endpoints on mux.
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /ws", s.handleList)
+	mux.HandleFunc("GET /ws/{topic}", s.handlePlay)
+}
+
+// Close terminates all sessions.
+func (s *Server) Close() {
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, ss := range s.sessions {
+		sessions = append(sessions, ss)
+	}
+	s.mu.Unlock()
+	for _, ss := range sessions {
+		ss.close()
+	}
+}
+
+func (s *Server) handlePlay(w http.ResponseWriter, r *http.Request) {
+	topicName := r.PathValue("topic")
+	if !topic.ValidName(topicName) {
+		http.Error(w, "invalid topic name", http.StatusBadRequest)
+		return
+	}
+	// subscribers play from the owner, like RTSP DESCRIBE
+	if s.cluster != nil {
+		a := s.cluster.Admit(topicName, false)
+		if a.Overloaded != "" {
+			plog.Info("ws: play for topic %s refused: node is overloaded", topicName)
+			metrics.IncOverloadRejections("503")
+			http.Error(w, "node is overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		if !s.cluster.IsSelf(a.Owner) && s.mgr.GetTopicStream(topicName) == nil {
+			http.Error(w, "topic owned by another node; play from "+a.Owner, http.StatusServiceUnavailable)
+			return
+		}
+	}
+	st := s.mgr.GetTopicStream(topicName)
+	if st == nil {
+		http.Error(w, "topic not found", http.StatusNotFound)
+		return
+	}
+	ss, err := newSession(s, topicName, r.RemoteAddr, st)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	// subscriber limits are shared with RTSP playback
+	if err := s.mgr.RegisterSubscriber(context.Background(), topicName, ss.sub); err != nil {
+		plog.Info("ws: register subscriber for %s failed: %v", topicName, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	// browsers connect from dashboards on other origins
+	srv := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			s.mu.Lock()
+			s.sessions[ss.id] = ss
+			s.mu.Unlock()
+			plog.Info("ws: session %s started for topic %s from %s", ss.id, topicName, r.RemoteAddr)
+			ss.run(conn)
+		},
+	}
+	srv.ServeHTTP(w, r)
+	// the handler did not run when the upgrade failed
+	ss.close()
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	out := make([]SessionStats, 0, len(s.sessions))
+	for _, ss := range s.sessions {
+		out = append(out, ss.stats())
+	}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"sessions": out})
+}
+
+// usableTracks returns the first H.264 and AAC track of a stream.
+func usableTracks(st *gortsplib.ServerStream) (video *gortsplib.TrackH264, videoID int, audio *gortsplib.TrackMPEG4Audio, audioID int) {
+	videoID, audioID = -1, -1
+	for i, t := range st.Tracks() {
+		switch tt := t.(type) {
+		case *gortsplib.TrackH264:
+			if video == nil {
+				video, videoID = tt, i
+			}
+		case *gortsplib.TrackMPEG4Audio:
+			if audio == nil {
+				audio, audioID = tt, i
+			}
+		}
+	}
+	return
+}
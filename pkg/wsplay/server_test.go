@@ -0,0 +1,149 @@
+package wsplay
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"golang.org/x/net/websocket"
+
+	"redalf.de/rtsper/pkg/cluster"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0, 0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00, 0x00, 0x03, 0x00, 0x3d, 0x08}
+	testPPS = []byte{0x68, 0xee, 0x3c, 0x80}
+)
+
+func TestWebSocketFMP4(t *testing.T) {
+	m := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	if err := m.RegisterPublisher(context.Background(), "cam1", topic.NewPublisherSession("p1")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	track := &gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1, SPS: testSPS, PPS: testPPS}
+	m.SetTopicStream("cam1", gortsplib.NewServerStream(gortsplib.Tracks{track}))
+
+	s := NewServer(m, nil, Config{})
+	defer s.Close()
+	mux := http.NewServeMux()
+	s.Register(mux)
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	if res, err := http.Get(hs.URL + "/ws/missing"); err != nil || res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown topic, got %v %v", res, err)
+	}
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(hs.URL, "http")+"/ws/cam1", "", "http://dashboard.example")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// publish a P frame (must be skipped), then keyframes and P frames
+	enc := track.CreateEncoder()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 0; ; i++ {
+			nalu := []byte{0x41, 0x9a, byte(i)}
+			if i%10 == 1 {
+				nalu = []byte{0x65, 0x88, byte(i)}
+			}
+			pkts, _ := enc.Encode([][]byte{nalu}, time.Duration(i)*40*time.Millisecond)
+			for _, p := range pkts {
+				m.WritePacketRTP("cam1", 0, p)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	var mime string
+	if err := websocket.Message.Receive(conn, &mime); err != nil || !strings.Contains(mime, `codecs=\"avc1.64000c\"`) {
+		t.Fatalf("unexpected mime message %q: %v", mime, err)
+	}
+	var init []byte
+	if err := websocket.Message.Receive(conn, &init); err != nil || !bytes.Equal(init[4:8], []byte("ftyp")) {
+		t.Fatalf("expected init segment: %v", err)
+	}
+	var frag []byte
+	if err := websocket.Message.Receive(conn, &frag); err != nil || !bytes.Equal(frag[4:8], []byte("moof")) {
+		t.Fatalf("expected fragment: %v", err)
+	}
+	// the first fragment starts on the keyframe
+	if !bytes.Contains(frag, []byte{0x65, 0x88, 1}) {
+		t.Fatalf("first fragment is not the keyframe")
+	}
+
+	s.mu.Lock()
+	n := len(s.sessions)
+	s.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("expected one session, got %d", n)
+	}
+	if st := m.Status(); st.Topics[0].SubscriberCount != 1 {
+		t.Fatalf("expected websocket subscriber to count against the topic")
+	}
+}
+
+func TestSlowClientSkipsToKeyframe(t *testing.T) {
+	m := topic.NewManager(topic.Config{})
+	ss := &session{s: NewServer(m, nil, Config{}), video: &gortsplib.TrackH264{}, out: make(chan interface{}, 1), pending: &videoSample{}}
+	ss.push([]byte{1})
+	ss.push([]byte{2})
+	if ss.dropped.Load() != 1 || !ss.needKey || ss.pending != nil {
+		t.Fatalf("expected drop to wait for keyframe: dropped=%d needKey=%v", ss.dropped.Load(), ss.needKey)
+	}
+}
+
+func TestDurationToLongStreams(t *testing.T) {
+	// 100h overflows int64 nanoseconds times 90 kHz if scaled in one step
+	if got := durationTo(100*time.Hour+500*time.Millisecond, 90000); got != 100*3600*90000+45000 {
+		t.Fatalf("unexpected 90 kHz duration %d", got)
+	}
+	if got := durationTo(-40*time.Millisecond, 90000); got != -3600 {
+		t.Fatalf("unexpected negative duration %d", got)
+	}
+}
+
+func TestWebSocketRefusedWhileOverloaded(t *testing.T) {
+	cl, err := cluster.NewFromCSV("self", "self")
+	if err != nil {
+		t.Fatalf("cluster: %v", err)
+	}
+	m := topic.NewManager(topic.Config{MaxSubscribersPerTopic: 5, PublisherQueueSize: 64})
+	if err := m.RegisterPublisher(context.Background(), "cam1", topic.NewPublisherSession("p1")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	track := &gortsplib.TrackH264{PayloadType: 96, PacketizationMode: 1, SPS: testSPS, PPS: testPPS}
+	m.SetTopicStream("cam1", gortsplib.NewServerStream(gortsplib.Tracks{track}))
+	lm := cluster.NewLoadMonitor(cl, m, cluster.LoadConfig{Thresholds: cluster.LoadThresholds{Publishers: 1}})
+	defer lm.Close()
+
+	s := NewServer(m, cl, Config{})
+	defer s.Close()
+	mux := http.NewServeMux()
+	s.Register(mux)
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	res, err := http.Get(hs.URL + "/ws/cam1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while overloaded, got %d", res.StatusCode)
+	}
+}
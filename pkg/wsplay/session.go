@@ -0,0 +1,361 @@
+package wsplay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/h264"
+	"github.com/aler9/gortsplib/pkg/mpeg4audio"
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtph264"
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtpmpeg4audio"
+	"github.com/pion/rtp"
+	"golang.org/x/net/websocket"
+
+	"redalf.de/rtsper/pkg/fmp4"
+	plog "redalf.de/rtsper/pkg/log"
+	"redalf.de/rtsper/pkg/topic"
+)
+
+// fragment track IDs
+const (
+	videoTrackID = 1
+	audioTrackID = 2
+)
+
+// streamCheckInterval is how often a session checks whether the publisher
+// was replaced; new tracks need a new init segment, so the client is
+// disconnected and expected to reconnect.
+const streamCheckInterval = time.Second
+
+// videoSample is held until the next one arrives, which gives its duration.
+type videoSample struct {
+	dts  time.Duration
+	pts  time.Duration
+	sync bool
+	data []byte
+}
+
+// session muxes one topic into fMP4 for one WebSocket client.
+type session struct {
+	s       *Server
+	id      string
+	topic   string
+	remote  string
+	created time.Time
+	stream  *gortsplib.ServerStream
+	sub     *topic.SubscriberSession
+
+	video        *gortsplib.TrackH264
+	videoID      int
+	videoDec     *rtph264.Decoder
+	dtsExtractor *h264.DTSExtractor
+	sps, pps     []byte
+
+	audio    *gortsplib.TrackMPEG4Audio
+	audioID  int
+	audioDec *rtpmpeg4audio.Decoder
+
+	// muxer state, owned by run
+	started    bool
+	startWall  time.Time
+	startDTS   time.Duration
+	haveDTS    bool
+	audioShift time.Duration
+	audioSync  bool
+	needKey    bool
+	pending    *videoSample
+	seq        uint32
+
+	// out carries the mime message (string) and segments ([]byte)
+	out       chan interface{}
+	done      chan struct{}
+	closeOnce sync.Once
+	conn      *websocket.Conn
+	connMu    sync.Mutex
+
+	codecs    atomic.Value // string
+	fragments atomic.Int64
+	bytes     atomic.Int64
+	dropped   atomic.Int64
+}
+
+func newSession(s *Server, topicName, remote string, st *gortsplib.ServerStream) (*session, error) {
+	ss := &session{
+		s:       s,
+		id:      newSessionID(),
+		topic:   topicName,
+		remote:  remote,
+		created: time.Now(),
+		stream:  st,
+		out:     make(chan interface{}, s.cfg.MaxPendingFragments),
+		done:    make(chan struct{}),
+	}
+	ss.codecs.Store("")
+	ss.video, ss.videoID, ss.audio, ss.audioID = usableTracks(st)
+	if ss.video == nil && ss.audio == nil {
+		return nil, errors.New("topic has no H264 or AAC tracks")
+	}
+	if ss.video != nil {
+		ss.videoDec = ss.video.CreateDecoder()
+		ss.dtsExtractor = h264.NewDTSExtractor()
+		ss.sps, ss.pps = ss.video.SafeSPS(), ss.video.SafePPS()
+	}
+	if ss.audio != nil {
+		ss.audioDec = ss.audio.CreateDecoder()
+	}
+	ss.sub = topic.NewSubscriberSession("ws-"+ss.id, s.cfg.SubscriberQueueSize)
+	return ss, nil
+}
+
+// run serves the session until the client, the topic or the server goes away.
+func (ss *session) run(conn *websocket.Conn) {
+	ss.connMu.Lock()
+	ss.conn = conn
+	ss.connMu.Unlock()
+	defer ss.close()
+
+	// the client sends nothing; reading detects it going away
+	go func() {
+		var msg []byte
+		for {
+			if err := websocket.Message.Receive(conn, &msg); err != nil {
+				ss.close()
+				return
+			}
+		}
+	}()
+	go ss.writeLoop(conn)
+
+	ticker := time.NewTicker(streamCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ss.done:
+			return
+		case <-ss.sub.Done():
+			return
+		case <-ticker.C:
+			if ss.s.mgr.GetTopicStream(ss.topic) != ss.stream {
+				plog.Info("ws: session %s: topic %s publisher changed, closing", ss.id, ss.topic)
+				return
+			}
+		case pkt := <-ss.sub.Packets():
+			if pkt == nil || pkt.RTCP {
+				continue
+			}
+			var p rtp.Packet
+			if err := p.Unmarshal(pkt.Raw); err != nil {
+				continue
+			}
+			switch pkt.Track {
+			case ss.videoID:
+				ss.onVideo(&p)
+			case ss.audioID:
+				ss.onAudio(&p)
+			}
+		}
+	}
+}
+
+func (ss *session) writeLoop(conn *websocket.Conn) {
+	for {
+		select {
+		case <-ss.done:
+			return
+		case msg := <-ss.out:
+			if err := websocket.Message.Send(conn, msg); err != nil {
+				ss.close()
+				return
+			}
+			if b, ok := msg.([]byte); ok {
+				ss.fragments.Add(1)
+				ss.bytes.Add(int64(len(b)))
+			}
+		}
+	}
+}
+
+// push queues a fragment without blocking. When the client falls behind the
+// fragment is dropped and video waits for the next keyframe.
+func (ss *session) push(b []byte) {
+	select {
+	case ss.out <- b:
+	default:
+		ss.dropped.Add(1)
+		if ss.video != nil && !ss.needKey {
+			ss.needKey = true
+			ss.pending = nil
+			plog.Debug("ws: session %s too slow, skipping to next keyframe", ss.id)
+		}
+	}
+}
+
+func (ss *session) onVideo(p *rtp.Packet) {
+	nalus, pts, err := ss.videoDec.DecodeUntilMarker(p)
+	if err != nil {
+		return
+	}
+	idr := h264.IDRPresent(nalus)
+	filtered := make([][]byte, 0, len(nalus)+2)
+	for _, n := range nalus {
+		switch h264.NALUType(n[0] & 0x1f) {
+		case h264.NALUTypeSPS:
+			ss.sps = append([]byte(nil), n...)
+		case h264.NALUTypePPS:
+			ss.pps = append([]byte(nil), n...)
+		case h264.NALUTypeAccessUnitDelimiter:
+			continue
+		}
+		filtered = append(filtered, n)
+	}
+	if !ss.started {
+		if !idr || ss.sps == nil || ss.pps == nil {
+			return
+		}
+		if !ss.start() {
+			return
+		}
+	}
+	if idr && h264.NALUType(filtered[0][0]&0x1f) != h264.NALUTypeSPS {
+		// the DTS extractor and decoders joining here need the parameters in-band
+		filtered = append([][]byte{ss.sps, ss.pps}, filtered...)
+	}
+	dts, err := ss.dtsExtractor.Extract(filtered, pts)
+	if err != nil {
+		plog.Debug("ws: session %s: %v", ss.id, err)
+		return
+	}
+	if !ss.haveDTS {
+		ss.startDTS = dts
+		ss.haveDTS = true
+	}
+	data, err := h264.AVCCMarshal(filtered)
+	if err != nil {
+		return
+	}
+	next := &videoSample{dts: dts, pts: pts, sync: idr, data: data}
+	if prev := ss.pending; prev != nil {
+		ss.seq++
+		ss.push(fmp4.Fragment(ss.seq, videoTrackID, uint64(durationTo(prev.dts-ss.startDTS, 90000)), []fmp4.Sample{{
+			Duration:  uint32(durationTo(dts-prev.dts, 90000)),
+			PTSOffset: int32(durationTo(prev.pts-prev.dts, 90000)),
+			IsSync:    prev.sync,
+			Data:      prev.data,
+		}}))
+	}
+	if ss.needKey && !idr {
+		// this or an earlier fragment was dropped
+		ss.pending = nil
+		return
+	}
+	ss.needKey = false
+	ss.pending = next
+}
+
+func (ss *session) onAudio(p *rtp.Packet) {
+	aus, pts, err := ss.audioDec.Decode(p)
+	if err != nil {
+		return
+	}
+	if !ss.started {
+		if ss.video != nil || !ss.start() {
+			return
+		}
+	}
+	if !ss.audioSync {
+		// audio and video have independent RTP clocks; line them up on arrival
+		ss.audioShift = time.Since(ss.startWall) - pts
+		ss.audioSync = true
+	}
+	t := pts + ss.audioShift
+	if t < 0 {
+		return
+	}
+	rate := ss.audio.Config.SampleRate
+	samples := make([]fmp4.Sample, len(aus))
+	for i, au := range aus {
+		samples[i] = fmp4.Sample{Duration: mpeg4audio.SamplesPerAccessUnit, IsSync: true, Data: au}
+	}
+	ss.seq++
+	ss.push(fmp4.Fragment(ss.seq, audioTrackID, uint64(durationTo(t, rate)), samples))
+}
+
+// start sends the mime type and init segment.
+func (ss *session) start() bool {
+	var tracks []*fmp4.Track
+	if ss.video != nil {
+		tracks = append(tracks, &fmp4.Track{ID: videoTrackID, TimeScale: 90000, H264: &fmp4.H264Config{SPS: ss.sps, PPS: ss.pps}})
+	}
+	if ss.audio != nil {
+		tracks = append(tracks, &fmp4.Track{ID: audioTrackID, TimeScale: uint32(ss.audio.Config.SampleRate), MPEG4Audio: ss.audio.Config})
+	}
+	init, err := fmp4.Init(tracks)
+	if err != nil {
+		plog.Info("ws: session %s: %v", ss.id, err)
+		ss.close()
+		return false
+	}
+	codecs := make([]string, len(tracks))
+	for i, t := range tracks {
+		codecs[i] = t.Codec()
+	}
+	ss.codecs.Store(strings.Join(codecs, ","))
+	mime, _ := json.Marshal(map[string]string{"mime": `video/mp4; codecs="` + strings.Join(codecs, ",") + `"`})
+	// nothing was queued before, so the header messages cannot be dropped
+	ss.out <- string(mime)
+	ss.out <- init
+	ss.started = true
+	ss.startWall = time.Now()
+	return true
+}
+
+// durationTo converts d to units of timescale. Whole seconds and the rest
+// are scaled separately, so that long streams do not overflow.
+func durationTo(d time.Duration, timescale int) int64 {
+	sec, rem := int64(d/time.Second), int64(d%time.Second)
+	return sec*int64(timescale) + rem*int64(timescale)/int64(time.Second)
+}
+
+func (ss *session) close() {
+	ss.closeOnce.Do(func() {
+		close(ss.done)
+		ss.s.mu.Lock()
+		delete(ss.s.sessions, ss.id)
+		ss.s.mu.Unlock()
+		ss.s.mgr.UnregisterSubscriber(ss.topic, ss.sub.ID())
+		ss.connMu.Lock()
+		if ss.conn != nil {
+			ss.conn.Close()
+		}
+		ss.connMu.Unlock()
+		plog.Info("ws: session %s for topic %s closed", ss.id, ss.topic)
+	})
+}
+
+func (ss *session) stats() SessionStats {
+	return SessionStats{
+		ID:            ss.id,
+		Topic:         ss.topic,
+		Remote:        ss.remote,
+		Created:       ss.created,
+		Codecs:        ss.codecs.Load().(string),
+		FragmentsSent: ss.fragments.Load(),
+		BytesSent:     ss.bytes.Load(),
+		Dropped:       ss.dropped.Load(),
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		plog.Warn("ws: random session id: %v", err)
+	}
+	return hex.EncodeToString(b)
+}